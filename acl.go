@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// queryACL decides which client addresses may query the server
+type queryACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newQueryACL builds the ACL from the configured CIDR lists
+func newQueryACL(config *Config) (*queryACL, error) {
+	allow, err := parseCIDRList(config.AllowQueryFrom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow_query_from: %v", err)
+	}
+
+	deny, err := parseCIDRList(config.DenyQueryFrom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deny_query_from: %v", err)
+	}
+
+	return &queryACL{allow: allow, deny: deny}, nil
+}
+
+// parseCIDRList parses CIDRs, treating bare addresses as single-host networks
+func parseCIDRList(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Allowed reports whether a client may query; deny entries take precedence
+func (a *queryACL) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range a.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	for _, network := range a.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP extracts the IP address from a client's network address
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
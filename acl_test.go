@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// queryFrom sends an owned-zone SOA query from ip through handleDNSRequest
+func queryFrom(ip string) *fakeResponseWriter {
+	w := newFakeResponseWriter(ip)
+	q := new(dns.Msg)
+	q.SetQuestion("owned.test.", dns.TypeSOA)
+	handleDNSRequest(w, q)
+	return w
+}
+
+func TestQueryACLDefaults(t *testing.T) {
+	useConfig(t, &Config{ProxyDomains: []string{"owned.test"}})
+	useServerReady(t)
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.9", true},
+		{"192.168.1.10", true},
+		{"203.0.113.7", false},
+		{"2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		w := queryFrom(tt.ip)
+		if len(w.replies) != 1 {
+			t.Fatalf("%s: got %d replies, want 1", tt.ip, len(w.replies))
+		}
+		refused := w.replies[0].Rcode == dns.RcodeRefused
+		if refused == tt.allowed {
+			t.Errorf("%s: rcode %s, allowed should be %v", tt.ip, dns.RcodeToString[w.replies[0].Rcode], tt.allowed)
+		}
+	}
+}
+
+func TestQueryACLDenyTakesPrecedence(t *testing.T) {
+	useConfig(t, &Config{
+		ProxyDomains:   []string{"owned.test"},
+		AllowQueryFrom: []string{"0.0.0.0/0"},
+		DenyQueryFrom:  []string{"198.51.100.0/24", "192.0.2.5"},
+	})
+	useServerReady(t)
+
+	for ip, allowed := range map[string]bool{"203.0.113.7": true, "198.51.100.20": false, "192.0.2.5": false, "192.0.2.6": true} {
+		w := queryFrom(ip)
+		if refused := w.replies[0].Rcode == dns.RcodeRefused; refused == allowed {
+			t.Errorf("%s: rcode %s, allowed should be %v", ip, dns.RcodeToString[w.replies[0].Rcode], allowed)
+		}
+	}
+}
+
+func TestQueryACLDropAction(t *testing.T) {
+	useConfig(t, &Config{ProxyDomains: []string{"owned.test"}, DeniedQueryAction: "drop"})
+	useServerReady(t)
+
+	if w := queryFrom("203.0.113.7"); len(w.replies) != 0 {
+		t.Errorf("denied client got %d replies, want none", len(w.replies))
+	}
+	if w := queryFrom("127.0.0.1"); len(w.replies) != 1 || w.replies[0].Rcode != dns.RcodeSuccess {
+		t.Errorf("allowed client got %v", w.replies)
+	}
+}
+
+func TestNewQueryACLRejectsInvalidEntries(t *testing.T) {
+	if _, err := newQueryACL(&Config{AllowQueryFrom: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("invalid allow_query_from accepted")
+	}
+	if _, err := newQueryACL(&Config{DenyQueryFrom: []string{"not-an-ip"}}); err == nil {
+		t.Error("invalid deny_query_from accepted")
+	}
+}
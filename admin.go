@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// newAdminMux builds the handlers served on the admin HTTP listener
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/resolve", handleResolve)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/stats/top", handleStatsTop)
+	mux.HandleFunc("/debug/matchers", handleMatchers)
+
+	// Profiling handlers, which answer 404 unless EnablePprof is set
+	mux.HandleFunc("/debug/pprof/", pprofGuard(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", pprofGuard(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", pprofGuard(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", pprofGuard(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", pprofGuard(pprof.Trace))
+	return mux
+}
+
+// pprofGuard only lets a profiling request through when profiling is enabled
+// and the client is in PprofAllowFrom. The config is checked on every request
+// so a reload can switch profiling on or off.
+func pprofGuard(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig()
+		if !config.EnablePprof {
+			http.NotFound(w, r)
+			return
+		}
+
+		allow, err := parseCIDRList(config.PprofAllowFrom)
+		if err != nil {
+			log.Printf("Invalid pprof_allow_from, refusing profiling request: %v", err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		acl := &queryACL{allow: allow}
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if !acl.Allowed(net.ParseIP(host)) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// startAdminServer serves the admin endpoints on the given address
+func startAdminServer(addr string) *http.Server {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: newAdminMux(),
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Admin server error: %v", err)
+		}
+	}()
+
+	return server
+}
+
+// handleMetrics exposes the resolver metrics in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+// resolveRecord is a single record in a /resolve response
+type resolveRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	TTL   uint32 `json:"ttl"`
+	Value string `json:"value"`
+}
+
+// resolveResponse is the JSON body returned by /resolve
+type resolveResponse struct {
+	Name      string          `json:"name"`
+	Type      string          `json:"type"`
+	Decision  string          `json:"decision"`
+	Rcode     string          `json:"rcode"`
+	Answer    []resolveRecord `json:"answer"`
+	Authority []resolveRecord `json:"authority"`
+}
+
+// toResolveRecords converts DNS records into their JSON form
+func toResolveRecords(records []dns.RR) []resolveRecord {
+	result := make([]resolveRecord, 0, len(records))
+	for _, rr := range records {
+		hdr := rr.Header()
+		result = append(result, resolveRecord{
+			Name:  hdr.Name,
+			Type:  dns.TypeToString[hdr.Rrtype],
+			TTL:   hdr.Ttl,
+			Value: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+	return result
+}
+
+// handleResolve runs a query through the resolver and returns the result as JSON,
+// e.g. GET /resolve?name=example.com&type=AAAA
+func handleResolve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing name parameter", http.StatusBadRequest)
+		return
+	}
+
+	qtype := dns.TypeA
+	if typeName := r.URL.Query().Get("type"); typeName != "" {
+		t, ok := dns.StringToType[strings.ToUpper(typeName)]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown record type %q", typeName), http.StatusBadRequest)
+			return
+		}
+		qtype = t
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), qtype)
+	reply, decision := resolveWithDecision(query)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resolveResponse{
+		Name:      dns.Fqdn(name),
+		Type:      dns.TypeToString[qtype],
+		Decision:  decision,
+		Rcode:     dns.RcodeToString[reply.Rcode],
+		Answer:    toResolveRecords(reply.Answer),
+		Authority: toResolveRecords(reply.Ns),
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// getResolve calls the /resolve endpoint and decodes its JSON response
+func getResolve(t *testing.T, query string) resolveResponse {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handleResolve(recorder, httptest.NewRequest(http.MethodGet, "/resolve?"+query, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("/resolve?%s returned %d: %s", query, recorder.Code, recorder.Body)
+	}
+	if ct := recorder.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+
+	var resp resolveResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding /resolve response: %v", err)
+	}
+	return resp
+}
+
+func TestResolveEndpointProxied(t *testing.T) {
+	useConfig(t, &Config{ProxyDomains: []string{"proxied.test"}, ProxyMode: "ephemeral", ProxyEphemeralTTL: 5})
+	useMemoryCache(t)
+	useServerReady(t)
+	resetProxyIPCache(t)
+	countingEnvelopeWorker(t)
+
+	resp := getResolve(t, "name=proxied.test")
+	if resp.Name != "proxied.test." || resp.Type != "A" || resp.Decision != "proxied" || resp.Rcode != "NOERROR" {
+		t.Errorf("response = %+v, want a proxied NOERROR A answer for proxied.test.", resp)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("got %d answers, want 1", len(resp.Answer))
+	}
+	want := resolveRecord{Name: "proxied.test.", Type: "A", TTL: 5, Value: "203.0.113.1"}
+	if resp.Answer[0] != want {
+		t.Errorf("answer = %+v, want %+v", resp.Answer[0], want)
+	}
+}
+
+func TestResolveEndpointForwarded(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}})
+	useMemoryCache(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "203.0.113.80"), nil
+	})
+
+	resp := getResolve(t, "name=example.com&type=a")
+	if resp.Type != "A" || resp.Decision != "forwarded" || resp.Rcode != "NOERROR" {
+		t.Errorf("response = %+v, want a forwarded NOERROR A answer", resp)
+	}
+	want := []resolveRecord{{Name: "example.com.", Type: "A", TTL: 300, Value: "203.0.113.80"}}
+	if len(resp.Answer) != 1 || resp.Answer[0] != want[0] {
+		t.Errorf("answer = %+v, want %+v", resp.Answer, want)
+	}
+	if resp.Authority == nil {
+		t.Error("authority is null, want an empty array")
+	}
+}
+
+func TestResolveEndpointBadRequests(t *testing.T) {
+	useConfig(t, &Config{})
+
+	for _, target := range []string{"/resolve", "/resolve?name=example.com&type=BOGUS"} {
+		recorder := httptest.NewRecorder()
+		handleResolve(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("GET %s returned %d, want 400", target, recorder.Code)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	handleResolve(recorder, httptest.NewRequest(http.MethodPost, "/resolve?name=example.com", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST returned %d, want 405", recorder.Code)
+	}
+}
+
+func TestPprofEndpoint(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+		remote string
+		want   int
+	}{
+		{"off by default", &Config{}, "127.0.0.1:40000", http.StatusNotFound},
+		{"enabled for loopback", &Config{EnablePprof: true}, "127.0.0.1:40000", http.StatusOK},
+		{"enabled for IPv6 loopback", &Config{EnablePprof: true}, "[::1]:40000", http.StatusOK},
+		{"other clients refused", &Config{EnablePprof: true}, "192.0.2.1:40000", http.StatusForbidden},
+		{"allow list widened", &Config{EnablePprof: true, PprofAllowFrom: []string{"192.0.2.0/24"}}, "192.0.2.1:40000", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.config)
+			mux := newAdminMux()
+			for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline"} {
+				r := httptest.NewRequest(http.MethodGet, path, nil)
+				r.RemoteAddr = tt.remote
+				recorder := httptest.NewRecorder()
+				mux.ServeHTTP(recorder, r)
+				if recorder.Code != tt.want {
+					t.Errorf("GET %s from %s = %d, want %d", path, tt.remote, recorder.Code, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// clampTTL limits a TTL to the configured MinTTL/MaxTTL range
+func clampTTL(ttl uint32) uint32 {
+	config := currentConfig()
+	if ttl < config.MinTTL {
+		return config.MinTTL
+	}
+	if config.MaxTTL > 0 && ttl > config.MaxTTL {
+		return config.MaxTTL
+	}
+	return ttl
+}
+
+// ttlOverride returns the configured fixed TTL for a record type, if any
+func ttlOverride(rrtype uint16) (uint32, bool) {
+	ttl, ok := currentConfig().TTLOverrides[dns.TypeToString[rrtype]]
+	return ttl, ok
+}
+
+// clamp limits a TTL to the range
+func (r TTLRange) clamp(ttl uint32) uint32 {
+	if ttl < r.Min {
+		return r.Min
+	}
+	if r.Max > 0 && ttl > r.Max {
+		return r.Max
+	}
+	return ttl
+}
+
+// domainTTLRange returns the TTL range configured for the longest suffix of
+// name in DomainTTLOverrides, if any
+func domainTTLRange(name string) (TTLRange, bool) {
+	config := currentConfig()
+	if len(config.DomainTTLOverrides) == 0 {
+		return TTLRange{}, false
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for {
+		if ttlRange, ok := config.DomainTTLOverrides[name]; ok {
+			return ttlRange, true
+		}
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			return TTLRange{}, false
+		}
+		name = parent
+	}
+}
+
+// clampRecordTTL applies the domain override for a record, then the per-type
+// override, falling back to the global range
+func clampRecordTTL(hdr *dns.RR_Header) uint32 {
+	if ttlRange, ok := domainTTLRange(hdr.Name); ok {
+		return ttlRange.clamp(hdr.Ttl)
+	}
+	if override, ok := ttlOverride(hdr.Rrtype); ok {
+		return override
+	}
+	return clampTTL(hdr.Ttl)
+}
+
+// clampTTLs applies the configured TTL overrides and range to every record in place
+func clampTTLs(records []dns.RR) {
+	for _, rr := range records {
+		rr.Header().Ttl = clampRecordTTL(rr.Header())
+	}
+}
+
+// sortAnswers orders records deterministically, keeping CNAMEs ahead of the
+// records they point to so chains stay readable for clients. CNAMEs keep their
+// upstream order, which is the order the chain is followed in.
+func sortAnswers(records []dns.RR) {
+	sort.SliceStable(records, func(i, j int) bool {
+		ti, tj := records[i].Header().Rrtype, records[j].Header().Rrtype
+		if (ti == dns.TypeCNAME) != (tj == dns.TypeCNAME) {
+			return ti == dns.TypeCNAME
+		}
+		if ti == dns.TypeCNAME {
+			return false
+		}
+		if ti != tj {
+			return ti < tj
+		}
+		return records[i].String() < records[j].String()
+	})
+}
+
+// permuteAnswers reorders the records of each type among themselves, leaving
+// CNAMEs where they are so chains stay intact
+func permuteAnswers(records []dns.RR, shuffle func(n int, swap func(i, j int))) {
+	positions := make(map[uint16][]int)
+	for i, rr := range records {
+		if rrtype := rr.Header().Rrtype; rrtype != dns.TypeCNAME {
+			positions[rrtype] = append(positions[rrtype], i)
+		}
+	}
+	for _, idx := range positions {
+		shuffle(len(idx), func(i, j int) {
+			records[idx[i]], records[idx[j]] = records[idx[j]], records[idx[i]]
+		})
+	}
+}
+
+// clientAffinitySeed derives a stable shuffle seed from the client address
+func clientAffinitySeed(client net.IP) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(client.String()))
+	return int64(h.Sum64())
+}
+
+// orderAnswers applies the configured AnswerOrder to the answer section
+func orderAnswers(records []dns.RR, client net.IP) {
+	switch currentConfig().AnswerOrder {
+	case "sorted":
+		sortAnswers(records)
+	case "shuffle":
+		permuteAnswers(records, rand.Shuffle)
+	case "client-affinity":
+		// Start from a fixed order so the result doesn't depend on upstream
+		sortAnswers(records)
+		permuteAnswers(records, rand.New(rand.NewSource(clientAffinitySeed(client))).Shuffle)
+	}
+}
+
+// minimizeResponse strips the sections a client doesn't need to use the
+// answer, leaving the SOA of negative answers and the OPT record
+func minimizeResponse(m *dns.Msg) {
+	if len(m.Answer) > 0 {
+		m.Ns = nil
+	}
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
+
+// shapeAnswers rewrites addresses, clamps TTLs and orders the answer section for the client
+func shapeAnswers(records []dns.RR, client net.IP) {
+	rewriteAnswers(records)
+	clampTTLs(records)
+	orderAnswers(records, client)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClampTTL(t *testing.T) {
+	useConfig(t, &Config{MinTTL: 30, MaxTTL: 3600})
+
+	tests := []struct {
+		ttl  uint32
+		want uint32
+	}{
+		{0, 30},
+		{29, 30},
+		{300, 300},
+		{3600, 3600},
+		{86400, 3600},
+	}
+	for _, tt := range tests {
+		if got := clampTTL(tt.ttl); got != tt.want {
+			t.Errorf("clampTTL(%d) = %d, want %d", tt.ttl, got, tt.want)
+		}
+	}
+}
+
+func TestClampTTLsAppliesToRecords(t *testing.T) {
+	useConfig(t, &Config{MinTTL: 60, MaxTTL: 3600})
+
+	low, _ := dns.NewRR("a.example. 0 IN A 192.0.2.1")
+	high, _ := dns.NewRR("a.example. 86400 IN A 192.0.2.2")
+	clampTTLs([]dns.RR{low, high})
+
+	if got := low.Header().Ttl; got != 60 {
+		t.Errorf("TTL 0 clamped to %d, want MinTTL 60", got)
+	}
+	if got := high.Header().Ttl; got != 3600 {
+		t.Errorf("TTL 86400 clamped to %d, want MaxTTL 3600", got)
+	}
+}
+
+func TestTTLOverridesByRecordType(t *testing.T) {
+	useConfig(t, &Config{MinTTL: 60, MaxTTL: 3600, TTLOverrides: map[string]uint32{"a": 20, "TXT": 86400}})
+
+	a, _ := dns.NewRR("a.example. 300 IN A 192.0.2.1")
+	txt, _ := dns.NewRR("a.example. 300 IN TXT \"verify\"")
+	aaaa, _ := dns.NewRR("a.example. 10 IN AAAA 2001:db8::1")
+	mx, _ := dns.NewRR("a.example. 86400 IN MX 10 mail.example.")
+	clampTTLs([]dns.RR{a, txt, aaaa, mx})
+
+	// Overrides win over the global range in both directions
+	if got := a.Header().Ttl; got != 20 {
+		t.Errorf("A TTL = %d, want the A override 20", got)
+	}
+	if got := txt.Header().Ttl; got != 86400 {
+		t.Errorf("TXT TTL = %d, want the TXT override 86400", got)
+	}
+
+	// Unlisted types fall back to the global clamps
+	if got := aaaa.Header().Ttl; got != 60 {
+		t.Errorf("AAAA TTL = %d, want MinTTL 60", got)
+	}
+	if got := mx.Header().Ttl; got != 3600 {
+		t.Errorf("MX TTL = %d, want MaxTTL 3600", got)
+	}
+}
+
+func TestTTLOverridesAppliedToCachedRecords(t *testing.T) {
+	useConfig(t, &Config{MinTTL: 60, TTLOverrides: map[string]uint32{"A": 20}})
+	cache := NewMemoryCache()
+
+	a, _ := dns.NewRR("a.example. 300 IN A 192.0.2.1")
+	aaaa, _ := dns.NewRR("a.example. 10 IN AAAA 2001:db8::1")
+	cache.Set("a.example.", dns.TypeA, []dns.RR{a})
+	cache.Set("a.example.", dns.TypeAAAA, []dns.RR{aaaa})
+
+	records, ok := cache.Get("a.example.", dns.TypeA)
+	if !ok {
+		t.Fatal("A record not cached")
+	}
+	if got := records[0].Header().Ttl; got > 20 || got < 19 {
+		t.Errorf("cached A TTL = %d, want the A override 20", got)
+	}
+
+	records, ok = cache.Get("a.example.", dns.TypeAAAA)
+	if !ok {
+		t.Fatal("AAAA record not cached")
+	}
+	if got := records[0].Header().Ttl; got > 60 || got < 59 {
+		t.Errorf("cached AAAA TTL = %d, want MinTTL 60", got)
+	}
+}
+
+func TestDomainTTLOverrides(t *testing.T) {
+	useConfig(t, &Config{
+		MinTTL:       60,
+		MaxTTL:       3600,
+		TTLOverrides: map[string]uint32{"A": 20},
+		DomainTTLOverrides: map[string]TTLRange{
+			"Flaky-API.example.":   {Min: 7200, Max: 86400},
+			"v2.flaky-api.example": {Max: 10},
+			"short.example":        {Min: 5},
+		},
+	})
+
+	tests := []struct {
+		record string
+		want   uint32
+	}{
+		// The domain range wins over the A override and MaxTTL
+		{"flaky-api.example. 300 IN A 192.0.2.1", 7200},
+		{"eu.flaky-api.example. 300 IN A 192.0.2.1", 7200},
+		{"flaky-api.example. 172800 IN TXT \"x\"", 86400},
+		// The longest suffix wins
+		{"v2.flaky-api.example. 300 IN A 192.0.2.1", 10},
+		// A range without a ceiling lets TTLs above MaxTTL through, and overrides MinTTL
+		{"short.example. 86400 IN AAAA 2001:db8::1", 86400},
+		{"short.example. 1 IN AAAA 2001:db8::1", 5},
+		// Other names keep the type and global clamps
+		{"other.example. 300 IN A 192.0.2.1", 20},
+		{"other.example. 10 IN AAAA 2001:db8::1", 60},
+		{"notflaky-api.example. 86400 IN AAAA 2001:db8::1", 3600},
+	}
+	for _, tt := range tests {
+		rr, err := dns.NewRR(tt.record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clampTTLs([]dns.RR{rr})
+		if got := rr.Header().Ttl; got != tt.want {
+			t.Errorf("%s clamped to %d, want %d", tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestDomainTTLOverridesAppliedToCachedRecords(t *testing.T) {
+	useConfig(t, &Config{
+		MaxTTL:             3600,
+		TTLOverrides:       map[string]uint32{"A": 20},
+		DomainTTLOverrides: map[string]TTLRange{"flaky-api.example": {Min: 7200}},
+	})
+	cache := NewMemoryCache()
+
+	a, _ := dns.NewRR("flaky-api.example. 300 IN A 192.0.2.1")
+	cache.Set("flaky-api.example.", dns.TypeA, []dns.RR{a})
+	records, ok := cache.Get("flaky-api.example.", dns.TypeA)
+	if !ok {
+		t.Fatal("A record not cached")
+	}
+	if got := records[0].Header().Ttl; got > 7200 || got < 7199 {
+		t.Errorf("cached TTL = %d, want the domain floor 7200 over the A override and MaxTTL", got)
+	}
+}
+
+func TestSortAnswersKeepsCNAMEFirst(t *testing.T) {
+	var records []dns.RR
+	for _, s := range []string{
+		"www.example. 60 IN A 192.0.2.9",
+		"www.example. 60 IN A 192.0.2.1",
+		"alias.example. 60 IN CNAME www.example.",
+	} {
+		rr, _ := dns.NewRR(s)
+		records = append(records, rr)
+	}
+
+	sortAnswers(records)
+	if records[0].Header().Rrtype != dns.TypeCNAME {
+		t.Fatalf("first record is %s, want the CNAME", records[0])
+	}
+	if records[1].(*dns.A).A.String() != "192.0.2.1" || records[2].(*dns.A).A.String() != "192.0.2.9" {
+		t.Errorf("A records not sorted: %v", records[1:])
+	}
+}
+
+func TestSortAnswersKeepsCNAMEChainOrder(t *testing.T) {
+	// The chain is followed top down, the names sort the other way round
+	var records []dns.RR
+	for _, s := range []string{
+		"host.example. 60 IN A 192.0.2.1",
+		"z.example. 60 IN CNAME a.example.",
+		"a.example. 60 IN CNAME host.example.",
+	} {
+		rr, _ := dns.NewRR(s)
+		records = append(records, rr)
+	}
+
+	sortAnswers(records)
+	first, ok1 := records[0].(*dns.CNAME)
+	second, ok2 := records[1].(*dns.CNAME)
+	if !ok1 || !ok2 || first.Hdr.Name != "z.example." || second.Hdr.Name != "a.example." {
+		t.Errorf("sorted to %v, want z.example. -> a.example. -> host.example. in chain order", records)
+	}
+}
+
+// answerRecords builds A records for www.example. in the given order
+func answerRecords(ips ...string) []dns.RR {
+	var records []dns.RR
+	for _, ip := range ips {
+		rr, _ := dns.NewRR("www.example. 60 IN A " + ip)
+		records = append(records, rr)
+	}
+	return records
+}
+
+// answerOrder returns the addresses of A records in order
+func answerOrder(records []dns.RR) string {
+	var ips []string
+	for _, rr := range records {
+		ips = append(ips, rr.(*dns.A).A.String())
+	}
+	return strings.Join(ips, ",")
+}
+
+func TestAnswerOrderClientAffinity(t *testing.T) {
+	useConfig(t, &Config{AnswerOrder: "client-affinity"})
+	ips := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5", "192.0.2.6"}
+	reversed := []string{"192.0.2.6", "192.0.2.5", "192.0.2.4", "192.0.2.3", "192.0.2.2", "192.0.2.1"}
+
+	// The same client gets the same order every time, whatever order upstream used
+	client := net.ParseIP("198.51.100.7")
+	first := answerRecords(ips...)
+	orderAnswers(first, client)
+	for i := 0; i < 10; i++ {
+		again := answerRecords(reversed...)
+		orderAnswers(again, client)
+		if answerOrder(again) != answerOrder(first) {
+			t.Fatalf("client got %s, then %s", answerOrder(first), answerOrder(again))
+		}
+	}
+
+	// Different clients are spread over different preferred records
+	preferred := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		records := answerRecords(ips...)
+		orderAnswers(records, net.IPv4(198, 51, 100, byte(i)))
+		preferred[answerOrder(records[:1])] = true
+	}
+	if len(preferred) < 2 {
+		t.Errorf("50 clients all prefer %v", preferred)
+	}
+}
+
+func TestAnswerOrderPolicies(t *testing.T) {
+	upstream := []string{"192.0.2.3", "192.0.2.1", "192.0.2.2"}
+	for order, want := range map[string]string{
+		"":         "192.0.2.3,192.0.2.1,192.0.2.2",
+		"upstream": "192.0.2.3,192.0.2.1,192.0.2.2",
+		"sorted":   "192.0.2.1,192.0.2.2,192.0.2.3",
+	} {
+		useConfig(t, &Config{AnswerOrder: order})
+		records := answerRecords(upstream...)
+		orderAnswers(records, net.ParseIP("198.51.100.7"))
+		if got := answerOrder(records); got != want {
+			t.Errorf("answer_order %q gave %s, want %s", order, got, want)
+		}
+	}
+
+	// Shuffling keeps every record
+	useConfig(t, &Config{AnswerOrder: "shuffle"})
+	records := answerRecords(upstream...)
+	orderAnswers(records, nil)
+	sortAnswers(records)
+	if got := answerOrder(records); got != "192.0.2.1,192.0.2.2,192.0.2.3" {
+		t.Errorf("shuffled answers are %s, want the same three records", got)
+	}
+}
+
+func TestMinimizeResponse(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(q)
+	a, _ := dns.NewRR("www.example. 300 IN A 192.0.2.1")
+	ns, _ := dns.NewRR("example. 300 IN NS ns1.example.")
+	glue, _ := dns.NewRR("ns1.example. 300 IN A 192.0.2.53")
+	m.Answer = []dns.RR{a}
+	m.Ns = []dns.RR{ns}
+	m.Extra = []dns.RR{glue}
+	m.SetEdns0(1232, true)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeFiltered})
+
+	minimizeResponse(m)
+	if len(m.Answer) != 1 || m.Answer[0] != a {
+		t.Errorf("answer section %v, want it kept", m.Answer)
+	}
+	if len(m.Ns) != 0 {
+		t.Errorf("authority section %v kept on a positive answer", m.Ns)
+	}
+	if len(m.Extra) != 1 || m.IsEdns0() == nil || !m.IsEdns0().Do() || len(m.IsEdns0().Option) != 1 {
+		t.Errorf("additional section %v, want only the OPT with its options", m.Extra)
+	}
+
+	// Negative answers keep their SOA so clients can cache them
+	soa, _ := dns.NewRR("example. 300 IN SOA ns1.example. hostmaster.example. 1 3600 600 86400 300")
+	m = new(dns.Msg)
+	m.SetRcode(q, dns.RcodeNameError)
+	m.Ns = []dns.RR{soa}
+	m.Extra = []dns.RR{glue}
+	minimizeResponse(m)
+	if len(m.Ns) != 1 || len(m.Extra) != 0 {
+		t.Errorf("NXDOMAIN minimized to authority %v additional %v, want the SOA only", m.Ns, m.Extra)
+	}
+}
+
+func TestMinimalResponsesDropsCompanionRecords(t *testing.T) {
+	for _, minimal := range []bool{false, true} {
+		useConfig(t, &Config{
+			ProxyDomains:          []string{"proxied.test"},
+			ProxyCompanionRecords: []string{"HTTPS"},
+			MinimalResponses:      minimal,
+			HostsFile:             "off",
+		})
+		useMemoryCache(t)
+		useServerReady(t)
+		resetProxyIPCache(t)
+		countingEnvelopeWorker(t)
+
+		q := new(dns.Msg)
+		q.SetQuestion("proxied.test.", dns.TypeA)
+		q.SetEdns0(1232, false)
+		m, _ := resolveWithDecision(q)
+		if len(m.Answer) != 1 {
+			t.Fatalf("minimal %v: got %d answers, want the proxied A", minimal, len(m.Answer))
+		}
+		var extras int
+		for _, rr := range m.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extras++
+			}
+		}
+		if want := map[bool]int{false: 1, true: 0}[minimal]; extras != want {
+			t.Errorf("minimal %v: %d additional records besides OPT, want %d", minimal, extras, want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authExpiryMargin refreshes tokens a little before they actually expire
+const authExpiryMargin = 30 * time.Second
+
+// Authenticator provides the bearer token for Blessnet API requests
+type Authenticator interface {
+	Token(ctx context.Context) (string, time.Time, error)
+}
+
+// newAuthenticator creates the provider selected by AuthMethod. API keys are
+// exchanged for tokens through api.
+func newAuthenticator(config *Config, api *BlessnetNodeAPI) (Authenticator, error) {
+	switch config.AuthMethod {
+	case "", "apikey":
+		return &apiKeyAuthenticator{
+			api:    api,
+			key:    config.BlessnetAPIKey,
+			secret: config.BlessnetAPISecret,
+			token:  config.Auth.Token,
+		}, nil
+	case "oauth2":
+		if config.OAuth2.TokenURL == "" || config.OAuth2.ClientID == "" {
+			return nil, fmt.Errorf("oauth2 auth requires oauth2.token_url and oauth2.client_id")
+		}
+		return &oauth2Authenticator{
+			tokenURL:     config.OAuth2.TokenURL,
+			clientID:     config.OAuth2.ClientID,
+			clientSecret: config.OAuth2.ClientSecret,
+			scopes:       config.OAuth2.Scopes,
+			client:       &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	case "mtls":
+		cert, err := tls.LoadX509KeyPair(config.MTLS.CertFile, config.MTLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading mTLS client certificate: %v", err)
+		}
+		authenticator := &mtlsAuthenticator{certificate: cert}
+		if config.MTLS.CAFile != "" {
+			pem, err := ioutil.ReadFile(config.MTLS.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading mTLS CA file: %v", err)
+			}
+			authenticator.roots = x509.NewCertPool()
+			if !authenticator.roots.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in mTLS CA file %s", config.MTLS.CAFile)
+			}
+		}
+		return authenticator, nil
+	default:
+		return nil, fmt.Errorf("unknown auth method %q", config.AuthMethod)
+	}
+}
+
+// apiKeyAuthenticator exchanges the Blessnet API key and secret for a token.
+// A fixed auth.token is used as is, and without credentials a local token is simulated.
+type apiKeyAuthenticator struct {
+	api    *BlessnetNodeAPI
+	key    string
+	secret string
+	token  string
+}
+
+// Token returns a token for the configured API key
+func (a *apiKeyAuthenticator) Token(ctx context.Context) (string, time.Time, error) {
+	if a.token != "" {
+		return a.token, time.Time{}, nil
+	}
+
+	// No credentials configured, so there is no API to talk to
+	if a.key == "" {
+		return "simulated_token_" + time.Now().Format(time.RFC3339), time.Now().Add(24 * time.Hour), nil
+	}
+
+	// The exchange itself can't carry the token it is fetching
+	resp, err := a.api.unauthenticated().Auth(a.key, a.secret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return resp.AccessToken, resp.ExpiresAt, nil
+}
+
+// oauth2Authenticator fetches tokens with the OAuth2 client credentials grant
+type oauth2Authenticator struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	client       *http.Client
+}
+
+// Token requests a new access token from the token endpoint
+func (a *oauth2Authenticator) Token(ctx context.Context) (string, time.Time, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", a.clientID)
+	form.Set("client_secret", a.clientSecret)
+	if len(a.scopes) > 0 {
+		form.Set("scope", strings.Join(a.scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", a.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("error creating token request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("error sending token request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", time.Time{}, fmt.Errorf("token request failed: %s - %s", resp.Status, string(body))
+	}
+
+	var tokenResp AuthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", time.Time{}, fmt.Errorf("error parsing token response: %v", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("token response has no access_token")
+	}
+
+	// Tokens without expires_in are treated as long-lived
+	expiresAt := time.Time{}
+	if tokenResp.ExpiresIn > 0 {
+		expiresAt = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	}
+	return tokenResp.AccessToken, expiresAt, nil
+}
+
+// mtlsAuthenticator authenticates with a client certificate instead of a bearer token
+type mtlsAuthenticator struct {
+	certificate tls.Certificate
+	roots       *x509.CertPool
+}
+
+// Token returns no bearer token, the certificate is presented during the TLS handshake
+func (a *mtlsAuthenticator) Token(ctx context.Context) (string, time.Time, error) {
+	return "", time.Time{}, nil
+}
+
+// TLSConfig returns the client TLS settings carrying the certificate
+func (a *mtlsAuthenticator) TLSConfig() *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{a.certificate}, RootCAs: a.roots}
+}
+
+// authRetryInterval is how long a stale token is handed out before the
+// provider is asked again, so a failing auth endpoint isn't hit on every call
+const authRetryInterval = 10 * time.Second
+
+// cachedAuthenticator reuses a provider's token until shortly before it expires.
+// If a refresh fails, the old token is kept in use until grace after its expiry.
+type cachedAuthenticator struct {
+	provider  Authenticator
+	grace     time.Duration
+	mutex     sync.Mutex
+	token     string
+	expiresAt time.Time
+	fetched   bool
+	stale     bool
+	retryAt   time.Time
+}
+
+// newCachedAuthenticator wraps a provider with token caching
+func newCachedAuthenticator(provider Authenticator, grace time.Duration) *cachedAuthenticator {
+	return &cachedAuthenticator{provider: provider, grace: grace}
+}
+
+// authGrace returns the configured stale token grace period
+func authGrace(config *Config) time.Duration {
+	if config.AuthGraceSeconds < 0 {
+		return 0
+	}
+	return time.Duration(config.AuthGraceSeconds) * time.Second
+}
+
+// Token returns the cached token, fetching a new one once it has expired.
+// A zero expiry means the token never expires.
+func (a *cachedAuthenticator) Token(ctx context.Context) (string, time.Time, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	if a.fetched && !a.stale && (a.expiresAt.IsZero() || now.Add(authExpiryMargin).Before(a.expiresAt)) {
+		return a.token, a.expiresAt, nil
+	}
+
+	// A refresh failed recently, don't ask the provider again just yet
+	if a.usableStale(now) && now.Before(a.retryAt) {
+		return a.token, a.expiresAt, nil
+	}
+
+	token, expiresAt, err := a.provider.Token(ctx)
+	if err != nil {
+		if !a.usableStale(now) {
+			return "", time.Time{}, err
+		}
+		a.retryAt = now.Add(authRetryInterval)
+		if a.expiresAt.IsZero() || now.Before(a.expiresAt) {
+			log.Printf("Auth refresh failed, operating on a stale token that expires in %v: %v", a.expiresAt.Sub(now).Round(time.Second), err)
+		} else {
+			log.Printf("Auth refresh failed, operating on a stale token that expired %v ago: %v", now.Sub(a.expiresAt).Round(time.Second), err)
+		}
+		return a.token, a.expiresAt, nil
+	}
+	a.token, a.expiresAt, a.fetched, a.stale = token, expiresAt, true, false
+	return token, expiresAt, nil
+}
+
+// usableStale reports whether the cached token may still stand in when a refresh fails
+func (a *cachedAuthenticator) usableStale(now time.Time) bool {
+	if !a.fetched || a.grace <= 0 {
+		return false
+	}
+	return a.expiresAt.IsZero() || now.Before(a.expiresAt.Add(a.grace))
+}
+
+// Invalidate forces the next Token call to fetch a fresh token. The old token
+// is kept as a fallback within the grace period.
+func (a *cachedAuthenticator) Invalidate() {
+	a.mutex.Lock()
+	a.stale = true
+	a.retryAt = time.Time{}
+	a.mutex.Unlock()
+}
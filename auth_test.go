@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAuthenticator hands out numbered tokens that expire after ttl
+type fakeAuthenticator struct {
+	ttl   time.Duration
+	mutex sync.Mutex
+	calls int
+}
+
+func (a *fakeAuthenticator) Token(ctx context.Context) (string, time.Time, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.calls++
+	return fmt.Sprintf("token-%d", a.calls), time.Now().Add(a.ttl), nil
+}
+
+func (a *fakeAuthenticator) Calls() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.calls
+}
+
+func TestAuthenticatorTokenUsedAndRefetchedAfterExpiry(t *testing.T) {
+	var mutex sync.Mutex
+	var seen []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		seen = append(seen, r.Header.Get("Authorization"))
+		mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"data":[]}`)
+	}))
+	defer server.Close()
+
+	// The token is inside the refresh margin 100ms after it is fetched
+	provider := &fakeAuthenticator{ttl: authExpiryMargin + 100*time.Millisecond}
+	api := NewBlessnetNodeAPI(server.URL)
+	api.Authenticator = newCachedAuthenticator(provider, 0)
+
+	for i := 0; i < 2; i++ {
+		if _, err := api.GetNodes(); err != nil {
+			t.Fatalf("GetNodes: %v", err)
+		}
+	}
+	if provider.Calls() != 1 {
+		t.Errorf("provider asked %d times for a valid token, want 1", provider.Calls())
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, err := api.GetNodes(); err != nil {
+		t.Fatalf("GetNodes: %v", err)
+	}
+	if provider.Calls() != 2 {
+		t.Errorf("provider asked %d times, want the expired token re-fetched", provider.Calls())
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []string{"Bearer token-1", "Bearer token-1", "Bearer token-2"}
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("Authorization headers = %q, want %q", seen, want)
+	}
+}
+
+// writeClientCertificate writes a self-signed client certificate and key, returning their paths
+func writeClientCertificate(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "phantomdns-test-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestNodeAPIFromConfigNegotiatesOverMTLS(t *testing.T) {
+	useKnownNodeEndpoints(t)
+
+	var mutex sync.Mutex
+	var clients []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/versions" {
+			http.NotFound(w, r)
+			return
+		}
+		mutex.Lock()
+		for _, cert := range r.TLS.PeerCertificates {
+			clients = append(clients, cert.Subject.CommonName)
+		}
+		mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"versions":["v1","v2"]}`)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{}
+	c.API.BaseURL = server.URL
+	c.API.NegotiateVersion = true
+	c.AuthMethod = "mtls"
+	c.MTLS.CertFile, c.MTLS.KeyFile = writeClientCertificate(t)
+	c.MTLS.CAFile = caFile
+	api, err := NewBlessnetNodeAPIFromConfig(c)
+	if err != nil {
+		t.Fatalf("NewBlessnetNodeAPIFromConfig: %v", err)
+	}
+
+	// The server refuses connections without a certificate, so v2 is only
+	// picked if negotiation already went through the mTLS transport
+	if api.APIVersion != "v2" {
+		t.Errorf("APIVersion = %q, want v2 negotiated over mTLS", api.APIVersion)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(clients) != 1 || clients[0] != "phantomdns-test-client" {
+		t.Errorf("negotiation presented certificates %v, want the client certificate", clients)
+	}
+}
+
+func TestNewAuthenticatorMTLSBadCAFile(t *testing.T) {
+	c := &Config{AuthMethod: "mtls"}
+	c.MTLS.CertFile, c.MTLS.KeyFile = writeClientCertificate(t)
+	c.MTLS.CAFile = c.MTLS.KeyFile
+	if _, err := newAuthenticator(c, nil); err == nil {
+		t.Error("CA file without certificates accepted, want an error")
+	}
+}
+
+// flakyAuthenticator hands out tokens expiring at expiresIn from now until it
+// is told to fail, like an auth endpoint going down
+type flakyAuthenticator struct {
+	expiresIn time.Duration
+	mutex     sync.Mutex
+	failing   bool
+	calls     int
+}
+
+func (a *flakyAuthenticator) Token(ctx context.Context) (string, time.Time, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.calls++
+	if a.failing {
+		return "", time.Time{}, fmt.Errorf("auth endpoint unavailable")
+	}
+	return fmt.Sprintf("token-%d", a.calls), time.Now().Add(a.expiresIn), nil
+}
+
+func (a *flakyAuthenticator) Calls() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.calls
+}
+
+func (a *flakyAuthenticator) Fail() {
+	a.mutex.Lock()
+	a.failing = true
+	a.mutex.Unlock()
+}
+
+func TestAuthenticatorStaleTokenWithinGrace(t *testing.T) {
+	logs := captureLog(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-1" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"data":[]}`)
+	}))
+	defer server.Close()
+
+	// The token expires shortly after it is fetched
+	provider := &flakyAuthenticator{expiresIn: 200 * time.Millisecond}
+	api := NewBlessnetNodeAPI(server.URL)
+	api.Authenticator = newCachedAuthenticator(provider, time.Minute)
+	if _, err := api.GetNodes(); err != nil {
+		t.Fatalf("GetNodes: %v", err)
+	}
+
+	provider.Fail()
+	time.Sleep(300 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if _, err := api.GetNodes(); err != nil {
+			t.Fatalf("GetNodes with the auth endpoint down: %v", err)
+		}
+	}
+	if !strings.Contains(logs.String(), "operating on a stale token that expired") {
+		t.Errorf("stale token use not logged:\n%s", logs)
+	}
+
+	// The failing endpoint is retried at most every authRetryInterval
+	if calls := provider.Calls(); calls != 2 {
+		t.Errorf("provider asked %d times, want one failed refresh after the first token", calls)
+	}
+}
+
+func TestAuthenticatorStaleTokenGraceRunsOut(t *testing.T) {
+	for _, grace := range []time.Duration{0, 50 * time.Millisecond} {
+		provider := &flakyAuthenticator{expiresIn: -time.Second}
+		auth := newCachedAuthenticator(provider, grace)
+		if _, _, err := auth.Token(context.Background()); err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+
+		provider.Fail()
+		if token, _, err := auth.Token(context.Background()); err == nil {
+			t.Errorf("grace %v: token %q handed out a second after it expired", grace, token)
+		}
+	}
+
+	// A token invalidated by the API is still the fallback while it's within grace
+	provider := &flakyAuthenticator{expiresIn: time.Hour}
+	auth := newCachedAuthenticator(provider, time.Minute)
+	auth.Token(context.Background())
+	provider.Fail()
+	auth.Invalidate()
+	if token, _, err := auth.Token(context.Background()); err != nil || token != "token-1" {
+		t.Errorf("Token after Invalidate = %q, %v, want the old token-1", token, err)
+	}
+}
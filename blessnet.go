@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -51,10 +55,15 @@ type BlessnetClient struct {
 	Config     *Config
 	WorkerURL  string
 	Regions    []string
-	ActiveNode string
-	client     *http.Client
+	ActiveNode string // Selected node, WorkerURL is used while empty
 	mutex      sync.RWMutex
 	auth       *AuthConfig
+
+	// Provider used to obtain new tokens
+	authenticator *cachedAuthenticator
+
+	// Node API client, configured from the api, auth and discovery settings
+	nodeAPI *BlessnetNodeAPI
 }
 
 // NewBlessnetClient creates a new Blessnet client
@@ -62,10 +71,20 @@ func NewBlessnetClient(config *Config) (*BlessnetClient, error) {
 	client := &BlessnetClient{
 		Config:  config,
 		Regions: []string{"us-east", "eu-west", "ap-east"},
-		client:  &http.Client{Timeout: 30 * time.Second},
 		auth:    &AuthConfig{},
 	}
 
+	// Build the node API client along with its authentication provider
+	nodeAPI, err := NewBlessnetNodeAPIFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	client.nodeAPI = nodeAPI
+	client.authenticator = nodeAPI.Authenticator.(*cachedAuthenticator)
+	if len(config.Worker.Regions) > 0 {
+		client.Regions = config.Worker.Regions
+	}
+
 	// Get the worker URL from config or use the default from bls.toml
 	client.WorkerURL = config.BlessnetWorkerURL
 	if client.WorkerURL == "" {
@@ -75,7 +94,7 @@ func NewBlessnetClient(config *Config) (*BlessnetClient, error) {
 	log.Printf("Initializing Blessnet client with worker URL: %s", client.WorkerURL)
 
 	// Test the connection to the worker
-	err := client.TestConnection()
+	err = client.TestConnection()
 	if err != nil {
 		log.Printf("Warning: Initial connection to Blessnet worker failed: %v", err)
 		log.Printf("Will try alternative methods or regions when needed")
@@ -86,38 +105,124 @@ func NewBlessnetClient(config *Config) (*BlessnetClient, error) {
 	return client, nil
 }
 
+// GetWorkerURL returns the worker URL currently in use
+func (b *BlessnetClient) GetWorkerURL() string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.activeWorkerURL()
+}
+
+// activeWorkerURL returns the selected node, falling back to WorkerURL while
+// none is selected. Callers must hold the mutex.
+func (b *BlessnetClient) activeWorkerURL() string {
+	if b.ActiveNode != "" {
+		return b.ActiveNode
+	}
+	return b.WorkerURL
+}
+
+// SetActiveNode selects the node requests are sent to. An empty node clears the
+// selection so WorkerURL is used again; anything that isn't an http(s) URL is
+// rejected and the current selection kept.
+func (b *BlessnetClient) SetActiveNode(node string) error {
+	if node != "" && !isWorkerURL(node) {
+		return fmt.Errorf("active node %q is not an http(s) URL", node)
+	}
+
+	b.mutex.Lock()
+	b.ActiveNode = node
+	b.mutex.Unlock()
+	return nil
+}
+
+// isWorkerURL reports whether s is an absolute http(s) URL with a host
+func isWorkerURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// UpdateConfig applies a reloaded configuration to the live client without
+// recreating it, then re-checks connectivity against the new worker. Worker
+// timeouts live on the shared worker HTTP client, which the reload rebuilds.
+func (b *BlessnetClient) UpdateConfig(config *Config) error {
+	b.mutex.Lock()
+	oldURL := b.activeWorkerURL()
+	b.Config = config
+	if config.BlessnetWorkerURL != "" {
+		b.WorkerURL = config.BlessnetWorkerURL
+	}
+	if len(config.Worker.Regions) > 0 {
+		b.Regions = config.Worker.Regions
+	}
+	newURL := b.activeWorkerURL()
+	b.mutex.Unlock()
+
+	if newURL == oldURL {
+		return nil
+	}
+
+	log.Printf("Worker URL changed from %s to %s", oldURL, newURL)
+	if err := b.TestConnection(); err != nil {
+		return fmt.Errorf("connection to new Blessnet worker %s failed: %v", newURL, err)
+	}
+	return nil
+}
+
 // Authenticate with the Blessnet API
 func (b *BlessnetClient) Authenticate() error {
-	// Check if token is still valid
-	if b.auth.Token != "" && b.auth.ExpiresAt.After(time.Now()) {
-		log.Printf("Using existing token (expires in %v)", time.Until(b.auth.ExpiresAt))
+	// Check if token is still valid, a zero expiry never runs out
+	b.mutex.RLock()
+	valid := b.auth.Token != "" && (b.auth.ExpiresAt.IsZero() || b.auth.ExpiresAt.After(time.Now()))
+	b.mutex.RUnlock()
+	if valid {
 		return nil
 	}
 
 	log.Printf("Authenticating with Blessnet API...")
 
-	// In a real implementation, we would call the Blessnet API to get a token
-	// For this demo, we'll just generate a fake token
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	token, expiresAt, err := b.authenticator.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("error authenticating: %v", err)
+	}
+
 	b.mutex.Lock()
-	b.auth.Token = "simulated_token_" + time.Now().Format(time.RFC3339)
-	b.auth.ExpiresAt = time.Now().Add(24 * time.Hour)
+	b.auth.Token = token
+	b.auth.ExpiresAt = expiresAt
 	b.mutex.Unlock()
 
-	log.Printf("Authentication successful, token expires in %v", time.Until(b.auth.ExpiresAt))
+	switch {
+	case expiresAt.IsZero():
+		log.Printf("Authentication successful")
+	case expiresAt.After(time.Now()):
+		log.Printf("Authentication successful, token expires in %v", time.Until(expiresAt))
+	}
 	return nil
 }
 
+// AuthToken returns a valid token, authenticating first if needed
+func (b *BlessnetClient) AuthToken() (string, error) {
+	if err := b.Authenticate(); err != nil {
+		return "", err
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.auth.Token, nil
+}
+
 // RefreshAuth forces a refresh of the authentication token
 func (b *BlessnetClient) RefreshAuth() error {
 	b.mutex.Lock()
 	b.auth.Token = ""
 	b.mutex.Unlock()
+	b.authenticator.Invalidate()
 	return b.Authenticate()
 }
 
 // TestConnection checks if the worker URL is accessible
 func (b *BlessnetClient) TestConnection() error {
-	_, err := fetchFromWorker("https://example.com")
+	_, err := b.FetchPage("https://example.com")
 	return err
 }
 
@@ -157,8 +262,7 @@ func (b *BlessnetClient) RefreshNodes() error {
 
 // SendProxyRequest enables proxy functionality for a blocked domain
 func (b *BlessnetClient) SendProxyRequest(targetURL string) ([]byte, error) {
-	// Use the fetchFromWorker function for proxy requests
-	return fetchFromWorker(targetURL)
+	return b.FetchPage(targetURL)
 }
 
 // ListDeployments gets a list of all current deployments
@@ -172,21 +276,77 @@ func (b *BlessnetClient) ListDeployments() ([]string, error) {
 	return []string{"apricot-emu-jacklin-qikeha7m.bls.dev"}, nil
 }
 
+// WorkerTemplateOptions selects optional behavior of the generated worker
+type WorkerTemplateOptions struct {
+	// DisableWelcome answers requests without a TARGET with a bare 404 instead
+	// of the welcome page, so scanners can't tell what the worker is
+	DisableWelcome bool
+
+	// AuthToken, when set, must accompany every request or the worker answers 404
+	AuthToken string
+}
+
+// config returns the client's configuration, which UpdateConfig may replace
+func (b *BlessnetClient) config() *Config {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.Config
+}
+
+// workerTemplateOptions returns the template options set in the client's config
+func (b *BlessnetClient) workerTemplateOptions() WorkerTemplateOptions {
+	config := b.config()
+	if config == nil {
+		return WorkerTemplateOptions{}
+	}
+	return WorkerTemplateOptions{
+		DisableWelcome: config.WorkerDisableWelcome,
+		AuthToken:      config.WorkerAuthToken,
+	}
+}
+
 // CreateWorkerTemplate returns a TypeScript template for creating a new worker
-func (b *BlessnetClient) CreateWorkerTemplate() string {
-	return `import { main } from "@blockless/sdk-ts/dist/lib/entry"; // Import directly from submodule
+func (b *BlessnetClient) CreateWorkerTemplate(opts WorkerTemplateOptions) string {
+	maxRedirects := 5
+	signingSecret := ""
+	signatureMaxAge := 300
+	if config := b.config(); config != nil {
+		maxRedirects = *config.MaxRedirects
+		signingSecret = config.WorkerSigningSecret
+		signatureMaxAge = config.WorkerSignatureMaxAgeSeconds
+	}
 
-// Define a type for environment variables
-interface EnvVars {
-  TARGET?: string;
+	noTarget := workerWelcomeBlock
+	if opts.DisableWelcome {
+		noTarget = workerNoTargetBlock
+	}
+	authCheck := ""
+	if opts.AuthToken != "" {
+		authCheck = strings.Replace(workerAuthBlock, "{{AUTH_TOKEN}}", strconv.Quote(opts.AuthToken), 1)
+	}
+
+	// With a signing secret the worker only serves requests signed by
+	// signWorkerTarget, checking TS and SIG before fetching anything
+	return strings.NewReplacer(
+		"{{AUTH_CHECK}}", authCheck,
+		"{{NO_TARGET}}", noTarget,
+		"{{MAX_REDIRECTS}}", strconv.Itoa(maxRedirects),
+		"{{SIGNING_SECRET}}", strconv.Quote(signingSecret),
+		"{{SIGNATURE_MAX_AGE}}", strconv.Itoa(signatureMaxAge),
+	).Replace(workerTemplate)
 }
 
-main(async () => {
-  // Get environment variables and check if TARGET is empty or undefined
-  const env: EnvVars = process.env as any;
-  const targetUrl = env.TARGET || "";
-  
-  // Show info if no target is specified
+// workerAuthBlock rejects requests without the auth token. Workers only see
+// query parameters, so the token arrives as AUTH alongside the header.
+const workerAuthBlock = `  // Only PhantomDNS knows the token, anyone else gets a plain 404
+  if (env.AUTH !== {{AUTH_TOKEN}}) {
+    return new Response("Not Found", { status: 404, headers: { "Content-Type": "text/plain" } });
+  }
+
+`
+
+// workerWelcomeBlock shows a welcome page for requests without a target
+const workerWelcomeBlock = `  // Show info if no target is specified
   if (!targetUrl || targetUrl.trim() === "") {
     console.log("PhantomDNS Worker is active - Displaying welcome info");
     
@@ -206,24 +366,93 @@ main(async () => {
       }
     });
   }
+`
+
+// workerNoTargetBlock answers requests without a target with a bare 404
+const workerNoTargetBlock = `  // PhantomDNS always sends a target, anything else gets a plain 404
+  if (!targetUrl || targetUrl.trim() === "") {
+    return new Response("Not Found", { status: 404, headers: { "Content-Type": "text/plain" } });
+  }
+`
+
+// workerTemplate is the worker source, with placeholders filled in by CreateWorkerTemplate
+const workerTemplate = `import { main } from "@blockless/sdk-ts/dist/lib/entry"; // Import directly from submodule
+
+// Maximum number of redirects followed for a target
+const MAX_REDIRECTS = {{MAX_REDIRECTS}};
+
+// Shared secret for request signatures, empty to accept unsigned requests
+const SIGNING_SECRET = {{SIGNING_SECRET}};
+
+// Maximum age in seconds of a signed request
+const SIGNATURE_MAX_AGE = {{SIGNATURE_MAX_AGE}};
+
+// Define a type for environment variables
+interface EnvVars {
+  TARGET?: string;
+  TS?: string;
+  SIG?: string;
+  REQUEST_ID?: string;
+  AUTH?: string;
+}
+
+main(async () => {
+  // Get environment variables and check if TARGET is empty or undefined
+  const env: EnvVars = process.env as any;
+  const targetUrl = env.TARGET || "";
+
+  // Request ID from PhantomDNS, logged and echoed back so fetches can be correlated with queries
+  const requestId = env.REQUEST_ID || "";
+  const tag = requestId ? "[" + requestId + "] " : "";
   
-  console.log("PhantomDNS Worker active - Processing request for: " + targetUrl);
+{{AUTH_CHECK}}{{NO_TARGET}}  
+  // Reject unsigned, tampered or stale requests so the worker isn't an open proxy
+  if (SIGNING_SECRET !== "" && !(await verifySignature(targetUrl, env.TS || "", env.SIG || ""))) {
+    console.log(tag + "Rejected request with invalid signature for: " + targetUrl);
+    return new Response("ERROR: Invalid or expired signature", {
+      status: 403,
+      headers: {
+        "Content-Type": "text/plain",
+        "X-Proxy-By": "PhantomDNS",
+        "X-Request-ID": requestId
+      }
+    });
+  }
+
+  console.log(tag + "PhantomDNS Worker active - Processing request for: " + targetUrl);
 
   try {
-    console.log("Establishing connection: " + targetUrl);
+    console.log(tag + "Establishing connection: " + targetUrl);
     
     // Send request to external API using fetch
     // NOTE: Make sure this URL is in the permissions list in the bls.toml file
-    const response = await fetch(targetUrl, { 
+    const requestOptions = { 
       method: 'GET', 
+      redirect: 'manual' as RequestRedirect,
       headers: { 
         "User-Agent": "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36",
         "Accept": "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8",
         "Accept-Language": "en-US,en;q=0.9"
       }
-    });
+    };
+    let finalUrl = targetUrl;
+    let response = await fetch(finalUrl, requestOptions);
+
+    // Follow redirects ourselves so they can be bounded and loops detected
+    const visited: string[] = [finalUrl];
+    while (response.status >= 300 && response.status < 400 && response.headers.get("Location")) {
+      if (visited.length > MAX_REDIRECTS) {
+        throw new Error("Too many redirects (limit " + MAX_REDIRECTS + "), last URL: " + finalUrl);
+      }
+      finalUrl = new URL(response.headers.get("Location") || "", finalUrl).toString();
+      if (visited.indexOf(finalUrl) !== -1) {
+        throw new Error("Redirect loop detected at " + finalUrl);
+      }
+      visited.push(finalUrl);
+      response = await fetch(finalUrl, requestOptions);
+    }
 
-    console.log("Connection status: " + response.status);
+    console.log(tag + "Connection status: " + response.status + " (final URL: " + finalUrl + ")");
 
     if (!response.ok) {
       // Return simple error text
@@ -236,34 +465,38 @@ main(async () => {
         status: 502,
         headers: {
           "Content-Type": "text/plain",
-          "X-Proxy-By": "PhantomDNS"
+          "X-Proxy-By": "PhantomDNS",
+          "X-Request-ID": requestId
         }
       });
     }
 
     // Get response as text
     const text = await response.text();
-    console.log("Response received, size: " + text.length + " bytes");
+    console.log(tag + "Response received, size: " + text.length + " bytes");
     
-    // Return simple success text with content sample
-    const resultInfo = 
-      "SUCCESS: Connected to target\n" +
-      "Status: " + response.status + "\n" +
-      "Target: " + targetUrl + "\n" +
-      "Content Size: " + text.length + " bytes\n\n" +
-      "Content Sample:\n" +
-      "------------\n" +
-      text.substring(0, 300) + (text.length > 300 ? "..." : "");
+    // Return a structured envelope PhantomDNS can decode
+    const envelope = {
+      status: response.status,
+      target: targetUrl,
+      finalURL: finalUrl,
+      resolvedIP: await resolveTarget(targetUrl),
+      contentType: response.headers.get("Content-Type") || "",
+      cacheControl: response.headers.get("Cache-Control") || "",
+      expires: response.headers.get("Expires") || "",
+      bodyBase64: btoa(unescape(encodeURIComponent(text)))
+    };
     
-    return new Response(resultInfo, {
+    return new Response(JSON.stringify(envelope), {
       status: 200,
       headers: {
-        "Content-Type": "text/plain",
-        "X-Proxy-By": "PhantomDNS"
+        "Content-Type": "application/json",
+        "X-Proxy-By": "PhantomDNS",
+        "X-Request-ID": requestId
       }
     });
   } catch (error) {
-    console.error("Error: " + error.message);
+    console.error(tag + "Error: " + error.message);
     
     // Return simple error text
     const errorInfo = 
@@ -274,16 +507,140 @@ main(async () => {
       status: 500,
       headers: {
         "Content-Type": "text/plain",
-        "X-Proxy-By": "PhantomDNS"
+        "X-Proxy-By": "PhantomDNS",
+        "X-Request-ID": requestId
       }
     });
   }
-});`
+});
+
+// Check SIG = hex(HMAC-SHA256(SIGNING_SECRET, target + "\n" + TS)) and that TS is recent
+async function verifySignature(targetUrl: string, ts: string, sig: string): Promise<boolean> {
+  const timestamp = parseInt(ts, 10);
+  if (isNaN(timestamp) || Math.abs(Date.now() / 1000 - timestamp) > SIGNATURE_MAX_AGE) {
+    return false;
+  }
+  const encoder = new TextEncoder();
+  const key = await crypto.subtle.importKey(
+    "raw", encoder.encode(SIGNING_SECRET), { name: "HMAC", hash: "SHA-256" }, false, ["sign"]
+  );
+  const digest = await crypto.subtle.sign("HMAC", key, encoder.encode(targetUrl + "\n" + ts));
+  const expected = Array.from(new Uint8Array(digest)).map((b) => b.toString(16).padStart(2, "0")).join("");
+
+  // Compare in constant time
+  if (expected.length !== sig.length) {
+    return false;
+  }
+  let diff = 0;
+  for (let i = 0; i < expected.length; i++) {
+    diff |= expected.charCodeAt(i) ^ sig.charCodeAt(i);
+  }
+  return diff === 0;
+}
+
+// Resolve the target host's IPv4 address over DNS-over-HTTPS
+async function resolveTarget(targetUrl: string): Promise<string> {
+  try {
+    const host = new URL(targetUrl).hostname;
+    const response = await fetch("https://cloudflare-dns.com/dns-query?type=A&name=" + encodeURIComponent(host), {
+      headers: { "Accept": "application/dns-json" }
+    });
+    const data: any = await response.json();
+    const answer = (data.Answer || []).find((record: any) => record.type === 1);
+    return answer ? answer.data : "";
+  } catch (error) {
+    console.error("Error resolving target: " + error.message);
+    return "";
+  }
+}`
+
+// workerEndpoints returns the primary worker followed by the configured fallbacks
+func (b *BlessnetClient) workerEndpoints() []WorkerEndpoint {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	region := "default"
+	if len(b.Regions) > 0 {
+		region = b.Regions[0]
+	}
+	endpoints := []WorkerEndpoint{{URL: b.activeWorkerURL(), Region: region}}
+	for _, fallback := range b.Config.Worker.Fallbacks {
+		if fallback.URL != "" {
+			endpoints = append(endpoints, fallback)
+		}
+	}
+	return endpoints
+}
+
+// fetchWithFailover fetches a URL through the primary worker, moving on to the
+// fallback workers in order when it fails, and returns the worker that answered.
+// Every attempt carries the same request ID.
+func (b *BlessnetClient) fetchWithFailover(targetURL string, requestID string) ([]byte, WorkerEndpoint, error) {
+	if requestID == "" {
+		requestID = newTraceID()
+	}
+
+	var lastErr error
+	for i, endpoint := range b.workerEndpoints() {
+		body, err := fetchFromWorkerWithOptions(targetURL, workerFetchOptions{WorkerURL: endpoint.URL, RequestID: requestID})
+		if err != nil {
+			result := "error"
+			var challenge *workerChallengeError
+			if errors.As(err, &challenge) {
+				result = "challenge"
+			}
+			workerRequests.Inc(endpoint.URL, endpoint.Region, result)
+			log.Printf("[%s] Worker %s (%s) failed: %v", requestID, endpoint.URL, endpoint.Region, err)
+			lastErr = err
+			continue
+		}
+
+		workerRequests.Inc(endpoint.URL, endpoint.Region, "success")
+		if i > 0 {
+			workerFallbacks.Inc()
+			log.Printf("[%s] Served %s from fallback worker %s (%s)", requestID, targetURL, endpoint.URL, endpoint.Region)
+		}
+		return body, endpoint, nil
+	}
+	return nil, WorkerEndpoint{}, lastErr
 }
 
 // FetchPage retrieves content from a URL using the Blessnet worker
 func (b *BlessnetClient) FetchPage(targetURL string) ([]byte, error) {
-	return fetchFromWorker(targetURL)
+	body, _, err := b.fetchWithFailover(targetURL, "")
+	return body, err
+}
+
+// FetchEnvelope retrieves a URL using the Blessnet worker and decodes the structured
+// response, tagging the fetch with requestID (a new one when empty)
+func (b *BlessnetClient) FetchEnvelope(targetURL string, requestID string) (*WorkerEnvelope, error) {
+	body, worker, err := b.fetchWithFailover(targetURL, requestID)
+	if err != nil {
+		return nil, err
+	}
+	return decodeEnvelope(body, worker)
+}
+
+// FetchEnvelopeFrom retrieves a URL through a specific worker, without failover
+func (b *BlessnetClient) FetchEnvelopeFrom(worker WorkerEndpoint, targetURL string, requestID string) (*WorkerEnvelope, error) {
+	body, err := fetchFromWorkerWithOptions(targetURL, workerFetchOptions{WorkerURL: worker.URL, RequestID: requestID})
+	if err != nil {
+		workerRequests.Inc(worker.URL, worker.Region, "error")
+		return nil, err
+	}
+	workerRequests.Inc(worker.URL, worker.Region, "success")
+	return decodeEnvelope(body, worker)
+}
+
+// decodeEnvelope parses a worker response and records which worker served it
+func decodeEnvelope(body []byte, worker WorkerEndpoint) (*WorkerEnvelope, error) {
+	envelope, err := parseWorkerResponse(body)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing worker response: %v", err)
+	}
+	envelope.Worker = worker
+
+	return envelope, nil
 }
 
 // Using environment variables for API keys is more secure than hardcoding
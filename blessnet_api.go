@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,24 +10,234 @@ import (
 	"log"
 	"net/http"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // BlessnetNodeAPI represents a specific Blessnet node API client
 type BlessnetNodeAPI struct {
 	BaseURL    string
+	BaseURLs   []string // Failover base URLs, tried in order
 	APIVersion string
 	client     *http.Client
+
+	// Provides the bearer token for requests, if set
+	Authenticator Authenticator
+
+	// Node discovery settings
+	DiscoveryConcurrency int           // Maximum parallel connectivity checks
+	DiscoveryTimeout     time.Duration // Overall deadline for discovery
 }
 
 // NewBlessnetNodeAPI creates a new API client for a specific node
 func NewBlessnetNodeAPI(baseURL string) *BlessnetNodeAPI {
 	return &BlessnetNodeAPI{
-		BaseURL:    baseURL,
-		APIVersion: "v1",
-		client:     &http.Client{Timeout: 30 * time.Second},
+		BaseURL:              baseURL,
+		APIVersion:           "v1",
+		client:               &http.Client{Timeout: 30 * time.Second},
+		DiscoveryConcurrency: 8,
+		DiscoveryTimeout:     10 * time.Second,
+	}
+}
+
+// NewBlessnetNodeAPIFromConfig creates an API client using the configured API, auth and discovery settings
+func NewBlessnetNodeAPIFromConfig(config *Config) (*BlessnetNodeAPI, error) {
+	api := NewBlessnetNodeAPI(config.API.BaseURL)
+	if config.API.Version != "" {
+		api.APIVersion = config.API.Version
+	}
+	if config.Discovery.Concurrency > 0 {
+		api.DiscoveryConcurrency = config.Discovery.Concurrency
+	}
+	if config.Discovery.TimeoutSeconds > 0 {
+		api.DiscoveryTimeout = time.Duration(config.Discovery.TimeoutSeconds) * time.Second
+	}
+
+	authenticator, err := newAuthenticator(config, api)
+	if err != nil {
+		return nil, err
+	}
+
+	// Client certificates are presented on every connection, negotiation included
+	if mtls, ok := authenticator.(*mtlsAuthenticator); ok {
+		api.client.Transport = &http.Transport{TLSClientConfig: mtls.TLSConfig()}
+	}
+
+	// Move to a newer API version when the node offers one
+	if config.API.NegotiateVersion {
+		if version, err := api.NegotiateVersion(); err != nil {
+			log.Printf("API version negotiation failed, using %s: %v", version, err)
+		} else {
+			log.Printf("Negotiated node API version %s", version)
+		}
+	}
+
+	// Fail over across the reachable node endpoints
+	if err := api.UseDetectedEndpoints(); err != nil {
+		log.Printf("Node endpoint discovery failed, using %s only: %v", api.BaseURL, err)
+	}
+
+	api.Authenticator = newCachedAuthenticator(authenticator, authGrace(config))
+	return api, nil
+}
+
+// unauthenticated returns a copy of the client that sends no bearer token
+func (api *BlessnetNodeAPI) unauthenticated() *BlessnetNodeAPI {
+	copied := *api
+	copied.Authenticator = nil
+	return &copied
+}
+
+// supportedAPIVersions lists the node API versions this client can speak
+var supportedAPIVersions = []string{"v1", "v2"}
+
+// apiVersionNumber parses "v2" into 2, returning 0 for anything else
+func apiVersionNumber(version string) int {
+	version = strings.ToLower(version)
+	if !strings.HasPrefix(version, "v") {
+		return 0
+	}
+	n, err := strconv.Atoi(version[1:])
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// selectAPIVersion picks the highest version offered by the server that we support
+func selectAPIVersion(offered []string) (string, bool) {
+	best, bestNumber := "", 0
+	for _, version := range offered {
+		number := apiVersionNumber(version)
+		if number <= bestNumber {
+			continue
+		}
+		for _, supported := range supportedAPIVersions {
+			if apiVersionNumber(supported) == number {
+				best, bestNumber = supported, number
+			}
+		}
+	}
+	return best, best != ""
+}
+
+// NegotiateVersion asks the node API which versions it serves and switches to
+// the highest one we support, keeping the configured version if that fails
+func (api *BlessnetNodeAPI) NegotiateVersion() (string, error) {
+	resp, err := api.do(func(baseURL string) (*http.Request, error) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/versions", baseURL), nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating versions request: %v", err)
+		}
+		req.Header.Set("Accept", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return api.APIVersion, fmt.Errorf("error sending versions request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return api.APIVersion, fmt.Errorf("versions request failed: %s", resp.Status)
+	}
+
+	var versionsResp struct {
+		Versions []string `json:"versions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&versionsResp); err != nil {
+		return api.APIVersion, fmt.Errorf("error parsing versions response: %v", err)
+	}
+
+	version, ok := selectAPIVersion(versionsResp.Versions)
+	if !ok {
+		return api.APIVersion, fmt.Errorf("no supported API version among %v", versionsResp.Versions)
+	}
+
+	api.APIVersion = version
+	return version, nil
+}
+
+// baseURLs returns the base URLs to try, falling back to BaseURL alone
+func (api *BlessnetNodeAPI) baseURLs() []string {
+	if len(api.BaseURLs) == 0 {
+		return []string{api.BaseURL}
 	}
+	return api.BaseURLs
+}
+
+// UseDetectedEndpoints adds the reachable node endpoints as failover base URLs, fastest first
+func (api *BlessnetNodeAPI) UseDetectedEndpoints() error {
+	endpoints, err := api.DiscoverReachableEndpoints()
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	urls := []string{}
+	for _, u := range append([]string{api.BaseURL}, endpoints...) {
+		u = strings.TrimSuffix(u, "/")
+		if u == "" || seen[u] {
+			continue
+		}
+		seen[u] = true
+		urls = append(urls, u)
+	}
+
+	api.BaseURLs = urls
+	return nil
+}
+
+// do sends a request to each base URL in turn, moving on after transport
+// errors and 5xx responses, and returns the first usable response
+func (api *BlessnetNodeAPI) do(build func(baseURL string) (*http.Request, error)) (*http.Response, error) {
+	return api.doWith(api.client, build)
+}
+
+// doWith is do using a specific HTTP client
+func (api *BlessnetNodeAPI) doWith(client *http.Client, build func(baseURL string) (*http.Request, error)) (*http.Response, error) {
+	urls := api.baseURLs()
+	policy := defaultRetryPolicy
+	policy.Attempts = len(urls)
+
+	var resp *http.Response
+	err := withRetry(policy, func(attempt int) (bool, error) {
+		req, err := build(urls[attempt])
+		if err != nil {
+			return false, err
+		}
+
+		// Attach the provider's token, replacing any placeholder header
+		if api.Authenticator != nil {
+			token, _, err := api.Authenticator.Token(req.Context())
+			if err != nil {
+				return false, fmt.Errorf("error getting auth token: %v", err)
+			}
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+
+		r, err := client.Do(req)
+		if err != nil {
+			log.Printf("Node API request to %s failed: %v", urls[attempt], err)
+			return true, err
+		}
+
+		// Keep the last 5xx so the caller can report it if nothing else works
+		if isRetryableStatus(r.StatusCode) && attempt < len(urls)-1 {
+			log.Printf("Node API %s returned %s, trying next endpoint", urls[attempt], r.Status)
+			r.Body.Close()
+			return true, fmt.Errorf("node API returned status %d", r.StatusCode)
+		}
+
+		resp = r
+		return false, nil
+	})
+
+	return resp, err
 }
 
 // AuthResponse represents the response from authentication endpoint
@@ -52,11 +263,14 @@ func (b *BlessnetNodeAPI) Auth(apiKey string, apiSecret string) (*AuthResponse,
 	}
 
 	// Send request to authentication endpoint
-	resp, err := b.client.Post(
-		fmt.Sprintf("%s/%s/auth", b.BaseURL, b.APIVersion),
-		"application/json",
-		bytes.NewBuffer(jsonData),
-	)
+	resp, err := b.do(func(baseURL string) (*http.Request, error) {
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s/auth", baseURL, b.APIVersion), bytes.NewBuffer(jsonData))
+		if err != nil {
+			return nil, fmt.Errorf("error creating auth request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error sending auth request: %v", err)
 	}
@@ -82,19 +296,15 @@ func (b *BlessnetNodeAPI) Auth(apiKey string, apiSecret string) (*AuthResponse,
 }
 
 // GetNodes retrieves available nodes
-func (b *BlessnetNodeAPI) GetNodes() ([]map[string]interface{}, error) {
-	// Add authentication
-	req, err := http.NewRequest(
-		"GET",
-		fmt.Sprintf("%s/%s/nodes", b.BaseURL, b.APIVersion),
-		nil,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("error creating nodes request: %v", err)
-	}
-
+func (b *BlessnetNodeAPI) GetNodes() ([]Node, error) {
 	// Send request
-	resp, err := b.client.Do(req)
+	resp, err := b.do(func(baseURL string) (*http.Request, error) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s/nodes", baseURL, b.APIVersion), nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating nodes request: %v", err)
+		}
+		return req, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error getting nodes: %v", err)
 	}
@@ -108,7 +318,7 @@ func (b *BlessnetNodeAPI) GetNodes() ([]map[string]interface{}, error) {
 
 	// Parse response
 	var nodesResp struct {
-		Data []map[string]interface{} `json:"data"`
+		Data []Node `json:"data"`
 	}
 	err = json.NewDecoder(resp.Body).Decode(&nodesResp)
 	if err != nil {
@@ -119,19 +329,18 @@ func (b *BlessnetNodeAPI) GetNodes() ([]map[string]interface{}, error) {
 }
 
 // FetchNodeStatus checks the status of a specific Blessnet node
-func (api *BlessnetNodeAPI) FetchNodeStatus(nodeID string) (map[string]interface{}, error) {
-	url := fmt.Sprintf("%s/nodes/%s", api.BaseURL, nodeID)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create node status request: %v", err)
-	}
-
-	if api.APIVersion != "" {
-		req.Header.Set("Authorization", "Bearer "+api.APIVersion)
-	}
+func (api *BlessnetNodeAPI) FetchNodeStatus(nodeID string) (*Node, error) {
+	resp, err := api.do(func(baseURL string) (*http.Request, error) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/nodes/%s", baseURL, nodeID), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create node status request: %v", err)
+		}
 
-	resp, err := api.client.Do(req)
+		if api.APIVersion != "" {
+			req.Header.Set("Authorization", "Bearer "+api.APIVersion)
+		}
+		return req, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to send node status request: %v", err)
 	}
@@ -141,28 +350,27 @@ func (api *BlessnetNodeAPI) FetchNodeStatus(nodeID string) (map[string]interface
 		return nil, fmt.Errorf("node status query failed. Status code: %d", resp.StatusCode)
 	}
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	var node Node
+	if err := json.NewDecoder(resp.Body).Decode(&node); err != nil {
 		return nil, fmt.Errorf("failed to parse node status response: %v", err)
 	}
 
-	return result, nil
+	return &node, nil
 }
 
 // ListAvailableNodes lists all available Blessnet nodes
-func (api *BlessnetNodeAPI) ListAvailableNodes() ([]map[string]interface{}, error) {
-	url := fmt.Sprintf("%s/nodes", api.BaseURL)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create node list request: %v", err)
-	}
-
-	if api.APIVersion != "" {
-		req.Header.Set("Authorization", "Bearer "+api.APIVersion)
-	}
+func (api *BlessnetNodeAPI) ListAvailableNodes() ([]Node, error) {
+	resp, err := api.do(func(baseURL string) (*http.Request, error) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/nodes", baseURL), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create node list request: %v", err)
+		}
 
-	resp, err := api.client.Do(req)
+		if api.APIVersion != "" {
+			req.Header.Set("Authorization", "Bearer "+api.APIVersion)
+		}
+		return req, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to send node list request: %v", err)
 	}
@@ -172,7 +380,7 @@ func (api *BlessnetNodeAPI) ListAvailableNodes() ([]map[string]interface{}, erro
 		return nil, fmt.Errorf("node list query failed. Status code: %d", resp.StatusCode)
 	}
 
-	var result []map[string]interface{}
+	var result []Node
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, fmt.Errorf("failed to parse node list response: %v", err)
 	}
@@ -182,8 +390,6 @@ func (api *BlessnetNodeAPI) ListAvailableNodes() ([]map[string]interface{}, erro
 
 // DeployFunction deploys a function to specific Blessnet nodes
 func (api *BlessnetNodeAPI) DeployFunction(wasmBytes []byte, deployOptions map[string]interface{}) (map[string]interface{}, error) {
-	url := fmt.Sprintf("%s/functions", api.BaseURL)
-
 	// Create request body
 	requestBody, err := json.Marshal(map[string]interface{}{
 		"function": wasmBytes,
@@ -193,17 +399,18 @@ func (api *BlessnetNodeAPI) DeployFunction(wasmBytes []byte, deployOptions map[s
 		return nil, fmt.Errorf("failed to create JSON for deploy request: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create deploy request: %v", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	if api.APIVersion != "" {
-		req.Header.Set("Authorization", "Bearer "+api.APIVersion)
-	}
+	resp, err := api.do(func(baseURL string) (*http.Request, error) {
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s/functions", baseURL), bytes.NewBuffer(requestBody))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create deploy request: %v", err)
+		}
 
-	resp, err := api.client.Do(req)
+		req.Header.Set("Content-Type", "application/json")
+		if api.APIVersion != "" {
+			req.Header.Set("Authorization", "Bearer "+api.APIVersion)
+		}
+		return req, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to send deploy request: %v", err)
 	}
@@ -223,15 +430,95 @@ func (api *BlessnetNodeAPI) DeployFunction(wasmBytes []byte, deployOptions map[s
 
 // InvokeFunction calls a deployed function with specific parameters
 func (api *BlessnetNodeAPI) InvokeFunction(functionID string, params map[string]interface{}) (map[string]interface{}, error) {
-	url := fmt.Sprintf("%s/functions/%s/invoke", api.BaseURL, functionID)
-
 	// Create request body
 	requestBody, err := json.Marshal(params)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create JSON for invoke request: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	resp, err := api.do(func(baseURL string) (*http.Request, error) {
+		return api.newInvokeRequest(context.Background(), baseURL, functionID, requestBody)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send invoke request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Read response content (for error message)
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("invoke request failed. Status code: %d, Response: %s", resp.StatusCode, string(body))
+	}
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse invoke response: %v", err)
+	}
+
+	return result, nil
+}
+
+// InvokeResult is the outcome of one invocation in a batch
+type InvokeResult struct {
+	Index  int                    // Position of the parameters in the batch
+	Params map[string]interface{} // Parameters the function was invoked with
+	Output map[string]interface{} // Function output, nil on failure
+	Err    error                  // Invocation error, nil on success
+}
+
+// InvokeFunctionBatch invokes a function once per parameter set using a bounded
+// pool of workers. Failed invocations are reported in their result without
+// stopping the rest of the batch; results are returned in input order.
+func (api *BlessnetNodeAPI) InvokeFunctionBatch(functionID string, paramsList []map[string]interface{}, concurrency int) ([]InvokeResult, error) {
+	if functionID == "" {
+		return nil, fmt.Errorf("function ID is required")
+	}
+
+	results := make([]InvokeResult, len(paramsList))
+	if len(paramsList) == 0 {
+		return results, nil
+	}
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if concurrency > len(paramsList) {
+		concurrency = len(paramsList)
+	}
+
+	// Each worker writes only its own result slots, so no locking is needed
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				output, err := api.InvokeFunction(functionID, paramsList[index])
+				results[index] = InvokeResult{
+					Index:  index,
+					Params: paramsList[index],
+					Output: output,
+					Err:    err,
+				}
+			}
+		}()
+	}
+
+	for index := range paramsList {
+		jobs <- index
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results, nil
+}
+
+// newInvokeRequest builds a function invocation request against a base URL
+func (api *BlessnetNodeAPI) newInvokeRequest(ctx context.Context, baseURL string, functionID string, requestBody []byte) (*http.Request, error) {
+	url := fmt.Sprintf("%s/functions/%s/invoke", baseURL, functionID)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(requestBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create invoke request: %v", err)
 	}
@@ -241,39 +528,66 @@ func (api *BlessnetNodeAPI) InvokeFunction(functionID string, params map[string]
 		req.Header.Set("Authorization", "Bearer "+api.APIVersion)
 	}
 
-	resp, err := api.client.Do(req)
+	return req, nil
+}
+
+// InvokeFunctionStream calls a deployed function and returns the raw response body
+// so streaming or large outputs can be consumed incrementally by the caller
+func (api *BlessnetNodeAPI) InvokeFunctionStream(functionID string, params map[string]interface{}) (io.ReadCloser, error) {
+	return api.InvokeFunctionStreamContext(context.Background(), functionID, params)
+}
+
+// InvokeFunctionStreamContext is InvokeFunctionStream with a context that
+// cancels the request and closes the stream when done
+func (api *BlessnetNodeAPI) InvokeFunctionStreamContext(ctx context.Context, functionID string, params map[string]interface{}) (io.ReadCloser, error) {
+	// Create request body
+	requestBody, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JSON for invoke request: %v", err)
+	}
+
+	// The regular client timeout covers the whole body read, which would cut
+	// long-running streams short, so rely on the context instead
+	streamClient := &http.Client{Transport: api.client.Transport}
+
+	resp, err := api.doWith(streamClient, func(baseURL string) (*http.Request, error) {
+		return api.newInvokeRequest(ctx, baseURL, functionID, requestBody)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to send invoke request: %v", err)
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		// Read response content (for error message)
 		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
 		return nil, fmt.Errorf("invoke request failed. Status code: %d, Response: %s", resp.StatusCode, string(body))
 	}
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("failed to parse invoke response: %v", err)
-	}
+	return resp.Body, nil
+}
 
-	return result, nil
+// knownNodeEndpoints are the node endpoints that are always considered during discovery
+var knownNodeEndpoints = []string{
+	"https://apricot-emu-jacklin-qikeha7m.bls.dev",
+	"https://api.bless.network",
 }
 
 // DetectNodeEndpoints detects Blessnet nodes in the local network or known hosts
 func (api *BlessnetNodeAPI) DetectNodeEndpoints() ([]string, error) {
+	return api.detectNodeEndpoints(context.Background())
+}
+
+// detectNodeEndpoints is DetectNodeEndpoints bounded by a context
+func (api *BlessnetNodeAPI) detectNodeEndpoints(ctx context.Context) ([]string, error) {
 	log.Println("Searching for Blessnet nodes in local network or known hosts...")
 
 	// NOTE: In a real application, node discovery would be done here
-	// For now, let's return a fixed list
-	knownEndpoints := []string{
-		"https://apricot-emu-jacklin-qikeha7m.bls.dev",
-		"https://api.bless.network",
-	}
+	// For now, let's start from a fixed list
+	knownEndpoints := append([]string{}, knownNodeEndpoints...)
 
 	// Try to get node information from Blessnet CLI
-	cmd := exec.Command("blessnet", "list", "nodes")
+	cmd := exec.CommandContext(ctx, "blessnet", "list", "nodes")
 	output, err := cmd.Output()
 	if err == nil {
 		// Parse CLI output and add endpoints
@@ -293,13 +607,92 @@ func (api *BlessnetNodeAPI) DetectNodeEndpoints() ([]string, error) {
 	return knownEndpoints, nil
 }
 
+// endpointLatency records how quickly a reachable endpoint answered
+type endpointLatency struct {
+	endpoint string
+	latency  time.Duration
+}
+
+// DiscoverReachableEndpoints detects node endpoints and checks them in parallel,
+// returning only the reachable ones ordered from fastest to slowest
+func (api *BlessnetNodeAPI) DiscoverReachableEndpoints() ([]string, error) {
+	timeout := api.DiscoveryTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	endpoints, err := api.detectNodeEndpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	workers := api.DiscoveryConcurrency
+	if workers <= 0 {
+		workers = 1
+	}
+	if workers > len(endpoints) {
+		workers = len(endpoints)
+	}
+
+	// Check endpoints with a bounded pool of workers
+	jobs := make(chan string)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	reachable := []endpointLatency{}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for endpoint := range jobs {
+				start := time.Now()
+				ok, err := api.connectivityCheck(ctx, endpoint)
+				if err != nil || !ok {
+					log.Printf("Node endpoint %s unreachable: %v", endpoint, err)
+					continue
+				}
+				mutex.Lock()
+				reachable = append(reachable, endpointLatency{endpoint: endpoint, latency: time.Since(start)})
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, endpoint := range endpoints {
+		select {
+		case jobs <- endpoint:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(reachable, func(i, j int) bool {
+		return reachable[i].latency < reachable[j].latency
+	})
+
+	result := make([]string, 0, len(reachable))
+	for _, r := range reachable {
+		result = append(result, r.endpoint)
+	}
+
+	return result, nil
+}
+
 // ConnectivityCheck performs a connection check to a Blessnet node
 func (api *BlessnetNodeAPI) ConnectivityCheck(endpoint string) (bool, error) {
+	return api.connectivityCheck(context.Background(), endpoint)
+}
+
+// connectivityCheck is ConnectivityCheck bounded by a context
+func (api *BlessnetNodeAPI) connectivityCheck(ctx context.Context, endpoint string) (bool, error) {
 	client := &http.Client{
 		Timeout: 5 * time.Second,
 	}
 
-	req, err := http.NewRequest("GET", endpoint, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
 	if err != nil {
 		return false, fmt.Errorf("failed to create connection check request: %v", err)
 	}
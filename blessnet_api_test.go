@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInvokeFunctionStreamReadsChunksAsTheyArrive(t *testing.T) {
+	next := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/functions/fn1/invoke" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, "chunk 1")
+		w.(http.Flusher).Flush()
+
+		// Hold the second chunk back until the client has read the first
+		select {
+		case <-next:
+		case <-time.After(5 * time.Second):
+			return
+		}
+		fmt.Fprintln(w, "chunk 2")
+	}))
+	defer server.Close()
+
+	api := NewBlessnetNodeAPI(server.URL)
+	stream, err := api.InvokeFunctionStream("fn1", map[string]interface{}{"n": 2})
+	if err != nil {
+		t.Fatalf("InvokeFunctionStream: %v", err)
+	}
+	defer stream.Close()
+
+	reader := bufio.NewReader(stream)
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "chunk 1\n" {
+		t.Fatalf("first chunk = %q, %v", line, err)
+	}
+
+	close(next)
+	line, err = reader.ReadString('\n')
+	if err != nil || line != "chunk 2\n" {
+		t.Fatalf("second chunk = %q, %v", line, err)
+	}
+}
+
+func TestInvokeFunctionStreamContextCancel(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "started")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	api := NewBlessnetNodeAPI(server.URL)
+	stream, err := api.InvokeFunctionStreamContext(ctx, "fn1", nil)
+	if err != nil {
+		t.Fatalf("InvokeFunctionStreamContext: %v", err)
+	}
+	defer stream.Close()
+
+	reader := bufio.NewReader(stream)
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatalf("reading first line: %v", err)
+	}
+
+	cancel()
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Fatal("read succeeded after the context was cancelled")
+	}
+}
+
+func TestInvokeFunctionStreamErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such function", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	api := NewBlessnetNodeAPI(server.URL)
+	if _, err := api.InvokeFunctionStream("missing", nil); err == nil {
+		t.Fatal("expected an error for a 404 response")
+	}
+}
+
+// useKnownNodeEndpoints replaces the fixed discovery list for the test
+func useKnownNodeEndpoints(t *testing.T, endpoints ...string) {
+	t.Helper()
+	old := knownNodeEndpoints
+	knownNodeEndpoints = endpoints
+	t.Cleanup(func() { knownNodeEndpoints = old })
+}
+
+// closedServerURL returns the URL of a server that no longer accepts connections
+func closedServerURL() string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return server.URL
+}
+
+func nodesServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/nodes" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"data":[{"id":"node-1","region":"eu-west"}]}`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGetNodesFailsOverToSecondBaseURL(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	tests := []struct {
+		name  string
+		first string
+	}{
+		{"transport error", closedServerURL()},
+		{"server error", failing.URL},
+	}
+
+	second := nodesServer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := NewBlessnetNodeAPI(tt.first)
+			api.BaseURLs = []string{tt.first, second.URL}
+
+			nodes, err := api.GetNodes()
+			if err != nil {
+				t.Fatalf("GetNodes: %v", err)
+			}
+			if len(nodes) != 1 || nodes[0].ID != "node-1" {
+				t.Errorf("nodes = %+v", nodes)
+			}
+		})
+	}
+}
+
+func TestGetNodesReportsLastFailure(t *testing.T) {
+	api := NewBlessnetNodeAPI(closedServerURL())
+	api.BaseURLs = []string{api.BaseURL, closedServerURL()}
+
+	if _, err := api.GetNodes(); err == nil {
+		t.Fatal("expected an error when every base URL fails")
+	}
+}
+
+func TestUseDetectedEndpointsAddsReachableFailovers(t *testing.T) {
+	reachable := nodesServer(t)
+	useKnownNodeEndpoints(t, closedServerURL(), reachable.URL)
+
+	api := NewBlessnetNodeAPI(closedServerURL())
+	api.DiscoveryTimeout = 5 * time.Second
+	if err := api.UseDetectedEndpoints(); err != nil {
+		t.Fatalf("UseDetectedEndpoints: %v", err)
+	}
+
+	want := []string{api.BaseURL, reachable.URL}
+	if fmt.Sprint(api.BaseURLs) != fmt.Sprint(want) {
+		t.Fatalf("BaseURLs = %v, want %v", api.BaseURLs, want)
+	}
+
+	// The configured base URL is down, so GetNodes has to use the discovered one
+	nodes, err := api.GetNodes()
+	if err != nil || len(nodes) != 1 {
+		t.Fatalf("GetNodes = %v, %v", nodes, err)
+	}
+}
+
+func TestNodeAPIFromConfigUsesDetectedEndpoints(t *testing.T) {
+	reachable := nodesServer(t)
+	useKnownNodeEndpoints(t, reachable.URL)
+
+	c := &Config{}
+	c.API.BaseURL = closedServerURL()
+	c.BlessnetAPIKey = "key"
+	api, err := NewBlessnetNodeAPIFromConfig(c)
+	if err != nil {
+		t.Fatalf("NewBlessnetNodeAPIFromConfig: %v", err)
+	}
+
+	if len(api.BaseURLs) != 2 || api.BaseURLs[1] != reachable.URL {
+		t.Errorf("BaseURLs = %v, want the discovered endpoint as failover", api.BaseURLs)
+	}
+
+	// The API key is exchanged through the same failover list
+	authenticator := api.Authenticator.(*cachedAuthenticator).provider.(*apiKeyAuthenticator)
+	if authenticator.api != api {
+		t.Error("the API key provider doesn't use the configured client")
+	}
+}
+
+// delayedServer answers every request with 200 after the given delay
+func delayedServer(t *testing.T, delay time.Duration) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDiscoverReachableEndpointsOrdersByLatency(t *testing.T) {
+	slow := delayedServer(t, 150*time.Millisecond)
+	medium := delayedServer(t, 50*time.Millisecond)
+	fast := delayedServer(t, 0)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	useKnownNodeEndpoints(t, slow.URL, closedServerURL(), failing.URL, medium.URL, fast.URL)
+
+	api := NewBlessnetNodeAPI("")
+	api.DiscoveryConcurrency = 5
+	endpoints, err := api.DiscoverReachableEndpoints()
+	if err != nil {
+		t.Fatalf("DiscoverReachableEndpoints: %v", err)
+	}
+
+	want := []string{fast.URL, medium.URL, slow.URL}
+	if fmt.Sprint(endpoints) != fmt.Sprint(want) {
+		t.Errorf("endpoints = %v, want %v", endpoints, want)
+	}
+}
+
+func TestDiscoverReachableEndpointsDeadline(t *testing.T) {
+	hanging := delayedServer(t, 5*time.Second)
+	fast := delayedServer(t, 0)
+	useKnownNodeEndpoints(t, hanging.URL, fast.URL)
+
+	api := NewBlessnetNodeAPI("")
+	api.DiscoveryConcurrency = 2
+	api.DiscoveryTimeout = 300 * time.Millisecond
+
+	start := time.Now()
+	endpoints, err := api.DiscoverReachableEndpoints()
+	if err != nil {
+		t.Fatalf("DiscoverReachableEndpoints: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("discovery took %v, the deadline wasn't applied", elapsed)
+	}
+	if len(endpoints) != 1 || endpoints[0] != fast.URL {
+		t.Errorf("endpoints = %v, want only %s", endpoints, fast.URL)
+	}
+}
+
+func TestNodeAPIFromConfigDiscoverySettings(t *testing.T) {
+	useKnownNodeEndpoints(t)
+
+	c := &Config{}
+	c.API.BaseURL = "http://127.0.0.1:1"
+	c.Discovery.Concurrency = 3
+	c.Discovery.TimeoutSeconds = 7
+	api, err := NewBlessnetNodeAPIFromConfig(c)
+	if err != nil {
+		t.Fatalf("NewBlessnetNodeAPIFromConfig: %v", err)
+	}
+	if api.DiscoveryConcurrency != 3 || api.DiscoveryTimeout != 7*time.Second {
+		t.Errorf("discovery settings = %d, %v; want 3, 7s", api.DiscoveryConcurrency, api.DiscoveryTimeout)
+	}
+}
+
+func TestInvokeFunctionBatchMixedResults(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			seen := maxInFlight.Load()
+			if current <= seen || maxInFlight.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		var params struct{ N int }
+		json.NewDecoder(r.Body).Decode(&params)
+		if params.N%2 == 1 {
+			http.Error(w, "odd input", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"doubled":%d}`, params.N*2)
+	}))
+	defer server.Close()
+
+	paramsList := make([]map[string]interface{}, 8)
+	for i := range paramsList {
+		paramsList[i] = map[string]interface{}{"n": i}
+	}
+
+	api := NewBlessnetNodeAPI(server.URL)
+	results, err := api.InvokeFunctionBatch("fn1", paramsList, 3)
+	if err != nil {
+		t.Fatalf("InvokeFunctionBatch: %v", err)
+	}
+	if len(results) != len(paramsList) {
+		t.Fatalf("got %d results, want %d", len(results), len(paramsList))
+	}
+
+	// One failure doesn't abort the batch, every item gets its own outcome
+	for i, result := range results {
+		if result.Index != i || result.Params["n"] != i {
+			t.Errorf("result %d is for index %d with %v", i, result.Index, result.Params)
+		}
+		if i%2 == 1 {
+			if result.Err == nil || !strings.Contains(result.Err.Error(), "400") {
+				t.Errorf("result %d: err = %v, want the 400 reported", i, result.Err)
+			}
+			continue
+		}
+		if result.Err != nil || result.Output["doubled"] != float64(i*2) {
+			t.Errorf("result %d = %v, %v, want doubled %d", i, result.Output, result.Err, i*2)
+		}
+	}
+
+	if got := maxInFlight.Load(); got > 3 || got < 2 {
+		t.Errorf("%d invocations ran at once, want at most 3 in parallel", got)
+	}
+}
+
+func TestInvokeFunctionBatchRequiresFunctionID(t *testing.T) {
+	api := NewBlessnetNodeAPI(closedServerURL())
+	if _, err := api.InvokeFunctionBatch("", []map[string]interface{}{{}}, 2); err == nil {
+		t.Error("batch without a function ID accepted, want an error")
+	}
+}
+
+// versionsServer offers the given API versions and serves auth and nodes under each
+func versionsServer(t *testing.T, offered string) (*httptest.Server, *[]string) {
+	t.Helper()
+	var mutex sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/versions" && offered == "":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case r.URL.Path == "/versions":
+			fmt.Fprintf(w, `{"versions":%s}`, offered)
+		case strings.HasSuffix(r.URL.Path, "/auth"):
+			fmt.Fprintf(w, `{"access_token":"token-%s","expires_in":3600}`, strings.Split(r.URL.Path, "/")[1])
+		case strings.HasSuffix(r.URL.Path, "/nodes"):
+			fmt.Fprint(w, `{"data":[{"id":"node-1"}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &paths
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		offered string
+		want    string
+		ok      bool
+	}{
+		{`["v1","v2"]`, "v2", true},
+		{`["v2","v1","v3"]`, "v2", true},
+		{`["v1"]`, "v1", true},
+		{`["v9"]`, "v1", false},
+		{``, "v1", false},
+	}
+	for _, tt := range tests {
+		server, _ := versionsServer(t, tt.offered)
+		api := NewBlessnetNodeAPI(server.URL)
+
+		version, err := api.NegotiateVersion()
+		if (err == nil) != tt.ok {
+			t.Errorf("offered %s: err = %v, want success %v", tt.offered, err, tt.ok)
+		}
+		if version != tt.want || api.APIVersion != tt.want {
+			t.Errorf("offered %s: negotiated %q, client uses %q, want %q", tt.offered, version, api.APIVersion, tt.want)
+		}
+	}
+}
+
+func TestNodeAPIFromConfigAuthUsesNegotiatedVersion(t *testing.T) {
+	useKnownNodeEndpoints(t)
+	server, paths := versionsServer(t, `["v1","v2"]`)
+
+	c := &Config{}
+	c.API.BaseURL = server.URL
+	c.API.NegotiateVersion = true
+	c.BlessnetAPIKey = "key"
+	c.BlessnetAPISecret = "secret"
+	api, err := NewBlessnetNodeAPIFromConfig(c)
+	if err != nil {
+		t.Fatalf("NewBlessnetNodeAPIFromConfig: %v", err)
+	}
+	if api.APIVersion != "v2" {
+		t.Fatalf("APIVersion = %q, want v2", api.APIVersion)
+	}
+
+	token, _, err := api.Authenticator.Token(context.Background())
+	if err != nil || token != "token-v2" {
+		t.Errorf("Token = %q, %v, want the token from /v2/auth", token, err)
+	}
+	if _, err := api.GetNodes(); err != nil {
+		t.Fatalf("GetNodes: %v", err)
+	}
+
+	want := []string{"GET /versions", "POST /v2/auth", "GET /v2/nodes"}
+	if fmt.Sprint(*paths) != fmt.Sprint(want) {
+		t.Errorf("requests = %v, want %v", *paths, want)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchWithFailoverCountsFallback(t *testing.T) {
+	config := useConfig(t, &Config{})
+	primary, _ := useWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	secondary, requests := workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	config.Worker.Fallbacks = []WorkerEndpoint{{URL: secondary.URL, Region: "us-east"}}
+
+	fallbacks := workerFallbacks.Value()
+	body, err := blessnetClient.FetchPage("https://example.com")
+	if err != nil {
+		t.Fatalf("FetchPage: %v", err)
+	}
+	if string(body) != "ok" || len(*requests) != 1 {
+		t.Fatalf("body %q after %d fallback requests, want ok from the secondary worker", body, len(*requests))
+	}
+
+	// Scrape the metrics the way Prometheus would
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	scraped := rec.Body.String()
+
+	if got := scrapedValue(t, scraped, "phantomdns_worker_fallback_total"); got != fallbacks+1 {
+		t.Errorf("phantomdns_worker_fallback_total = %v, want %v", got, fallbacks+1)
+	}
+	for _, series := range []string{
+		fmt.Sprintf(`phantomdns_worker_requests_total{worker=%q,region="default",result="error"} 1`, primary.URL),
+		fmt.Sprintf(`phantomdns_worker_requests_total{worker=%q,region="us-east",result="success"} 1`, secondary.URL),
+	} {
+		if !strings.Contains(scraped, series+"\n") {
+			t.Errorf("metrics missing %s", series)
+		}
+	}
+}
+
+// scrapedValue returns the value of an unlabelled series in Prometheus text output
+func scrapedValue(t *testing.T, scraped string, name string) float64 {
+	t.Helper()
+	for _, line := range strings.Split(scraped, "\n") {
+		var value float64
+		if strings.HasPrefix(line, name+" ") {
+			if _, err := fmt.Sscan(strings.TrimPrefix(line, name+" "), &value); err != nil {
+				t.Fatalf("bad sample %q: %v", line, err)
+			}
+			return value
+		}
+	}
+	t.Fatalf("%s not in the scraped metrics", name)
+	return 0
+}
+
+func TestCreateWorkerTemplateWelcome(t *testing.T) {
+	client := &BlessnetClient{Config: useConfig(t, &Config{})}
+
+	source := client.CreateWorkerTemplate(WorkerTemplateOptions{})
+	if !strings.Contains(source, workerWelcomeBlock) {
+		t.Error("default template has no welcome page")
+	}
+
+	source = client.CreateWorkerTemplate(WorkerTemplateOptions{DisableWelcome: true})
+	for _, welcome := range []string{"welcomeInfo", "PhantomDNS Worker is active", "To use: Add TARGET"} {
+		if strings.Contains(source, welcome) {
+			t.Errorf("template with the welcome page disabled still contains %q", welcome)
+		}
+	}
+	if !strings.Contains(source, workerNoTargetBlock) {
+		t.Error("template with the welcome page disabled doesn't answer 404 without a target")
+	}
+	if strings.Contains(source, "{{") {
+		t.Error("template has unfilled placeholders")
+	}
+}
+
+func TestCreateWorkerTemplateAuthToken(t *testing.T) {
+	config := useConfig(t, &Config{WorkerDisableWelcome: true, WorkerAuthToken: `t0k"en`})
+	client := &BlessnetClient{Config: config}
+
+	if source := client.CreateWorkerTemplate(WorkerTemplateOptions{}); strings.Contains(source, "env.AUTH") {
+		t.Error("template without a token checks AUTH")
+	}
+
+	// The config's options are what redeploys use
+	opts := client.workerTemplateOptions()
+	if !opts.DisableWelcome || opts.AuthToken != `t0k"en` {
+		t.Fatalf("options from config = %+v", opts)
+	}
+	source := client.CreateWorkerTemplate(opts)
+	check := `if (env.AUTH !== "t0k\"en") {`
+	if !strings.Contains(source, check) {
+		t.Fatalf("template is missing the auth check %s", check)
+	}
+
+	// The token is checked before anything else, including requests without a target
+	if strings.Index(source, check) > strings.Index(source, workerNoTargetBlock) {
+		t.Error("auth check comes after the no-target response")
+	}
+}
+
+func TestWorkerRequestCarriesAuthToken(t *testing.T) {
+	useConfig(t, &Config{WorkerAuthToken: "t0ken"})
+	server, requests := workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	if _, err := fetchFromWorkerWithOptions("https://example.com", workerFetchOptions{WorkerURL: server.URL}); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	r := (*requests)[0]
+	if r.Header.Get("X-Worker-Auth") != "t0ken" || r.URL.Query().Get("AUTH") != "t0ken" {
+		t.Errorf("request sent X-Worker-Auth %q and AUTH %q, want the token in both", r.Header.Get("X-Worker-Auth"), r.URL.Query().Get("AUTH"))
+	}
+}
+
+func TestActiveNodeFallsBackToWorkerURL(t *testing.T) {
+	useConfig(t, &Config{})
+	worker, workerRequests := useWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("worker"))
+	})
+	node, nodeRequests := workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("node"))
+	})
+	fetch := func() string {
+		t.Helper()
+		body, err := blessnetClient.FetchPage("https://example.com")
+		if err != nil {
+			t.Fatalf("FetchPage: %v", err)
+		}
+		return string(body)
+	}
+
+	// No node selected yet
+	if got := blessnetClient.GetWorkerURL(); got != worker.URL {
+		t.Errorf("GetWorkerURL = %q with no active node, want WorkerURL %q", got, worker.URL)
+	}
+	if body := fetch(); body != "worker" || len(*workerRequests) != 1 {
+		t.Errorf("fetched %q with no active node, want it from WorkerURL", body)
+	}
+
+	// A selected node takes over
+	if err := blessnetClient.SetActiveNode(node.URL); err != nil {
+		t.Fatalf("SetActiveNode: %v", err)
+	}
+	if body := fetch(); body != "node" || len(*nodeRequests) != 1 || blessnetClient.GetWorkerURL() != node.URL {
+		t.Errorf("fetched %q with an active node, want it from the node", body)
+	}
+
+	// Invalid nodes are refused and the selection is kept
+	for _, bad := range []string{"not a url", "ftp://node.example", "/relative"} {
+		if err := blessnetClient.SetActiveNode(bad); err == nil {
+			t.Errorf("SetActiveNode(%q) accepted", bad)
+		}
+	}
+	if got := blessnetClient.GetWorkerURL(); got != node.URL {
+		t.Errorf("GetWorkerURL = %q after invalid nodes, want %q", got, node.URL)
+	}
+
+	// Clearing the selection goes back to WorkerURL
+	if err := blessnetClient.SetActiveNode(""); err != nil {
+		t.Fatalf("SetActiveNode: %v", err)
+	}
+	if body := fetch(); body != "worker" || len(*workerRequests) != 2 {
+		t.Errorf("fetched %q after clearing the node, want it from WorkerURL", body)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// blockedZone returns the blocked suffix that a domain falls under, if any
+func blockedZone(domain string) (string, bool) {
+	return matchAny(domain, suffixList(currentConfig().BlockedDomains), listDB.Blocked(), listBundle.Blocked())
+}
+
+// blockedSOA builds the SOA sent with block responses, whose minimum controls
+// how long clients negatively cache the block decision
+func blockedSOA(zone string) dns.RR {
+	config := currentConfig()
+	soa := synthesizeSOA(zone).(*dns.SOA)
+	soa.Hdr.Ttl = config.BlockedRecordTTL
+	soa.Minttl = config.BlockedRecordTTL
+	return soa
+}
+
+// suppressedType reports whether answers of a type are suppressed by config
+func suppressedType(qtype uint16) bool {
+	config := currentConfig()
+	return (qtype == dns.TypeAAAA && config.SuppressAAAA) || (qtype == dns.TypeA && config.SuppressA)
+}
+
+// handleSuppressedType answers NODATA, with an SOA so clients cache it like
+// any other negative answer
+func handleSuppressedType(m *dns.Msg, q dns.Question) {
+	m.Ns = append(m.Ns, blockedSOA(q.Name))
+}
+
+// handleBlockedDomain answers a query for a blocked domain with NXDOMAIN or a sinkhole address
+func handleBlockedDomain(m *dns.Msg, q dns.Question, zone string) {
+	config := currentConfig()
+	m.Authoritative = true
+
+	if config.BlockResponse != "sinkhole" {
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, blockedSOA(zone))
+		return
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: config.BlockedRecordTTL}
+	switch q.Qtype {
+	case dns.TypeA:
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP(config.SinkholeIP)})
+	case dns.TypeAAAA:
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(config.SinkholeIPv6)})
+	default:
+		// Other types get NODATA so clients still cache the decision
+		m.Ns = append(m.Ns, blockedSOA(zone))
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// resolveBlocked resolves a query for a name under the blocked zone ads.example
+func resolveBlocked(t *testing.T, qtype uint16) *dns.Msg {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("tracker.ads.example.", qtype)
+	m, decision := resolveWithDecision(q)
+	if decision != "blocked" {
+		t.Fatalf("decision = %q, want blocked", decision)
+	}
+	return m
+}
+
+func TestBlockedNXDOMAINSOAMinimum(t *testing.T) {
+	useConfig(t, &Config{BlockedDomains: []string{"ads.example"}, BlockedRecordTTL: 120})
+	useMemoryCache(t)
+
+	m := resolveBlocked(t, dns.TypeA)
+	if m.Rcode != dns.RcodeNameError {
+		t.Fatalf("rcode = %s, want NXDOMAIN", dns.RcodeToString[m.Rcode])
+	}
+	if len(m.Ns) != 1 {
+		t.Fatalf("authority section has %d records, want the SOA", len(m.Ns))
+	}
+	soa, ok := m.Ns[0].(*dns.SOA)
+	if !ok {
+		t.Fatalf("authority record is %T, want *dns.SOA", m.Ns[0])
+	}
+	if soa.Minttl != 120 || soa.Hdr.Ttl != 120 {
+		t.Errorf("SOA minimum %d and TTL %d, want both 120", soa.Minttl, soa.Hdr.Ttl)
+	}
+}
+
+func TestBlockedSinkholeTTL(t *testing.T) {
+	useConfig(t, &Config{BlockedDomains: []string{"ads.example"}, BlockResponse: "sinkhole", BlockedRecordTTL: 45})
+	useMemoryCache(t)
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := resolveBlocked(t, qtype)
+		if len(m.Answer) != 1 {
+			t.Fatalf("%s: got %d answers, want the sinkhole record", dns.TypeToString[qtype], len(m.Answer))
+		}
+		if got := m.Answer[0].Header().Ttl; got != 45 {
+			t.Errorf("%s sinkhole TTL = %d, want 45", dns.TypeToString[qtype], got)
+		}
+	}
+
+	// Other types get NODATA whose SOA minimum carries the same TTL
+	m := resolveBlocked(t, dns.TypeMX)
+	if len(m.Answer) != 0 || len(m.Ns) != 1 {
+		t.Fatalf("MX: got %d answers and %d authority records, want NODATA with an SOA", len(m.Answer), len(m.Ns))
+	}
+	if soa := m.Ns[0].(*dns.SOA); soa.Minttl != 45 {
+		t.Errorf("MX NODATA SOA minimum = %d, want 45", soa.Minttl)
+	}
+}
+
+func TestBlockedRecordTTLDefault(t *testing.T) {
+	config := &Config{}
+	applyConfigDefaults(config)
+	if config.BlockedRecordTTL != 60 {
+		t.Errorf("blocked_record_ttl = %d, want the default of 60", config.BlockedRecordTTL)
+	}
+}
+
+func TestSuppressAddressFamilies(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     Config
+		suppressed uint16
+		resolved   uint16
+	}{
+		{"suppress_aaaa", Config{SuppressAAAA: true}, dns.TypeAAAA, dns.TypeA},
+		{"suppress_a", Config{SuppressA: true}, dns.TypeA, dns.TypeAAAA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config
+			c.Nameservers = []string{"192.0.2.1"}
+			c.HostsFile = "off"
+			useConfig(t, &c)
+			useMemoryCache(t)
+			upstream := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+				r := new(dns.Msg)
+				r.SetReply(m)
+				hdr := dns.RR_Header{Name: m.Question[0].Name, Rrtype: m.Question[0].Qtype, Class: dns.ClassINET, Ttl: 300}
+				if hdr.Rrtype == dns.TypeA {
+					r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.80")})
+				} else {
+					r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::80")})
+				}
+				return r, nil
+			})
+
+			q := new(dns.Msg)
+			q.SetQuestion("dualstack.example.", tt.suppressed)
+			m, decision := resolveWithDecision(q)
+			if decision != "suppressed" || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+				t.Errorf("%s query got %s %v (%s), want NODATA", dns.TypeToString[tt.suppressed], dns.RcodeToString[m.Rcode], m.Answer, decision)
+			}
+			if len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA {
+				t.Errorf("authority section %v, want an SOA so the NODATA is cached", m.Ns)
+			}
+			if len(upstream.Calls()) != 0 {
+				t.Errorf("%d upstream queries for a suppressed type, want none", len(upstream.Calls()))
+			}
+
+			// The other family still resolves
+			q.SetQuestion("dualstack.example.", tt.resolved)
+			m, decision = resolveWithDecision(q)
+			if decision != "forwarded" || len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != tt.resolved {
+				t.Errorf("%s query got %v (%s), want the upstream answer", dns.TypeToString[tt.resolved], m.Answer, decision)
+			}
+		})
+	}
+}
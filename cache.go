@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Cache stores resolved record sets until their TTL runs out
+type Cache interface {
+	Get(name string, qtype uint16) ([]dns.RR, bool)
+	Set(name string, qtype uint16, records []dns.RR)
+	Delete(name string, qtype uint16)
+	FlushCache() int
+	FlushDomain(name string) int
+	FlushSubtree(name string) int
+	Len() int
+}
+
+// NewCacheFromConfig creates the cache backend selected in the configuration
+func NewCacheFromConfig(config *Config) (Cache, error) {
+	switch config.CacheBackend {
+	case "", "memory":
+		return NewMemoryCache(), nil
+	case "redis":
+		return NewRedisCache(config.RedisAddr)
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", config.CacheBackend)
+	}
+}
+
+// cacheEntry holds a cached record set and its absolute expiry time
+type cacheEntry struct {
+	name      string
+	records   []dns.RR
+	expiresAt time.Time
+}
+
+// MemoryCache is the default in-process cache, keyed by query name and type
+type MemoryCache struct {
+	entries map[string]*cacheEntry
+	mutex   sync.RWMutex
+}
+
+// NewMemoryCache creates an empty in-memory cache
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// cacheKey builds the lookup key for a name and query type
+func cacheKey(name string, qtype uint16) string {
+	return fmt.Sprintf("%s/%d", strings.ToLower(dns.Fqdn(name)), qtype)
+}
+
+// Get returns a copy of the cached records with their remaining TTL
+func (c *MemoryCache) Get(name string, qtype uint16) ([]dns.RR, bool) {
+	c.mutex.RLock()
+	entry, ok := c.entries[cacheKey(name, qtype)]
+	c.mutex.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	remaining := time.Until(entry.expiresAt)
+	if remaining <= 0 {
+		c.mutex.Lock()
+		delete(c.entries, cacheKey(name, qtype))
+		c.mutex.Unlock()
+		return nil, false
+	}
+
+	// Hand out copies so callers can't modify the cached records
+	return withRemainingTTL(entry.records, remaining), true
+}
+
+// Set stores a record set, clamping TTLs before computing the expiry
+func (c *MemoryCache) Set(name string, qtype uint16, records []dns.RR) {
+	if len(records) == 0 {
+		return
+	}
+
+	stored, ttl := prepareForCache(records)
+
+	// Nothing to cache if the record set expires immediately
+	if ttl == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	c.entries[cacheKey(name, qtype)] = &cacheEntry{
+		name:      strings.ToLower(dns.Fqdn(name)),
+		records:   stored,
+		expiresAt: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	c.mutex.Unlock()
+}
+
+// Delete removes the cached entry for a name and type
+func (c *MemoryCache) Delete(name string, qtype uint16) {
+	c.mutex.Lock()
+	delete(c.entries, cacheKey(name, qtype))
+	c.mutex.Unlock()
+}
+
+// FlushCache removes every cached entry
+func (c *MemoryCache) FlushCache() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	count := len(c.entries)
+	c.entries = make(map[string]*cacheEntry)
+	return count
+}
+
+// FlushDomain removes the cached entries for an exact name, across all types
+func (c *MemoryCache) FlushDomain(name string) int {
+	name = strings.ToLower(dns.Fqdn(name))
+	return c.flushMatching(func(entryName string) bool {
+		return entryName == name
+	})
+}
+
+// FlushSubtree removes the cached entries for a name and all of its subdomains
+func (c *MemoryCache) FlushSubtree(name string) int {
+	name = strings.ToLower(dns.Fqdn(name))
+	return c.flushMatching(func(entryName string) bool {
+		return dns.IsSubDomain(name, entryName)
+	})
+}
+
+// flushMatching removes every entry whose name satisfies match
+func (c *MemoryCache) flushMatching(match func(entryName string) bool) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	count := 0
+	for key, entry := range c.entries {
+		if match(entry.name) {
+			delete(c.entries, key)
+			count++
+		}
+	}
+	return count
+}
+
+// Len returns the number of cached entries
+func (c *MemoryCache) Len() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return len(c.entries)
+}
+
+// prepareForCache copies records with clamped TTLs and returns the lowest TTL
+func prepareForCache(records []dns.RR) ([]dns.RR, uint32) {
+	stored := make([]dns.RR, 0, len(records))
+	ttl := uint32(0)
+	for i, rr := range records {
+		cp := dns.Copy(rr)
+		cp.Header().Ttl = clampRecordTTL(cp.Header())
+		if i == 0 || cp.Header().Ttl < ttl {
+			ttl = cp.Header().Ttl
+		}
+		stored = append(stored, cp)
+	}
+	return stored, ttl
+}
+
+// withRemainingTTL copies records, setting their TTL to the time left in the cache
+func withRemainingTTL(records []dns.RR, remaining time.Duration) []dns.RR {
+	result := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		cp := dns.Copy(rr)
+		ttl := uint32(remaining.Seconds())
+		// A type override was already applied on insert and the remaining time can only be lower
+		if ttlRange, ok := domainTTLRange(cp.Header().Name); ok {
+			ttl = ttlRange.clamp(ttl)
+		} else if _, ok := ttlOverride(cp.Header().Rrtype); !ok {
+			ttl = clampTTL(ttl)
+		}
+		cp.Header().Ttl = ttl
+		result = append(result, cp)
+	}
+	return result
+}
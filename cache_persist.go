@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistedEntry is the on-disk form of a cache entry
+type persistedEntry struct {
+	Key       string    `json:"key"`
+	Name      string    `json:"name"`
+	Records   string    `json:"records"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SaveFile writes every unexpired entry to path, replacing the file atomically
+func (c *MemoryCache) SaveFile(path string) (int, error) {
+	now := time.Now()
+
+	c.mutex.RLock()
+	entries := make([]persistedEntry, 0, len(c.entries))
+	for key, entry := range c.entries {
+		if !entry.expiresAt.After(now) {
+			continue
+		}
+		entries = append(entries, persistedEntry{
+			Key:       key,
+			Name:      entry.name,
+			Records:   encodeRecords(entry.records),
+			ExpiresAt: entry.expiresAt,
+		})
+	}
+	c.mutex.RUnlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return 0, fmt.Errorf("error encoding cache: %v", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a partial cache
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".phantomdns-cache-*")
+	if err != nil {
+		return 0, fmt.Errorf("error creating cache file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("error writing cache file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("error writing cache file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, fmt.Errorf("error replacing cache file: %v", err)
+	}
+
+	return len(entries), nil
+}
+
+// LoadFile restores entries saved by SaveFile, skipping any that expired in the meantime.
+// A missing file is not an error, there is simply nothing to restore.
+func (c *MemoryCache) LoadFile(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading cache file: %v", err)
+	}
+
+	var entries []persistedEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, fmt.Errorf("error parsing cache file: %v", err)
+	}
+
+	now := time.Now()
+	loaded := 0
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, entry := range entries {
+		if !entry.ExpiresAt.After(now) {
+			continue
+		}
+		records, err := decodeRecords(entry.Records)
+		if err != nil || len(records) == 0 {
+			continue
+		}
+		c.entries[entry.Key] = &cacheEntry{
+			name:      entry.Name,
+			records:   records,
+			expiresAt: entry.ExpiresAt,
+		}
+		loaded++
+	}
+
+	return loaded, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCachePersistRoundTrip(t *testing.T) {
+	useConfig(t, &Config{})
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	cache := NewMemoryCache()
+	cache.Set("keep.example.", dns.TypeA, []dns.RR{aRecord(t, "keep.example", 300, "192.0.2.1")})
+	cache.Set("soon.example.", dns.TypeA, []dns.RR{aRecord(t, "soon.example", 300, "192.0.2.2")})
+
+	// Expire soon.example while the cache is "down", after it was saved
+	cache.entries[cacheKey("soon.example.", dns.TypeA)].expiresAt = time.Now().Add(50 * time.Millisecond)
+
+	saved, err := cache.SaveFile(path)
+	if err != nil || saved != 2 {
+		t.Fatalf("SaveFile = %d, %v, want 2 entries saved", saved, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	restored := NewMemoryCache()
+	loaded, err := restored.LoadFile(path)
+	if err != nil || loaded != 1 {
+		t.Fatalf("LoadFile = %d, %v, want 1 entry loaded", loaded, err)
+	}
+
+	records, ok := restored.Get("keep.example.", dns.TypeA)
+	if !ok || len(records) != 1 {
+		t.Fatal("unexpired entry didn't survive the restart")
+	}
+	if a := records[0].(*dns.A); !a.A.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("restored address = %s, want 192.0.2.1", a.A)
+	}
+	if ttl := records[0].Header().Ttl; ttl > 300 || ttl < 298 {
+		t.Errorf("restored TTL = %d, want the remaining time of about 300", ttl)
+	}
+	if _, ok := restored.Get("soon.example.", dns.TypeA); ok {
+		t.Error("entry that expired while down was restored")
+	}
+}
+
+func TestCachePersistSkipsExpiredOnSave(t *testing.T) {
+	useConfig(t, &Config{})
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	cache := NewMemoryCache()
+	cache.Set("gone.example.", dns.TypeA, []dns.RR{aRecord(t, "gone.example", 300, "192.0.2.3")})
+	cache.entries[cacheKey("gone.example.", dns.TypeA)].expiresAt = time.Now().Add(-time.Second)
+
+	if saved, err := cache.SaveFile(path); err != nil || saved != 0 {
+		t.Errorf("SaveFile = %d, %v, want nothing saved", saved, err)
+	}
+}
+
+func TestCachePersistMissingAndCorruptFiles(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewMemoryCache()
+
+	if loaded, err := cache.LoadFile(filepath.Join(dir, "missing.json")); err != nil || loaded != 0 {
+		t.Errorf("LoadFile of a missing file = %d, %v, want 0, nil", loaded, err)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte("[{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.LoadFile(corrupt); err == nil {
+		t.Error("corrupt cache file loaded, want an error")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeyPrefix namespaces PhantomDNS keys in a shared Redis database
+const redisKeyPrefix = "phantomdns:cache:"
+
+// RedisCache shares cached record sets between PhantomDNS instances through Redis.
+// Record sets are stored in presentation format, one record per line, and expire
+// through the Redis key TTL.
+type RedisCache struct {
+	client  *redis.Client
+	timeout time.Duration
+}
+
+// NewRedisCache connects to Redis and creates a cache backed by it
+func NewRedisCache(addr string) (*RedisCache, error) {
+	c := &RedisCache{
+		client:  redis.NewClient(&redis.Options{Addr: addr}),
+		timeout: 2 * time.Second,
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.client.Ping(ctx).Err(); err != nil {
+		c.client.Close()
+		return nil, fmt.Errorf("error connecting to redis at %s: %v", addr, err)
+	}
+
+	log.Printf("Using Redis cache at %s", addr)
+	return c, nil
+}
+
+// context returns a context bounded by the per-operation timeout
+func (c *RedisCache) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.timeout)
+}
+
+// Get returns the cached records with their remaining TTL
+func (c *RedisCache) Get(name string, qtype uint16) ([]dns.RR, bool) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	key := redisKeyPrefix + cacheKey(name, qtype)
+	pipe := c.client.Pipeline()
+	getCmd := pipe.Get(ctx, key)
+	ttlCmd := pipe.PTTL(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		if err != redis.Nil {
+			log.Printf("Error reading %s from redis cache: %v", key, err)
+		}
+		return nil, false
+	}
+
+	remaining := ttlCmd.Val()
+	if remaining <= 0 {
+		return nil, false
+	}
+
+	records, err := decodeRecords(getCmd.Val())
+	if err != nil {
+		log.Printf("Discarding unreadable redis cache entry %s: %v", key, err)
+		return nil, false
+	}
+
+	return withRemainingTTL(records, remaining), true
+}
+
+// Set stores a record set with a Redis TTL matching its lowest record TTL
+func (c *RedisCache) Set(name string, qtype uint16, records []dns.RR) {
+	if len(records) == 0 {
+		return
+	}
+
+	stored, ttl := prepareForCache(records)
+	if ttl == 0 {
+		return
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	key := redisKeyPrefix + cacheKey(name, qtype)
+	if err := c.client.Set(ctx, key, encodeRecords(stored), time.Duration(ttl)*time.Second).Err(); err != nil {
+		log.Printf("Error writing %s to redis cache: %v", key, err)
+	}
+}
+
+// Delete removes the cached entry for a name and type
+func (c *RedisCache) Delete(name string, qtype uint16) {
+	ctx, cancel := c.context()
+	defer cancel()
+	c.client.Del(ctx, redisKeyPrefix+cacheKey(name, qtype))
+}
+
+// FlushCache removes every PhantomDNS entry from Redis
+func (c *RedisCache) FlushCache() int {
+	return c.flushMatching(func(string) bool { return true })
+}
+
+// FlushDomain removes the cached entries for an exact name, across all types
+func (c *RedisCache) FlushDomain(name string) int {
+	name = strings.ToLower(dns.Fqdn(name))
+	return c.flushMatching(func(entryName string) bool {
+		return entryName == name
+	})
+}
+
+// FlushSubtree removes the cached entries for a name and all of its subdomains
+func (c *RedisCache) FlushSubtree(name string) int {
+	name = strings.ToLower(dns.Fqdn(name))
+	return c.flushMatching(func(entryName string) bool {
+		return dns.IsSubDomain(name, entryName)
+	})
+}
+
+// Len returns the number of PhantomDNS entries in Redis
+func (c *RedisCache) Len() int {
+	return len(c.keys(func(string) bool { return true }))
+}
+
+// flushMatching deletes every entry whose name satisfies match
+func (c *RedisCache) flushMatching(match func(entryName string) bool) int {
+	keys := c.keys(match)
+	if len(keys) == 0 {
+		return 0
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	removed, err := c.client.Del(ctx, keys...).Result()
+	if err != nil {
+		log.Printf("Error flushing redis cache: %v", err)
+	}
+	return int(removed)
+}
+
+// keys scans for PhantomDNS keys whose entry name satisfies match
+func (c *RedisCache) keys(match func(entryName string) bool) []string {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	keys := []string{}
+	iter := c.client.Scan(ctx, 0, redisKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		entry := strings.TrimPrefix(key, redisKeyPrefix)
+		if slash := strings.LastIndex(entry, "/"); slash >= 0 && match(entry[:slash]) {
+			keys = append(keys, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("Error scanning redis cache: %v", err)
+	}
+
+	return keys
+}
+
+// encodeRecords serializes records in presentation format, one per line
+func encodeRecords(records []dns.RR) string {
+	lines := make([]string, 0, len(records))
+	for _, rr := range records {
+		lines = append(lines, rr.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// decodeRecords parses records serialized by encodeRecords
+func decodeRecords(data string) ([]dns.RR, error) {
+	records := []dns.RR{}
+	for _, line := range strings.Split(data, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rr)
+	}
+	return records, nil
+}
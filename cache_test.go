@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// aRecord builds an A record for tests
+func aRecord(t *testing.T, name string, ttl uint32, ip string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN A %s", dns.Fqdn(name), ttl, ip))
+	if err != nil {
+		t.Fatalf("NewRR: %v", err)
+	}
+	return rr
+}
+
+// populatedCache returns a memory cache holding A and AAAA entries for a small tree of names
+func populatedCache(t *testing.T) *MemoryCache {
+	t.Helper()
+	cache := NewMemoryCache()
+	for _, name := range []string{"example.com", "www.example.com", "a.b.example.com", "notexample.com", "other.org"} {
+		cache.Set(name, dns.TypeA, []dns.RR{aRecord(t, name, 300, "192.0.2.1")})
+	}
+	aaaa, _ := dns.NewRR("example.com. 300 IN AAAA 2001:db8::1")
+	cache.Set("example.com", dns.TypeAAAA, []dns.RR{aaaa})
+	return cache
+}
+
+func TestMemoryCacheFlushDomain(t *testing.T) {
+	useConfig(t, &Config{})
+	cache := populatedCache(t)
+
+	if removed := cache.FlushDomain("Example.COM"); removed != 2 {
+		t.Errorf("FlushDomain removed %d entries, want both types of example.com", removed)
+	}
+	if _, ok := cache.Get("example.com", dns.TypeA); ok {
+		t.Error("example.com A still cached")
+	}
+	if _, ok := cache.Get("www.example.com", dns.TypeA); !ok {
+		t.Error("FlushDomain removed a subdomain")
+	}
+	if cache.Len() != 4 {
+		t.Errorf("Len = %d, want 4", cache.Len())
+	}
+}
+
+func TestMemoryCacheFlushSubtree(t *testing.T) {
+	useConfig(t, &Config{})
+	cache := populatedCache(t)
+
+	if removed := cache.FlushSubtree("example.com."); removed != 4 {
+		t.Errorf("FlushSubtree removed %d entries, want 4", removed)
+	}
+	for _, name := range []string{"notexample.com", "other.org"} {
+		if _, ok := cache.Get(name, dns.TypeA); !ok {
+			t.Errorf("%s was flushed but isn't under example.com", name)
+		}
+	}
+}
+
+func TestMemoryCacheFlushCache(t *testing.T) {
+	useConfig(t, &Config{})
+	cache := populatedCache(t)
+
+	if removed := cache.FlushCache(); removed != 6 {
+		t.Errorf("FlushCache removed %d entries, want 6", removed)
+	}
+	if cache.Len() != 0 {
+		t.Errorf("Len = %d after FlushCache", cache.Len())
+	}
+}
+
+func TestControlCacheFlush(t *testing.T) {
+	useConfig(t, &Config{})
+	old := dnsCache
+	dnsCache = populatedCache(t)
+	t.Cleanup(func() { dnsCache = old })
+
+	resp := executeControlCommand("cache-flush example.com subtree")
+	if !resp.OK {
+		t.Fatalf("cache-flush failed: %s", resp.Error)
+	}
+	if removed := resp.Data.(map[string]int)["removed"]; removed != 4 {
+		t.Errorf("removed = %d, want 4", removed)
+	}
+
+	resp = executeControlCommand("cache-flush")
+	if removed := resp.Data.(map[string]int)["removed"]; removed != 2 {
+		t.Errorf("full flush removed %d, want the 2 remaining entries", removed)
+	}
+}
+
+// testCacheBackend runs the behaviour every Cache implementation shares
+func testCacheBackend(t *testing.T, cache Cache) {
+	cache.FlushCache()
+
+	records := []dns.RR{aRecord(t, "Example.com", 300, "192.0.2.1"), aRecord(t, "example.com", 600, "192.0.2.2")}
+	cache.Set("Example.com.", dns.TypeA, records)
+
+	got, ok := cache.Get("example.COM", dns.TypeA)
+	if !ok || len(got) != 2 {
+		t.Fatalf("Get = %v, %v; want both records", got, ok)
+	}
+	for _, rr := range got {
+		if ttl := rr.Header().Ttl; ttl == 0 || ttl > 300 {
+			t.Errorf("TTL %d, want the remaining time of the lowest TTL", ttl)
+		}
+	}
+
+	// Returned records are copies
+	got[0].(*dns.A).A = net.ParseIP("198.51.100.1")
+	if again, _ := cache.Get("example.com", dns.TypeA); again[0].(*dns.A).A.String() == "198.51.100.1" {
+		t.Error("modifying a returned record changed the cache")
+	}
+
+	if _, ok := cache.Get("example.com", dns.TypeAAAA); ok {
+		t.Error("Get found a type that was never stored")
+	}
+
+	cache.Delete("example.com", dns.TypeA)
+	if _, ok := cache.Get("example.com", dns.TypeA); ok {
+		t.Error("Delete left the entry behind")
+	}
+
+	cache.Set("zero.test", dns.TypeA, []dns.RR{aRecord(t, "zero.test", 0, "192.0.2.1")})
+	if cache.Len() != 0 {
+		t.Errorf("Len = %d, want 0 after storing a TTL 0 record set", cache.Len())
+	}
+}
+
+func TestMemoryCacheBackend(t *testing.T) {
+	useConfig(t, &Config{})
+	testCacheBackend(t, NewMemoryCache())
+}
+
+func TestMemoryCacheExpiry(t *testing.T) {
+	useConfig(t, &Config{})
+	cache := NewMemoryCache()
+	cache.Set("example.com", dns.TypeA, []dns.RR{aRecord(t, "example.com", 300, "192.0.2.1")})
+
+	// Age the entry past its expiry
+	cache.entries[cacheKey("example.com", dns.TypeA)].expiresAt = time.Now().Add(-time.Second)
+	if _, ok := cache.Get("example.com", dns.TypeA); ok {
+		t.Error("expired entry returned")
+	}
+	if cache.Len() != 0 {
+		t.Error("expired entry not removed on lookup")
+	}
+}
+
+// TestRedisCacheBackend needs a Redis server, set PHANTOMDNS_TEST_REDIS to its address
+func TestRedisCacheBackend(t *testing.T) {
+	addr := os.Getenv("PHANTOMDNS_TEST_REDIS")
+	if addr == "" {
+		t.Skip("PHANTOMDNS_TEST_REDIS not set")
+	}
+	useConfig(t, &Config{})
+	cache, err := NewRedisCache(addr)
+	if err != nil {
+		t.Fatalf("NewRedisCache: %v", err)
+	}
+	testCacheBackend(t, cache)
+}
+
+func TestRecordEncodingRoundTrip(t *testing.T) {
+	mx, _ := dns.NewRR("example.com. 300 IN MX 10 mail.example.com.")
+	txt, _ := dns.NewRR(`example.com. 300 IN TXT "v=spf1 -all" "second string"`)
+	records := []dns.RR{aRecord(t, "example.com", 300, "192.0.2.1"), mx, txt}
+
+	decoded, err := decodeRecords(encodeRecords(records))
+	if err != nil {
+		t.Fatalf("decodeRecords: %v", err)
+	}
+	if len(decoded) != len(records) {
+		t.Fatalf("decoded %d records, want %d", len(decoded), len(records))
+	}
+	for i := range records {
+		if !dns.IsDuplicate(records[i], decoded[i]) {
+			t.Errorf("record %d = %s, want %s", i, decoded[i], records[i])
+		}
+	}
+
+	if _, err := decodeRecords("not a record"); err == nil {
+		t.Error("garbage decoded without an error")
+	}
+}
+
+func TestNewCacheFromConfig(t *testing.T) {
+	cache, err := NewCacheFromConfig(&Config{})
+	if _, ok := cache.(*MemoryCache); err != nil || !ok {
+		t.Errorf("default backend = %T, %v; want *MemoryCache", cache, err)
+	}
+
+	if _, err := NewCacheFromConfig(&Config{CacheBackend: "memcached"}); err == nil {
+		t.Error("unknown backend accepted")
+	}
+
+	if _, err := NewCacheFromConfig(&Config{CacheBackend: "redis", RedisAddr: closedServerURL()[len("http://"):]}); err == nil {
+		t.Error("unreachable redis accepted")
+	}
+}
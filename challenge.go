@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// workerChallengeError reports a worker response that is an interstitial
+// (JS challenge, captcha or login page) rather than content or a hard error.
+// Retrying the same worker won't get past it, another worker might.
+type workerChallengeError struct {
+	Kind   string // "challenge", "captcha" or "login"
+	Status int
+	Signal string // what gave it away
+}
+
+func (e *workerChallengeError) Error() string {
+	return fmt.Sprintf("worker returned a %s page (status %d, %s)", e.Kind, e.Status, e.Signal)
+}
+
+// challengeBodyMarkers identify Cloudflare and generic challenge pages, checked in order
+var challengeBodyMarkers = []struct {
+	marker string
+	kind   string
+}{
+	{"cf-turnstile", "captcha"},
+	{"g-recaptcha", "captcha"},
+	{"h-captcha", "captcha"},
+	{"hcaptcha.com", "captcha"},
+	{"cf_captcha_kind", "captcha"},
+	{"/cdn-cgi/challenge-platform/", "challenge"},
+	{"cf_chl_opt", "challenge"},
+	{"cf-chl-", "challenge"},
+	{"<title>just a moment...</title>", "challenge"},
+	{"checking your browser before accessing", "challenge"},
+	{"attention required! | cloudflare", "challenge"},
+}
+
+// loginPathMarkers identify the login pages workers get redirected to, such
+// as Cloudflare Access in front of a protected worker
+var loginPathMarkers = []string{"/cdn-cgi/access/login", "/login", "/signin", "/sign-in", "/auth/"}
+
+// detectWorkerChallenge classifies a worker response as a challenge, captcha
+// or login page, or returns nil when it is an ordinary response. Body markers
+// are only trusted on the statuses challenges are served with, so a proxied
+// page that merely embeds a captcha widget isn't mistaken for one.
+func detectWorkerChallenge(resp *http.Response, body []byte) *workerChallengeError {
+	status := resp.StatusCode
+
+	// Cloudflare marks its own challenge responses
+	if mitigated := resp.Header.Get("Cf-Mitigated"); strings.EqualFold(mitigated, "challenge") {
+		return &workerChallengeError{Kind: "challenge", Status: status, Signal: "cf-mitigated header"}
+	}
+
+	// A redirect that ends on a login page means the worker sits behind access control
+	if resp.Request != nil && resp.Request.Response != nil {
+		path := strings.ToLower(resp.Request.URL.Path)
+		for _, marker := range loginPathMarkers {
+			if strings.Contains(path, marker) {
+				return &workerChallengeError{Kind: "login", Status: status, Signal: "redirected to " + resp.Request.URL.Host + resp.Request.URL.Path}
+			}
+		}
+	}
+
+	if status != http.StatusForbidden && status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+		return nil
+	}
+
+	lower := strings.ToLower(string(body))
+	for _, m := range challengeBodyMarkers {
+		if strings.Contains(lower, m.marker) {
+			return &workerChallengeError{Kind: m.kind, Status: status, Signal: "body contains " + m.marker}
+		}
+	}
+
+	// Any other Cloudflare block page
+	if status == http.StatusForbidden && (strings.Contains(lower, "cloudflare") || strings.EqualFold(resp.Header.Get("Server"), "cloudflare")) {
+		return &workerChallengeError{Kind: "challenge", Status: status, Signal: "cloudflare block page"}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const (
+	// Trimmed from the interstitial Cloudflare serves for a managed challenge
+	cloudflareChallengePage = `<!DOCTYPE html><html lang="en-US"><head><title>Just a moment...</title>` +
+		`<script>window._cf_chl_opt={cvId: '3',cZone: "worker.example"}</script></head>` +
+		`<body><script src="/cdn-cgi/challenge-platform/h/b/orchestrate/chl_page/v1"></script></body></html>`
+	// Trimmed from a Turnstile captcha page
+	cloudflareCaptchaPage = `<html><head><title>Attention Required! | Cloudflare</title></head>` +
+		`<body><div class="cf-turnstile" data-sitekey="0x4AAA"></div></body></html>`
+	// Trimmed from a Cloudflare firewall block page
+	cloudflareBlockPage = `<html><head><title>Access denied | worker.example used Cloudflare to restrict access</title></head>` +
+		`<body><h1>Error 1020</h1><p>Ray ID: 8a1b2c3d4e5f</p></body></html>`
+)
+
+func TestDetectWorkerChallenge(t *testing.T) {
+	redirected := &http.Request{
+		URL:      &url.URL{Scheme: "https", Host: "team.cloudflareaccess.com", Path: "/cdn-cgi/access/login/worker.example"},
+		Response: &http.Response{StatusCode: http.StatusFound},
+	}
+
+	tests := []struct {
+		name    string
+		status  int
+		header  http.Header
+		body    string
+		request *http.Request
+		kind    string
+	}{
+		{"cf-mitigated header", http.StatusForbidden, http.Header{"Cf-Mitigated": {"challenge"}}, "", nil, "challenge"},
+		{"js challenge", http.StatusServiceUnavailable, nil, cloudflareChallengePage, nil, "challenge"},
+		{"managed challenge", http.StatusForbidden, nil, cloudflareChallengePage, nil, "challenge"},
+		{"turnstile captcha", http.StatusForbidden, nil, cloudflareCaptchaPage, nil, "captcha"},
+		{"recaptcha", http.StatusTooManyRequests, nil, `<div class="g-recaptcha"></div>`, nil, "captcha"},
+		{"firewall block page", http.StatusForbidden, nil, cloudflareBlockPage, nil, "challenge"},
+		{"cloudflare server 403", http.StatusForbidden, http.Header{"Server": {"cloudflare"}}, "denied", nil, "challenge"},
+		{"redirect to access login", http.StatusOK, nil, "<html>Sign in</html>", redirected, "login"},
+
+		// Hard errors and ordinary pages are left to the usual handling
+		{"plain 403", http.StatusForbidden, nil, "forbidden", nil, ""},
+		{"worker error", http.StatusInternalServerError, nil, cloudflareChallengePage, nil, ""},
+		{"page embedding a captcha", http.StatusOK, nil, cloudflareCaptchaPage, nil, ""},
+		{"envelope", http.StatusOK, nil, `{"status":200,"target":"https://example.com"}`, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: tt.header, Request: tt.request}
+			if resp.Header == nil {
+				resp.Header = http.Header{}
+			}
+			got := detectWorkerChallenge(resp, []byte(tt.body))
+			switch {
+			case tt.kind == "" && got != nil:
+				t.Errorf("classified as %v, want an ordinary response", got)
+			case tt.kind != "" && (got == nil || got.Kind != tt.kind || got.Status != tt.status):
+				t.Errorf("classified as %v, want a %s page with status %d", got, tt.kind, tt.status)
+			}
+		})
+	}
+}
+
+func TestWorkerChallengeFailsOver(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    string
+		handler http.HandlerFunc
+	}{
+		{"challenge", "challenge", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Server", "cloudflare")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(cloudflareChallengePage))
+		}},
+		{"captcha", "captcha", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(cloudflareCaptchaPage))
+		}},
+		{"login", "login", func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, "/cdn-cgi/access/login") {
+				http.Redirect(w, r, "/cdn-cgi/access/login?redirect_url=%2F", http.StatusFound)
+				return
+			}
+			w.Write([]byte("<html>Sign in with your identity provider</html>"))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := useConfig(t, &Config{})
+			primary, _ := useWorker(t, tt.handler)
+			secondary, requests := workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			})
+			config.Worker.Fallbacks = []WorkerEndpoint{{URL: secondary.URL, Region: "us-east"}}
+			challenges := workerChallenges.Value(primary.URL, tt.kind)
+			results := workerRequests.Value(primary.URL, "default", "challenge")
+
+			body, err := blessnetClient.FetchPage("https://example.com")
+			if err != nil || string(body) != "ok" || len(*requests) != 1 {
+				t.Fatalf("FetchPage = %q, %v, want ok from the fallback worker", body, err)
+			}
+			if got := workerChallenges.Value(primary.URL, tt.kind); got != challenges+1 {
+				t.Errorf("phantomdns_worker_challenges_total{kind=%q} = %v, want %v", tt.kind, got, challenges+1)
+			}
+			if got := workerRequests.Value(primary.URL, "default", "challenge"); got != results+1 {
+				t.Errorf("phantomdns_worker_requests_total{result=\"challenge\"} = %v, want %v", got, results+1)
+			}
+		})
+	}
+}
+
+func TestWorkerChallengeError(t *testing.T) {
+	config := useConfig(t, &Config{})
+	useWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cf-Mitigated", "challenge")
+		w.WriteHeader(http.StatusForbidden)
+	})
+	config.Worker.Fallbacks = nil
+
+	// With no worker left to try the challenge surfaces as its own error
+	_, err := blessnetClient.FetchPage("https://example.com")
+	var challenge *workerChallengeError
+	if !errors.As(err, &challenge) || challenge.Kind != "challenge" || challenge.Status != http.StatusForbidden {
+		t.Errorf("FetchPage error = %v, want a workerChallengeError", err)
+	}
+}
@@ -2,17 +2,99 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
+// WorkerEndpoint is a worker URL and the region it runs in
+type WorkerEndpoint struct {
+	URL    string `json:"url"`
+	Region string `json:"region"`
+}
+
+// TTLRange is a TTL floor and ceiling in seconds, a Max of 0 means no ceiling
+type TTLRange struct {
+	Min uint32 `json:"min"`
+	Max uint32 `json:"max"`
+}
+
+// AnswerRewrite maps answer addresses in From onto To, e.g. "203.0.113.0/24" -> "10.0.0.0/24"
+type AnswerRewrite struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
 // Config holds all configuration for PhantomDNS
 type Config struct {
-	// DNS Server settings
-	DNSPort     int      `json:"dns_port"`
-	DNSListen   string   `json:"dns_listen"`
-	Nameservers []string `json:"nameservers"`
+	// Schema version, older files are migrated on load
+	ConfigVersion int `json:"config_version"`
+
+	// DNS Server settings. DNSPort defaults to 53, 0 picks a free port shared
+	// by UDP and TCP, logged once the listeners are up
+	DNSPort     *int        `json:"dns_port"`
+	DNSListen   ListenAddrs `json:"dns_listen"`
+	Nameservers []string    `json:"nameservers"`  // Unset uses 8.8.8.8 and 1.1.1.1, [] disables forwarding
+	BindRetries int         `json:"bind_retries"` // Attempts to bind while the address is in use
+
+	// Indentation used when writing the config file, two spaces by default
+	ConfigIndent string `json:"config_indent,omitempty"`
+
+	// Local address that upstream queries and worker fetches are sent from
+	UpstreamSourceIP string `json:"upstream_source_ip"`
+
+	// For names under these zones first ask upstream about only the zone plus
+	// QNameMinimizationKeepLabels labels, so names that don't exist are
+	// answered without the identifying prefix ever leaving the resolver
+	QNameMinimization           bool     `json:"qname_minimization"`
+	QNameMinimizationZones      []string `json:"qname_minimization_zones"`
+	QNameMinimizationKeepLabels int      `json:"qname_minimization_keep_labels"`
+
+	// Extra checks for bogus upstream answers, which are discarded so the next
+	// nameserver is tried: "zero_ttl_private" and "private_well_known" (private
+	// addresses for any name under WellKnownDomains)
+	UpstreamValidationRules []string `json:"upstream_validation_rules"`
+	WellKnownDomains        []string `json:"well_known_domains"`
+
+	// Query upstream over TCP for all names, or only for these domain suffixes
+	ForceTCPUpstream bool     `json:"force_tcp_upstream"`
+	ForceTCPDomains  []string `json:"force_tcp_domains"`
+
+	// DNS over HTTPS endpoint (RFC 8484), e.g. "https://1.1.1.1/dns-query". With
+	// HappyEyeballsUpstream every query races the nameservers against it and
+	// the first answer wins, for networks where plain DNS is intermittently
+	// filtered. Use an address or a name the system resolver can reach.
+	DoHUpstream           string `json:"doh_upstream"`
+	HappyEyeballsUpstream bool   `json:"happy_eyeballs_upstream"`
+
+	// EDNS0 padding block size in bytes (RFC 7830), 0 to disable. Applied to
+	// queries sent to DoH upstreams and to replies for clients that pad their
+	// own queries. RFC 8467 suggests 128 for queries and 468 for responses
+	EDNSPadding int `json:"edns_padding"`
+
+	// Pass the client's CD bit upstream and copy the upstream AD bit into
+	// replies. AD is cleared for cached, proxied or rewritten answers, which
+	// PhantomDNS can't vouch for
+	ForwardDNSSECFlags bool `json:"forward_dnssec_flags"`
+
+	// Extra attempts against the same nameserver after a network error, before
+	// moving on to the next one
+	UpstreamRetries *int `json:"upstream_retries"`
+
+	// Order in which nameservers are tried: "static" (as listed) or "score"
+	// (healthiest and fastest first, by rolling success rate and latency)
+	UpstreamOrdering string `json:"upstream_ordering"`
+
+	// Resolve uncached names through the nameservers (default true). When false
+	// only cached, owned and proxied names are answered and the rest get REFUSED.
+	AllowRecursion *bool `json:"allow_recursion"`
 
 	// Blessnet settings
 	BlessnetWorkerURL string `json:"blessnet_worker_url"`
@@ -21,8 +103,9 @@ type Config struct {
 
 	// API configuration
 	API struct {
-		BaseURL string `json:"base_url"`
-		Version string `json:"version"`
+		BaseURL          string `json:"base_url"`
+		Version          string `json:"version"`
+		NegotiateVersion bool   `json:"negotiate_version"` // Pick the highest version both sides support
 	} `json:"api"`
 
 	// Auth configuration
@@ -32,6 +115,30 @@ type Config struct {
 		Token    string `json:"token"`
 	} `json:"auth"`
 
+	// How to authenticate with the Blessnet API: "apikey" (default), "oauth2" or "mtls"
+	AuthMethod string `json:"auth_method"`
+
+	// How long an expired token keeps being used while the auth endpoint is
+	// failing (default 300), negative to fail as soon as the token expires
+	AuthGraceSeconds int `json:"auth_grace_seconds"`
+
+	// OAuth2 client credentials settings, used when AuthMethod is "oauth2"
+	OAuth2 struct {
+		TokenURL     string   `json:"token_url"`
+		ClientID     string   `json:"client_id"`
+		ClientSecret string   `json:"client_secret"`
+		Scopes       []string `json:"scopes"`
+	} `json:"oauth2"`
+
+	// Client certificate settings, used when AuthMethod is "mtls"
+	MTLS struct {
+		CertFile string `json:"cert_file"`
+		KeyFile  string `json:"key_file"`
+
+		// CA bundle the node API's certificate is verified against, the system roots when empty
+		CAFile string `json:"ca_file"`
+	} `json:"mtls"`
+
 	// Deployment configuration
 	Deployment struct {
 		ID  string `json:"id"`
@@ -43,18 +150,319 @@ type Config struct {
 		Count      int               `json:"count"`
 		Regions    []string          `json:"regions"`
 		Attributes map[string]string `json:"attributes"`
+		Fallbacks  []WorkerEndpoint  `json:"fallbacks"` // Tried in order when the primary worker fails
 	} `json:"worker"`
 
+	// Node discovery configuration
+	Discovery struct {
+		Concurrency    int `json:"concurrency"`
+		TimeoutSeconds int `json:"timeout_seconds"`
+	} `json:"discovery"`
+
 	// DNS blocking settings
-	BlockedDomains []string `json:"blocked_domains"`
-	ProxyDomains   []string `json:"proxy_domains"`
+	BlockedDomains   []string `json:"blocked_domains"`
+	ProxyDomains     []string `json:"proxy_domains"`
+	BlockResponse    string   `json:"block_response"`     // "nxdomain" or "sinkhole"
+	SinkholeIP       string   `json:"sinkhole_ip"`        // IPv4 address returned for blocked A queries
+	SinkholeIPv6     string   `json:"sinkhole_ipv6"`      // IPv6 address returned for blocked AAAA queries
+	BlockedRecordTTL uint32   `json:"blocked_record_ttl"` // TTL of sinkhole answers and NXDOMAIN SOA minimum
+
+	// Answer every AAAA (or A) query with NODATA, e.g. to keep clients on IPv4
+	// in a network with broken IPv6
+	SuppressAAAA bool `json:"suppress_aaaa"`
+	SuppressA    bool `json:"suppress_a"`
+
+	// DNS64 (RFC 6147): AAAA queries for names with only A records get AAAA
+	// answers embedding the IPv4 address in DNS64Prefix (default 64:ff9b::/96)
+	EnableDNS64 bool   `json:"enable_dns64"`
+	DNS64Prefix string `json:"dns64_prefix"`
+
+	// Reputation service consulted for names not in any list, blocking those
+	// it flags. Verdicts are cached for ReputationCacheSeconds (default 600);
+	// errors and timeouts (ReputationTimeoutMs, default 500) allow the name
+	ReputationURL          string `json:"reputation_url"`
+	ReputationTimeoutMs    int    `json:"reputation_timeout_ms"`
+	ReputationCacheSeconds int    `json:"reputation_cache_seconds"`
+
+	// Answer for queries no resolution path handled: "nodata" (empty NOERROR),
+	// "refused", "servfail", "nxdomain", or a sinkhole IP address
+	DefaultResponse string `json:"default_response"`
+
+	// Hosts file whose names are answered directly (A, AAAA and PTR), reloaded
+	// when it changes. Defaults to the OS hosts file, "off" disables it
+	HostsFile string `json:"hosts_file"`
+
+	// SQLite database with blocked_domains and proxied_domains tables, used
+	// alongside the lists above and reloaded every ListRefreshSeconds
+	ListDatabasePath   string `json:"list_database_path"`
+	ListRefreshSeconds int    `json:"list_refresh_seconds"`
+
+	// tar.gz or zip bundle of list files (path or http(s) URL), reloaded with
+	// the database. Remote archives are checked against ListArchiveSHA256, or
+	// the checksum published at the archive URL + ".sha256"
+	ListArchive       string `json:"list_archive"`
+	ListArchiveSHA256 string `json:"list_archive_sha256"`
 
 	// Proxy settings
-	ProxyMode string `json:"proxy_mode"`
+	ProxyMode          string `json:"proxy_mode"`           // "ephemeral" or "persistent"
+	ProxyEphemeralTTL  uint32 `json:"proxy_ephemeral_ttl"`  // TTL of proxied answers in ephemeral mode
+	ProxyPersistentTTL uint32 `json:"proxy_persistent_ttl"` // How long persistent mode reuses a worker IP
+
+	// What to do when the worker sends something other than an envelope (an
+	// error page, binary content): "upstream" (default) resolves the name
+	// normally, "servfail" fails the query, "worker" answers with the worker's
+	// own address as legacy passthrough workers expect
+	ProxyUnexpectedContent string `json:"proxy_unexpected_content"`
+
+	// Take the proxied answer TTL (and the persistent mode reuse time) from the
+	// origin's Cache-Control/Expires headers when present, clamped to MinTTL/MaxTTL
+	ProxyHonorCacheHeaders bool `json:"proxy_honor_cache_headers"`
+
+	// Experimental: answer TXT queries for proxied domains with the fetched
+	// content, base64 encoded and capped at ProxyTXTMaxBytes
+	ProxyTXTFallback bool `json:"proxy_txt_fallback"`
+	ProxyTXTMaxBytes int  `json:"proxy_txt_max_bytes"`
+
+	// Answer HTTPS and SVCB queries for proxied domains with a record hinting
+	// the proxy endpoint instead of forwarding them
+	ProxyServiceRecords bool `json:"proxy_service_records"`
+
+	// Service record types ("HTTPS", "SVCB") added to the additional section
+	// of proxied A answers, hinting the proxy endpoint so clients can skip the
+	// separate lookup. Dropped again by MinimalResponses
+	ProxyCompanionRecords []string `json:"proxy_companion_records"`
+
+	// Worker URL to use for specific proxied domain suffixes instead of the default worker
+	ProxyDomainWorkers map[string]string `json:"proxy_domain_workers"`
+
+	// Percentage of clients routed through the proxy for proxied domains, the
+	// rest resolve upstream. The split is stable per client and domain. The
+	// global value defaults to 100 and 0 sends no one through the proxy;
+	// per-suffix values override it
+	ProxyCanaryPercent *int           `json:"proxy_canary_percent"`
+	ProxyCanaryDomains map[string]int `json:"proxy_canary_domains"`
+
+	// Proxy targets refused by policy, answered like blocked domains. The deny
+	// list holds domain suffixes; the policy URL is queried with ?domain= and
+	// must return {"allowed": bool, "category": "..."}
+	ProxyDenyList  []string `json:"proxy_deny_list"`
+	ProxyPolicyURL string   `json:"proxy_policy_url"`
+
+	// Only proxy a domain when upstream fails, returns NXDOMAIN or answers with a poison IP
+	ProxyOnFailureOnly bool     `json:"proxy_on_failure_only"`
+	PoisonIPs          []string `json:"poison_ips"`
+
+	// Query access control (CIDR lists), deny wins over allow
+	AllowQueryFrom    []string `json:"allow_query_from"`
+	DenyQueryFrom     []string `json:"deny_query_from"`
+	DeniedQueryAction string   `json:"denied_query_action"` // "refuse" or "drop"
+
+	// Per-client rate limiting, disabled when RateLimitQPS is 0.
+	// RateLimitAction is "refused", "drop", "servfail" or "truncate"; with
+	// "truncate" every RateLimitSlip-th limited UDP query gets a TC reply.
+	RateLimitQPS    float64 `json:"rate_limit_qps"`
+	RateLimitBurst  int     `json:"rate_limit_burst"`
+	RateLimitAction string  `json:"rate_limit_action"`
+	RateLimitSlip   int     `json:"rate_limit_slip"`
+
+	// Cap on queries handled at the same time across all clients, 0 for no cap.
+	// Queries over the cap get InflightAction: "refused" (default) or "drop"
+	MaxInflightQueries int    `json:"max_inflight_queries"`
+	InflightAction     string `json:"inflight_action"`
+
+	// UDP retransmissions of a query still being resolved: "wait" (default)
+	// shares the original's answer, "drop" ignores them, "off" resolves each
+	DuplicateQueryAction string `json:"duplicate_query_action"`
+
+	// Largest query accepted in bytes (default 4096), bigger UDP and TCP
+	// messages are dropped before being parsed
+	MaxQuerySize int `json:"max_query_size"`
+
+	// Answer to queries received before startup completes: "servfail" or "forward" (upstream only)
+	NotReadyAction string `json:"not_ready_action"`
+
+	// DNS rebinding protection: upstream answers pointing public names at these
+	// ranges are stripped ("strip") or turned into NXDOMAIN ("nxdomain").
+	// Names under RebindAllowedDomains may resolve to private addresses.
+	RebindProtection     bool     `json:"rebind_protection"`
+	RebindProtectedCIDRs []string `json:"rebind_protected_cidrs"`
+	RebindAllowedDomains []string `json:"rebind_allowed_domains"`
+	RebindAction         string   `json:"rebind_action"`
+
+	// Address rewrites applied to A/AAAA answers before they are returned,
+	// after rebind protection. Each side is a CIDR or a single address and
+	// both must be the same size; the host part carries over
+	AnswerRewrites []AnswerRewrite `json:"answer_rewrites"`
+
+	// Admin HTTP listen address (metrics etc.), disabled when empty
+	AdminListen string `json:"admin_listen"`
+
+	// Serve net/http/pprof under /debug/pprof/ on the admin listener (default
+	// false), only to clients in PprofAllowFrom (default loopback only)
+	EnablePprof    bool     `json:"enable_pprof"`
+	PprofAllowFrom []string `json:"pprof_allow_from"`
+
+	// End-to-end health check served on /healthz: a domain resolved upstream,
+	// a control URL proxied through the worker, and how often to check
+	HealthCheckDomain          string `json:"health_check_domain"`
+	HealthCheckURL             string `json:"health_check_url"`
+	HealthCheckIntervalSeconds int    `json:"health_check_interval_seconds"`
+
+	// Redeploy the worker from the template after this many failed proxy
+	// checks in a row, at most once per cooldown
+	AutoRedeploy                bool   `json:"auto_redeploy"`
+	AutoRedeployAfterFailures   int    `json:"auto_redeploy_after_failures"`
+	AutoRedeployCooldownSeconds int    `json:"auto_redeploy_cooldown_seconds"`
+	WorkerSourcePath            string `json:"worker_source_path"`
+
+	// Type check the generated worker with tsc --noEmit before deploying it,
+	// skipped with a warning when tsc isn't installed
+	WorkerTypeCheck bool `json:"worker_type_check"`
+
+	// Queries slower than this are logged with their slowest stage
+	SlowQueryThresholdMs int `json:"slow_query_threshold_ms"`
+
+	// Send the log to syslog instead of stderr, falling back to stderr when
+	// syslog is unreachable. SyslogAddr is "host:port" (UDP), "tcp://host:port"
+	// or empty for the local daemon; SyslogFacility defaults to "daemon"
+	LogSyslog      bool   `json:"log_syslog"`
+	SyslogAddr     string `json:"syslog_addr"`
+	SyslogFacility string `json:"syslog_facility"`
+
+	// Window and per-window key cap for the top talkers served on /stats/top
+	StatsWindowSeconds int `json:"stats_window_seconds"`
+	StatsMaxKeys       int `json:"stats_max_keys"`
+
+	// Path of the local UNIX control socket, disabled when empty
+	ControlSocket string `json:"control_socket"`
+
+	// Timeout for a single worker request
+	WorkerTimeoutSeconds int `json:"worker_timeout_seconds"`
+
+	// Largest worker response body accepted, in bytes
+	MaxWorkerResponseBytes int64 `json:"max_worker_response_bytes"`
+
+	// Retries per second allowed across all worker and node API calls
+	RetryBudgetPerSecond float64 `json:"retry_budget_per_second"`
+
+	// Maximum redirects followed when proxying a target, 0 to follow none
+	MaxRedirects *int `json:"max_redirects"`
+
+	// Disable HTTP/2 for worker fetches (enabled by default)
+	DisableWorkerHTTP2 bool `json:"disable_worker_http2"`
+
+	// Outbound proxy for worker and other HTTP fetches, at most one may be set.
+	// HTTPProxy is an http(s):// URL, SOCKS5Proxy a host:port or socks5:// URL.
+	HTTPProxy   string `json:"http_proxy"`
+	SOCKS5Proxy string `json:"socks5_proxy"`
+
+	// Shared secret for signing worker requests, so the worker isn't an open proxy.
+	// Redeploy the worker after changing it, the secret is baked into the template.
+	WorkerSigningSecret          string `json:"worker_signing_secret"`
+	WorkerSignatureMaxAgeSeconds int    `json:"worker_signature_max_age_seconds"`
+
+	// Generated worker options, also baked into the template: answer requests
+	// without a target with 404 instead of a welcome page, and require a token
+	// (sent as the X-Worker-Auth header and AUTH parameter) on every request
+	WorkerDisableWelcome bool   `json:"worker_disable_welcome"`
+	WorkerAuthToken      string `json:"worker_auth_token"`
+
+	// Extra headers sent with every worker request, overriding the defaults
+	WorkerRequestHeaders map[string]string `json:"worker_request_headers"`
+
+	// Answer settings. AnswerOrder is "upstream" (as received), "sorted",
+	// "shuffle" or "client-affinity" (a stable order per client address)
+	MinTTL      uint32 `json:"min_ttl"`
+	MaxTTL      uint32 `json:"max_ttl"`
+	AnswerOrder string `json:"answer_order"`
+
+	// Keep replies to the answer section: drop the authority section from
+	// positive answers and every additional record but the OPT. Negative
+	// answers keep their SOA so clients can cache them
+	MinimalResponses bool `json:"minimal_responses"`
+
+	// Compress names in replies (default true), a pointer so an explicit false is kept
+	CompressResponses *bool `json:"compress_responses"`
+
+	// Fixed TTLs per record type ("A", "TXT", ...), taking precedence over MinTTL/MaxTTL
+	TTLOverrides map[string]uint32 `json:"ttl_overrides"`
+
+	// TTL ranges per domain suffix, taking precedence over TTLOverrides and
+	// MinTTL/MaxTTL for records under that suffix. The longest suffix wins
+	DomainTTLOverrides map[string]TTLRange `json:"domain_ttl_overrides"`
+
+	// Cache settings
+	CacheBackend string `json:"cache_backend"` // "memory" or "redis"
+	RedisAddr    string `json:"redis_addr"`
+
+	// File the memory cache is saved to on shutdown and restored from on startup, disabled when empty
+	CachePersistPath string `json:"cache_persist_path"`
+
+	// Domains resolved at startup and on an interval to keep the cache warm
+	PrefetchDomains         []string `json:"prefetch_domains"`
+	PrefetchIntervalSeconds int      `json:"prefetch_interval_seconds"`
+	PrefetchConcurrency     int      `json:"prefetch_concurrency"`
+
+	// Zone apex settings for owned domains
+	SOA struct {
+		MName   string `json:"mname"`
+		RName   string `json:"rname"`
+		Serial  uint32 `json:"serial"`
+		Refresh uint32 `json:"refresh"`
+		Retry   uint32 `json:"retry"`
+		Expire  uint32 `json:"expire"`
+		Minimum uint32 `json:"minimum"`
+	} `json:"soa"`
+
+	// Answer the EDNS EXPIRE option (RFC 7314) on owned-zone responses
+	EDNSExpire bool `json:"edns_expire"`
+
+	// Attach an Extended DNS Error (RFC 8914) saying why a query was blocked,
+	// refused or failed, for clients that sent EDNS
+	EnableExtendedErrors bool `json:"enable_extended_errors"`
 }
 
-// LoadConfig loads the configuration from file
+// ListenAddrs is a list of listen addresses; in JSON it may also be a single string
+type ListenAddrs []string
+
+// UnmarshalJSON accepts either "addr" or ["addr1", "addr2"]
+func (l *ListenAddrs) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		if single == "" {
+			*l = nil
+		} else {
+			*l = ListenAddrs{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("dns_listen must be a string or a list of strings: %v", err)
+	}
+	*l = list
+	return nil
+}
+
+// MarshalJSON writes a single address as a plain string for compatibility
+func (l ListenAddrs) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
+	}
+	return json.Marshal([]string(l))
+}
+
+// LoadConfig loads the configuration from a file, from stdin when path is "-",
+// or over HTTP when path is an http(s):// URL
 func LoadConfig(path string) (*Config, error) {
+	switch {
+	case path == "-":
+		return loadConfigFromReader(os.Stdin)
+	case strings.HasPrefix(path, "http://"), strings.HasPrefix(path, "https://"):
+		return loadConfigFromURL(path)
+	}
+
 	configFile, err := os.Open(path)
 	if err != nil {
 		// If file doesn't exist, create with default settings
@@ -65,23 +473,90 @@ func LoadConfig(path string) (*Config, error) {
 	}
 	defer configFile.Close()
 
-	// Read config file
 	configData, err := ioutil.ReadAll(configFile)
 	if err != nil {
 		return nil, err
 	}
+	migrated, version, err := migrateConfig(configData)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseConfig(migrated)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write upgraded configs back so the migration only happens once
+	if version < currentConfigVersion {
+		if err := rewriteMigratedConfig(path, configData, migrated, version, config.ConfigIndent); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return config, nil
+}
+
+// loadConfigFromReader reads and parses a JSON configuration, migrating
+// older config versions the same way LoadConfig does for files
+func loadConfigFromReader(r io.Reader) (*Config, error) {
+	configData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	config, version, err := parseVersionedConfig(configData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only files are written back, other sources are migrated on every load
+	if version < currentConfigVersion {
+		log.Printf("Config is version %d, migrated to version %d in memory only; update its source to skip the migration", version, currentConfigVersion)
+	}
+	return config, nil
+}
+
+// loadConfigFromURL fetches the configuration from a config service
+func loadConfigFromURL(configURL string) (*Config, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(configURL)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching config from %s: %v", configURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("config fetch from %s returned status %d", configURL, resp.StatusCode)
+	}
+
+	return loadConfigFromReader(resp.Body)
+}
+
+// parseConfig parses JSON configuration data and applies defaults
+func parseConfig(configData []byte) (*Config, error) {
+	config, _, err := parseVersionedConfig(configData)
+	return config, err
+}
+
+// parseVersionedConfig is parseConfig that also returns the config_version
+// the data had before it was migrated
+func parseVersionedConfig(configData []byte) (*Config, int, error) {
+	// Bring older configs up to the current schema first
+	configData, version, err := migrateConfig(configData)
+	if err != nil {
+		return nil, 0, err
+	}
 
 	// Parse JSON into Config struct
 	var config Config
 	err = json.Unmarshal(configData, &config)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// Apply defaults for any missing values
 	applyConfigDefaults(&config)
 
-	return &config, nil
+	return &config, version, nil
 }
 
 // createDefaultConfig creates a default configuration file
@@ -94,15 +569,17 @@ func createDefaultConfig(path string) (*Config, error) {
 
 	// Create default config
 	config := &Config{
-		DNSPort:     53,
-		DNSListen:   "127.0.0.1",
+		ConfigVersion: currentConfigVersion,
+
+		DNSListen:   ListenAddrs{"127.0.0.1"},
 		Nameservers: []string{"8.8.8.8", "1.1.1.1"},
 
 		BlessnetWorkerURL: "https://apricot-emu-jacklin-qikeha7m.bls.dev",
 
 		API: struct {
-			BaseURL string `json:"base_url"`
-			Version string `json:"version"`
+			BaseURL          string `json:"base_url"`
+			Version          string `json:"version"`
+			NegotiateVersion bool   `json:"negotiate_version"`
 		}{
 			BaseURL: "https://api.bless.network",
 			Version: "v1",
@@ -120,6 +597,7 @@ func createDefaultConfig(path string) (*Config, error) {
 			Count      int               `json:"count"`
 			Regions    []string          `json:"regions"`
 			Attributes map[string]string `json:"attributes"`
+			Fallbacks  []WorkerEndpoint  `json:"fallbacks"`
 		}{
 			Count:   3,
 			Regions: []string{"us-east", "eu-west", "ap-east"},
@@ -129,10 +607,15 @@ func createDefaultConfig(path string) (*Config, error) {
 		},
 
 		ProxyMode: "ephemeral",
+
+		MaxTTL: 3600,
 	}
 
+	// Fill in the remaining defaults
+	applyConfigDefaults(config)
+
 	// Write config to file
-	configData, err := json.MarshalIndent(config, "", "  ")
+	configData, err := marshalConfig(config)
 	if err != nil {
 		return nil, err
 	}
@@ -148,15 +631,173 @@ func createDefaultConfig(path string) (*Config, error) {
 // applyConfigDefaults applies default values to missing configuration fields
 func applyConfigDefaults(config *Config) {
 	// Apply DNS defaults if not set
-	if config.DNSPort == 0 {
-		config.DNSPort = 53
+	if config.DNSPort == nil || *config.DNSPort < 0 {
+		port := 53
+		config.DNSPort = &port
 	}
-	if config.DNSListen == "" {
-		config.DNSListen = "127.0.0.1"
+	if len(config.DNSListen) == 0 {
+		config.DNSListen = ListenAddrs{"127.0.0.1"}
 	}
-	if len(config.Nameservers) == 0 {
+	if config.BindRetries == 0 {
+		config.BindRetries = 5
+	}
+	if config.Nameservers == nil {
 		config.Nameservers = []string{"8.8.8.8", "1.1.1.1"}
 	}
+	if config.UpstreamRetries == nil || *config.UpstreamRetries < 0 {
+		retries := 1
+		config.UpstreamRetries = &retries
+	}
+	if config.UpstreamOrdering != "static" && config.UpstreamOrdering != "score" {
+		if config.UpstreamOrdering != "" {
+			log.Printf("Unknown upstream ordering %q, using static", config.UpstreamOrdering)
+		}
+		config.UpstreamOrdering = "static"
+	}
+	if config.AllowRecursion == nil {
+		recursion := true
+		config.AllowRecursion = &recursion
+	}
+
+	// Apply query ACL defaults if not set, allowing loopback and RFC1918 only
+	if len(config.AllowQueryFrom) == 0 {
+		config.AllowQueryFrom = []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+	}
+	if config.DeniedQueryAction == "" {
+		config.DeniedQueryAction = "refuse"
+	}
+
+	// Profiling is only offered to the local machine unless widened
+	if len(config.PprofAllowFrom) == 0 {
+		config.PprofAllowFrom = []string{"127.0.0.0/8", "::1/128"}
+	}
+
+	// Warn about validation rules that don't exist
+	for _, rule := range config.UpstreamValidationRules {
+		if _, ok := upstreamValidators[rule]; !ok {
+			log.Printf("Unknown upstream validation rule %q, ignoring", rule)
+		}
+	}
+
+	// Keep only the companion record types we can synthesize
+	if len(config.ProxyCompanionRecords) > 0 {
+		companions := make([]string, 0, len(config.ProxyCompanionRecords))
+		for _, rrtype := range config.ProxyCompanionRecords {
+			rrtype = strings.ToUpper(rrtype)
+			if rrtype != "HTTPS" && rrtype != "SVCB" {
+				log.Printf("Unknown proxy companion record type %q, ignoring", rrtype)
+				continue
+			}
+			companions = append(companions, rrtype)
+		}
+		config.ProxyCompanionRecords = companions
+	}
+
+	// Apply rebind protection defaults if not set
+	if len(config.RebindProtectedCIDRs) == 0 {
+		config.RebindProtectedCIDRs = []string{
+			"0.0.0.0/8", "127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+			"::1/128", "fc00::/7", "fe80::/10",
+		}
+	}
+	if config.RebindAction != "strip" && config.RebindAction != "nxdomain" {
+		if config.RebindAction != "" {
+			log.Printf("Unknown rebind action %q, using strip", config.RebindAction)
+		}
+		config.RebindAction = "strip"
+	}
+
+	// Apply rate limit defaults if not set
+	if config.RateLimitBurst <= 0 {
+		config.RateLimitBurst = int(config.RateLimitQPS)
+		if config.RateLimitBurst < 1 {
+			config.RateLimitBurst = 1
+		}
+	}
+	switch config.RateLimitAction {
+	case "refused", "drop", "servfail", "truncate":
+	default:
+		if config.RateLimitAction != "" {
+			log.Printf("Unknown rate limit action %q, using refused", config.RateLimitAction)
+		}
+		config.RateLimitAction = "refused"
+	}
+	if config.RateLimitSlip == 0 {
+		config.RateLimitSlip = 2
+	}
+	if config.InflightAction != "refused" && config.InflightAction != "drop" {
+		if config.InflightAction != "" {
+			log.Printf("Unknown inflight action %q, using refused", config.InflightAction)
+		}
+		config.InflightAction = "refused"
+	}
+	if config.DuplicateQueryAction != "wait" && config.DuplicateQueryAction != "drop" && config.DuplicateQueryAction != "off" {
+		if config.DuplicateQueryAction != "" {
+			log.Printf("Unknown duplicate query action %q, using wait", config.DuplicateQueryAction)
+		}
+		config.DuplicateQueryAction = "wait"
+	}
+	if config.MaxQuerySize <= 0 {
+		config.MaxQuerySize = 4096
+	}
+	if config.MaxQuerySize < 512 {
+		config.MaxQuerySize = 512
+	}
+	if config.MaxQuerySize > 65535 {
+		config.MaxQuerySize = 65535
+	}
+
+	// Compress replies unless explicitly disabled
+	if config.CompressResponses == nil {
+		compress := true
+		config.CompressResponses = &compress
+	}
+
+	// Apply retry budget default if not set
+	if config.RetryBudgetPerSecond <= 0 {
+		config.RetryBudgetPerSecond = 10
+	}
+
+	// Apply worker response size default if not set
+	if config.MaxWorkerResponseBytes <= 0 {
+		config.MaxWorkerResponseBytes = 10 << 20
+	}
+
+	// Apply worker signature default if not set
+	if config.WorkerSignatureMaxAgeSeconds == 0 {
+		config.WorkerSignatureMaxAgeSeconds = 300
+	}
+
+	// Apply not-ready default if not set
+	if config.NotReadyAction != "servfail" && config.NotReadyAction != "forward" {
+		if config.NotReadyAction != "" {
+			log.Printf("Unknown not-ready action %q, using servfail", config.NotReadyAction)
+		}
+		config.NotReadyAction = "servfail"
+	}
+
+	// Apply syslog facility default if not set
+	if config.SyslogFacility == "" {
+		config.SyslogFacility = "daemon"
+	} else if _, ok := syslogFacilities[strings.ToLower(config.SyslogFacility)]; ok {
+		config.SyslogFacility = strings.ToLower(config.SyslogFacility)
+	} else {
+		log.Printf("Unknown syslog facility %q, using daemon", config.SyslogFacility)
+		config.SyslogFacility = "daemon"
+	}
+
+	// Apply slow query threshold default if not set
+	if config.SlowQueryThresholdMs == 0 {
+		config.SlowQueryThresholdMs = 500
+	}
+
+	// Apply top talker defaults if not set
+	if config.StatsWindowSeconds <= 0 {
+		config.StatsWindowSeconds = 300
+	}
+	if config.StatsMaxKeys <= 0 {
+		config.StatsMaxKeys = 1000
+	}
 
 	// Apply Blessnet defaults if not set
 	if config.BlessnetWorkerURL == "" {
@@ -170,6 +811,9 @@ func applyConfigDefaults(config *Config) {
 	if config.API.Version == "" {
 		config.API.Version = "v1"
 	}
+	if config.AuthGraceSeconds == 0 {
+		config.AuthGraceSeconds = 300
+	}
 
 	// Apply worker defaults if not set
 	if config.Worker.Count == 0 {
@@ -184,10 +828,215 @@ func applyConfigDefaults(config *Config) {
 		}
 	}
 
+	// Apply worker timeout default if not set
+	if config.WorkerTimeoutSeconds == 0 {
+		config.WorkerTimeoutSeconds = 30
+	}
+
+	// Apply redirect limit default if not set
+	if config.MaxRedirects == nil || *config.MaxRedirects < 0 {
+		redirects := 5
+		config.MaxRedirects = &redirects
+	}
+
+	// Apply discovery defaults if not set
+	if config.Discovery.Concurrency == 0 {
+		config.Discovery.Concurrency = 8
+	}
+	if config.Discovery.TimeoutSeconds == 0 {
+		config.Discovery.TimeoutSeconds = 10
+	}
+
+	// Apply blocking defaults if not set
+	if config.BlockResponse == "" {
+		config.BlockResponse = "nxdomain"
+	}
+	if config.DNS64Prefix == "" {
+		config.DNS64Prefix = "64:ff9b::/96"
+	}
+	if config.ReputationTimeoutMs <= 0 {
+		config.ReputationTimeoutMs = 500
+	}
+	if config.ReputationCacheSeconds <= 0 {
+		config.ReputationCacheSeconds = 600
+	}
+	if config.SinkholeIP == "" {
+		config.SinkholeIP = "0.0.0.0"
+	}
+	if config.SinkholeIPv6 == "" {
+		config.SinkholeIPv6 = "::"
+	}
+	if config.BlockedRecordTTL == 0 {
+		config.BlockedRecordTTL = 60
+	}
+	switch config.DefaultResponse {
+	case "nodata", "refused", "servfail", "nxdomain":
+	default:
+		if net.ParseIP(config.DefaultResponse) == nil {
+			if config.DefaultResponse != "" {
+				log.Printf("Unknown default response %q, using nodata", config.DefaultResponse)
+			}
+			config.DefaultResponse = "nodata"
+		}
+	}
+
 	// Apply proxy mode default if not set
-	if config.ProxyMode == "" {
+	if config.ProxyMode != "ephemeral" && config.ProxyMode != "persistent" {
+		if config.ProxyMode != "" {
+			log.Printf("Unknown proxy mode %q, using ephemeral", config.ProxyMode)
+		}
 		config.ProxyMode = "ephemeral"
 	}
+	switch config.ProxyUnexpectedContent {
+	case "upstream", "servfail", "worker":
+	default:
+		if config.ProxyUnexpectedContent != "" {
+			log.Printf("Unknown proxy unexpected content action %q, using upstream", config.ProxyUnexpectedContent)
+		}
+		config.ProxyUnexpectedContent = "upstream"
+	}
+	if config.ProxyEphemeralTTL == 0 {
+		config.ProxyEphemeralTTL = 5
+	}
+	if config.ProxyCanaryPercent == nil || *config.ProxyCanaryPercent < 0 || *config.ProxyCanaryPercent > 100 {
+		percent := 100
+		config.ProxyCanaryPercent = &percent
+	}
+	if config.ProxyPersistentTTL == 0 {
+		config.ProxyPersistentTTL = 300
+	}
+
+	// Apply TTL clamp defaults if not set
+	if config.MaxTTL == 0 {
+		config.MaxTTL = 3600
+	}
+	if config.MinTTL > config.MaxTTL {
+		config.MinTTL = config.MaxTTL
+	}
+
+	// Apply answer order default if not set
+	switch config.AnswerOrder {
+	case "upstream", "sorted", "shuffle", "client-affinity":
+	default:
+		if config.AnswerOrder != "" {
+			log.Printf("Unknown answer order %q, using upstream", config.AnswerOrder)
+		}
+		config.AnswerOrder = "upstream"
+	}
+
+	// Apply cache defaults if not set
+	if config.CacheBackend == "" {
+		config.CacheBackend = "memory"
+	}
+	if config.CacheBackend == "redis" && config.RedisAddr == "" {
+		config.RedisAddr = "127.0.0.1:6379"
+	}
+
+	// Apply health check defaults if not set
+	if config.HealthCheckDomain == "" {
+		config.HealthCheckDomain = "example.com"
+	}
+	if config.HealthCheckURL == "" {
+		config.HealthCheckURL = "https://example.com"
+	}
+	if config.HealthCheckIntervalSeconds == 0 {
+		config.HealthCheckIntervalSeconds = 60
+	}
+
+	// Apply auto-redeploy defaults if not set
+	if config.AutoRedeployAfterFailures <= 0 {
+		config.AutoRedeployAfterFailures = 3
+	}
+	if config.AutoRedeployCooldownSeconds <= 0 {
+		config.AutoRedeployCooldownSeconds = 3600
+	}
+	if config.WorkerSourcePath == "" {
+		config.WorkerSourcePath = "src/index.ts"
+	}
+
+	// Apply TXT fallback size default, never beyond what fits a TCP reply
+	if config.ProxyTXTMaxBytes <= 0 {
+		config.ProxyTXTMaxBytes = 16384
+	}
+	if config.ProxyTXTMaxBytes > txtProxyHardLimit {
+		config.ProxyTXTMaxBytes = txtProxyHardLimit
+	}
+
+	// Apply list database default if not set
+	if config.HostsFile == "" {
+		config.HostsFile = defaultHostsFile()
+	}
+	if config.ListRefreshSeconds == 0 {
+		config.ListRefreshSeconds = 300
+	}
+
+	// Apply prefetch defaults if not set
+	if config.PrefetchIntervalSeconds == 0 {
+		config.PrefetchIntervalSeconds = 300
+	}
+	if config.PrefetchConcurrency == 0 {
+		config.PrefetchConcurrency = 4
+	}
+
+	// Normalize TTL override keys to record type names
+	if len(config.TTLOverrides) > 0 {
+		overrides := make(map[string]uint32, len(config.TTLOverrides))
+		for rrtype, ttl := range config.TTLOverrides {
+			overrides[strings.ToUpper(rrtype)] = ttl
+		}
+		config.TTLOverrides = overrides
+	}
+
+	// Normalize domain TTL override keys to bare lowercase names
+	if len(config.DomainTTLOverrides) > 0 {
+		overrides := make(map[string]TTLRange, len(config.DomainTTLOverrides))
+		for domain, ttlRange := range config.DomainTTLOverrides {
+			if ttlRange.Max > 0 && ttlRange.Min > ttlRange.Max {
+				log.Printf("Domain TTL override for %s has min above max, using max", domain)
+				ttlRange.Min = ttlRange.Max
+			}
+			overrides[strings.ToLower(strings.Trim(domain, "."))] = ttlRange
+		}
+		config.DomainTTLOverrides = overrides
+	}
+
+	// Apply SOA defaults if not set
+	if config.SOA.MName == "" {
+		config.SOA.MName = "ns1.phantomdns.local."
+	}
+	if config.SOA.RName == "" {
+		config.SOA.RName = "hostmaster.phantomdns.local."
+	}
+	if config.SOA.Serial == 0 {
+		config.SOA.Serial = 1
+	}
+	if config.SOA.Refresh == 0 {
+		config.SOA.Refresh = 3600
+	}
+	if config.SOA.Retry == 0 {
+		config.SOA.Retry = 600
+	}
+	if config.SOA.Expire == 0 {
+		config.SOA.Expire = 86400
+	}
+	if config.SOA.Minimum == 0 {
+		config.SOA.Minimum = 60
+	}
+}
+
+// marshalConfig renders a config as indented JSON. The output is deterministic:
+// struct fields keep their declared order and encoding/json sorts map keys
+// (Worker.Attributes, TTLOverrides, ...), so saving the same config twice
+// produces byte-identical files.
+func marshalConfig(config *Config) ([]byte, error) {
+	indent := config.ConfigIndent
+	if indent == "" {
+		indent = "  "
+	}
+	if strings.Trim(indent, " \t") != "" {
+		return nil, fmt.Errorf("config_indent must only contain spaces and tabs")
+	}
+	return json.MarshalIndent(config, "", indent)
 }
 
 // SaveConfig saves the configuration to a file
@@ -201,7 +1050,7 @@ func SaveConfig(config *Config) error {
 	}
 
 	// Convert configuration to JSON
-	data, err := json.MarshalIndent(config, "", "  ")
+	data, err := marshalConfig(config)
 	if err != nil {
 		return err
 	}
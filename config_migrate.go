@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// currentConfigVersion is the config_version written by this build. Files
+// without a config_version are version 1.
+const currentConfigVersion = 2
+
+// configMigrations upgrade a raw config one version at a time: entry i takes
+// version i+1 to version i+2
+var configMigrations = []func(raw map[string]json.RawMessage) error{
+	migrateConfigV1,
+}
+
+// migrateConfigV1 upgrades a version 1 config:
+//   - sort_answers: true becomes answer_order: "sorted"
+//   - dns_port: 0 meant the default port, it now picks a free one, so it is dropped
+func migrateConfigV1(raw map[string]json.RawMessage) error {
+	if value, ok := raw["sort_answers"]; ok {
+		var sortAnswers bool
+		if err := json.Unmarshal(value, &sortAnswers); err != nil {
+			return fmt.Errorf("invalid sort_answers: %v", err)
+		}
+		if _, set := raw["answer_order"]; sortAnswers && !set {
+			raw["answer_order"] = json.RawMessage(`"sorted"`)
+		}
+		delete(raw, "sort_answers")
+	}
+
+	if value, ok := raw["dns_port"]; ok {
+		var port int
+		if err := json.Unmarshal(value, &port); err == nil && port == 0 {
+			delete(raw, "dns_port")
+		}
+	}
+	return nil
+}
+
+// configVersion returns the config_version of raw config data
+func configVersion(raw map[string]json.RawMessage) (int, error) {
+	value, ok := raw["config_version"]
+	if !ok {
+		return 1, nil
+	}
+	var version int
+	if err := json.Unmarshal(value, &version); err != nil {
+		return 0, fmt.Errorf("invalid config_version: %v", err)
+	}
+	return version, nil
+}
+
+// migrateConfig upgrades config data to currentConfigVersion and returns it
+// with the version it started at. Data from a newer build is left alone.
+func migrateConfig(configData []byte) ([]byte, int, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(configData, &raw); err != nil {
+		return nil, 0, err
+	}
+
+	version, err := configVersion(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version > currentConfigVersion {
+		log.Printf("Config version %d is newer than this build supports (%d), fields may be ignored", version, currentConfigVersion)
+		return configData, version, nil
+	}
+	if version == currentConfigVersion {
+		return configData, version, nil
+	}
+
+	for v := version; v < currentConfigVersion; v++ {
+		if err := configMigrations[v-1](raw); err != nil {
+			return nil, 0, fmt.Errorf("error migrating config from version %d: %v", v, err)
+		}
+	}
+	raw["config_version"] = json.RawMessage(fmt.Sprint(currentConfigVersion))
+
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	return migrated, version, nil
+}
+
+// rewriteMigratedConfig saves the migrated config data over the original file,
+// keeping the original next to it as <path>.v<version>.bak. Only what the file
+// set is written, defaults stay out of it.
+func rewriteMigratedConfig(path string, original []byte, migrated []byte, version int, indent string) error {
+	backup := fmt.Sprintf("%s.v%d.bak", path, version)
+	if err := ioutil.WriteFile(backup, original, 0644); err != nil {
+		return fmt.Errorf("error backing up config to %s: %v", backup, err)
+	}
+
+	if indent == "" || strings.Trim(indent, " \t") != "" {
+		indent = "  "
+	}
+	var data bytes.Buffer
+	if err := json.Indent(&data, migrated, "", indent); err != nil {
+		return fmt.Errorf("error formatting migrated config: %v", err)
+	}
+	data.WriteByte('\n')
+	if err := ioutil.WriteFile(path, data.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing migrated config: %v", err)
+	}
+
+	log.Printf("Migrated %s from config version %d to %d, the original is saved as %s", path, version, currentConfigVersion, backup)
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// v1Config is a version 1 config that migration changes
+const v1Config = `{"sort_answers": true, "nameservers": ["192.0.2.53"]}`
+
+// checkMigrated fails unless config is v1Config brought up to date
+func checkMigrated(t *testing.T, config *Config) {
+	t.Helper()
+	if config.ConfigVersion != currentConfigVersion {
+		t.Errorf("config_version = %d, want %d", config.ConfigVersion, currentConfigVersion)
+	}
+	if config.AnswerOrder != "sorted" {
+		t.Errorf("answer_order = %q, want sort_answers migrated to sorted", config.AnswerOrder)
+	}
+	if len(config.Nameservers) != 1 || config.Nameservers[0] != "192.0.2.53" {
+		t.Errorf("nameservers = %v, want [192.0.2.53]", config.Nameservers)
+	}
+}
+
+func TestLoadConfigFromReaderMigrates(t *testing.T) {
+	config, err := loadConfigFromReader(strings.NewReader(v1Config))
+	if err != nil {
+		t.Fatalf("loadConfigFromReader: %v", err)
+	}
+	checkMigrated(t, config)
+}
+
+func TestLoadConfigFromStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString(v1Config)
+	w.Close()
+
+	old := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = old
+		r.Close()
+	})
+
+	config, err := LoadConfig("-")
+	if err != nil {
+		t.Fatalf("LoadConfig(-): %v", err)
+	}
+	checkMigrated(t, config)
+}
+
+func TestLoadConfigFromURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/config.json":
+			w.Write([]byte(v1Config))
+		case "/broken.json":
+			w.Write([]byte(`{"nameservers": [`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	config, err := LoadConfig(server.URL + "/config.json")
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	checkMigrated(t, config)
+
+	if _, err := LoadConfig(server.URL + "/broken.json"); err == nil {
+		t.Error("invalid JSON from the config service loaded, want an error")
+	}
+	if _, err := LoadConfig(server.URL + "/missing.json"); err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Errorf("err = %v, want the 404 reported", err)
+	}
+}
+
+func TestListenAddrsJSON(t *testing.T) {
+	tests := []struct {
+		data string
+		want []string
+	}{
+		{`{"dns_listen": "127.0.0.1"}`, []string{"127.0.0.1"}},
+		{`{"dns_listen": ["127.0.0.1", "192.168.1.10"]}`, []string{"127.0.0.1", "192.168.1.10"}},
+		{`{"dns_listen": ""}`, nil},
+	}
+	for _, tt := range tests {
+		var config Config
+		if err := json.Unmarshal([]byte(tt.data), &config); err != nil {
+			t.Errorf("%s: %v", tt.data, err)
+			continue
+		}
+		if !reflect.DeepEqual([]string(config.DNSListen), tt.want) {
+			t.Errorf("%s: dns_listen = %q, want %q", tt.data, config.DNSListen, tt.want)
+		}
+	}
+
+	var config Config
+	if err := json.Unmarshal([]byte(`{"dns_listen": 53}`), &config); err == nil {
+		t.Error("numeric dns_listen accepted, want an error")
+	}
+
+	// A single address is written back in the string form
+	data, err := json.Marshal(ListenAddrs{"127.0.0.1"})
+	if err != nil || string(data) != `"127.0.0.1"` {
+		t.Errorf("single address marshalled as %s, %v, want a plain string", data, err)
+	}
+	data, _ = json.Marshal(ListenAddrs{"127.0.0.1", "::1"})
+	if string(data) != `["127.0.0.1","::1"]` {
+		t.Errorf("two addresses marshalled as %s, want a list", data)
+	}
+}
+
+// configWithMaps returns a config whose map fields hold enough keys to expose
+// any randomized ordering
+func configWithMaps() *Config {
+	c := &Config{ProxyDomainWorkers: map[string]string{}, ProxyCanaryDomains: map[string]int{}}
+	c.Worker.Attributes = map[string]string{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%02d", 19-i)
+		c.Worker.Attributes[key] = fmt.Sprint(i)
+		c.ProxyDomainWorkers[key+".test"] = "https://" + key + ".bls.dev"
+		c.ProxyCanaryDomains[key+".test"] = i
+	}
+	return c
+}
+
+func TestSaveConfigDeterministic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("PHANTOMDNS_CONFIG", path)
+	c := configWithMaps()
+
+	var first []byte
+	for i := 0; i < 5; i++ {
+		if err := SaveConfig(c); err != nil {
+			t.Fatalf("SaveConfig: %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = data
+		} else if !bytes.Equal(data, first) {
+			t.Fatalf("save %d differs from the first save", i+1)
+		}
+	}
+
+	// Map keys come out sorted, so they never move between saves
+	if strings.Index(string(first), `"key-00"`) > strings.Index(string(first), `"key-19"`) {
+		t.Error("attributes not written in sorted key order")
+	}
+	if !strings.Contains(string(first), "\n  \"config_version\"") {
+		t.Error("config not indented with the default two spaces")
+	}
+}
+
+func TestSaveConfigIndent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("PHANTOMDNS_CONFIG", path)
+
+	c := configWithMaps()
+	c.ConfigIndent = "\t"
+	if err := SaveConfig(c); err != nil {
+		t.Fatalf("SaveConfig: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "\n\t\"config_version\"") || !strings.Contains(string(data), "\n\t\t\t\"key-00\"") {
+		t.Errorf("config not indented with tabs:\n%.200s", data)
+	}
+
+	c.ConfigIndent = "--"
+	if err := SaveConfig(c); err == nil {
+		t.Error("non-whitespace config_indent accepted, want an error")
+	}
+}
+
+func TestMigrateConfigV1(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want map[string]string
+	}{
+		{"sort_answers", `{"sort_answers": true}`, map[string]string{"answer_order": `"sorted"`}},
+		{"sort_answers off", `{"sort_answers": false}`, map[string]string{}},
+		{"explicit answer_order", `{"sort_answers": true, "answer_order": "shuffle"}`, map[string]string{"answer_order": `"shuffle"`}},
+		{"default dns_port", `{"dns_port": 0}`, map[string]string{}},
+		{"custom dns_port", `{"dns_port": 5353}`, map[string]string{"dns_port": "5353"}},
+	}
+	for _, tt := range tests {
+		migrated, version, err := migrateConfig([]byte(tt.data))
+		if err != nil {
+			t.Fatalf("%s: migrateConfig: %v", tt.name, err)
+		}
+		if version != 1 {
+			t.Errorf("%s: started at version %d, want 1", tt.name, version)
+		}
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(migrated, &raw); err != nil {
+			t.Fatalf("%s: migrated data %s: %v", tt.name, migrated, err)
+		}
+		got := map[string]string{}
+		for key, value := range raw {
+			if key != "config_version" {
+				got[key] = string(value)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) || string(raw["config_version"]) != fmt.Sprint(currentConfigVersion) {
+			t.Errorf("%s: migrated to %s, want %v at version %d", tt.name, migrated, tt.want, currentConfigVersion)
+		}
+	}
+
+	// Current and newer configs are left untouched
+	for _, data := range []string{
+		fmt.Sprintf(`{"config_version": %d, "sort_answers": true}`, currentConfigVersion),
+		fmt.Sprintf(`{"config_version": %d, "sort_answers": true}`, currentConfigVersion+1),
+	} {
+		if migrated, _, err := migrateConfig([]byte(data)); err != nil || string(migrated) != data {
+			t.Errorf("%s migrated to %s (%v), want it unchanged", data, migrated, err)
+		}
+	}
+}
+
+func TestLoadConfigRewritesMigratedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(v1Config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	checkMigrated(t, config)
+
+	// The original is kept and the file holds only what it set, migrated
+	if backup, err := os.ReadFile(path + ".v1.bak"); err != nil || string(backup) != v1Config {
+		t.Errorf("backup = %q (%v), want the original config", backup, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("rewritten config %s: %v", data, err)
+	}
+	var keys []string
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	if len(raw) != 3 || string(raw["answer_order"]) != `"sorted"` || raw["nameservers"] == nil || raw["config_version"] == nil {
+		t.Errorf("rewritten config has %v, want only config_version, answer_order and nameservers:\n%s", keys, data)
+	}
+	if !bytes.Contains(data, []byte("\n  \"answer_order\"")) {
+		t.Errorf("rewritten config isn't indented:\n%s", data)
+	}
+
+	// Loading again finds nothing left to migrate
+	config, err = LoadConfig(path)
+	if err != nil {
+		t.Fatalf("second LoadConfig: %v", err)
+	}
+	checkMigrated(t, config)
+	if _, err := os.Stat(path + ".v2.bak"); !os.IsNotExist(err) {
+		t.Errorf("an up to date config was backed up again: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ControlServer serves management commands over a local UNIX domain socket.
+// Each request is a single line ("stats", "resolve example.com A", ...) and
+// each reply is a single line of JSON.
+type ControlServer struct {
+	path     string
+	listener net.Listener
+}
+
+// controlResponse is the JSON reply to a control command
+type controlResponse struct {
+	OK    bool        `json:"ok"`
+	Error string      `json:"error,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// NewControlServer creates the control socket at the given path
+func NewControlServer(path string) (*ControlServer, error) {
+	// Remove a stale socket left behind by a previous run
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("error removing stale control socket: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on control socket: %v", err)
+	}
+
+	// Only the owning user may manage the server
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error setting control socket permissions: %v", err)
+	}
+
+	return &ControlServer{path: path, listener: listener}, nil
+}
+
+// Serve accepts control connections until the server is closed
+func (c *ControlServer) Serve() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+		go c.handleConn(conn)
+	}
+}
+
+// Close stops the control server and removes the socket file
+func (c *ControlServer) Close() error {
+	err := c.listener.Close()
+	os.Remove(c.path)
+	return err
+}
+
+// handleConn processes commands from one client, one per line
+func (c *ControlServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := encoder.Encode(executeControlCommand(line)); err != nil {
+			log.Printf("Error writing control response: %v", err)
+			return
+		}
+	}
+}
+
+// executeControlCommand runs a single control command
+func executeControlCommand(line string) controlResponse {
+	fields := strings.Fields(line)
+	command, args := fields[0], fields[1:]
+
+	switch command {
+	case "stats":
+		return controlResponse{OK: true, Data: stats.Snapshot()}
+
+	case "cache-flush":
+		// cache-flush [name [subtree]]
+		var removed int
+		switch {
+		case len(args) == 0:
+			removed = dnsCache.FlushCache()
+		case len(args) > 1 && args[1] == "subtree":
+			removed = dnsCache.FlushSubtree(args[0])
+		default:
+			removed = dnsCache.FlushDomain(args[0])
+		}
+		return controlResponse{OK: true, Data: map[string]int{"removed": removed}}
+
+	case "reload":
+		if err := reloadConfig(); err != nil {
+			return controlResponse{Error: fmt.Sprintf("reload failed: %v", err)}
+		}
+		return controlResponse{OK: true}
+
+	case "resolve":
+		if len(args) == 0 {
+			return controlResponse{Error: "usage: resolve <name> [type]"}
+		}
+		qtype := dns.TypeA
+		if len(args) > 1 {
+			t, ok := dns.StringToType[strings.ToUpper(args[1])]
+			if !ok {
+				return controlResponse{Error: fmt.Sprintf("unknown record type %q", args[1])}
+			}
+			qtype = t
+		}
+
+		query := new(dns.Msg)
+		query.SetQuestion(dns.Fqdn(args[0]), qtype)
+		reply := Resolve(query)
+
+		records := []string{}
+		for _, rr := range reply.Answer {
+			records = append(records, rr.String())
+		}
+		return controlResponse{OK: true, Data: map[string]interface{}{
+			"rcode":   dns.RcodeToString[reply.Rcode],
+			"answers": records,
+		}}
+
+	default:
+		return controlResponse{Error: fmt.Sprintf("unknown command %q", command)}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startControlServer serves the control socket from a temporary directory
+func startControlServer(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "control.sock")
+	server, err := NewControlServer(path)
+	if err != nil {
+		t.Fatalf("NewControlServer: %v", err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return path
+}
+
+// controlCommand sends one command over the socket and decodes the reply
+func controlCommand(t *testing.T, conn net.Conn, reader *bufio.Reader, command string) controlResponse {
+	t.Helper()
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		t.Fatalf("writing %q: %v", command, err)
+	}
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("reading reply to %q: %v", command, err)
+	}
+	var resp controlResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		t.Fatalf("decoding reply %q: %v", line, err)
+	}
+	return resp
+}
+
+func TestControlSocketStats(t *testing.T) {
+	useConfig(t, &Config{})
+	path := startControlServer(t)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	resp := controlCommand(t, conn, reader, "stats")
+	if !resp.OK {
+		t.Fatalf("stats failed: %s", resp.Error)
+	}
+	data, ok := resp.Data.(map[string]interface{})
+	if !ok {
+		t.Fatalf("stats data is %T, want an object", resp.Data)
+	}
+	for _, key := range []string{"uptime_seconds", "queries", "proxied", "forwarded", "cache_hits", "upstream_errors"} {
+		if _, ok := data[key]; !ok {
+			t.Errorf("stats reply lacks %q: %v", key, data)
+		}
+	}
+
+	// The connection stays open for further commands
+	if resp := controlCommand(t, conn, reader, "bogus"); resp.OK || resp.Error == "" {
+		t.Errorf("unknown command reply = %+v, want an error", resp)
+	}
+}
+
+func TestControlSocketPermissions(t *testing.T) {
+	path := startControlServer(t)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket mode = %o, want 600", perm)
+	}
+}
+
+// writeConfigFile writes a current-version config file for reloadConfig to read
+func writeConfigFile(t *testing.T, path string, proxyDomain string) {
+	t.Helper()
+	data := fmt.Sprintf(`{"config_version": %d, "proxy_domains": ["one.test", %q], "hosts_file": "off", "rate_limit_qps": 1000}`, currentConfigVersion, proxyDomain)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// useConfigPath points reloadConfig at a config file in a temporary directory
+func useConfigPath(t *testing.T) string {
+	t.Helper()
+	oldPath := configPath
+	configPath = filepath.Join(t.TempDir(), "config.json")
+	t.Cleanup(func() { configPath = oldPath })
+	return configPath
+}
+
+// TestReloadWhileServing reloads through the control socket while queries are
+// being answered. Run with -race to check the state swap is safe.
+func TestReloadWhileServing(t *testing.T) {
+	useConfig(t, &Config{ProxyDomains: []string{"one.test"}, HostsFile: "off"})
+	useServerReady(t)
+
+	configFile := useConfigPath(t)
+
+	path := startControlServer(t)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				w := newFakeResponseWriter("127.0.0.1")
+				q := new(dns.Msg)
+				q.SetQuestion("one.test.", dns.TypeSOA)
+				handleDNSRequest(w, q)
+				if len(w.replies) != 1 {
+					t.Errorf("got %d replies, want 1", len(w.replies))
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		writeConfigFile(t, configFile, fmt.Sprintf("zone%d.test", i%2))
+		if resp := controlCommand(t, conn, reader, "reload"); !resp.OK {
+			t.Fatalf("reload failed: %s", resp.Error)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if got := currentConfig().ProxyDomains; len(got) != 2 || got[1] != "zone1.test" {
+		t.Errorf("ProxyDomains after reload = %v, want [one.test zone1.test]", got)
+	}
+}
+
+// writeWorkerConfigFile writes a current-version config file using workerURL
+func writeWorkerConfigFile(t *testing.T, path string, workerURL string) {
+	t.Helper()
+	data := fmt.Sprintf(`{"config_version": %d, "proxy_domains": ["one.test"], "hosts_file": "off", "blessnet_worker_url": %q}`, currentConfigVersion, workerURL)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadSwitchesWorkerURL(t *testing.T) {
+	useConfig(t, &Config{ProxyDomains: []string{"one.test"}, HostsFile: "off"})
+	_, oldRequests := useWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("old"))
+	})
+	newWorker, newRequests := workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new"))
+	})
+
+	path := useConfigPath(t)
+	writeWorkerConfigFile(t, path, newWorker.URL)
+	if err := reloadConfig(); err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+	if got := blessnetClient.GetWorkerURL(); got != newWorker.URL {
+		t.Fatalf("worker URL = %s, want %s", got, newWorker.URL)
+	}
+
+	body, err := blessnetClient.FetchPage("https://example.com")
+	if err != nil {
+		t.Fatalf("FetchPage: %v", err)
+	}
+	if string(body) != "new" {
+		t.Errorf("fetch answered %q, want it served by the new worker", body)
+	}
+	if len(*oldRequests) != 0 {
+		t.Errorf("old worker saw %d requests after the reload, want 0", len(*oldRequests))
+	}
+
+	// The connection check and the fetch
+	if len(*newRequests) != 2 {
+		t.Errorf("new worker saw %d requests, want 2", len(*newRequests))
+	}
+}
+
+func TestReloadKeepsConfigWhenNewWorkerFails(t *testing.T) {
+	useConfig(t, &Config{ProxyDomains: []string{"one.test"}, HostsFile: "off"})
+	useWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("old"))
+	})
+	unreachable := closedServerURL()
+
+	path := useConfigPath(t)
+	writeWorkerConfigFile(t, path, unreachable)
+	if err := reloadConfig(); err != nil {
+		t.Fatalf("reloadConfig: %v, want the failed worker check only logged", err)
+	}
+	if got := currentConfig().BlessnetWorkerURL; got != unreachable {
+		t.Errorf("live worker URL = %s, want the reloaded %s", got, unreachable)
+	}
+
+	// Called directly, the failed check is reported to the caller
+	next := *currentConfig()
+	next.BlessnetWorkerURL = closedServerURL()
+	if err := blessnetClient.UpdateConfig(&next); err == nil {
+		t.Error("UpdateConfig to an unreachable worker succeeded, want an error")
+	}
+}
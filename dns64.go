@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// mappedIPv4 is ::ffff:0:0/96, whose AAAA records don't count as IPv6
+// connectivity and are ignored when deciding to synthesize (RFC 6147 5.1.4)
+var mappedIPv4 = &net.IPNet{IP: net.ParseIP("::ffff:0:0"), Mask: net.CIDRMask(96, 128)}
+
+// newDNS64Prefix parses the configured NAT64 prefix, or returns nil when DNS64
+// is disabled. RFC 6052 allows /32, /40, /48, /56, /64 and /96 with bits 64-71 zero.
+func newDNS64Prefix(config *Config) (*net.IPNet, error) {
+	if !config.EnableDNS64 {
+		return nil, nil
+	}
+
+	ip, prefix, err := net.ParseCIDR(config.DNS64Prefix)
+	if err != nil || ip.To4() != nil {
+		return nil, fmt.Errorf("invalid dns64_prefix %q: not an IPv6 prefix", config.DNS64Prefix)
+	}
+	switch ones, _ := prefix.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("invalid dns64_prefix %q: length must be 32, 40, 48, 56, 64 or 96", config.DNS64Prefix)
+	}
+	if prefix.IP[8] != 0 {
+		return nil, fmt.Errorf("invalid dns64_prefix %q: bits 64-71 must be zero", config.DNS64Prefix)
+	}
+	return prefix, nil
+}
+
+// embedIPv4 builds the IPv4-embedded IPv6 address for a NAT64 prefix, skipping
+// the reserved octet at bits 64-71 (RFC 6052 2.2)
+func embedIPv4(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	result := make(net.IP, net.IPv6len)
+	copy(result, prefix.IP)
+
+	pos := ones / 8
+	for _, b := range ip4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		result[pos] = b
+		pos++
+	}
+	return result
+}
+
+// hasIPv6Answer reports whether records hold an AAAA outside ::ffff:0:0/96
+func hasIPv6Answer(records []dns.RR) bool {
+	for _, rr := range records {
+		if aaaa, ok := rr.(*dns.AAAA); ok && !mappedIPv4.Contains(aaaa.AAAA) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDNS64 resolves a AAAA query upstream and, when the name has no IPv6
+// address but does have IPv4 ones, answers with AAAA records synthesized
+// from the A records under the NAT64 prefix (RFC 6147)
+func handleDNS64(m *dns.Msg, q dns.Question, trace *queryTrace) {
+	forwardToUpstream(m, q, trace)
+
+	// Only an empty NOERROR is synthesized, and CD queries want the real data
+	prefix := currentState().dns64
+	if prefix == nil || m.Rcode != dns.RcodeSuccess || hasIPv6Answer(m.Answer) || m.CheckingDisabled {
+		return
+	}
+
+	reply := new(dns.Msg)
+	forwardToUpstream(reply, dns.Question{Name: q.Name, Qtype: dns.TypeA, Qclass: q.Qclass}, trace)
+	if reply.Rcode != dns.RcodeSuccess {
+		return
+	}
+
+	answer := []dns.RR{}
+	for _, rr := range reply.Answer {
+		switch record := rr.(type) {
+		case *dns.CNAME:
+			answer = append(answer, record)
+		case *dns.A:
+			hdr := record.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: embedIPv4(prefix, record.A)})
+		}
+	}
+	if !hasIPv6Answer(answer) {
+		return
+	}
+
+	// Synthesized records can't carry a validated signature
+	trace.decide("dns64")
+	m.Answer = answer
+	m.AuthenticatedData = false
+}
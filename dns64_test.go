@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNewDNS64Prefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		ok     bool
+	}{
+		{"64:ff9b::/96", true},
+		{"2001:db8:64::/48", true},
+		{"2001:db8::/32", true},
+		{"2001:db8::/120", false},
+		{"2001:db8:0:0:ff00::/96", false},
+		{"192.0.2.0/24", false},
+		{"not-a-prefix", false},
+	}
+	for _, tt := range tests {
+		_, err := newDNS64Prefix(&Config{EnableDNS64: true, DNS64Prefix: tt.prefix})
+		if (err == nil) != tt.ok {
+			t.Errorf("newDNS64Prefix(%q) error = %v, want ok %v", tt.prefix, err, tt.ok)
+		}
+	}
+
+	if prefix, err := newDNS64Prefix(&Config{DNS64Prefix: "64:ff9b::/96"}); prefix != nil || err != nil {
+		t.Errorf("disabled DNS64 = %v, %v, want no prefix", prefix, err)
+	}
+}
+
+func TestEmbedIPv4(t *testing.T) {
+	// The examples from RFC 6052 2.4 for 192.0.2.33
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+	}
+	for _, tt := range tests {
+		_, prefix, _ := net.ParseCIDR(tt.prefix)
+		if got := embedIPv4(prefix, net.ParseIP("192.0.2.33")); !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("embedIPv4(%s) = %s, want %s", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestDNS64Synthesis(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		want   string
+	}{
+		{"default prefix", "", "64:ff9b::c000:221"},
+		{"configured prefix", "2001:db8:64::/96", "2001:db8:64::c000:221"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, HostsFile: "off", EnableDNS64: true, DNS64Prefix: tt.prefix})
+			useMemoryCache(t)
+			useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+				if m.Question[0].Qtype == dns.TypeA {
+					return replyWithA(m, "192.0.2.33"), nil
+				}
+				r := new(dns.Msg)
+				r.SetReply(m)
+				return r, nil
+			})
+
+			q := new(dns.Msg)
+			q.SetQuestion("ipv4only.example.", dns.TypeAAAA)
+			m, decision := resolveWithDecision(q)
+			if decision != "dns64" || len(m.Answer) != 1 {
+				t.Fatalf("got %v (%s), want one synthesized AAAA", m.Answer, decision)
+			}
+			aaaa, ok := m.Answer[0].(*dns.AAAA)
+			if !ok || !aaaa.AAAA.Equal(net.ParseIP(tt.want)) || aaaa.Hdr.Name != "ipv4only.example." || aaaa.Hdr.Ttl != 300 {
+				t.Errorf("synthesized %v, want %s carrying the A record's name and TTL", m.Answer[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestDNS64KeepsRealAnswers(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, HostsFile: "off", EnableDNS64: true})
+	useMemoryCache(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		switch {
+		case m.Question[0].Qtype == dns.TypeA:
+			r = replyWithA(m, "192.0.2.33")
+		case m.Question[0].Name == "dualstack.example.":
+			r.Answer = append(r.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 300},
+				AAAA: net.ParseIP("2001:db8::33"),
+			})
+		case m.Question[0].Name == "missing.example.":
+			r.Rcode = dns.RcodeNameError
+		}
+		return r, nil
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("dualstack.example.", dns.TypeAAAA)
+	m, _ := resolveWithDecision(q)
+	if len(m.Answer) != 1 || !m.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("2001:db8::33")) {
+		t.Errorf("name with IPv6 got %v, want its own AAAA", m.Answer)
+	}
+
+	// NXDOMAIN is passed on rather than synthesized over
+	q.SetQuestion("missing.example.", dns.TypeAAAA)
+	if m, decision := resolveWithDecision(q); m.Rcode != dns.RcodeNameError || decision == "dns64" {
+		t.Errorf("missing name got %s (%s), want NXDOMAIN", dns.RcodeToString[m.Rcode], decision)
+	}
+}
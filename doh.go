@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the wire format content type for DNS over HTTPS (RFC 8484)
+const dohMediaType = "application/dns-message"
+
+// dohClient sends queries to a DNS over HTTPS endpoint. The address passed to
+// Exchange is the endpoint URL.
+type dohClient struct {
+	client *http.Client
+}
+
+// newDoHClient creates a DoH client, sending from UpstreamSourceIP when set
+// and through the same outbound proxy as worker fetches
+func newDoHClient() *dohClient {
+	config := currentConfig()
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	if ip := net.ParseIP(config.UpstreamSourceIP); ip != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	transport := &http.Transport{DialContext: dialer.DialContext, ForceAttemptHTTP2: true}
+	if proxyURL, err := outboundProxy(config); err == nil && proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return &dohClient{client: &http.Client{Timeout: 5 * time.Second, Transport: transport}}
+}
+
+// newDoHExchanger creates the exchanger for DoH queries. It is a variable so
+// the race between transports can be driven without a real endpoint.
+var newDoHExchanger = func() Exchanger {
+	return newDoHClient()
+}
+
+// Exchange POSTs a query to the DoH endpoint and unpacks the reply
+func (c *dohClient) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error packing query: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, address, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating DoH request: %v", err)
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error querying %s: %v", address, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s returned status %d", address, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading reply from %s: %v", address, err)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, 0, fmt.Errorf("error unpacking reply from %s: %v", address, err)
+	}
+	return r, time.Since(start), nil
+}
+
+// exchangeDoH sends a question to DoHUpstream
+func exchangeDoH(q dns.Question, checkingDisabled bool) (*dns.Msg, error) {
+	return exchangeMinimized(q, checkingDisabled, queryDoH)
+}
+
+// queryDoH sends q unchanged to DoHUpstream
+func queryDoH(q dns.Question, checkingDisabled bool) (*dns.Msg, error) {
+	config := currentConfig()
+	upstreamMsg := newUpstreamQuery(q.Name, q.Qtype, checkingDisabled)
+	padMessage(upstreamMsg, config.EDNSPadding)
+
+	r, _, err := newDoHExchanger().Exchange(upstreamMsg, config.DoHUpstream)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateUpstreamAnswer(upstreamMsg, r); err != nil {
+		return nil, fmt.Errorf("discarding malformed reply from %s: %v", config.DoHUpstream, err)
+	}
+	if r.Rcode == dns.RcodeRefused || r.Rcode == dns.RcodeServerFailure {
+		return nil, fmt.Errorf("%s answered %s for %s", config.DoHUpstream, dns.RcodeToString[r.Rcode], q.Name)
+	}
+	return r, nil
+}
+
+// raceUpstream queries the nameservers and DoHUpstream at the same time and
+// returns whichever answers first, waiting for the other if the first fails
+func raceUpstream(q dns.Question, checkingDisabled bool) (*dns.Msg, error) {
+	type result struct {
+		transport string
+		reply     *dns.Msg
+		err       error
+	}
+
+	// Buffered so the loser can finish after we've returned
+	results := make(chan result, 2)
+	go func() {
+		r, err := exchangeNameservers(q, checkingDisabled)
+		results <- result{"dns", r, err}
+	}()
+	go func() {
+		r, err := exchangeDoH(q, checkingDisabled)
+		results <- result{"doh", r, err}
+	}()
+
+	var errs []error
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.err == nil {
+			upstreamRaceWins.Inc(res.transport)
+			return res.reply, nil
+		}
+		log.Printf("Upstream %s query for %s failed: %v", res.transport, q.Name, res.err)
+		errs = append(errs, res.err)
+	}
+	return nil, fmt.Errorf("all upstream transports failed for %s: %v", q.Name, errs)
+}
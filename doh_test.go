@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohServer answers DoH queries with the given address after delay
+func dohServer(t *testing.T, ip string, delay time.Duration) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	queries := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		q := new(dns.Msg)
+		if r.Header.Get("Content-Type") != dohMediaType || q.Unpack(body) != nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		time.Sleep(delay)
+		packed, _ := replyWithA(q, ip).Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(packed)
+	}))
+	t.Cleanup(server.Close)
+	return server, queries
+}
+
+// stalledUpstream makes plain DNS queries hang until the test ends, like a
+// network that silently drops UDP
+func stalledUpstream(t *testing.T) *fakeExchanger {
+	t.Helper()
+	release := make(chan struct{})
+	fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		<-release
+		return nil, errors.New("i/o timeout")
+	})
+	t.Cleanup(func() { close(release) })
+	return fake
+}
+
+func TestHappyEyeballsDoHWinsWhenUDPStalls(t *testing.T) {
+	doh, _ := dohServer(t, "203.0.113.53", 0)
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, DoHUpstream: doh.URL, HappyEyeballsUpstream: true, HostsFile: "off"})
+	useMemoryCache(t)
+	fake := stalledUpstream(t)
+	wins := upstreamRaceWins.Value("doh")
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	m, _ := resolveWithDecision(q)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("answer took %v, want it as soon as DoH replied", elapsed)
+	}
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "203.0.113.53" {
+		t.Fatalf("got %s %v, want the DoH answer", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	if len(fake.Calls()) != 1 {
+		t.Errorf("plain DNS queried %d times, want it raced once", len(fake.Calls()))
+	}
+	if got := upstreamRaceWins.Value("doh"); got != wins+1 {
+		t.Errorf("doh race wins = %v, want %v", got, wins+1)
+	}
+}
+
+func TestHappyEyeballsFasterTransportWins(t *testing.T) {
+	// The slow DoH upstream fails outright, so the losing query returns
+	// straight from the exchange without reading config after the test ends
+	dohQueries := &atomic.Int32{}
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dohQueries.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(doh.Close)
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, DoHUpstream: doh.URL, HappyEyeballsUpstream: true})
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "203.0.113.1"), nil
+	})
+	wins := upstreamRaceWins.Value("dns")
+
+	start := time.Now()
+	r, err := exchangeUpstream(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if err != nil {
+		t.Fatalf("exchangeUpstream: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("answer took %v, want it without waiting for DoH", elapsed)
+	}
+	if r.Answer[0].(*dns.A).A.String() != "203.0.113.1" {
+		t.Errorf("answer %v, want the faster plain DNS one", r.Answer)
+	}
+	if got := upstreamRaceWins.Value("dns"); got != wins+1 {
+		t.Errorf("dns race wins = %v, want %v", got, wins+1)
+	}
+
+	// The losing DoH query is still sent
+	for deadline := time.Now().Add(2 * time.Second); dohQueries.Load() == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dohQueries.Load() != 1 {
+		t.Errorf("%d DoH queries, want the race to ask both", dohQueries.Load())
+	}
+}
+
+func TestHappyEyeballsOff(t *testing.T) {
+	doh, dohQueries := dohServer(t, "203.0.113.53", 0)
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, DoHUpstream: doh.URL})
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "203.0.113.1"), nil
+	})
+
+	if _, err := exchangeUpstream(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); err != nil {
+		t.Fatalf("exchangeUpstream: %v", err)
+	}
+	if dohQueries.Load() != 0 {
+		t.Errorf("DoH queried %d times without happy_eyeballs_upstream", dohQueries.Load())
+	}
+}
+
+func TestHappyEyeballsAllTransportsFail(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, DoHUpstream: closedServerURL(), HappyEyeballsUpstream: true})
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return nil, errors.New("i/o timeout")
+	})
+
+	if _, err := exchangeUpstream(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); err == nil {
+		t.Error("exchangeUpstream succeeded with every transport down")
+	}
+}
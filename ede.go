@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// addExtendedError attaches an extended DNS error to a reply. The OPT record
+// is only added for clients that sent one themselves.
+func addExtendedError(m *dns.Msg, r *dns.Msg, ede *dns.EDNS0_EDE) {
+	if !currentConfig().EnableExtendedErrors || ede == nil || r.IsEdns0() == nil {
+		return
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(r.IsEdns0().UDPSize(), r.IsEdns0().Do())
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, ede)
+}
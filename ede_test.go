@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// extendedError returns the extended DNS error on a reply, or nil without one
+func extendedError(m *dns.Msg) *dns.EDNS0_EDE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if ede, ok := option.(*dns.EDNS0_EDE); ok {
+			return ede
+		}
+	}
+	return nil
+}
+
+// ednsQuery returns an A query for name, with an OPT record when edns is set
+func ednsQuery(name string, edns bool) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	if edns {
+		q.SetEdns0(1232, false)
+	}
+	return q
+}
+
+func TestExtendedErrorBlocked(t *testing.T) {
+	useConfig(t, &Config{BlockedDomains: []string{"ads.example"}, EnableExtendedErrors: true, HostsFile: "off"})
+	useMemoryCache(t)
+
+	m, decision := resolveWithDecision(ednsQuery("tracker.ads.example.", true))
+	if decision != "blocked" {
+		t.Fatalf("decision = %q, want blocked", decision)
+	}
+	ede := extendedError(m)
+	if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeBlocked || ede.ExtraText != "blocked by policy" {
+		t.Errorf("extended error = %v, want Blocked", ede)
+	}
+
+	// Clients that didn't send EDNS don't get an OPT record they can't read
+	m, _ = resolveWithDecision(ednsQuery("tracker.ads.example.", false))
+	if m.IsEdns0() != nil {
+		t.Errorf("reply to a query without EDNS carries %v", m.IsEdns0())
+	}
+}
+
+func TestExtendedErrorProxyFailure(t *testing.T) {
+	useConfig(t, &Config{ProxyDomains: []string{"proxied.test"}, EnableExtendedErrors: true, HostsFile: "off"})
+	useMemoryCache(t)
+	useServerReady(t)
+	resetProxyIPCache(t)
+	useWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "worker crashed", http.StatusInternalServerError)
+	})
+
+	m, _ := resolveWithDecision(ednsQuery("proxied.test.", true))
+	if m.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("rcode = %s, want SERVFAIL", dns.RcodeToString[m.Rcode])
+	}
+	if ede := extendedError(m); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeNetworkError {
+		t.Errorf("extended error = %v, want Network Error", ede)
+	}
+}
+
+func TestExtendedErrorUpstreamFailure(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, EnableExtendedErrors: true, HostsFile: "off"})
+	useMemoryCache(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return nil, errors.New("i/o timeout")
+	})
+
+	m, _ := resolveWithDecision(ednsQuery("example.com.", true))
+	if ede := extendedError(m); m.Rcode != dns.RcodeServerFailure || ede == nil || ede.InfoCode != dns.ExtendedErrorCodeNoReachableAuthority {
+		t.Errorf("%s with extended error %v, want SERVFAIL with No Reachable Authority", dns.RcodeToString[m.Rcode], ede)
+	}
+}
+
+func TestExtendedErrorsOff(t *testing.T) {
+	useConfig(t, &Config{BlockedDomains: []string{"ads.example"}, HostsFile: "off"})
+	useMemoryCache(t)
+
+	m, _ := resolveWithDecision(ednsQuery("tracker.ads.example.", true))
+	if ede := extendedError(m); ede != nil {
+		t.Errorf("extended error %v attached with enable_extended_errors off", ede)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WorkerEnvelope is the structured response emitted by the worker
+type WorkerEnvelope struct {
+	Status       int    `json:"status"`
+	Target       string `json:"target"`
+	FinalURL     string `json:"finalURL"`
+	ResolvedIP   string `json:"resolvedIP"`
+	ContentType  string `json:"contentType"`
+	CacheControl string `json:"cacheControl"`
+	Expires      string `json:"expires"`
+	BodyBase64   string `json:"bodyBase64"`
+
+	// Legacy is set when the envelope was recovered from the plain-text format
+	Legacy bool `json:"-"`
+
+	// Raw is set when the worker sent neither format and the body was passed
+	// through as is; ContentType is then sniffed from the body
+	Raw bool `json:"-"`
+
+	// Worker is the worker that served the response
+	Worker WorkerEndpoint `json:"-"`
+}
+
+// Body decodes the proxied content carried by the envelope
+func (e *WorkerEnvelope) Body() ([]byte, error) {
+	return base64.StdEncoding.DecodeString(e.BodyBase64)
+}
+
+// CacheTTL derives a TTL from the origin's caching headers. s-maxage wins over
+// max-age, which wins over Expires; no-store and no-cache give 0. It reports
+// false when the headers say nothing usable
+func (e *WorkerEnvelope) CacheTTL(now time.Time) (uint32, bool) {
+	maxAge, sharedMaxAge := -1, -1
+	for _, directive := range strings.Split(e.CacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0, true
+		case "max-age", "s-maxage":
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil || seconds < 0 {
+				continue
+			}
+			if strings.EqualFold(name, "s-maxage") {
+				sharedMaxAge = seconds
+			} else {
+				maxAge = seconds
+			}
+		}
+	}
+	if sharedMaxAge >= 0 {
+		return uint32(sharedMaxAge), true
+	}
+	if maxAge >= 0 {
+		return uint32(maxAge), true
+	}
+
+	if e.Expires == "" {
+		return 0, false
+	}
+	expires, err := http.ParseTime(e.Expires)
+	if err != nil {
+		// Invalid dates such as "0" mean already expired (RFC 9111)
+		return 0, true
+	}
+	if remaining := expires.Sub(now); remaining > 0 {
+		return uint32(remaining / time.Second), true
+	}
+	return 0, true
+}
+
+// parseWorkerResponse decodes a worker response, accepting the JSON envelope
+// as well as the older plain-text "SUCCESS:/ERROR:" format
+func parseWorkerResponse(body []byte) (*WorkerEnvelope, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		var envelope WorkerEnvelope
+		if err := json.Unmarshal(trimmed, &envelope); err == nil && envelope.Status != 0 {
+			return &envelope, nil
+		}
+	}
+
+	return parseLegacyWorkerResponse(body)
+}
+
+// parseLegacyWorkerResponse recovers what it can from the plain-text worker format.
+// Anything that isn't in that format is treated as raw passthrough content.
+func parseLegacyWorkerResponse(body []byte) (*WorkerEnvelope, error) {
+	text := string(body)
+	envelope := &WorkerEnvelope{Legacy: true}
+
+	if !strings.HasPrefix(text, "SUCCESS:") && !strings.HasPrefix(text, "ERROR:") {
+		envelope.Status = 200
+		envelope.Raw = true
+		envelope.ContentType = http.DetectContentType(body)
+		envelope.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+		return envelope, nil
+	}
+
+	// Header lines run until the first blank line, content follows the separator
+	header, content, _ := strings.Cut(text, "\n\n")
+	for _, line := range strings.Split(header, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "Status":
+			status, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid status %q in worker response", value)
+			}
+			envelope.Status = status
+		case "Target":
+			envelope.Target = value
+		}
+	}
+
+	if _, sample, ok := strings.Cut(content, "------------\n"); ok {
+		envelope.BodyBase64 = base64.StdEncoding.EncodeToString([]byte(sample))
+	}
+
+	if envelope.Status == 0 {
+		if strings.HasPrefix(text, "ERROR:") {
+			return nil, fmt.Errorf("worker reported an error: %s", strings.SplitN(text, "\n", 2)[0])
+		}
+		envelope.Status = 200
+	}
+
+	return envelope, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseWorkerResponseEnvelope(t *testing.T) {
+	body := []byte(`{"status":200,"target":"https://example.com","finalURL":"https://www.example.com/","resolvedIP":"93.184.216.34","contentType":"text/html","bodyBase64":"PGgxPmhpPC9oMT4="}`)
+
+	envelope, err := parseWorkerResponse(body)
+	if err != nil {
+		t.Fatalf("parseWorkerResponse: %v", err)
+	}
+	if envelope.Legacy {
+		t.Error("envelope marked legacy, want JSON")
+	}
+	if envelope.Status != 200 || envelope.Target != "https://example.com" || envelope.FinalURL != "https://www.example.com/" {
+		t.Errorf("envelope = %+v, want status, target and final URL decoded", envelope)
+	}
+	if envelope.ResolvedIP != "93.184.216.34" {
+		t.Errorf("ResolvedIP = %q, want 93.184.216.34", envelope.ResolvedIP)
+	}
+	content, err := envelope.Body()
+	if err != nil {
+		t.Fatalf("Body: %v", err)
+	}
+	if string(content) != "<h1>hi</h1>" {
+		t.Errorf("Body = %q, want <h1>hi</h1>", content)
+	}
+}
+
+func TestParseWorkerResponseLegacyText(t *testing.T) {
+	body := []byte("SUCCESS: Connected to target\nStatus: 200\nTarget: https://example.com\n\nContent sample:\n------------\n<h1>hi</h1>")
+
+	envelope, err := parseWorkerResponse(body)
+	if err != nil {
+		t.Fatalf("parseWorkerResponse: %v", err)
+	}
+	if !envelope.Legacy || envelope.Raw {
+		t.Errorf("Legacy = %v, Raw = %v, want a legacy text response", envelope.Legacy, envelope.Raw)
+	}
+	if envelope.Status != 200 || envelope.Target != "https://example.com" {
+		t.Errorf("envelope = %+v, want status 200 for https://example.com", envelope)
+	}
+	if envelope.ResolvedIP != "" {
+		t.Errorf("ResolvedIP = %q, legacy text carries none", envelope.ResolvedIP)
+	}
+	content, _ := envelope.Body()
+	if string(content) != "<h1>hi</h1>" {
+		t.Errorf("Body = %q, want the content sample", content)
+	}
+}
+
+func TestParseWorkerResponseLegacyError(t *testing.T) {
+	envelope, err := parseWorkerResponse([]byte("ERROR: Failed to connect to target\nStatus: 502\nTarget: https://example.com"))
+	if err != nil {
+		t.Fatalf("parseWorkerResponse: %v", err)
+	}
+	if envelope.Status != 502 {
+		t.Errorf("Status = %d, want 502", envelope.Status)
+	}
+
+	if _, err := parseWorkerResponse([]byte("ERROR: Exception occurred\nMessage: boom")); err == nil {
+		t.Error("error without a status parsed, want an error")
+	}
+}
+
+func TestParseWorkerResponseRawPassthrough(t *testing.T) {
+	envelope, err := parseWorkerResponse([]byte("<html><body>plain page</body></html>"))
+	if err != nil {
+		t.Fatalf("parseWorkerResponse: %v", err)
+	}
+	if !envelope.Raw || envelope.Status != 200 {
+		t.Errorf("Raw = %v, Status = %d, want raw passthrough with status 200", envelope.Raw, envelope.Status)
+	}
+	if envelope.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("ContentType = %q, want it sniffed from the body", envelope.ContentType)
+	}
+}
+
+func TestFetchEnvelopeDecodesGzipResponse(t *testing.T) {
+	useConfig(t, &Config{})
+	_, requests := useWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			http.Error(w, "expected the transport's own Accept-Encoding", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"status":200,"target":"https://example.com","resolvedIP":"203.0.113.7"}`))
+		gz.Close()
+	})
+
+	envelope, err := blessnetClient.FetchEnvelope("https://example.com", "")
+	if err != nil {
+		t.Fatalf("FetchEnvelope: %v", err)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("worker saw %d requests, want 1", len(*requests))
+	}
+	if envelope.ResolvedIP != "203.0.113.7" {
+		t.Errorf("ResolvedIP = %q, want the gzip body decoded transparently", envelope.ResolvedIP)
+	}
+}
+
+func TestWorkerEnvelopeCacheTTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		cacheControl, expires string
+		ttl                   uint32
+		ok                    bool
+	}{
+		{"", "", 0, false},
+		{"public", "", 0, false},
+		{"max-age=600", "", 600, true},
+		{"public, max-age=600, s-maxage=120", "", 120, true},
+		{`max-age="90"`, "", 90, true},
+		{"max-age=bogus", "", 0, false},
+		{"no-cache, max-age=600", "", 0, true},
+		{"max-age=600, no-store", "", 0, true},
+		{"", "Mon, 01 Jan 2024 12:05:00 GMT", 300, true},
+		{"max-age=30", "Mon, 01 Jan 2024 12:05:00 GMT", 30, true},
+		{"", "Mon, 01 Jan 2024 11:00:00 GMT", 0, true},
+		{"", "0", 0, true},
+	}
+	for _, tt := range tests {
+		envelope := &WorkerEnvelope{CacheControl: tt.cacheControl, Expires: tt.expires}
+		ttl, ok := envelope.CacheTTL(now)
+		if ttl != tt.ttl || ok != tt.ok {
+			t.Errorf("CacheTTL(%q, %q) = %d, %v, want %d, %v", tt.cacheControl, tt.expires, ttl, ok, tt.ttl, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// healthCheck is the outcome of one component check
+type healthCheck struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency"`
+}
+
+// healthReport is the overall health served on /healthz.
+// Status is "ok", "degraded" (upstream works but proxying is broken) or "down".
+type healthReport struct {
+	Status    string      `json:"status"`
+	Upstream  healthCheck `json:"upstream"`
+	Proxy     healthCheck `json:"proxy"`
+	CheckedAt time.Time   `json:"checked_at"`
+}
+
+// Latest health report, nil until the first check has run
+var lastHealth = struct {
+	sync.RWMutex
+	report *healthReport
+}{}
+
+// runHealthCheck checks upstream resolution and end-to-end proxying
+func runHealthCheck() *healthReport {
+	report := &healthReport{
+		Upstream:  checkUpstreamHealth(),
+		Proxy:     checkProxyHealth(),
+		CheckedAt: time.Now(),
+	}
+
+	switch {
+	case report.Upstream.OK && report.Proxy.OK:
+		report.Status = "ok"
+	case report.Upstream.OK:
+		report.Status = "degraded"
+	default:
+		report.Status = "down"
+	}
+	return report
+}
+
+// checkUpstreamHealth resolves the health check domain through the upstream nameservers
+func checkUpstreamHealth() healthCheck {
+	start := time.Now()
+	_, err := exchangeUpstream(dns.Question{Name: dns.Fqdn(currentConfig().HealthCheckDomain), Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	return newHealthCheck(start, err)
+}
+
+// checkProxyHealth proxies the control URL through the worker and validates the envelope,
+// which catches a worker that is reachable but no longer proxies correctly
+func checkProxyHealth() healthCheck {
+	start := time.Now()
+	if blessnetClient == nil {
+		return newHealthCheck(start, fmt.Errorf("blessnet client not initialized"))
+	}
+
+	envelope, err := blessnetClient.FetchEnvelope(currentConfig().HealthCheckURL, "")
+	if err == nil && (envelope.Status < 200 || envelope.Status >= 300) {
+		err = fmt.Errorf("control URL returned status %d through the worker", envelope.Status)
+	}
+	if err == nil && !envelope.Legacy {
+		if body, decodeErr := envelope.Body(); decodeErr != nil || len(body) == 0 {
+			err = fmt.Errorf("worker returned no content for the control URL")
+		}
+	}
+	return newHealthCheck(start, err)
+}
+
+// newHealthCheck builds a check result from an error and the check start time
+func newHealthCheck(start time.Time, err error) healthCheck {
+	check := healthCheck{OK: err == nil, Latency: time.Since(start).String()}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// runHealthLoop refreshes the health report on the configured interval
+func runHealthLoop() {
+	for {
+		report := runHealthCheck()
+		lastHealth.Lock()
+		lastHealth.report = report
+		lastHealth.Unlock()
+
+		// The proxy check doubles as the worker self-test
+		redeployer.Observe(report.Proxy.OK)
+
+		time.Sleep(time.Duration(currentConfig().HealthCheckIntervalSeconds) * time.Second)
+	}
+}
+
+// handleHealthz serves the latest health report, 503 when nothing works yet
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	lastHealth.RLock()
+	report := lastHealth.report
+	lastHealth.RUnlock()
+
+	if report == nil {
+		report = &healthReport{Status: "starting"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" && report.Status != "degraded" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
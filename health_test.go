@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// useHealthWorker sets up a working upstream and a worker answering with handler
+func useHealthWorker(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}})
+	useMemoryCache(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "192.0.2.10"), nil
+	})
+	useWorker(t, handler)
+}
+
+// checkHealthz runs a health check and returns the /healthz status code and report
+func checkHealthz(t *testing.T) (int, healthReport) {
+	t.Helper()
+	lastHealth.Lock()
+	old := lastHealth.report
+	lastHealth.report = runHealthCheck()
+	lastHealth.Unlock()
+	t.Cleanup(func() {
+		lastHealth.Lock()
+		lastHealth.report = old
+		lastHealth.Unlock()
+	})
+
+	rec := httptest.NewRecorder()
+	handleHealthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+	var report healthReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("decoding /healthz: %v", err)
+	}
+	return rec.Code, report
+}
+
+// envelopeHandler answers every fetch with an envelope of the given status and body
+func envelopeHandler(status int, bodyBase64 string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":%d,"target":%q,"contentType":"text/html","bodyBase64":%q}`, status, r.URL.Query().Get("TARGET"), bodyBase64)
+	}
+}
+
+func TestHealthzOK(t *testing.T) {
+	useHealthWorker(t, envelopeHandler(200, "PGgxPmhpPC9oMT4="))
+
+	code, report := checkHealthz(t)
+	if code != http.StatusOK || report.Status != "ok" {
+		t.Errorf("/healthz = %d %q, want 200 ok", code, report.Status)
+	}
+	if !report.Upstream.OK || !report.Proxy.OK {
+		t.Errorf("checks = %+v, %+v, want both passing", report.Upstream, report.Proxy)
+	}
+}
+
+func TestHealthzDegradedWhenProxyBroken(t *testing.T) {
+	tests := map[string]http.HandlerFunc{
+		// The worker is reachable but the target fetch fails behind it
+		"target error": envelopeHandler(502, ""),
+		// The worker answers but carries no content
+		"empty content": envelopeHandler(200, ""),
+	}
+	for name, handler := range tests {
+		t.Run(name, func(t *testing.T) {
+			useHealthWorker(t, handler)
+
+			code, report := checkHealthz(t)
+			if code != http.StatusOK || report.Status != "degraded" {
+				t.Errorf("/healthz = %d %q, want 200 degraded", code, report.Status)
+			}
+			if !report.Upstream.OK || report.Proxy.OK || report.Proxy.Error == "" {
+				t.Errorf("checks = %+v, %+v, want upstream passing and the proxy failure reported", report.Upstream, report.Proxy)
+			}
+		})
+	}
+}
+
+func TestHealthzDownWhenUpstreamFails(t *testing.T) {
+	useHealthWorker(t, envelopeHandler(200, "PGgxPmhpPC9oMT4="))
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return nil, errors.New("connection refused")
+	})
+
+	code, report := checkHealthz(t)
+	if code != http.StatusServiceUnavailable || report.Status != "down" {
+		t.Errorf("/healthz = %d %q, want 503 down", code, report.Status)
+	}
+}
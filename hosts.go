@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// hostsPollInterval is how often the hosts file is checked for changes
+	hostsPollInterval = 5 * time.Second
+
+	// hostsRecordTTL is the TTL of answers taken from the hosts file
+	hostsRecordTTL = 60
+)
+
+// hostsTable holds the names and addresses read from a hosts file. It is
+// reloaded only when the file's path, size or modification time changes.
+type hostsTable struct {
+	mutex   sync.RWMutex
+	path    string
+	modTime time.Time
+	size    int64
+	names   map[string][]net.IP // FQDN to addresses, in file order
+	addrs   map[string][]string // reverse name to FQDNs, canonical name first
+}
+
+// Global hosts table, empty when HostsFile is "off"
+var hosts = &hostsTable{}
+
+// defaultHostsFile returns the operating system's hosts file
+func defaultHostsFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("SystemRoot"), "System32", "drivers", "etc", "hosts")
+	}
+	return "/etc/hosts"
+}
+
+// Refresh reloads the hosts file at path if it changed since the last load
+// and reports whether it did. A missing file empties the table; any other
+// error keeps the previous entries.
+func (h *hostsTable) Refresh(path string) (bool, error) {
+	if path == "" || path == "off" {
+		return h.swap(path, time.Time{}, 0, nil, nil), nil
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return h.swap(path, time.Time{}, 0, nil, nil), nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error reading hosts file: %v", err)
+	}
+
+	h.mutex.RLock()
+	unchanged := h.path == path && h.modTime.Equal(info.ModTime()) && h.size == info.Size()
+	h.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("error reading hosts file: %v", err)
+	}
+	defer file.Close()
+
+	names, addrs, err := parseHostsFile(file)
+	if err != nil {
+		return false, fmt.Errorf("error reading hosts file: %v", err)
+	}
+	h.swap(path, info.ModTime(), info.Size(), names, addrs)
+	return true, nil
+}
+
+// swap replaces the table under the lock, reporting whether anything changed
+func (h *hostsTable) swap(path string, modTime time.Time, size int64, names map[string][]net.IP, addrs map[string][]string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	changed := h.path != path || !h.modTime.Equal(modTime) || h.size != size || len(h.names) != len(names)
+	h.path, h.modTime, h.size = path, modTime, size
+	h.names, h.addrs = names, addrs
+	return changed
+}
+
+// Len returns the number of names in the table
+func (h *hostsTable) Len() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.names)
+}
+
+// Answer returns the records for an A, AAAA or PTR question found in the
+// hosts file. ok is false when the file doesn't know the name; a known name
+// without an address of the queried family gets no records (NODATA).
+func (h *hostsTable) Answer(q dns.Question) ([]dns.RR, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	name := strings.ToLower(q.Name)
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: hostsRecordTTL}
+	records := []dns.RR{}
+
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		ips, ok := h.names[name]
+		if !ok {
+			return nil, false
+		}
+		for _, ip := range ips {
+			v4 := ip.To4()
+			if q.Qtype == dns.TypeA && v4 != nil {
+				records = append(records, &dns.A{Hdr: hdr, A: v4})
+			} else if q.Qtype == dns.TypeAAAA && v4 == nil {
+				records = append(records, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		return records, true
+	case dns.TypePTR:
+		names, ok := h.addrs[name]
+		if !ok {
+			return nil, false
+		}
+		for _, target := range names {
+			records = append(records, &dns.PTR{Hdr: hdr, Ptr: target})
+		}
+		return records, true
+	}
+	return nil, false
+}
+
+// parseHostsFile reads "address name [alias...]" lines, skipping comments
+// and lines whose address doesn't parse. IPv6 zones ("fe80::1%eth0") are dropped.
+func parseHostsFile(r io.Reader) (map[string][]net.IP, map[string][]string, error) {
+	names := make(map[string][]net.IP)
+	addrs := make(map[string][]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		address, _, _ := strings.Cut(fields[0], "%")
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+
+		for _, field := range fields[1:] {
+			name := dns.Fqdn(strings.ToLower(field))
+			if _, ok := dns.IsDomainName(name); !ok {
+				continue
+			}
+			if !containsIP(names[name], ip) {
+				names[name] = append(names[name], ip)
+			}
+			if !containsString(addrs[reverse], name) {
+				addrs[reverse] = append(addrs[reverse], name)
+			}
+		}
+	}
+	return names, addrs, scanner.Err()
+}
+
+// containsIP reports whether ips holds ip
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, existing := range ips {
+		if existing.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString reports whether list holds s
+func containsString(list []string, s string) bool {
+	for _, existing := range list {
+		if existing == s {
+			return true
+		}
+	}
+	return false
+}
+
+// loadHostsFile refreshes the hosts table from the configured file and logs reloads
+func loadHostsFile() {
+	config := currentConfig()
+	reloaded, err := hosts.Refresh(config.HostsFile)
+	if err != nil {
+		log.Printf("Failed to load hosts file: %v", err)
+		return
+	}
+	if reloaded && config.HostsFile != "off" {
+		log.Printf("Loaded %d names from hosts file %s", hosts.Len(), config.HostsFile)
+	}
+}
+
+// runHostsWatchLoop reloads the hosts file whenever it changes
+func runHostsWatchLoop() {
+	for {
+		time.Sleep(hostsPollInterval)
+		loadHostsFile()
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const sampleHosts = `# Static entries
+127.0.0.1	localhost
+::1		localhost ip6-localhost
+192.0.2.10	nas.lan nas   # the file server
+192.0.2.11	Printer.LAN
+2001:db8::10	nas.lan
+fe80::1%eth0	router.lan
+not-an-ip	broken.lan
+192.0.2.12
+`
+
+// hostsAnswer asks table about name and returns the record data as strings
+func hostsAnswer(table *hostsTable, name string, qtype uint16) ([]string, bool) {
+	records, ok := table.Answer(dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET})
+	var data []string
+	for _, rr := range records {
+		switch rr := rr.(type) {
+		case *dns.A:
+			data = append(data, rr.A.String())
+		case *dns.AAAA:
+			data = append(data, rr.AAAA.String())
+		case *dns.PTR:
+			data = append(data, rr.Ptr)
+		}
+	}
+	return data, ok
+}
+
+// writeHosts writes a hosts file and sets its modification time
+func writeHosts(t *testing.T, path string, content string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostsFileAnswers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	writeHosts(t, path, sampleHosts, time.Now())
+	table := &hostsTable{}
+	if _, err := table.Refresh(path); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  string
+		known bool
+	}{
+		{"localhost.", dns.TypeA, "127.0.0.1", true},
+		{"localhost.", dns.TypeAAAA, "::1", true},
+		{"ip6-localhost.", dns.TypeA, "", true},
+		{"nas.lan.", dns.TypeA, "192.0.2.10", true},
+		{"nas.", dns.TypeA, "192.0.2.10", true},
+		{"NAS.lan.", dns.TypeAAAA, "2001:db8::10", true},
+		{"printer.lan.", dns.TypeA, "192.0.2.11", true},
+		{"router.lan.", dns.TypeAAAA, "fe80::1", true},
+		{"broken.lan.", dns.TypeA, "", false},
+		{"unknown.lan.", dns.TypeA, "", false},
+		{"nas.lan.", dns.TypeMX, "", false},
+		{"10.2.0.192.in-addr.arpa.", dns.TypePTR, "nas.lan. nas.", true},
+		{"1.0.0.127.in-addr.arpa.", dns.TypePTR, "localhost.", true},
+	}
+	for _, tt := range tests {
+		data, known := hostsAnswer(table, tt.name, tt.qtype)
+		if got := strings.Join(data, " "); got != tt.want || known != tt.known {
+			t.Errorf("%s %s = %q (known %v), want %q (known %v)", tt.name, dns.TypeToString[tt.qtype], got, known, tt.want, tt.known)
+		}
+	}
+}
+
+func TestHostsFileReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	modTime := time.Now().Add(-time.Hour)
+	writeHosts(t, path, "192.0.2.10 nas.lan\n", modTime)
+	table := &hostsTable{}
+
+	if reloaded, err := table.Refresh(path); !reloaded || err != nil {
+		t.Fatalf("first Refresh = %v, %v, want a load", reloaded, err)
+	}
+	if reloaded, _ := table.Refresh(path); reloaded {
+		t.Error("unchanged file reloaded")
+	}
+
+	writeHosts(t, path, "192.0.2.20 nas.lan\n192.0.2.21 backup.lan\n", modTime.Add(time.Minute))
+	if reloaded, err := table.Refresh(path); !reloaded || err != nil {
+		t.Fatalf("Refresh after an edit = %v, %v, want a reload", reloaded, err)
+	}
+	if data, _ := hostsAnswer(table, "nas.lan.", dns.TypeA); len(data) != 1 || data[0] != "192.0.2.20" {
+		t.Errorf("nas.lan = %v after the edit, want 192.0.2.20", data)
+	}
+	if table.Len() != 2 {
+		t.Errorf("%d names after the edit, want 2", table.Len())
+	}
+
+	// Removing the file empties the table
+	os.Remove(path)
+	if reloaded, err := table.Refresh(path); !reloaded || err != nil || table.Len() != 0 {
+		t.Errorf("Refresh after removal = %v, %v with %d names, want an empty table", reloaded, err, table.Len())
+	}
+}
+
+func TestHostsFileResolves(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	writeHosts(t, path, sampleHosts, time.Now())
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, HostsFile: path})
+	useMemoryCache(t)
+	upstream := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "192.0.2.80"), nil
+	})
+	old := hosts
+	hosts = &hostsTable{}
+	t.Cleanup(func() { hosts = old })
+	loadHostsFile()
+
+	q := new(dns.Msg)
+	q.SetQuestion("nas.lan.", dns.TypeA)
+	m, decision := resolveWithDecision(q)
+	if decision != "hosts" || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.0.2.10" {
+		t.Errorf("got %v (%s), want 192.0.2.10 from the hosts file", m.Answer, decision)
+	}
+	if len(upstream.Calls()) != 0 {
+		t.Errorf("%d upstream queries for a hosts file name", len(upstream.Calls()))
+	}
+
+	q.SetQuestion("example.com.", dns.TypeA)
+	if _, decision := resolveWithDecision(q); decision != "forwarded" {
+		t.Errorf("name missing from the hosts file decision = %q, want forwarded", decision)
+	}
+
+	// hosts_file "off" ignores it
+	currentConfig().HostsFile = "off"
+	loadHostsFile()
+	q.SetQuestion("nas.lan.", dns.TypeA)
+	if _, decision := resolveWithDecision(q); decision != "forwarded" {
+		t.Errorf("decision with hosts_file off = %q, want forwarded", decision)
+	}
+}
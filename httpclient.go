@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shared HTTP client for worker fetches, so connections (and HTTP/2 streams) are reused
+var (
+	workerClient      *http.Client
+	workerClientMutex sync.Mutex
+)
+
+// newWorkerHTTPClient builds the HTTP client used for worker fetches
+func newWorkerHTTPClient(config *Config) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	// Egress from the configured source address on multi-homed hosts
+	if ip := net.ParseIP(config.UpstreamSourceIP); ip != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	// Route fetches through the configured outbound proxy, if any.
+	// The proxy was validated at startup so errors can't happen here.
+	if proxyURL, err := outboundProxy(config); err == nil && proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	// A custom dialer turns off Go's automatic HTTP/2, so opt back in explicitly.
+	// Cloudflare prefers h2 and it lets concurrent fetches share one connection.
+	if config.DisableWorkerHTTP2 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	} else {
+		transport.ForceAttemptHTTP2 = true
+	}
+
+	return &http.Client{
+		Timeout:       time.Duration(config.WorkerTimeoutSeconds) * time.Second,
+		Transport:     transport,
+		CheckRedirect: limitRedirects(*config.MaxRedirects),
+	}
+}
+
+// outboundProxy returns the configured HTTP or SOCKS5 proxy URL, or nil when none is set
+func outboundProxy(config *Config) (*url.URL, error) {
+	if config.HTTPProxy != "" && config.SOCKS5Proxy != "" {
+		return nil, fmt.Errorf("http_proxy and socks5_proxy can't both be set")
+	}
+
+	if config.HTTPProxy != "" {
+		proxyURL, err := url.Parse(config.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http_proxy %q: %v", config.HTTPProxy, err)
+		}
+		if (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid http_proxy %q: expected http://host:port or https://host:port", config.HTTPProxy)
+		}
+		return proxyURL, nil
+	}
+
+	if config.SOCKS5Proxy != "" {
+		raw := config.SOCKS5Proxy
+		if !strings.Contains(raw, "://") {
+			raw = "socks5://" + raw
+		}
+		proxyURL, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socks5_proxy %q: %v", config.SOCKS5Proxy, err)
+		}
+		if (proxyURL.Scheme != "socks5" && proxyURL.Scheme != "socks5h") || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid socks5_proxy %q: expected host:port or socks5://host:port", config.SOCKS5Proxy)
+		}
+		return proxyURL, nil
+	}
+
+	return nil, nil
+}
+
+// redirectLimitError is returned when a fetch hits the redirect limit or loops
+type redirectLimitError struct {
+	URL  string
+	Loop bool
+	Max  int
+}
+
+func (e *redirectLimitError) Error() string {
+	if e.Loop {
+		return fmt.Sprintf("redirect loop detected at %s", e.URL)
+	}
+	return fmt.Sprintf("stopped after %d redirects at %s", e.Max, e.URL)
+}
+
+// limitRedirects stops following redirects after max hops or when a URL repeats
+func limitRedirects(max int) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			return &redirectLimitError{URL: req.URL.String(), Max: max}
+		}
+		for _, prev := range via {
+			if prev.URL.String() == req.URL.String() {
+				return &redirectLimitError{URL: req.URL.String(), Loop: true}
+			}
+		}
+		return nil
+	}
+}
+
+// getWorkerHTTPClient returns the shared worker HTTP client, creating it on first use
+func getWorkerHTTPClient() *http.Client {
+	workerClientMutex.Lock()
+	defer workerClientMutex.Unlock()
+
+	if workerClient == nil {
+		workerClient = newWorkerHTTPClient(currentConfig())
+	}
+	return workerClient
+}
+
+// resetWorkerHTTPClient drops the shared client so the next fetch picks up new settings
+func resetWorkerHTTPClient() {
+	workerClientMutex.Lock()
+	defer workerClientMutex.Unlock()
+
+	if workerClient != nil {
+		workerClient.CloseIdleConnections()
+		workerClient = nil
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useTLSWorker starts a TLS worker with HTTP/2 enabled and installs a shared
+// worker client, built from the running config, that trusts its certificate
+func useTLSWorker(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	client := newWorkerHTTPClient(currentConfig())
+	client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+
+	workerClientMutex.Lock()
+	workerClient = client
+	workerClientMutex.Unlock()
+	t.Cleanup(resetWorkerHTTPClient)
+	return server
+}
+
+func TestWorkerFetchNegotiatesHTTP2AndMultiplexes(t *testing.T) {
+	useConfig(t, &Config{})
+
+	const fetches = 4
+	var mutex sync.Mutex
+	protocols := make(map[string]bool)
+	remotes := make(map[string]bool)
+	serialized := false
+
+	// Concurrent fetches wait for each other, so they can only all finish
+	// if they are in flight at the same time
+	var arrived sync.WaitGroup
+	arrived.Add(fetches)
+	server := useTLSWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		protocols[r.Proto] = true
+		remotes[r.RemoteAddr] = true
+		wait := r.URL.Query().Get("TARGET") != "https://warmup.test"
+		mutex.Unlock()
+
+		if wait {
+			arrived.Done()
+			done := make(chan struct{})
+			go func() { arrived.Wait(); close(done) }()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				mutex.Lock()
+				serialized = true
+				mutex.Unlock()
+			}
+		}
+		w.Write([]byte("ok"))
+	})
+
+	// Open the connection first so the concurrent fetches have one to share
+	if _, err := fetchFromWorkerWithOptions("https://warmup.test", workerFetchOptions{WorkerURL: server.URL}); err != nil {
+		t.Fatalf("warmup fetch: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, fetches)
+	for i := 0; i < fetches; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := fetchFromWorkerWithOptions("https://example.com", workerFetchOptions{WorkerURL: server.URL}); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent fetch: %v", err)
+	}
+
+	if serialized {
+		t.Error("fetches did not overlap, want them in flight together")
+	}
+	if len(protocols) != 1 || !protocols["HTTP/2.0"] {
+		t.Errorf("protocols = %v, want only HTTP/2.0", protocols)
+	}
+	if len(remotes) != 1 {
+		t.Errorf("fetches used %d connections, want them multiplexed over 1", len(remotes))
+	}
+}
+
+func TestWorkerFetchHTTP2Disabled(t *testing.T) {
+	useConfig(t, &Config{DisableWorkerHTTP2: true})
+	var proto string
+	server := useTLSWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+		w.Write([]byte("ok"))
+	})
+
+	if _, err := fetchFromWorkerWithOptions("https://example.com", workerFetchOptions{WorkerURL: server.URL}); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if proto != "HTTP/1.1" {
+		t.Errorf("protocol = %q, want HTTP/1.1 with disable_worker_http2", proto)
+	}
+}
+
+// redirectingWorker starts a worker that answers /hop/N with a redirect chosen by next
+func redirectingWorker(t *testing.T, next func(hop int) int) (*httptest.Server, *[]*http.Request) {
+	t.Helper()
+	return workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hop := 0
+		fmt.Sscanf(r.URL.Path, "/hop/%d", &hop)
+		http.Redirect(w, r, fmt.Sprintf("/hop/%d?%s", next(hop), r.URL.RawQuery), http.StatusFound)
+	})
+}
+
+func TestWorkerFetchStopsAtRedirectLimit(t *testing.T) {
+	redirects := 3
+	useConfig(t, &Config{MaxRedirects: &redirects})
+	server, requests := redirectingWorker(t, func(hop int) int { return hop + 1 })
+
+	_, err := fetchFromWorkerWithOptions("https://example.com", workerFetchOptions{WorkerURL: server.URL + "/hop/0"})
+	if err == nil || !strings.Contains(err.Error(), "stopped after 3 redirects") {
+		t.Fatalf("err = %v, want the redirect limit error", err)
+	}
+
+	// The first request plus 3 redirects, and no retries
+	if len(*requests) != 4 {
+		t.Errorf("worker saw %d requests, want 4", len(*requests))
+	}
+}
+
+func TestWorkerFetchDetectsRedirectLoop(t *testing.T) {
+	useConfig(t, &Config{})
+	server, requests := redirectingWorker(t, func(hop int) int { return 1 - hop })
+
+	_, err := fetchFromWorkerWithOptions("https://example.com", workerFetchOptions{WorkerURL: server.URL + "/hop/0"})
+	if err == nil || !strings.Contains(err.Error(), "redirect loop detected") {
+		t.Fatalf("err = %v, want a redirect loop error", err)
+	}
+	if len(*requests) != 2 {
+		t.Errorf("worker saw %d requests, want 2 with no retries", len(*requests))
+	}
+}
+
+func TestWorkerFetchZeroMaxRedirectsFollowsNone(t *testing.T) {
+	redirects := 0
+	config := useConfig(t, &Config{MaxRedirects: &redirects})
+	if *config.MaxRedirects != 0 {
+		t.Fatalf("max_redirects = %d after defaults, want 0 kept", *config.MaxRedirects)
+	}
+	server, requests := redirectingWorker(t, func(hop int) int { return hop + 1 })
+
+	if _, err := fetchFromWorkerWithOptions("https://example.com", workerFetchOptions{WorkerURL: server.URL + "/hop/0"}); err == nil {
+		t.Fatal("redirected fetch succeeded, want an error with redirects disabled")
+	}
+	if len(*requests) != 1 {
+		t.Errorf("worker saw %d requests, want 1", len(*requests))
+	}
+}
+
+func TestMaxRedirectsDefault(t *testing.T) {
+	config := &Config{}
+	applyConfigDefaults(config)
+	if config.MaxRedirects == nil || *config.MaxRedirects != 5 {
+		t.Errorf("max_redirects = %v, want the default of 5", config.MaxRedirects)
+	}
+}
+
+// httpProxy starts a forward proxy that records the absolute URLs it is asked
+// for and answers them with handler instead of contacting the origin
+func httpProxy(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *[]string) {
+	t.Helper()
+	var mutex sync.Mutex
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requested = append(requested, r.URL.Scheme+"://"+r.URL.Host+r.URL.Path)
+		mutex.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requested
+}
+
+// socks5Proxy starts a minimal SOCKS5 proxy without authentication that
+// connects to the requested address and counts the connections it relayed
+func socks5Proxy(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var relayed atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				// Greeting: version, method count, methods; accept "no auth"
+				greeting := make([]byte, 2)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				io.CopyN(io.Discard, conn, int64(greeting[1]))
+				conn.Write([]byte{5, 0})
+
+				// Request: version, CONNECT, reserved, address type, address, port
+				header := make([]byte, 4)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				var host string
+				switch header[3] {
+				case 1:
+					ip := make([]byte, 4)
+					io.ReadFull(conn, ip)
+					host = net.IP(ip).String()
+				case 3:
+					length := make([]byte, 1)
+					io.ReadFull(conn, length)
+					name := make([]byte, length[0])
+					io.ReadFull(conn, name)
+					host = string(name)
+				default:
+					return
+				}
+				port := make([]byte, 2)
+				io.ReadFull(conn, port)
+
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))))
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				relayed.Add(1)
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return listener.Addr().String(), &relayed
+}
+
+func TestWorkerFetchThroughHTTPProxy(t *testing.T) {
+	proxy, requested := httpProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("via proxy"))
+	})
+	useConfig(t, &Config{HTTPProxy: proxy.URL})
+
+	body, err := fetchFromWorkerWithOptions("https://example.com", workerFetchOptions{WorkerURL: "http://worker.invalid/"})
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if string(body) != "via proxy" {
+		t.Errorf("body = %q, want the proxy's answer", body)
+	}
+	if len(*requested) != 1 || (*requested)[0] != "http://worker.invalid/" {
+		t.Errorf("proxy was asked for %v, want the worker URL", *requested)
+	}
+}
+
+func TestWorkerFetchThroughSOCKS5Proxy(t *testing.T) {
+	proxyAddr, relayed := socks5Proxy(t)
+	useConfig(t, &Config{SOCKS5Proxy: proxyAddr})
+	server, requests := workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	if _, err := fetchFromWorkerWithOptions("https://example.com", workerFetchOptions{WorkerURL: server.URL}); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if relayed.Load() != 1 || len(*requests) != 1 {
+		t.Errorf("proxy relayed %d connections and the worker saw %d requests, want 1 each", relayed.Load(), len(*requests))
+	}
+}
+
+func TestDoHThroughHTTPProxy(t *testing.T) {
+	proxy, requested := httpProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		q := new(dns.Msg)
+		if err := q.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		packed, _ := replyWithA(q, "203.0.113.5").Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(packed)
+	})
+	useConfig(t, &Config{HTTPProxy: proxy.URL, DoHUpstream: "http://doh.invalid/dns-query"})
+
+	r, err := exchangeDoH(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, false)
+	if err != nil {
+		t.Fatalf("exchangeDoH: %v", err)
+	}
+	if len(r.Answer) != 1 {
+		t.Errorf("got %d answers, want 1", len(r.Answer))
+	}
+	if len(*requested) != 1 || (*requested)[0] != "http://doh.invalid/dns-query" {
+		t.Errorf("proxy was asked for %v, want the DoH endpoint", *requested)
+	}
+}
+
+func TestOutboundProxyValidation(t *testing.T) {
+	valid := []*Config{
+		{},
+		{HTTPProxy: "http://proxy.example:3128"},
+		{HTTPProxy: "https://proxy.example:3129"},
+		{SOCKS5Proxy: "127.0.0.1:1080"},
+		{SOCKS5Proxy: "socks5h://proxy.example:1080"},
+	}
+	for _, config := range valid {
+		if _, err := outboundProxy(config); err != nil {
+			t.Errorf("outboundProxy(%q, %q) = %v, want nil", config.HTTPProxy, config.SOCKS5Proxy, err)
+		}
+	}
+
+	invalid := []*Config{
+		{HTTPProxy: "http://proxy.example:3128", SOCKS5Proxy: "127.0.0.1:1080"},
+		{HTTPProxy: "ftp://proxy.example"},
+		{HTTPProxy: "proxy.example:3128"},
+		{SOCKS5Proxy: "http://proxy.example:1080"},
+	}
+	for _, config := range invalid {
+		if _, err := outboundProxy(config); err == nil {
+			t.Errorf("outboundProxy(%q, %q) accepted, want an error", config.HTTPProxy, config.SOCKS5Proxy)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// inflightLimiter caps how many queries are being handled at once
+type inflightLimiter struct {
+	slots chan struct{}
+}
+
+// newInflightLimiter creates a limiter for the configured cap, or nil when disabled
+func newInflightLimiter(config *Config) *inflightLimiter {
+	if config.MaxInflightQueries <= 0 {
+		return nil
+	}
+	return &inflightLimiter{slots: make(chan struct{}, config.MaxInflightQueries)}
+}
+
+// TryAcquire takes a slot without waiting, reporting false when all are in use.
+// A nil limiter always succeeds.
+func (l *inflightLimiter) TryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release returns a slot taken by TryAcquire
+func (l *inflightLimiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// Size returns the configured cap, 0 for a nil limiter
+func (l *inflightLimiter) Size() int {
+	if l == nil {
+		return 0
+	}
+	return cap(l.slots)
+}
+
+// handleInflightSaturated answers a query turned away because the server is at its cap
+func handleInflightSaturated(w dns.ResponseWriter, r *dns.Msg) {
+	config := currentConfig()
+	inflightRejected.Inc(config.InflightAction)
+	if config.InflightAction == "drop" {
+		return
+	}
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+	w.WriteMsg(m)
+}
+
+// In-flight limiting metrics
+var inflightRejected = newCounterVec(
+	"phantomdns_inflight_rejected_total",
+	"Queries turned away because MaxInflightQueries were already being handled, by configured action.",
+	"action",
+)
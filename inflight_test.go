@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useSlowUpstream makes upstream queries for slow*.example. block until
+// release is closed, reporting each one on entered
+func useSlowUpstream(t *testing.T) (entered chan string, release chan struct{}) {
+	t.Helper()
+	entered = make(chan string, 16)
+	release = make(chan struct{})
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		if name := m.Question[0].Name; name != "fast.example." {
+			entered <- name
+			<-release
+		}
+		return replyWithA(m, "192.0.2.53"), nil
+	})
+	return entered, release
+}
+
+// queryName sends an A query for name through the handler and returns the
+// replies written
+func queryName(name string) []*dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	w := newFakeResponseWriter("127.0.0.1")
+	handleDNSRequest(w, q)
+	return w.replies
+}
+
+func TestMaxInflightQueries(t *testing.T) {
+	for _, action := range []string{"refused", "drop"} {
+		t.Run(action, func(t *testing.T) {
+			useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, HostsFile: "off", MaxInflightQueries: 2, InflightAction: action})
+			useMemoryCache(t)
+			useServerReady(t)
+			entered, release := useSlowUpstream(t)
+			rejected := inflightRejected.Value(action)
+
+			// Fill every slot with a query stuck on the upstream
+			var wg sync.WaitGroup
+			slow := make([][]*dns.Msg, 2)
+			for i := range slow {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					slow[i] = queryName(fmt.Sprintf("slow%d.example.", i))
+				}(i)
+			}
+			for range slow {
+				select {
+				case <-entered:
+				case <-time.After(2 * time.Second):
+					t.Fatal("slow queries never reached the upstream")
+				}
+			}
+
+			// Everything past the cap is turned away without waiting
+			for i := 0; i < 3; i++ {
+				replies := queryName("fast.example.")
+				switch {
+				case action == "refused" && (len(replies) != 1 || replies[0].Rcode != dns.RcodeRefused):
+					t.Errorf("query over the cap got %v, want REFUSED", replies)
+				case action == "drop" && len(replies) != 0:
+					t.Errorf("query over the cap got %v, want it dropped", replies)
+				}
+			}
+			if got := inflightRejected.Value(action); got != rejected+3 {
+				t.Errorf("phantomdns_inflight_rejected_total{action=%q} = %v, want %v", action, got, rejected+3)
+			}
+
+			// The held queries finish normally and free their slots
+			close(release)
+			wg.Wait()
+			for i, replies := range slow {
+				if len(replies) != 1 || len(replies[0].Answer) != 1 {
+					t.Errorf("slow query %d got %v, want its answer", i, replies)
+				}
+			}
+			if replies := queryName("fast.example."); len(replies) != 1 || len(replies[0].Answer) != 1 {
+				t.Errorf("query after the slots freed got %v, want its answer", replies)
+			}
+		})
+	}
+}
+
+func TestMaxInflightQueriesUnlimited(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, HostsFile: "off"})
+	useMemoryCache(t)
+	useServerReady(t)
+	entered, release := useSlowUpstream(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			queryName(fmt.Sprintf("slow%d.example.", i))
+		}(i)
+	}
+wait:
+	for i := 0; i < 8; i++ {
+		select {
+		case <-entered:
+		case <-time.After(2 * time.Second):
+			t.Errorf("only %d of 8 queries handled at once without a cap", i)
+			break wait
+		}
+	}
+	close(release)
+	wg.Wait()
+}
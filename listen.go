@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+// activatedServers builds DNS servers for sockets handed over through systemd
+// socket activation (LISTEN_PID/LISTEN_FDS), or returns nil when there are none
+func activatedServers() ([]*dns.Server, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	// The sockets belong to us now, don't pass them on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	servers := []*dns.Server{}
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		server, err := serverFromFD(uintptr(fd))
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+
+	return servers, nil
+}
+
+// serverFromFD wraps an already-bound UDP or TCP socket in a DNS server
+func serverFromFD(fd uintptr) (*dns.Server, error) {
+	file := os.NewFile(fd, fmt.Sprintf("listen-fd-%d", fd))
+	if file == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer file.Close()
+
+	if conn, err := net.FilePacketConn(file); err == nil {
+		return &dns.Server{PacketConn: conn, Net: "udp"}, nil
+	}
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor %d is neither a UDP nor a TCP socket: %v", fd, err)
+	}
+	return &dns.Server{Listener: listener, Net: "tcp"}, nil
+}
+
+// newListenServers creates a UDP and a TCP server for every listen address.
+// With port 0 each address gets a free port, pre-bound so UDP and TCP share it.
+func newListenServers(addrs []string, port int) ([]*dns.Server, error) {
+	servers := make([]*dns.Server, 0, len(addrs)*2)
+	for _, addr := range addrs {
+		if port == 0 {
+			conn, listener, err := bindFreePort(addr)
+			if err != nil {
+				return nil, err
+			}
+			servers = append(servers,
+				&dns.Server{PacketConn: conn, Net: "udp"},
+				&dns.Server{Listener: listener, Net: "tcp"},
+			)
+			continue
+		}
+
+		hostPort := net.JoinHostPort(addr, strconv.Itoa(port))
+		for _, network := range []string{"udp", "tcp"} {
+			servers = append(servers, &dns.Server{Addr: hostPort, Net: network})
+		}
+	}
+	return servers, nil
+}
+
+// bindFreePort binds UDP to a port picked by the kernel and TCP to the same
+// port, trying again if that port is already taken for TCP
+func bindFreePort(addr string) (net.PacketConn, net.Listener, error) {
+	var lastErr error
+	for attempt := 0; attempt < 10; attempt++ {
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(addr, "0"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error binding a free UDP port on %s: %v", addr, err)
+		}
+
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		listener, err := net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
+		if err == nil {
+			return conn, listener, nil
+		}
+		conn.Close()
+		lastErr = err
+	}
+	return nil, nil, fmt.Errorf("error binding a free port for UDP and TCP on %s: %v", addr, lastErr)
+}
+
+// boundAddr returns the address a started server is actually listening on,
+// which differs from its configured address when a free port was picked
+func boundAddr(server *dns.Server) net.Addr {
+	if server.PacketConn != nil {
+		return server.PacketConn.LocalAddr()
+	}
+	if server.Listener != nil {
+		return server.Listener.Addr()
+	}
+	return nil
+}
+
+// serveDNS starts a server on its pre-bound socket or by binding its address
+func serveDNS(server *dns.Server) error {
+	if server.PacketConn != nil || server.Listener != nil {
+		return server.ActivateAndServe()
+	}
+	return server.ListenAndServe()
+}
+
+// serveDNSWithRetry starts a server, retrying with backoff while its address is
+// still in use (e.g. during a restart); other errors are returned immediately
+func serveDNSWithRetry(server *dns.Server, attempts int) error {
+	policy := retryPolicy{
+		Attempts:  attempts,
+		BaseDelay: 500 * time.Millisecond,
+		MaxDelay:  10 * time.Second,
+	}
+
+	return withRetry(policy, func(attempt int) (bool, error) {
+		err := serveDNS(server)
+		if err != nil && errors.Is(err, syscall.EADDRINUSE) {
+			log.Printf("Address %s in use (attempt %d/%d), retrying...", server.Addr, attempt+1, attempts)
+			return true, err
+		}
+		return false, err
+	})
+}
+
+// bindErrorHint turns a permission-denied bind into an actionable message
+func bindErrorHint(err error, port int) error {
+	if !errors.Is(err, syscall.EACCES) && !errors.Is(err, os.ErrPermission) {
+		return err
+	}
+
+	return fmt.Errorf("%v\n"+
+		"Binding port %d requires elevated privileges. Either:\n"+
+		"  - set dns_port in config.json to a port above 1024 (e.g. 5355)\n"+
+		"  - grant the binary the capability: sudo setcap 'cap_net_bind_service=+ep' ./phantomdns\n"+
+		"  - run PhantomDNS with sudo\n"+
+		"  - start it through systemd socket activation", err, port)
+}
@@ -0,0 +1,283 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// handOver duplicates the descriptor of file and closes file, leaving the
+// copy to be owned by serverFromFD like a socket passed by systemd
+func handOver(t *testing.T, file *os.File) uintptr {
+	t.Helper()
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		t.Fatalf("dup: %v", err)
+	}
+	file.Close()
+	return uintptr(fd)
+}
+
+// serveFromFD starts a DNS server on a handed over copy of the socket,
+// answering every query with an A record
+func serveFromFD(t *testing.T, file *os.File) *dns.Server {
+	t.Helper()
+	server, err := serverFromFD(handOver(t, file))
+	if err != nil {
+		t.Fatalf("serverFromFD: %v", err)
+	}
+	server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(replyWithA(r, "192.0.2.53"))
+	})
+
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return server
+}
+
+// queryServer sends an A query for example.com to addr over network
+func queryServer(t *testing.T, network string, addr net.Addr) {
+	t.Helper()
+	client := &dns.Client{Net: network}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r, _, err := client.Exchange(q, addr.String())
+	if err != nil {
+		t.Fatalf("%s query: %v", network, err)
+	}
+	if len(r.Answer) != 1 {
+		t.Fatalf("%s query got %d answers, want 1", network, len(r.Answer))
+	}
+}
+
+func TestServerFromFDUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	file, err := conn.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := serveFromFD(t, file)
+	if server.Net != "udp" {
+		t.Errorf("Net = %q, want udp", server.Net)
+	}
+	if got := boundAddr(server).String(); got != conn.LocalAddr().String() {
+		t.Errorf("bound address = %s, want the passed socket's %s", got, conn.LocalAddr())
+	}
+	queryServer(t, "udp", conn.LocalAddr())
+}
+
+func TestServerFromFDTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := serveFromFD(t, file)
+	if server.Net != "tcp" {
+		t.Errorf("Net = %q, want tcp", server.Net)
+	}
+	queryServer(t, "tcp", listener.Addr())
+}
+
+func TestServerFromFDRejectsOtherFiles(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "not-a-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serverFromFD(handOver(t, file)); err == nil {
+		t.Error("regular file accepted as a listen socket")
+	}
+}
+
+func TestActivatedServersIgnoresOtherProcesses(t *testing.T) {
+	t.Setenv("LISTEN_PID", fmt.Sprint(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+
+	servers, err := activatedServers()
+	if err != nil || servers != nil {
+		t.Errorf("activatedServers() = %v, %v, want none for another process's sockets", servers, err)
+	}
+}
+
+func TestBindErrorHint(t *testing.T) {
+	denied := &net.OpError{Op: "listen", Net: "udp", Err: os.NewSyscallError("bind", syscall.EACCES)}
+	err := bindErrorHint(denied, 53)
+	if !strings.Contains(err.Error(), "Binding port 53 requires elevated privileges") || !strings.Contains(err.Error(), "setcap") {
+		t.Errorf("permission error hint = %q, want the privilege suggestions", err)
+	}
+
+	other := errors.New("address already in use")
+	if got := bindErrorHint(other, 53); got != other {
+		t.Errorf("other errors changed to %q, want them returned as is", got)
+	}
+}
+
+func TestNewListenServersPerAddress(t *testing.T) {
+	servers, err := newListenServers([]string{"127.0.0.1", "192.0.2.10"}, 5353)
+	if err != nil {
+		t.Fatalf("newListenServers: %v", err)
+	}
+
+	var got []string
+	for _, server := range servers {
+		got = append(got, server.Net+" "+server.Addr)
+	}
+	want := []string{"udp 127.0.0.1:5353", "tcp 127.0.0.1:5353", "udp 192.0.2.10:5353", "tcp 192.0.2.10:5353"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("servers = %v, want %v", got, want)
+	}
+}
+
+func TestNewListenServersFreePortShared(t *testing.T) {
+	servers, err := newListenServers([]string{"127.0.0.1"}, 0)
+	if err != nil {
+		t.Fatalf("newListenServers: %v", err)
+	}
+	t.Cleanup(func() {
+		servers[0].PacketConn.Close()
+		servers[1].Listener.Close()
+	})
+
+	if len(servers) != 2 || servers[0].Net != "udp" || servers[1].Net != "tcp" {
+		t.Fatalf("got %d servers, want one UDP and one TCP", len(servers))
+	}
+	udp := boundAddr(servers[0]).(*net.UDPAddr)
+	tcp := boundAddr(servers[1]).(*net.TCPAddr)
+	if udp.Port == 0 || udp.Port != tcp.Port {
+		t.Errorf("UDP port %d and TCP port %d, want the same free port", udp.Port, tcp.Port)
+	}
+}
+
+// occupyUDPPort binds a free UDP port and returns the socket holding it
+func occupyUDPPort(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestServeDNSWithRetryWaitsForPort(t *testing.T) {
+	occupied := occupyUDPPort(t)
+	server := &dns.Server{Addr: occupied.LocalAddr().String(), Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(replyWithA(r, "192.0.2.53"))
+	})}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+
+	result := make(chan error, 1)
+	go func() { result <- serveDNSWithRetry(server, 5) }()
+
+	// Free the port after the first attempt has failed
+	time.Sleep(100 * time.Millisecond)
+	occupied.Close()
+
+	select {
+	case <-started:
+	case err := <-result:
+		t.Fatalf("serveDNSWithRetry gave up: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't start once the port was free")
+	}
+	defer server.Shutdown()
+	queryServer(t, "udp", occupied.LocalAddr())
+}
+
+func TestServeDNSWithRetryGivesUp(t *testing.T) {
+	occupied := occupyUDPPort(t)
+	server := &dns.Server{Addr: occupied.LocalAddr().String(), Net: "udp"}
+
+	err := serveDNSWithRetry(server, 2)
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("err = %v, want address in use after the last attempt", err)
+	}
+}
+
+func TestServeDNSWithRetryFailsFastOnOtherErrors(t *testing.T) {
+	server := &dns.Server{Addr: "192.0.2.1:0", Net: "udp"}
+
+	start := time.Now()
+	err := serveDNSWithRetry(server, 5)
+	if err == nil || errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("err = %v, want the bind error for a non-local address", err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("gave up after %v, want no retries", elapsed)
+	}
+}
+
+func TestFreePortServesQueries(t *testing.T) {
+	free := 0
+	useConfig(t, &Config{DNSPort: &free, Nameservers: []string{"192.0.2.1"}, HostsFile: "off"})
+	useMemoryCache(t)
+	useServerReady(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "192.0.2.53"), nil
+	})
+
+	servers, err := newListenServers([]string{"127.0.0.1"}, *currentConfig().DNSPort)
+	if err != nil {
+		t.Fatalf("newListenServers: %v", err)
+	}
+	for _, server := range servers {
+		server.Handler = dns.HandlerFunc(handleDNSRequest)
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go serveDNS(server)
+		<-started
+		t.Cleanup(func() { server.Shutdown() })
+	}
+
+	// The port the kernel picked is discovered from the running servers
+	for _, server := range servers {
+		addr := boundAddr(server)
+		if _, port, _ := net.SplitHostPort(addr.String()); port == "0" || port == "53" {
+			t.Fatalf("%s server reports port %s, want a picked free port", server.Net, port)
+		}
+		queryServer(t, server.Net, addr)
+	}
+}
+
+func TestDNSPortDefaults(t *testing.T) {
+	free, custom, negative := 0, 5353, -1
+	tests := []struct {
+		configured *int
+		want       int
+	}{
+		{nil, 53},
+		{&free, 0},
+		{&custom, 5353},
+		{&negative, 53},
+	}
+	for _, tt := range tests {
+		c := &Config{DNSPort: tt.configured}
+		applyConfigDefaults(c)
+		if *c.DNSPort != tt.want {
+			t.Errorf("dns_port %v became %d, want %d", tt.configured, *c.DNSPort, tt.want)
+		}
+	}
+}
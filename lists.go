@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+)
+
+// domainMatcher matches query names against a set of domains. Match returns
+// the domain entry that matched so callers can report or synthesize for it.
+type domainMatcher interface {
+	Match(domain string) (string, bool)
+	Len() int
+}
+
+// suffixList matches the domains listed in the config file by suffix
+type suffixList []string
+
+// Match returns the first listed domain that the name is or falls under.
+// Names are compared case-insensitively on label boundaries, so example.com
+// matches www.example.com but not evilexample.com.
+func (l suffixList) Match(domain string) (string, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, d := range l {
+		d = strings.ToLower(strings.Trim(d, "."))
+		if d != "" && (domain == d || strings.HasSuffix(domain, "."+d)) {
+			return d, true
+		}
+	}
+	return "", false
+}
+
+// Len returns the number of listed domains
+func (l suffixList) Len() int {
+	return len(l)
+}
+
+// domainSet matches a name or any of its parent domains against a set, which
+// keeps lookups fast for large lists loaded from a database
+type domainSet map[string]bool
+
+// newDomainSet builds a set from domain names, normalized to lowercase without the trailing dot
+func newDomainSet(domains []string) domainSet {
+	set := make(domainSet, len(domains))
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), "."))
+		if d != "" {
+			set[d] = true
+		}
+	}
+	return set
+}
+
+// Match walks from the full name up through its parents and returns the first one in the set
+func (s domainSet) Match(domain string) (string, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for domain != "" {
+		if s[domain] {
+			return domain, true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return "", false
+}
+
+// Len returns the number of domains in the set
+func (s domainSet) Len() int {
+	return len(s)
+}
+
+// matchAny returns the first match from a list of matchers
+func matchAny(domain string, matchers ...domainMatcher) (string, bool) {
+	for _, m := range matchers {
+		if m == nil {
+			continue
+		}
+		if match, ok := m.Match(domain); ok {
+			return match, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxListArchiveBytes caps the size of a list archive and of each file inside it
+const maxListArchiveBytes = 64 << 20
+
+// listArchive holds the blocked and proxied domains loaded from a list bundle.
+// Files inside the archive are assigned by name: anything under a path starting
+// with "block" is a blocklist, "proxy" a proxy list (e.g. blocked/ads.txt,
+// proxied.txt). Each file has one domain per line, hosts-file lines are accepted.
+type listArchive struct {
+	mutex   sync.RWMutex
+	blocked domainSet
+	proxied domainSet
+	files   []listFile
+}
+
+// listFile records a list file loaded from an archive
+type listFile struct {
+	Name  string
+	Kind  string // "blocked" or "proxied"
+	Count int
+}
+
+// Global archive-backed list source, empty when ListArchive is unset
+var listBundle = &listArchive{}
+
+// Refresh reloads the archive named in the config, replacing both lists at
+// once. The old lists are kept if the archive can't be fetched or verified.
+func (a *listArchive) Refresh() error {
+	config := currentConfig()
+	if config.ListArchive == "" {
+		a.swap(domainSet{}, domainSet{}, nil)
+		return nil
+	}
+
+	data, err := readListSource(config.ListArchive)
+	if err != nil {
+		return err
+	}
+
+	checksum := config.ListArchiveSHA256
+	if checksum == "" && isRemoteListSource(config.ListArchive) {
+		// Remote archives must be verified, fall back to a published checksum file
+		sidecar, err := readListSource(config.ListArchive + ".sha256")
+		if err != nil {
+			return fmt.Errorf("remote list archive needs list_archive_sha256 or a .sha256 file: %v", err)
+		}
+		checksum = firstField(string(sidecar))
+	}
+	if checksum != "" {
+		if err := verifyListChecksum(data, checksum); err != nil {
+			return err
+		}
+	}
+
+	blocked, proxied, files, err := extractListArchive(data)
+	if err != nil {
+		return err
+	}
+	a.swap(newDomainSet(blocked), newDomainSet(proxied), files)
+	return nil
+}
+
+// swap replaces both lists under the lock
+func (a *listArchive) swap(blocked domainSet, proxied domainSet, files []listFile) {
+	a.mutex.Lock()
+	a.blocked = blocked
+	a.proxied = proxied
+	a.files = files
+	a.mutex.Unlock()
+}
+
+// Files returns the list files loaded from the archive
+func (a *listArchive) Files() []listFile {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.files
+}
+
+// Blocked returns the current blocked domain matcher
+func (a *listArchive) Blocked() domainMatcher {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.blocked
+}
+
+// Proxied returns the current proxied domain matcher
+func (a *listArchive) Proxied() domainMatcher {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.proxied
+}
+
+// isRemoteListSource reports whether a list source is an http(s) URL
+func isRemoteListSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// readListSource reads a local file or downloads an http(s) URL
+func readListSource(source string) ([]byte, error) {
+	if !isRemoteListSource(source) {
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return nil, fmt.Errorf("error reading list archive: %v", err)
+		}
+		return data, nil
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s: %v", source, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch of %s returned status %d", source, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxListArchiveBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", source, err)
+	}
+	if len(data) > maxListArchiveBytes {
+		return nil, fmt.Errorf("%s exceeds the %d byte limit", source, maxListArchiveBytes)
+	}
+	return data, nil
+}
+
+// verifyListChecksum compares the SHA-256 of data with a hex checksum, optionally prefixed "sha256:"
+func verifyListChecksum(data []byte, checksum string) error {
+	want := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(checksum), "sha256:"))
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return fmt.Errorf("list archive checksum mismatch: got %s, want %s", got, want)
+	}
+	return nil
+}
+
+// extractListArchive reads every list file from a tar.gz or zip archive,
+// returning the blocked and proxied domains and the files they came from
+func extractListArchive(data []byte) ([]string, []string, []listFile, error) {
+	blocked, proxied, files := []string{}, []string{}, []listFile{}
+	add := func(name string, r io.Reader) error {
+		domains, err := parseListFile(io.LimitReader(r, maxListArchiveBytes))
+		if err != nil {
+			return fmt.Errorf("error reading %s from list archive: %v", name, err)
+		}
+		files = append(files, listFile{Name: name, Kind: listKind(name), Count: len(domains)})
+		switch listKind(name) {
+		case "blocked":
+			blocked = append(blocked, domains...)
+		case "proxied":
+			proxied = append(proxied, domains...)
+		}
+		return nil
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error opening list archive: %v", err)
+		}
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("error reading list archive: %v", err)
+			}
+			if hdr.Typeflag != tar.TypeReg || listKind(hdr.Name) == "" {
+				continue
+			}
+			if err := add(hdr.Name, tr); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error opening list archive: %v", err)
+		}
+		for _, file := range zr.File {
+			if file.FileInfo().IsDir() || listKind(file.Name) == "" {
+				continue
+			}
+			rc, err := file.Open()
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("error reading %s from list archive: %v", file.Name, err)
+			}
+			err = add(file.Name, rc)
+			rc.Close()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	default:
+		return nil, nil, nil, fmt.Errorf("list archive is neither tar.gz nor zip")
+	}
+
+	return blocked, proxied, files, nil
+}
+
+// listKind returns "blocked" or "proxied" for a file path inside an archive,
+// or "" for files that aren't lists
+func listKind(name string) string {
+	for _, part := range strings.Split(strings.ToLower(path.Clean(name)), "/") {
+		switch {
+		case strings.HasPrefix(part, "block"):
+			return "blocked"
+		case strings.HasPrefix(part, "proxy"), strings.HasPrefix(part, "proxied"):
+			return "proxied"
+		}
+	}
+	return ""
+}
+
+// parseListFile reads domains one per line, skipping comments. Hosts-file
+// lines ("0.0.0.0 ads.example.com") contribute every name after the address.
+func parseListFile(r io.Reader) ([]string, error) {
+	domains := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		domains = append(domains, fields...)
+	}
+	return domains, scanner.Err()
+}
+
+// firstField returns the first whitespace-separated field, as in "<hash>  <file>" checksum files
+func firstField(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sampleListFiles is a bundle with a blocklist directory, a proxy list and a README
+var sampleListFiles = []struct{ name, body string }{
+	{"blocked/ads.txt", "# ad servers\nads.example\n0.0.0.0 tracker.example metrics.example\n"},
+	{"blocked/malware.txt", "malware.example\n"},
+	{"proxied.txt", "news.example\n\nvideo.example # streaming\n"},
+	{"README.md", "not.a.list\n"},
+}
+
+// useListBundle empties the archive lists and restores them after the test
+func useListBundle(t *testing.T) {
+	t.Helper()
+	listBundle.swap(domainSet{}, domainSet{}, nil)
+	t.Cleanup(func() { listBundle.swap(domainSet{}, domainSet{}, nil) })
+}
+
+func tarGzListArchive(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "blocked/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, file := range sampleListFiles {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(file.body))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(file.body))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+func zipListArchive(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, file := range sampleListFiles {
+		w, err := zw.Create(file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(file.body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkSampleLists asserts the sample bundle's domains are blocked and proxied
+func checkSampleLists(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{"ads.example.", "cdn.tracker.example.", "metrics.example.", "malware.example."} {
+		if _, ok := blockedZone(name); !ok {
+			t.Errorf("%s not blocked", name)
+		}
+	}
+	for _, name := range []string{"news.example", "www.video.example"} {
+		if !isProxyDomain(name) {
+			t.Errorf("%s not proxied", name)
+		}
+	}
+	if _, ok := blockedZone("not.a.list."); ok || isProxyDomain("not.a.list") {
+		t.Error("README contents loaded as a list")
+	}
+	if files := listBundle.Files(); len(files) != 3 {
+		t.Errorf("loaded files %+v, want the three list files", files)
+	}
+}
+
+func TestListArchiveLocal(t *testing.T) {
+	for _, format := range []struct {
+		name string
+		data func(t *testing.T) []byte
+	}{
+		{"lists.tar.gz", tarGzListArchive},
+		{"lists.zip", zipListArchive},
+	} {
+		t.Run(format.name, func(t *testing.T) {
+			data := format.data(t)
+			path := filepath.Join(t.TempDir(), format.name)
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			useConfig(t, &Config{ListArchive: path, ListArchiveSHA256: "sha256:" + sha256Hex(data)})
+			useListBundle(t)
+
+			if err := listBundle.Refresh(); err != nil {
+				t.Fatalf("Refresh: %v", err)
+			}
+			checkSampleLists(t)
+		})
+	}
+}
+
+func TestListArchiveBadChecksumKeepsLists(t *testing.T) {
+	data := tarGzListArchive(t)
+	path := filepath.Join(t.TempDir(), "lists.tar.gz")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := useConfig(t, &Config{ListArchive: path})
+	useListBundle(t)
+	if err := listBundle.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	config.ListArchiveSHA256 = sha256Hex([]byte("something else"))
+	if err := listBundle.Refresh(); err == nil {
+		t.Fatal("archive with a wrong checksum accepted")
+	}
+	checkSampleLists(t)
+}
+
+func TestListArchiveRemoteSidecarChecksum(t *testing.T) {
+	data := zipListArchive(t)
+	checksum := sha256Hex(data)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/lists.zip", "/unsigned.zip":
+			w.Write(data)
+		case "/lists.zip.sha256":
+			w.Write([]byte(checksum + "  lists.zip\n"))
+		case "/tampered.zip":
+			w.Write(append(data, 0))
+		case "/tampered.zip.sha256":
+			w.Write([]byte(checksum + "  tampered.zip\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	config := useConfig(t, &Config{ListArchive: server.URL + "/tampered.zip"})
+	useListBundle(t)
+	if err := listBundle.Refresh(); err == nil {
+		t.Fatal("remote archive not matching its published checksum accepted")
+	}
+	if listBundle.Blocked().Len() != 0 {
+		t.Error("lists loaded from a rejected archive")
+	}
+
+	config.ListArchive = server.URL + "/unsigned.zip"
+	if err := listBundle.Refresh(); err == nil {
+		t.Fatal("remote archive without any checksum accepted")
+	}
+
+	config.ListArchive = server.URL + "/lists.zip"
+	if err := listBundle.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	checkSampleLists(t)
+}
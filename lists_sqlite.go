@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// listDatabase loads blocked and proxied domains from a SQLite database
+type listDatabase struct {
+	db      *sql.DB
+	mutex   sync.RWMutex
+	blocked domainSet
+	proxied domainSet
+}
+
+// Global database-backed list source, nil when ListDatabasePath is unset
+var listDB *listDatabase
+
+// listDatabaseSchema creates the list tables if they don't exist yet
+const listDatabaseSchema = `
+CREATE TABLE IF NOT EXISTS blocked_domains (domain TEXT PRIMARY KEY);
+CREATE TABLE IF NOT EXISTS proxied_domains (domain TEXT PRIMARY KEY);
+`
+
+// openListDatabase opens the database at path and loads both lists
+func openListDatabase(path string) (*listDatabase, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening list database: %v", err)
+	}
+	if _, err := db.Exec(listDatabaseSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating list tables: %v", err)
+	}
+
+	lists := &listDatabase{db: db}
+	if err := lists.Refresh(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return lists, nil
+}
+
+// Refresh reloads both lists, keeping the old ones if the database can't be read
+func (l *listDatabase) Refresh() error {
+	blocked, err := l.loadDomains("blocked_domains")
+	if err != nil {
+		return err
+	}
+	proxied, err := l.loadDomains("proxied_domains")
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	l.blocked = newDomainSet(blocked)
+	l.proxied = newDomainSet(proxied)
+	l.mutex.Unlock()
+	return nil
+}
+
+// loadDomains reads every domain from a list table
+func (l *listDatabase) loadDomains(table string) ([]string, error) {
+	rows, err := l.db.Query("SELECT domain FROM " + table)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	domains := []string{}
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", table, err)
+		}
+		domains = append(domains, domain)
+	}
+	return domains, rows.Err()
+}
+
+// Blocked returns the current blocked domain matcher
+func (l *listDatabase) Blocked() domainMatcher {
+	if l == nil {
+		return nil
+	}
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.blocked
+}
+
+// Proxied returns the current proxied domain matcher
+func (l *listDatabase) Proxied() domainMatcher {
+	if l == nil {
+		return nil
+	}
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.proxied
+}
+
+// Close closes the database
+func (l *listDatabase) Close() error {
+	return l.db.Close()
+}
+
+// runListRefreshLoop reloads the database and archive lists on the configured interval
+func runListRefreshLoop() {
+	for {
+		time.Sleep(time.Duration(currentConfig().ListRefreshSeconds) * time.Second)
+		if listDB != nil {
+			if err := listDB.Refresh(); err != nil {
+				log.Printf("Failed to refresh list database: %v", err)
+			}
+		}
+		if err := listBundle.Refresh(); err != nil {
+			log.Printf("Failed to refresh list archive: %v", err)
+		}
+	}
+}
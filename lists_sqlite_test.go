@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// useListDatabase opens an in-memory list database as the global list source
+func useListDatabase(t *testing.T) *listDatabase {
+	t.Helper()
+	lists, err := openListDatabase(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()))
+	if err != nil {
+		t.Fatalf("openListDatabase: %v", err)
+	}
+	old := listDB
+	listDB = lists
+	t.Cleanup(func() {
+		listDB = old
+		lists.Close()
+	})
+	return lists
+}
+
+func TestListDatabaseMatching(t *testing.T) {
+	useConfig(t, &Config{})
+	lists := useListDatabase(t)
+	for _, stmt := range []string{
+		"INSERT INTO blocked_domains VALUES ('ads.example'), ('Tracker.Test.')",
+		"INSERT INTO proxied_domains VALUES ('blocked-site.example')",
+	} {
+		if _, err := lists.db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lists.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	if lists.Blocked().Len() != 2 || lists.Proxied().Len() != 1 {
+		t.Errorf("loaded %d blocked and %d proxied domains, want 2 and 1", lists.Blocked().Len(), lists.Proxied().Len())
+	}
+	for _, name := range []string{"ads.example.", "cdn.ads.example.", "tracker.test."} {
+		if _, ok := blockedZone(name); !ok {
+			t.Errorf("%s not blocked by the database list", name)
+		}
+	}
+	if _, ok := blockedZone("notads.example."); ok {
+		t.Error("notads.example. blocked, want only ads.example and its subdomains")
+	}
+	if !isProxyDomain("www.blocked-site.example") || isProxyDomain("ads.example") {
+		t.Error("proxied domains not matched from the database list")
+	}
+}
+
+func TestListDatabaseRefresh(t *testing.T) {
+	useConfig(t, &Config{})
+	lists := useListDatabase(t)
+	if _, ok := blockedZone("new.example."); ok {
+		t.Fatal("empty database blocks new.example.")
+	}
+
+	// New rows show up on the next refresh
+	lists.db.Exec("INSERT INTO blocked_domains VALUES ('new.example')")
+	if _, ok := blockedZone("new.example."); ok {
+		t.Error("row matched before the refresh")
+	}
+	if err := lists.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if _, ok := blockedZone("new.example."); !ok {
+		t.Error("row not matched after the refresh")
+	}
+
+	// A broken database keeps the lists already loaded
+	lists.db.Exec("DROP TABLE blocked_domains")
+	if err := lists.Refresh(); err == nil {
+		t.Error("refresh of a database without blocked_domains succeeded, want an error")
+	}
+	if _, ok := blockedZone("new.example."); !ok {
+		t.Error("failed refresh dropped the loaded list")
+	}
+}
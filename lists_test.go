@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSuffixListMatch(t *testing.T) {
+	list := suffixList{"Ads.Example.", "tracker.test"}
+
+	tests := []struct {
+		name  string
+		want  string
+		match bool
+	}{
+		{"ads.example.", "ads.example", true},
+		{"x.ADS.example.", "ads.example", true},
+		{"tracker.test", "tracker.test", true},
+		{"badads.example.", "", false},
+		{"example.", "", false},
+		{"nottracker.test.", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := list.Match(tt.name)
+		if ok != tt.match || got != tt.want {
+			t.Errorf("Match(%q) = %q, %v; want %q, %v", tt.name, got, ok, tt.want, tt.match)
+		}
+	}
+}
+
+func TestDomainSetMatch(t *testing.T) {
+	set := newDomainSet([]string{"Example.com.", " blocked.test "})
+
+	if got, ok := set.Match("a.b.EXAMPLE.com."); !ok || got != "example.com" {
+		t.Errorf("subdomain match = %q, %v", got, ok)
+	}
+	if _, ok := set.Match("notexample.com."); ok {
+		t.Error("matched across a label boundary")
+	}
+	if set.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", set.Len())
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// syslogFacilities maps facility names to their RFC 5424 codes
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// fallbackWriter writes to primary, copying a line to fallback whenever the
+// primary write fails so nothing is lost while syslog is unreachable
+type fallbackWriter struct {
+	primary  io.Writer
+	fallback io.Writer
+}
+
+// Write implements io.Writer
+func (w *fallbackWriter) Write(p []byte) (int, error) {
+	if _, err := w.primary.Write(p); err != nil {
+		return w.fallback.Write(p)
+	}
+	return len(p), nil
+}
+
+var (
+	logOutputMutex sync.Mutex
+	logOutput      io.Closer // current syslog connection, nil when logging to stderr
+)
+
+// parseSyslogAddr splits SyslogAddr into a network and address. A bare
+// "host:port" is UDP, "tcp://" and "udp://" prefixes pick the transport, and
+// an empty address means the local syslog daemon.
+func parseSyslogAddr(addr string) (string, string, error) {
+	if addr == "" {
+		return "", "", nil
+	}
+	network, host, found := strings.Cut(addr, "://")
+	if !found {
+		return "udp", addr, nil
+	}
+	switch network {
+	case "udp", "tcp", "unix", "unixgram":
+		return network, host, nil
+	}
+	return "", "", fmt.Errorf("unsupported syslog network %q", network)
+}
+
+// applyLogOutput points the log at syslog when LogSyslog is set, or at stderr
+// otherwise. If syslog can't be reached the log stays on stderr.
+func applyLogOutput(config *Config) {
+	logOutputMutex.Lock()
+	defer logOutputMutex.Unlock()
+
+	previous := logOutput
+	logOutput = nil
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags)
+	if previous != nil {
+		previous.Close()
+	}
+
+	if !config.LogSyslog {
+		return
+	}
+
+	writer, err := dialSyslog(config.SyslogAddr, syslogFacilities[config.SyslogFacility])
+	if err != nil {
+		log.Printf("Syslog unavailable, logging to stderr: %v", err)
+		return
+	}
+
+	// Syslog stamps messages itself
+	logOutput = writer
+	log.SetFlags(0)
+	log.SetOutput(&fallbackWriter{primary: writer, fallback: os.Stderr})
+}
@@ -1,111 +1,631 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
-// Global configuration and client instances
+// Global client instances, the configuration lives in the runtime state
 var (
-	config         *Config
 	blessnetClient *BlessnetClient
+	dnsCache       Cache
 )
 
+// Set once startup has finished and proxied queries can be served
+var serverReady atomic.Bool
+
+// Path of the configuration file in use
+var configPath = "config.json"
+
 // handleDNSRequest processes incoming DNS queries and routes them through Blessnet if necessary
 func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
+	defer recoverDNSPanic(w, r)
+
+	// Admission checks all use the state current when the query arrived
+	state := currentState()
+	config := state.config
+
+	ip := clientIP(w.RemoteAddr())
+	if len(r.Question) > 0 {
+		state.stats.Record(ip.String(), r.Question[0].Name)
+	}
+
+	// Reject clients outside the query ACL
+	if !state.acl.Allowed(ip) {
+		log.Printf("Denied query from %s", w.RemoteAddr())
+		if config.DeniedQueryAction == "drop" {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
+	// Throttle clients over their query rate
+	if ok, limited := state.limiter.Allow(ip); !ok {
+		handleRateLimited(w, r, limited)
+		return
+	}
+
+	// Retransmissions attach to the copy already being resolved rather than
+	// starting another, possibly slow, resolution of their own
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	var pending *pendingQuery
+	if udp && config.DuplicateQueryAction != "off" && len(r.Question) == 1 {
+		key := newRetransmitKey(w.RemoteAddr(), r)
+		var first bool
+		if pending, first = pendingQueries.Begin(key); !first {
+			handleDuplicateQuery(w, r, pending)
+			return
+		}
+		defer pendingQueries.Finish(key, pending)
+	}
+
+	// Turn queries away rather than pile up goroutines behind slow resolvers
+	limiter := state.inflight
+	if !limiter.TryAcquire() {
+		handleInflightSaturated(w, r)
+		return
+	}
+	defer limiter.Release()
+
+	// Until startup completes the Blessnet client isn't available,
+	// so fail fast unless forwarding everything upstream is acceptable
+	if !serverReady.Load() && config.NotReadyAction != "forward" {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+
+	m, _ := resolveForClient(r, ip)
+	pending.Resolve(m)
+	padReply(m, r, udp)
+	w.WriteMsg(m)
+}
+
+// recoverDNSPanic turns a panic while handling a query into a SERVFAIL reply,
+// so one bad query can't take the whole server down
+func recoverDNSPanic(w dns.ResponseWriter, r *dns.Msg) {
+	p := recover()
+	if p == nil {
+		return
+	}
+
+	handlerPanics.Inc()
+	question := "(no question)"
+	if len(r.Question) > 0 {
+		question = r.Question[0].String()
+	}
+	log.Printf("Panic handling query %s from %s: %v\n%s", question, w.RemoteAddr(), p, debug.Stack())
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	w.WriteMsg(m)
+}
+
+// Resolve builds the reply for a DNS query without touching the network socket
+func Resolve(r *dns.Msg) *dns.Msg {
+	m, _ := resolveWithDecision(r)
+	return m
+}
+
+// resolveWithDecision is Resolve that also reports the resolution path taken
+func resolveWithDecision(r *dns.Msg) (*dns.Msg, string) {
+	return resolveForClient(r, nil)
+}
+
+// resolveForClient is resolveWithDecision for a query from a known client
+func resolveForClient(r *dns.Msg, client net.IP) (*dns.Msg, string) {
+	config := currentConfig()
+	decision := "none"
 	m := new(dns.Msg)
 	m.SetReply(r)
-	m.Compress = false
+	m.Compress = *config.CompressResponses
+	m.RecursionAvailable = *config.AllowRecursion
 
 	switch r.Opcode {
 	case dns.OpcodeQuery:
-		for _, q := range m.Question {
-			switch q.Qtype {
-			case dns.TypeA:
-				log.Printf("Query for %s\n", q.Name)
-
-				// Check if domain is in proxied list
-				domain := strings.TrimSuffix(q.Name, ".")
-				if isProxyDomain(domain) {
-					// Use Blessnet to fetch this domain through ephemeral proxy
-					handleProxiedDomain(m, q)
-				} else {
-					// Forward to upstream DNS
-					forwardToUpstream(m, q)
-				}
-			}
+		// Malformed question sections get FORMERR instead of a guess
+		if err := validateQuestions(r.Question); err != nil {
+			log.Printf("Rejecting malformed query: %v\n", err)
+			m.Rcode = dns.RcodeFormatError
+			decision = "formerr"
+			break
+		}
+
+		// Exactly one question is left, so the RCODE always belongs to it
+		q := m.Question[0]
+		stats.Queries.Add(1)
+		trace := newQueryTrace(client)
+		resolveQuestion(m, q, trace)
+		if trace.decision == "none" {
+			// Nothing handled the question, so give the configured terminal answer
+			trace.decide("default")
+			handleDefaultResponse(m, q)
+		}
+		trace.finish(q)
+		decision = trace.decision
+		addExtendedError(m, r, trace.ede)
+
+		// Tell secondaries how long synthesized records stay fresh
+		if decision == "authoritative" {
+			addEDNSExpire(m, r)
 		}
+	default:
+		m.Rcode = dns.RcodeNotImplemented
 	}
 
-	w.WriteMsg(m)
+	// Only claim validated data to clients that understand the AD bit
+	if m.AuthenticatedData && !wantsAuthenticatedData(r) {
+		m.AuthenticatedData = false
+	}
+
+	// Clamp TTLs and order answers before replying
+	shapeAnswers(m.Answer, client)
+	if config.MinimalResponses {
+		minimizeResponse(m)
+	}
+
+	return m, decision
 }
 
-// isProxyDomain checks if a domain should be proxied through Blessnet
-func isProxyDomain(domain string) bool {
-	// Check config for domains that should be proxied
-	for _, d := range config.ProxyDomains {
-		if strings.HasSuffix(domain, d) {
-			return true
+// resolveQuestion answers a single question into the reply
+func resolveQuestion(m *dns.Msg, q dns.Question, trace *queryTrace) {
+	config := currentConfig()
+
+	// Blocked domains never reach the proxy or upstream
+	if zone, ok := blockedZone(q.Name); ok {
+		log.Printf("Blocked query for %s\n", q.Name)
+		trace.decide("blocked")
+		trace.explain(dns.ExtendedErrorCodeBlocked, "blocked by policy")
+		handleBlockedDomain(m, q, zone)
+		return
+	}
+
+	// Address families turned off by config get NODATA whatever the source
+	if suppressedType(q.Qtype) {
+		trace.decide("suppressed")
+		trace.explain(dns.ExtendedErrorCodeFiltered, dns.TypeToString[q.Qtype]+" answers suppressed")
+		handleSuppressedType(m, q)
+		return
+	}
+
+	// Names in the hosts file are answered from it, like the system resolver
+	if records, ok := hosts.Answer(q); ok {
+		log.Printf("Answering %s %s from hosts file\n", dns.TypeToString[q.Qtype], q.Name)
+		trace.decide("hosts")
+		m.Answer = append(m.Answer, records...)
+		return
+	}
+
+	// Names on no list at all may still be flagged by the reputation service
+	if reputation := currentState().reputation; reputation != nil && !isProxyDomain(strings.TrimSuffix(q.Name, ".")) {
+		if _, owned := ownedZone(q.Name); !owned && reputation.Blocked(q.Name) {
+			log.Printf("Blocked query for %s (reputation)\n", q.Name)
+			trace.decide("blocked")
+			trace.explain(dns.ExtendedErrorCodeBlocked, "flagged by reputation service")
+			handleBlockedDomain(m, q, strings.TrimSuffix(q.Name, "."))
+			return
 		}
 	}
 
-	return false
+	switch q.Qtype {
+	case dns.TypeA:
+		log.Printf("Query for %s\n", q.Name)
+
+		// Check if domain is in proxied list, and this client in its canary
+		domain := strings.TrimSuffix(q.Name, ".")
+		proxied := isProxyDomain(domain) && inProxyCanary(domain, trace.client)
+		if !serverReady.Load() {
+			// Not ready to proxy yet, resolve normally in the meantime
+			forwardToUpstream(m, q, trace)
+		} else if proxied && config.ProxyOnFailureOnly {
+			// Only proxy when normal resolution is blocked
+			forwardOrProxy(m, q, trace)
+		} else if proxied {
+			// Use Blessnet to fetch this domain through ephemeral proxy
+			handleProxiedDomain(m, q, trace)
+		} else {
+			// Forward to upstream DNS
+			forwardToUpstream(m, q, trace)
+		}
+	case dns.TypeSOA, dns.TypeNS:
+		log.Printf("%s query for %s\n", dns.TypeToString[q.Qtype], q.Name)
+
+		// Answer the zone apex ourselves for owned domains
+		if zone, ok := ownedZone(q.Name); ok {
+			trace.decide("authoritative")
+			handleZoneApex(m, q, zone)
+		} else {
+			forwardToUpstream(m, q, trace)
+		}
+	case dns.TypeTXT:
+		// Experimental: carry proxied content in TXT records
+		domain := strings.TrimSuffix(q.Name, ".")
+		if config.ProxyTXTFallback && serverReady.Load() && isProxyDomain(domain) && inProxyCanary(domain, trace.client) {
+			if zone, denied := proxyTargetDenied(q.Name); denied {
+				trace.decide("denied")
+				trace.explain(dns.ExtendedErrorCodeProhibited, "proxy target denied by policy")
+				handleBlockedDomain(m, q, zone)
+				return
+			}
+			handleProxiedTXT(m, q, trace)
+			return
+		}
+		if zone, ok := ownedZone(q.Name); ok && !config.ProxyOnFailureOnly {
+			trace.decide("authoritative")
+			handleOwnedNoData(m, zone)
+		} else {
+			forwardToUpstream(m, q, trace)
+		}
+	case dns.TypeSRV, dns.TypeNAPTR, dns.TypeCAA, dns.TypeHTTPS, dns.TypeSVCB:
+		log.Printf("%s query for %s\n", dns.TypeToString[q.Qtype], q.Name)
+
+		// Service and policy records are resolved and cached like any other
+		// type, except that proxied domains may get a synthesized HTTPS/SVCB
+		if (q.Qtype == dns.TypeHTTPS || q.Qtype == dns.TypeSVCB) && wantsProxiedService(q, trace) {
+			handleProxiedService(m, q, trace)
+		} else if zone, ok := ownedZone(q.Name); ok && !config.ProxyOnFailureOnly {
+			trace.decide("authoritative")
+			handleOwnedNoData(m, zone)
+		} else {
+			forwardToUpstream(m, q, trace)
+		}
+	case dns.TypeAAAA:
+		// Owned names only have A records. With DNS64 other names that lack
+		// IPv6 get addresses synthesized from their A records; proxied names
+		// never do, that would route around the proxy. The rest go upstream.
+		if zone, ok := ownedZone(q.Name); ok && !config.ProxyOnFailureOnly {
+			log.Printf("AAAA query for owned name %s, answering NODATA\n", q.Name)
+			trace.decide("authoritative")
+			handleOwnedNoData(m, zone)
+		} else if currentState().dns64 != nil && !isProxyDomain(strings.TrimSuffix(q.Name, ".")) {
+			log.Printf("AAAA query for %s (DNS64)\n", q.Name)
+			handleDNS64(m, q, trace)
+		} else {
+			log.Printf("AAAA query for %s\n", q.Name)
+			forwardToUpstream(m, q, trace)
+		}
+	default:
+		// Owned names only have A records, so other types are NODATA. With
+		// ProxyOnFailureOnly the names live upstream and we don't own them.
+		// Everything else, MX, PTR and the like, is forwarded.
+		if zone, ok := ownedZone(q.Name); ok && !config.ProxyOnFailureOnly {
+			log.Printf("%s query for owned name %s, answering NODATA\n", dns.TypeToString[q.Qtype], q.Name)
+			trace.decide("authoritative")
+			handleOwnedNoData(m, zone)
+		} else {
+			log.Printf("%s query for %s\n", dns.TypeToString[q.Qtype], q.Name)
+			forwardToUpstream(m, q, trace)
+		}
+	}
+}
+
+// isProxyDomain checks if a domain should be proxied through Blessnet
+func isProxyDomain(domain string) bool {
+	_, ok := matchAny(domain, suffixList(currentConfig().ProxyDomains), listDB.Proxied(), listBundle.Proxied())
+	return ok
 }
 
 // handleProxiedDomain processes domains that need to be proxied through Blessnet
-func handleProxiedDomain(m *dns.Msg, q dns.Question) {
-	// Implementation will depend on your specific requirements
-	log.Printf("Proxying domain: %s", q.Name)
+func handleProxiedDomain(m *dns.Msg, q dns.Question, trace *queryTrace) {
+	// Targets disallowed by policy get the block response instead of a fetch
+	if zone, denied := proxyTargetDenied(q.Name); denied {
+		log.Printf("[%s] Proxy target %s denied by policy", trace.id, q.Name)
+		trace.decide("denied")
+		trace.explain(dns.ExtendedErrorCodeProhibited, "proxy target denied by policy")
+		handleBlockedDomain(m, q, zone)
+		return
+	}
 
-	// This is where you would use the Blessnet client to fetch content
-	// and determine the appropriate IP to return
+	log.Printf("[%s] Proxying domain: %s (%s mode)", trace.id, q.Name, currentConfig().ProxyMode)
+	stats.Proxied.Add(1)
+	trace.decide("proxied")
 
-	// For now, adding a placeholder IP for testing
-	rr, err := dns.NewRR(fmt.Sprintf("%s A 192.168.1.1", q.Name))
-	if err == nil {
-		m.Answer = append(m.Answer, rr)
+	// Fetch through the worker and answer with the worker origin IP
+	start := time.Now()
+	ip, ttl, err := lookupProxyIP(q.Name, trace.id)
+	trace.timeStage("worker", start)
+	if err != nil {
+		handleProxyLookupError(m, q, trace, err)
+		return
 	}
+
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   ip,
+	})
+	addCompanionRecords(m, q, ip, ttl)
+}
+
+// handleProxyLookupError answers a proxied query whose worker lookup failed.
+// Content the worker shouldn't have sent is handled per ProxyUnexpectedContent,
+// everything else is a SERVFAIL.
+func handleProxyLookupError(m *dns.Msg, q dns.Question, trace *queryTrace, err error) {
+	var unexpected *unexpectedWorkerContentError
+	if errors.As(err, &unexpected) && currentConfig().ProxyUnexpectedContent == "upstream" {
+		log.Printf("[%s] %v, resolving upstream instead", trace.id, err)
+		forwardToUpstream(m, q, trace)
+		return
+	}
+
+	log.Printf("[%s] Error proxying %s: %v", trace.id, q.Name, err)
+	trace.explain(dns.ExtendedErrorCodeNetworkError, "proxy fetch failed")
+	m.Rcode = dns.RcodeServerFailure
 }
 
 // forwardToUpstream forwards a DNS query to upstream DNS servers
-func forwardToUpstream(m *dns.Msg, q dns.Question) {
-	// Use a proper upstream DNS (e.g., Google DNS)
-	for _, ns := range config.Nameservers {
-		c := new(dns.Client)
-		upstreamMsg := new(dns.Msg)
-		upstreamMsg.SetQuestion(q.Name, q.Qtype)
-		upstreamMsg.RecursionDesired = true
-
-		r, _, err := c.Exchange(upstreamMsg, fmt.Sprintf("%s:53", ns))
-		if err != nil {
-			log.Printf("Error querying upstream DNS %s: %v", ns, err)
-			continue
+func forwardToUpstream(m *dns.Msg, q dns.Question, trace *queryTrace) {
+	config := currentConfig()
+
+	// Unvalidated answers for CD queries must not reach the shared cache, and
+	// cached answers don't remember AD, so CD queries always go upstream
+	checkingDisabled := config.ForwardDNSSECFlags && m.CheckingDisabled
+
+	// Serve from cache when we have a fresh answer
+	if !checkingDisabled {
+		start := time.Now()
+		records, ok := dnsCache.Get(q.Name, q.Qtype)
+		trace.timeStage("cache", start)
+		if ok {
+			stats.CacheHits.Add(1)
+			trace.decide("cached")
+			m.Answer = append(m.Answer, records...)
+			return
 		}
+	}
 
-		if r != nil && len(r.Answer) > 0 {
-			m.Answer = append(m.Answer, r.Answer...)
+	// A non-recursive server only answers what it already knows
+	if !*config.AllowRecursion {
+		trace.decide("refused")
+		trace.explain(dns.ExtendedErrorCodeNotAuthoritative, "recursion disabled")
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+
+	// Without nameservers there is nowhere to forward to, and the question
+	// is left to the default response
+	if len(config.Nameservers) == 0 && (!config.HappyEyeballsUpstream || config.DoHUpstream == "") {
+		return
+	}
+	stats.Forwarded.Add(1)
+	trace.decide("forwarded")
+
+	start := time.Now()
+	defer trace.timeStage("upstream", start)
+
+	r, err := exchangeUpstreamWithCD(q, checkingDisabled)
+	if err != nil {
+		// No upstream could be reached, so don't pretend the name is empty
+		log.Printf("%v", err)
+		trace.explain(dns.ExtendedErrorCodeNoReachableAuthority, "no upstream answered")
+		m.Rcode = dns.RcodeServerFailure
+		return
+	}
+
+	// Drop private addresses for public names to block DNS rebinding
+	if answer, stripped := currentState().rebind.Filter(q.Name, r.Answer); stripped {
+		log.Printf("Removed private addresses from the answer for %s (rebind protection)", q.Name)
+		trace.explain(dns.ExtendedErrorCodeFiltered, "private addresses removed")
+		r.Answer = answer
+		r.AuthenticatedData = false
+		if config.RebindAction == "nxdomain" {
+			m.Rcode = dns.RcodeNameError
 			return
 		}
 	}
+
+	// An empty answer is a legitimate NODATA/NXDOMAIN, not a failure
+	if !checkingDisabled {
+		dnsCache.Set(q.Name, q.Qtype, r.Answer)
+	}
+	m.Answer = append(m.Answer, r.Answer...)
+	m.Rcode = r.Rcode
+	m.AuthenticatedData = config.ForwardDNSSECFlags && r.AuthenticatedData
+}
+
+// handleDefaultResponse answers a query that no resolution path handled
+func handleDefaultResponse(m *dns.Msg, q dns.Question) {
+	config := currentConfig()
+	switch config.DefaultResponse {
+	case "nodata":
+	case "refused":
+		m.Rcode = dns.RcodeRefused
+	case "servfail":
+		m.Rcode = dns.RcodeServerFailure
+	case "nxdomain":
+		m.Rcode = dns.RcodeNameError
+	default:
+		// A sinkhole address answers queries of its own family, others get NODATA
+		ip := net.ParseIP(config.DefaultResponse)
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: config.BlockedRecordTTL}
+		if ip4 := ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+}
+
+// forwardOrProxy resolves a proxy domain upstream first and falls back to the
+// Blessnet proxy only when the upstream answer failed or looks poisoned
+func forwardOrProxy(m *dns.Msg, q dns.Question, trace *queryTrace) {
+	reply := new(dns.Msg)
+	reply.CheckingDisabled = m.CheckingDisabled
+	forwardToUpstream(reply, q, trace)
+
+	if !upstreamAnswerBlocked(reply) {
+		m.Answer = append(m.Answer, reply.Answer...)
+		m.Rcode = reply.Rcode
+		m.AuthenticatedData = reply.AuthenticatedData
+		return
+	}
+
+	log.Printf("Upstream answer for %s looks blocked (%s), proxying through Blessnet", q.Name, dns.RcodeToString[reply.Rcode])
+	trace.explain(dns.ExtendedErrorCodeCensored, "upstream answer blocked, proxied")
+	handleProxiedDomain(m, q, trace)
+}
+
+// upstreamAnswerBlocked reports whether an upstream reply failed, claims the name
+// doesn't exist, or points at one of the configured poison IPs
+func upstreamAnswerBlocked(reply *dns.Msg) bool {
+	if reply.Rcode == dns.RcodeServerFailure || reply.Rcode == dns.RcodeNameError {
+		return true
+	}
+
+	for _, rr := range reply.Answer {
+		var ip net.IP
+		switch record := rr.(type) {
+		case *dns.A:
+			ip = record.A
+		case *dns.AAAA:
+			ip = record.AAAA
+		default:
+			continue
+		}
+		for _, poison := range currentConfig().PoisonIPs {
+			if ip.Equal(net.ParseIP(poison)) {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
 func main() {
+	// The config location can come from the environment or the command line
+	if envPath := os.Getenv("PHANTOMDNS_CONFIG"); envPath != "" {
+		configPath = envPath
+	}
+	flag.StringVar(&configPath, "config", configPath, "config file path, \"-\" for stdin, or an http(s):// URL")
+	flag.Parse()
+
 	// Load configuration
-	var err error
-	config, err = LoadConfig("config.json")
+	config, err := LoadConfig(configPath)
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	applyLogOutput(config)
+
+	// Make sure the configured source address exists on this host
+	if err := validateSourceIP(config.UpstreamSourceIP); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// Fail early on a malformed outbound proxy
+	if _, err := outboundProxy(config); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// Build the ACL, filters and limiters the handlers use and publish them
+	// along with the config
+	state, err := newRuntimeState(config, nil)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	liveState.Store(state)
+
+	// Load the database-backed block and proxy lists
+	if config.ListDatabasePath != "" {
+		listDB, err = openListDatabase(config.ListDatabasePath)
+		if err != nil {
+			log.Fatalf("Failed to load list database: %v", err)
+		}
+		log.Printf("Loaded %d blocked and %d proxied domains from %s",
+			listDB.Blocked().Len(), listDB.Proxied().Len(), config.ListDatabasePath)
+	}
+
+	// Answer names from the hosts file, following changes to it
+	loadHostsFile()
+	go runHostsWatchLoop()
+
+	// Load the block and proxy lists bundled in an archive
+	if config.ListArchive != "" {
+		if err := listBundle.Refresh(); err != nil {
+			log.Fatalf("Failed to load list archive: %v", err)
+		}
+		log.Printf("Loaded %d blocked and %d proxied domains from %s",
+			listBundle.Blocked().Len(), listBundle.Proxied().Len(), config.ListArchive)
+	}
+	if config.ListDatabasePath != "" || config.ListArchive != "" {
+		go runListRefreshLoop()
+	}
+
+	retryBudget.SetRate(config.RetryBudgetPerSecond)
+
+	// Create resolver cache
+	dnsCache, err = NewCacheFromConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to initialize cache: %v", err)
+	}
+
+	// Warm the cache with entries saved before the last shutdown
+	if memoryCache, ok := dnsCache.(*MemoryCache); ok && config.CachePersistPath != "" {
+		if loaded, err := memoryCache.LoadFile(config.CachePersistPath); err != nil {
+			log.Printf("Failed to restore cache: %v", err)
+		} else {
+			log.Printf("Restored %d cache entries from %s", loaded, config.CachePersistPath)
+		}
+	}
+
+	// Attach DNS request handler and start listening right away,
+	// serverReady holds proxied queries back until startup completes
+	dns.HandleFunc(".", handleDNSRequest)
+
+	// Use sockets passed in by systemd if present, otherwise bind ourselves
+	servers, err := activatedServers()
+	if err != nil {
+		log.Fatalf("Failed to use activated sockets: %v", err)
+	}
+	if len(servers) > 0 {
+		log.Printf("Starting DNS server on %d activated sockets", len(servers))
+	} else {
+		servers, err = newListenServers(config.DNSListen, *config.DNSPort)
+		if err != nil {
+			log.Fatalf("Failed to bind DNS server: %v", err)
+		}
+		for _, server := range servers {
+			addr := server.Addr
+			if bound := boundAddr(server); bound != nil {
+				addr = bound.String()
+			}
+			log.Printf("Starting DNS server on %s (%s)", addr, server.Net)
+		}
+	}
+
+	// Each server reports in once it is serving, for the startup self-check,
+	// and logs where it ended up in case the port was picked for it
+	listenersStarted := make(chan struct{}, len(servers))
+	for _, server := range servers {
+		server.NotifyStartedFunc = func() {
+			log.Printf("DNS server listening on %s (%s)", boundAddr(server), server.Net)
+			listenersStarted <- struct{}{}
+		}
+		limitQuerySize(server, config.MaxQuerySize)
+		go func(server *dns.Server) {
+			if err := serveDNSWithRetry(server, config.BindRetries); err != nil {
+				log.Fatalf("Failed to start DNS server: %v", bindErrorHint(err, *config.DNSPort))
+			}
+		}(server)
+	}
 
 	// Create Blessnet client
 	blessnetClient, err = NewBlessnetClient(config)
@@ -113,108 +633,314 @@ func main() {
 		log.Fatalf("Failed to initialize Blessnet client: %v", err)
 	}
 
-	// Attach DNS request handler
-	dns.HandleFunc(".", handleDNSRequest)
-
-	// Start DNS server
-	server := &dns.Server{
-		Addr: fmt.Sprintf("%s:%d", config.DNSListen, config.DNSPort),
-		Net:  "udp",
+	// Warm the cache with known-popular domains before serving
+	if len(config.PrefetchDomains) > 0 {
+		log.Printf("Prefetching %d domains", len(config.PrefetchDomains))
+		prefetchDomains(config.PrefetchDomains, config.PrefetchConcurrency)
+	}
+	go runPrefetchLoop()
+
+	// Check everything the resolver depends on and summarize it before serving
+	listenTimeout := time.Duration(config.BindRetries) * 10 * time.Second
+	report := runStartupSelfCheck(waitForListeners(listenersStarted, len(servers), listenTimeout))
+	log.Printf("Startup self-check: %s", report)
+	if report.Status == "failed" {
+		log.Fatalf("Startup self-check failed, see the report above")
 	}
 
-	log.Printf("Starting DNS server on %s:%d", config.DNSListen, config.DNSPort)
-	log.Printf("Using enhanced Blessnet integration\n")
-	log.Printf("ATTENTION: Blessnet API integration has been improved:\n")
-	log.Printf("- Better handling of Cloudflare protection\n")
-	log.Printf("- Automatic fallback to alternative regions when primary region is unavailable\n")
-	log.Printf("- Enhanced permission system for secure API access\n")
+	// Everything the resolver depends on is up
+	serverReady.Store(true)
+	log.Printf("PhantomDNS is ready")
 
-	go func() {
-		if err := server.ListenAndServe(); err != nil {
-			log.Fatalf("Failed to start DNS server: %v", err)
+	// Keep checking that upstream resolution and proxying both work
+	go runHealthLoop()
+
+	// Start the admin HTTP server if configured
+	if config.AdminListen != "" {
+		admin := startAdminServer(config.AdminListen)
+		log.Printf("Admin server listening on %s", config.AdminListen)
+		defer admin.Close()
+	}
+
+	// Start the local control socket if configured
+	if config.ControlSocket != "" {
+		control, err := NewControlServer(config.ControlSocket)
+		if err != nil {
+			log.Fatalf("Failed to start control socket: %v", err)
 		}
-	}()
+		log.Printf("Control socket listening on %s", config.ControlSocket)
+		go control.Serve()
+		defer control.Close()
+	}
 
-	// Handle graceful shutdown
+	// Reload on SIGHUP, shut down gracefully on SIGINT/SIGTERM
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	s := <-sig
+	for s == syscall.SIGHUP {
+		log.Printf("Signal (%v) received, reloading configuration...", s)
+		if err := reloadConfig(); err != nil {
+			log.Printf("Configuration reload failed: %v", err)
+		}
+		s = <-sig
+	}
 	log.Printf("Signal (%v) received, shutting down...", s)
-	server.Shutdown()
+	for _, server := range servers {
+		server.Shutdown()
+	}
+
+	// Honour a cache path changed by a reload
+	config = currentConfig()
+
+	// Save the cache so the next start doesn't begin cold
+	if memoryCache, ok := dnsCache.(*MemoryCache); ok && config.CachePersistPath != "" {
+		if saved, err := memoryCache.SaveFile(config.CachePersistPath); err != nil {
+			log.Printf("Failed to save cache: %v", err)
+		} else {
+			log.Printf("Saved %d cache entries to %s", saved, config.CachePersistPath)
+		}
+	}
+}
+
+// defaultWorkerHeaders simulate a browser to get past Cloudflare protection
+var defaultWorkerHeaders = map[string]string{
+	"User-Agent":                "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+	"Accept":                    "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7",
+	"Accept-Language":           "en-US,en;q=0.9",
+	"Cache-Control":             "max-age=0",
+	"sec-ch-ua":                 "\"Google Chrome\";v=\"120\", \"Chromium\";v=\"120\", \"Not=A?Brand\";v=\"99\"",
+	"sec-ch-ua-mobile":          "?0",
+	"sec-ch-ua-platform":        "\"Windows\"",
+	"sec-fetch-dest":            "document",
+	"sec-fetch-mode":            "navigate",
+	"sec-fetch-site":            "none",
+	"sec-fetch-user":            "?1",
+	"upgrade-insecure-requests": "1",
+	"Connection":                "keep-alive",
+}
+
+// workerFetchOptions customizes a single worker fetch
+type workerFetchOptions struct {
+	// WorkerURL overrides the worker the request is sent to
+	WorkerURL string
+
+	// Headers override the default and configured headers for this request
+	Headers map[string]string
+
+	// RequestID is sent as X-Request-ID and prefixes the fetch's log lines,
+	// one is generated when empty
+	RequestID string
+}
+
+// workerHeaders merges the default, configured and per-request headers, later ones winning
+func workerHeaders(overrides map[string]string) map[string]string {
+	config := currentConfig()
+	headers := make(map[string]string, len(defaultWorkerHeaders))
+	for k, v := range defaultWorkerHeaders {
+		headers[k] = v
+	}
+	if config != nil {
+		for k, v := range config.WorkerRequestHeaders {
+			headers[k] = v
+		}
+	}
+	for k, v := range overrides {
+		headers[k] = v
+	}
+	return headers
+}
+
+// reloadConfig re-reads the configuration file and swaps it in
+func reloadConfig() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	// Stdin can only be read once
+	if configPath == "-" {
+		return fmt.Errorf("configuration was read from stdin and cannot be reloaded")
+	}
+
+	newConfig, err := LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	if err := validateSourceIP(newConfig.UpstreamSourceIP); err != nil {
+		return err
+	}
+
+	if _, err := outboundProxy(newConfig); err != nil {
+		return err
+	}
+
+	oldState := currentState()
+	newState, err := newRuntimeState(newConfig, oldState)
+	if err != nil {
+		return err
+	}
+
+	// Pick up list database changes along with the config
+	if listDB != nil {
+		if err := listDB.Refresh(); err != nil {
+			log.Printf("Failed to refresh list database: %v", err)
+		}
+	}
+
+	// Queries pick up the new config and everything built from it at once
+	liveState.Store(newState)
+	loadHostsFile()
+
+	oldConfig := oldState.config
+	if newConfig.LogSyslog != oldConfig.LogSyslog || newConfig.SyslogAddr != oldConfig.SyslogAddr || newConfig.SyslogFacility != oldConfig.SyslogFacility {
+		applyLogOutput(newConfig)
+	}
+	retryBudget.SetRate(newConfig.RetryBudgetPerSecond)
+	resetWorkerHTTPClient()
+
+	// Load the list archive the new config points at
+	if err := listBundle.Refresh(); err != nil {
+		log.Printf("Failed to refresh list archive: %v", err)
+	}
+
+	// Point the live Blessnet client at the new settings. The new config is
+	// already live, so a worker that fails its check is only worth a warning.
+	if blessnetClient != nil {
+		if err := blessnetClient.UpdateConfig(newConfig); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	log.Printf("Configuration reloaded from %s", configPath)
+	return nil
+}
+
+// currentWorkerURL returns the worker URL of the live client, or the configured one
+func currentWorkerURL() string {
+	if blessnetClient != nil {
+		return blessnetClient.GetWorkerURL()
+	}
+	return currentConfig().BlessnetWorkerURL
 }
 
 // fetchFromWorker handles communication with Blessnet workers
 func fetchFromWorker(targetURL string) ([]byte, error) {
-	log.Printf("Fetching from worker: %s", targetURL)
-
-	// Create a custom HTTP client with appropriate timeouts
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   10 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
+	return fetchFromWorkerWithOptions(targetURL, workerFetchOptions{})
+}
+
+// fetchFromWorkerWithOptions fetches a target through the worker with per-request options
+func fetchFromWorkerWithOptions(targetURL string, opts workerFetchOptions) ([]byte, error) {
+	if opts.RequestID == "" {
+		opts.RequestID = newTraceID()
+	}
+	log.Printf("[%s] Fetching from worker: %s", opts.RequestID, targetURL)
+
+	// Use the shared client so connections are reused across fetches
+	client := getWorkerHTTPClient()
+
+	// Retry transport errors and 5xx responses with backoff
+	var body []byte
+	err := withRetry(defaultRetryPolicy, func(attempt int) (bool, error) {
+		var retry bool
+		var err error
+		body, retry, err = doWorkerRequest(client, targetURL, opts)
+		if err != nil && retry {
+			log.Printf("[%s] Worker attempt %d failed: %v", opts.RequestID, attempt+1, err)
+		}
+		return retry, err
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	return body, nil
+}
+
+// doWorkerRequest performs a single worker fetch and reports whether a failure is worth retrying
+func doWorkerRequest(client *http.Client, targetURL string, opts workerFetchOptions) ([]byte, bool, error) {
+	config := currentConfig()
+
 	// Create a request to the worker with the TARGET parameter
-	workerURL := "https://apricot-emu-jacklin-qikeha7m.bls.dev/"
+	workerURL := opts.WorkerURL
+	if workerURL == "" {
+		workerURL = currentWorkerURL()
+	}
 	req, err := http.NewRequest("GET", workerURL, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
+		return nil, false, fmt.Errorf("error creating request: %v", err)
 	}
 
 	// Add the TARGET parameter as a query parameter
 	q := req.URL.Query()
 	q.Add("TARGET", targetURL)
+	addWorkerSignature(q, config.WorkerSigningSecret, targetURL)
+
+	// Workers only see query parameters, so the request ID and auth token go in both places
+	if opts.RequestID != "" {
+		q.Set("REQUEST_ID", opts.RequestID)
+	}
+	if config.WorkerAuthToken != "" {
+		q.Set("AUTH", config.WorkerAuthToken)
+	}
 	req.URL.RawQuery = q.Encode()
 
-	// Add headers to simulate a browser and bypass Cloudflare protection
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-	req.Header.Set("Cache-Control", "max-age=0")
-	req.Header.Set("sec-ch-ua", "\"Google Chrome\";v=\"120\", \"Chromium\";v=\"120\", \"Not=A?Brand\";v=\"99\"")
-	req.Header.Set("sec-ch-ua-mobile", "?0")
-	req.Header.Set("sec-ch-ua-platform", "\"Windows\"")
-	req.Header.Set("sec-fetch-dest", "document")
-	req.Header.Set("sec-fetch-mode", "navigate")
-	req.Header.Set("sec-fetch-site", "none")
-	req.Header.Set("sec-fetch-user", "?1")
-	req.Header.Set("upgrade-insecure-requests", "1")
-	req.Header.Set("Connection", "keep-alive")
+	// Add default, configured and per-request headers
+	for k, v := range workerHeaders(opts.Headers) {
+		req.Header.Set(k, v)
+	}
+	if opts.RequestID != "" {
+		req.Header.Set("X-Request-ID", opts.RequestID)
+	}
+	if config.WorkerAuthToken != "" {
+		req.Header.Set("X-Worker-Auth", config.WorkerAuthToken)
+	}
 
 	// Send the request
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching from worker: %v", err)
+		// The client wraps CheckRedirect errors in a *url.Error. Redirecting
+		// too often won't change on a retry.
+		var redirectErr *redirectLimitError
+		if errors.As(err, &redirectErr) {
+			return nil, false, fmt.Errorf("error fetching from worker: %v", err)
+		}
+		return nil, true, fmt.Errorf("error fetching from worker: %v", err)
 	}
 	defer resp.Body.Close()
 
 	// Log response details
-	log.Printf("Worker response status: %s", resp.Status)
+	log.Printf("[%s] Worker response status: %s (%s)", opts.RequestID, resp.Status, resp.Proto)
+	if finalURL := resp.Request.URL.String(); finalURL != req.URL.String() {
+		log.Printf("[%s] Worker request redirected to %s", opts.RequestID, finalURL)
+	}
 
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
+	// Refuse oversized responses up front when the length is announced
+	limit := config.MaxWorkerResponseBytes
+	if resp.ContentLength > limit {
+		return nil, false, fmt.Errorf("worker response of %d bytes exceeds the %d byte limit", resp.ContentLength, limit)
+	}
+
+	// Read the response body, stopping one byte past the limit. The client
+	// timeout covers reading the body too, so a slow worker can't stall us.
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
 	if err != nil {
-		return nil, fmt.Errorf("error reading worker response: %v", err)
+		return nil, true, fmt.Errorf("error reading worker response: %v", err)
+	}
+	if int64(len(body)) > limit {
+		return nil, false, fmt.Errorf("worker response exceeds the %d byte limit", limit)
+	}
+
+	// Challenge, captcha and login pages won't go away on a retry, the error
+	// sends BlessnetClient on to the next fallback worker instead
+	if challenge := detectWorkerChallenge(resp, body); challenge != nil {
+		workerChallenges.Inc(workerURL, challenge.Kind)
+		log.Printf("[%s] Worker %s served a %s page (%s), trying alternative worker...", opts.RequestID, workerURL, challenge.Kind, challenge.Signal)
+		return nil, false, challenge
 	}
 
 	// If response is not successful, log and return error
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Worker returned non-200 status: %d, body: %s", resp.StatusCode, string(body))
-		if resp.StatusCode == 403 && strings.Contains(string(body), "Cloudflare") {
-			log.Printf("Detected Cloudflare protection, trying alternative worker...")
-			// Here you could implement fallback to another worker or region
-		}
-		return nil, fmt.Errorf("worker returned status %d", resp.StatusCode)
+		log.Printf("[%s] Worker returned non-200 status: %d, body: %s", opts.RequestID, resp.StatusCode, string(body))
+		return nil, isRetryableStatus(resp.StatusCode), fmt.Errorf("worker returned status %d", resp.StatusCode)
 	}
 
-	return body, nil
+	return body, false, nil
 }
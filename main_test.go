@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useConfig installs c, with defaults applied, as the running config for the
+// rest of the test
+func useConfig(t testing.TB, c *Config) *Config {
+	t.Helper()
+	applyConfigDefaults(c)
+	state, err := newRuntimeState(c, nil)
+	if err != nil {
+		t.Fatalf("newRuntimeState: %v", err)
+	}
+
+	old := liveState.Swap(state)
+	resetWorkerHTTPClient()
+	t.Cleanup(func() {
+		liveState.Store(old)
+		resetWorkerHTTPClient()
+	})
+	return c
+}
+
+// useMemoryCache gives the test an empty resolver cache
+func useMemoryCache(t testing.TB) *MemoryCache {
+	t.Helper()
+	cache := NewMemoryCache()
+	old := dnsCache
+	dnsCache = cache
+	t.Cleanup(func() { dnsCache = old })
+	return cache
+}
+
+// logBuffer collects log output; writes may come from other goroutines
+type logBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// captureLog collects the standard logger's output for the rest of the test
+func captureLog(t *testing.T) *logBuffer {
+	t.Helper()
+	buf := &logBuffer{}
+	old := log.Writer()
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(old) })
+	return buf
+}
+
+// fakeResponseWriter is a dns.ResponseWriter that records the replies written to it
+type fakeResponseWriter struct {
+	remote  net.Addr
+	replies []*dns.Msg
+}
+
+// newFakeResponseWriter returns a writer for a UDP query from the given address
+func newFakeResponseWriter(ip string) *fakeResponseWriter {
+	return &fakeResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP(ip), Port: 53000}}
+}
+
+func (w *fakeResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *fakeResponseWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *fakeResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.replies = append(w.replies, m)
+	return nil
+}
+func (w *fakeResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
+func (w *fakeResponseWriter) Close() error        { return nil }
+func (w *fakeResponseWriter) TsigStatus() error   { return nil }
+func (w *fakeResponseWriter) TsigTimersOnly(bool) {}
+func (w *fakeResponseWriter) Hijack()             {}
+
+// useServerReady marks startup as finished for the rest of the test
+func useServerReady(t testing.TB) {
+	t.Helper()
+	old := serverReady.Load()
+	serverReady.Store(true)
+	t.Cleanup(func() { serverReady.Store(old) })
+}
+
+// useWorker points the Blessnet client at a fake worker for the rest of the test.
+// Call it after useConfig.
+func useWorker(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *[]*http.Request) {
+	t.Helper()
+	server, requests := workerServer(t, handler)
+	old := blessnetClient
+	blessnetClient = &BlessnetClient{Config: currentConfig(), WorkerURL: server.URL, auth: &AuthConfig{}}
+	t.Cleanup(func() { blessnetClient = old })
+	return server, requests
+}
+
+// workerServer starts a fake worker that records each request and answers with handler
+func workerServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *[]*http.Request) {
+	t.Helper()
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestWorkerRequestHeadersDefaults(t *testing.T) {
+	useConfig(t, &Config{})
+	server, requests := workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	if _, err := fetchFromWorkerWithOptions("https://example.com", workerFetchOptions{WorkerURL: server.URL}); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+
+	got := (*requests)[0].Header
+	for _, name := range []string{"User-Agent", "Accept", "Accept-Language", "sec-fetch-mode"} {
+		if got.Get(name) != defaultWorkerHeaders[name] {
+			t.Errorf("%s = %q, want the default %q", name, got.Get(name), defaultWorkerHeaders[name])
+		}
+	}
+}
+
+func TestWorkerRequestHeadersConfiguredAndPerRequest(t *testing.T) {
+	useConfig(t, &Config{WorkerRequestHeaders: map[string]string{
+		"User-Agent": "PhantomDNS-Test/1.0",
+		"X-Team":     "blue",
+	}})
+	server, requests := workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	opts := workerFetchOptions{WorkerURL: server.URL, Headers: map[string]string{"X-Team": "red"}}
+	if _, err := fetchFromWorkerWithOptions("https://example.com", opts); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+
+	got := (*requests)[0].Header
+	if got.Get("User-Agent") != "PhantomDNS-Test/1.0" {
+		t.Errorf("User-Agent = %q, want the configured value", got.Get("User-Agent"))
+	}
+	if got.Get("X-Team") != "red" {
+		t.Errorf("X-Team = %q, want the per-request override", got.Get("X-Team"))
+	}
+	if got.Get("Accept-Language") != defaultWorkerHeaders["Accept-Language"] {
+		t.Errorf("Accept-Language = %q, want the default kept", got.Get("Accept-Language"))
+	}
+}
+
+func TestWorkerResponseOverLimitAnnounced(t *testing.T) {
+	useConfig(t, &Config{MaxWorkerResponseBytes: 1024})
+	server, requests := workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "4096")
+		w.Write(make([]byte, 4096))
+	})
+
+	_, err := fetchFromWorkerWithOptions("https://example.com", workerFetchOptions{WorkerURL: server.URL})
+	if err == nil || !strings.Contains(err.Error(), "exceeds the 1024 byte limit") {
+		t.Fatalf("err = %v, want the size limit reported", err)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("worker saw %d requests, want 1 since a bigger body won't shrink on retry", len(*requests))
+	}
+}
+
+func TestWorkerResponseOverLimitStreamed(t *testing.T) {
+	useConfig(t, &Config{MaxWorkerResponseBytes: 1024})
+
+	// Stream far more than any socket buffer holds, without announcing the length
+	const total = 64 << 20
+	var written atomic.Int64
+	done := make(chan struct{})
+	server, _ := workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		chunk := make([]byte, 32<<10)
+		for written.Load() < total {
+			n, err := w.Write(chunk)
+			written.Add(int64(n))
+			if err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	})
+
+	_, err := fetchFromWorkerWithOptions("https://example.com", workerFetchOptions{WorkerURL: server.URL})
+	if err == nil || !strings.Contains(err.Error(), "exceeds the 1024 byte limit") {
+		t.Fatalf("err = %v, want the size limit reported", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker still writing, the client didn't hang up")
+	}
+	if written.Load() >= total {
+		t.Errorf("worker wrote all %d bytes, want the client to stop reading at the limit", total)
+	}
+}
+
+// FuzzHandleDNSRequest feeds arbitrary messages through the handler and checks
+// every one gets a single well-formed reply without a recovered panic
+func FuzzHandleDNSRequest(f *testing.F) {
+	for _, seed := range []*dns.Msg{
+		new(dns.Msg).SetQuestion("example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("example.com.", dns.TypeAAAA),
+		new(dns.Msg).SetQuestion("one.test.", dns.TypeSOA),
+		new(dns.Msg).SetEdns0(4096, true),
+	} {
+		packed, err := seed.Pack()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(packed)
+	}
+	// Malformed: a label with an invalid length, a truncated header and two questions
+	f.Add([]byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x3f, 'a', 0x00, 0x00, 0x01, 0x00, 0x01})
+	f.Add([]byte{0x12, 0x34, 0x01})
+	two := new(dns.Msg).SetQuestion("a.example.", dns.TypeA)
+	two.Question = append(two.Question, dns.Question{Name: "b.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if packed, err := two.Pack(); err == nil {
+		f.Add(packed)
+	}
+
+	useConfig(f, &Config{Nameservers: []string{"192.0.2.1"}, ProxyDomains: []string{"one.test"}, HostsFile: "off"})
+	useMemoryCache(f)
+	useServerReady(f)
+	useUpstream(f, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		return r, nil
+	})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := new(dns.Msg)
+		if err := r.Unpack(data); err != nil {
+			// The server answers these itself, they never reach the handler
+			return
+		}
+
+		panics := handlerPanics.Value()
+		w := newFakeResponseWriter("127.0.0.1")
+		handleDNSRequest(w, r)
+
+		if handlerPanics.Value() != panics {
+			t.Fatalf("handler panicked on %v", r)
+		}
+		if len(w.replies) != 1 {
+			t.Fatalf("got %d replies, want 1", len(w.replies))
+		}
+		reply := w.replies[0]
+		if reply.Id != r.Id || !reply.Response {
+			t.Errorf("reply ID %d (response %v), want a response to ID %d", reply.Id, reply.Response, r.Id)
+		}
+		if _, err := reply.Pack(); err != nil {
+			t.Errorf("reply doesn't pack: %v", err)
+		}
+	})
+}
+
+func TestHandleDNSRequestFormErr(t *testing.T) {
+	useConfig(t, &Config{HostsFile: "off"})
+	useServerReady(t)
+
+	noQuestion := new(dns.Msg)
+	noQuestion.Id = 1
+
+	badName := new(dns.Msg)
+	badName.SetQuestion("example.com.", dns.TypeA)
+	badName.Question[0].Name = "bad..name."
+
+	notFqdn := new(dns.Msg)
+	notFqdn.SetQuestion("example.com.", dns.TypeA)
+	notFqdn.Question[0].Name = "example.com"
+
+	for name, r := range map[string]*dns.Msg{"no question": noQuestion, "invalid name": badName, "relative name": notFqdn} {
+		w := newFakeResponseWriter("127.0.0.1")
+		handleDNSRequest(w, r)
+		if len(w.replies) != 1 {
+			t.Errorf("%s: got %d replies, want 1", name, len(w.replies))
+			continue
+		}
+		if got := w.replies[0].Rcode; got != dns.RcodeFormatError {
+			t.Errorf("%s: rcode = %s, want FORMERR", name, dns.RcodeToString[got])
+		}
+	}
+}
+
+func TestHandleDNSRequestQuestionCount(t *testing.T) {
+	useConfig(t, &Config{HostsFile: "off", Nameservers: []string{"192.0.2.1"}})
+	useServerReady(t)
+	useMemoryCache(t)
+	upstream := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "203.0.113.1"), nil
+	})
+
+	single := new(dns.Msg)
+	single.SetQuestion("single.example.com.", dns.TypeA)
+	w := newFakeResponseWriter("127.0.0.1")
+	handleDNSRequest(w, single)
+	if len(w.replies) != 1 {
+		t.Fatalf("got %d replies, want 1", len(w.replies))
+	}
+	if reply := w.replies[0]; reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 {
+		t.Errorf("single question: rcode %s with %d answers, want NOERROR with 1", dns.RcodeToString[reply.Rcode], len(reply.Answer))
+	}
+	calls := len(upstream.Calls())
+
+	// A second question would leave the RCODE ambiguous, so neither is answered
+	multi := new(dns.Msg)
+	multi.SetQuestion("first.example.com.", dns.TypeA)
+	multi.Question = append(multi.Question, dns.Question{Name: "second.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	w = newFakeResponseWriter("127.0.0.1")
+	handleDNSRequest(w, multi)
+	if len(w.replies) != 1 {
+		t.Fatalf("got %d replies, want 1", len(w.replies))
+	}
+	if reply := w.replies[0]; reply.Rcode != dns.RcodeFormatError || len(reply.Answer) != 0 {
+		t.Errorf("two questions: rcode %s with %d answers, want FORMERR with none", dns.RcodeToString[reply.Rcode], len(reply.Answer))
+	}
+	if got := len(upstream.Calls()); got != calls {
+		t.Errorf("upstream queried %d more times for a multi-question message, want 0", got-calls)
+	}
+}
+
+// resolvePackedSize resolves a name whose upstream answer repeats it in many
+// records and returns the packed size of the reply
+func resolvePackedSize(t *testing.T, compress *bool) int {
+	t.Helper()
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, CompressResponses: compress})
+	useMemoryCache(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "203.0.113.1", "203.0.113.2", "203.0.113.3", "203.0.113.4", "203.0.113.5", "203.0.113.6"), nil
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("a-fairly-long-name.cdn.example.com.", dns.TypeA)
+	m, _ := resolveWithDecision(q)
+	if len(m.Answer) != 6 {
+		t.Fatalf("got %d answers, want 6", len(m.Answer))
+	}
+	if m.Compress != (compress == nil || *compress) {
+		t.Errorf("Compress = %v with compress_responses %v", m.Compress, compress)
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	return len(packed)
+}
+
+func TestCompressResponses(t *testing.T) {
+	off := false
+	compressed := resolvePackedSize(t, nil)
+	uncompressed := resolvePackedSize(t, &off)
+
+	// Each answer repeats the 35 byte owner name, compression turns that into a 2 byte pointer
+	if compressed >= uncompressed || uncompressed-compressed < 6*30 {
+		t.Errorf("packed %d bytes compressed and %d uncompressed, want the repeated names compressed away", compressed, uncompressed)
+	}
+}
+
+func TestDefaultResponse(t *testing.T) {
+	tests := []struct {
+		response string
+		qtype    uint16
+		rcode    int
+		answer   string
+	}{
+		{"", dns.TypeTXT, dns.RcodeSuccess, ""},
+		{"nodata", dns.TypeTXT, dns.RcodeSuccess, ""},
+		{"refused", dns.TypeTXT, dns.RcodeRefused, ""},
+		{"servfail", dns.TypeTXT, dns.RcodeServerFailure, ""},
+		{"nxdomain", dns.TypeTXT, dns.RcodeNameError, ""},
+		{"bogus", dns.TypeTXT, dns.RcodeSuccess, ""},
+		{"2001:db8::99", dns.TypeAAAA, dns.RcodeSuccess, "unmatched.example.\t60\tIN\tAAAA\t2001:db8::99"},
+		{"192.0.2.99", dns.TypeA, dns.RcodeSuccess, "unmatched.example.\t60\tIN\tA\t192.0.2.99"},
+		{"192.0.2.99", dns.TypeAAAA, dns.RcodeSuccess, ""},
+		{"192.0.2.99", dns.TypeTXT, dns.RcodeSuccess, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.response+"/"+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			useConfig(t, &Config{Nameservers: []string{}, DefaultResponse: tt.response, HostsFile: "off"})
+			useMemoryCache(t)
+
+			// Neither owned nor proxied, and with no nameservers nothing else answers it
+			q := new(dns.Msg)
+			q.SetQuestion("unmatched.example.", tt.qtype)
+			m, decision := resolveWithDecision(q)
+			if decision != "default" {
+				t.Fatalf("decision = %q, want default", decision)
+			}
+			if m.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			var answer string
+			if len(m.Answer) == 1 {
+				answer = m.Answer[0].String()
+			}
+			if answer != tt.answer || len(m.Answer) > 1 {
+				t.Errorf("answer = %v, want %q", m.Answer, tt.answer)
+			}
+		})
+	}
+}
+
+func TestHandleDNSRequestRecoversPanic(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, HostsFile: "off"})
+	useMemoryCache(t)
+	useServerReady(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		// A faulty stage that blows up on one name
+		if m.Question[0].Name == "panic.example." {
+			panic("malformed record")
+		}
+		return replyWithA(m, "203.0.113.1"), nil
+	})
+	logs := captureLog(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(handleDNSRequest), NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+
+	panics := handlerPanics.Value()
+	client := &dns.Client{Net: "udp", Timeout: 2 * time.Second}
+	q := new(dns.Msg)
+	q.SetQuestion("panic.example.", dns.TypeA)
+	r, _, err := client.Exchange(q, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("query that panicked got no reply: %v", err)
+	}
+	if r.Rcode != dns.RcodeServerFailure || r.Id != q.Id {
+		t.Errorf("reply %s id %d, want SERVFAIL for query %d", dns.RcodeToString[r.Rcode], r.Id, q.Id)
+	}
+	if got := handlerPanics.Value(); got != panics+1 {
+		t.Errorf("phantomdns_handler_panics_total = %v, want %v", got, panics+1)
+	}
+	if !strings.Contains(logs.String(), "Panic handling query ;panic.example.\tIN\t A") || !strings.Contains(logs.String(), "malformed record") {
+		t.Errorf("log doesn't name the query and panic:\n%s", logs)
+	}
+
+	// The server is still answering
+	q.SetQuestion("fine.example.", dns.TypeA)
+	r, _, err = client.Exchange(q, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("query after the panic: %v", err)
+	}
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Errorf("reply after the panic %s with %d answers, want an answer", dns.RcodeToString[r.Rcode], len(r.Answer))
+	}
+}
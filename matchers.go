@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// matcherSource is one place a matcher's entries were loaded from
+type matcherSource struct {
+	Source string `json:"source"`
+	Count  int    `json:"count"`
+}
+
+// matcherSummary reports the size of one matcher and where its entries come
+// from. Total is the sum over sources, a name listed twice counts twice.
+type matcherSummary struct {
+	Name    string          `json:"name"`
+	Total   int             `json:"total"`
+	Sources []matcherSource `json:"sources"`
+}
+
+// add appends a source, skipping empty ones
+func (s *matcherSummary) add(source string, count int) {
+	if count == 0 {
+		return
+	}
+	s.Sources = append(s.Sources, matcherSource{Source: source, Count: count})
+	s.Total += count
+}
+
+// activeMatchers describes every name matcher currently in use
+func activeMatchers() []matcherSummary {
+	config := currentConfig()
+	blocked := matcherSummary{Name: "blocked", Sources: []matcherSource{}}
+	proxied := matcherSummary{Name: "proxied", Sources: []matcherSource{}}
+
+	blocked.add("config:blocked_domains", len(config.BlockedDomains))
+	proxied.add("config:proxy_domains", len(config.ProxyDomains))
+	if listDB != nil {
+		blocked.add("database:"+config.ListDatabasePath, listDB.Blocked().Len())
+		proxied.add("database:"+config.ListDatabasePath, listDB.Proxied().Len())
+	}
+	for _, file := range listBundle.Files() {
+		switch file.Kind {
+		case "blocked":
+			blocked.add("archive:"+file.Name, file.Count)
+		case "proxied":
+			proxied.add("archive:"+file.Name, file.Count)
+		}
+	}
+
+	static := matcherSummary{Name: "hosts", Sources: []matcherSource{}}
+	static.add("file:"+config.HostsFile, hosts.Len())
+
+	denied := matcherSummary{Name: "proxy_deny", Sources: []matcherSource{}}
+	denied.add("config:proxy_deny_list", len(config.ProxyDenyList))
+
+	rebindAllowed := matcherSummary{Name: "rebind_allowed", Sources: []matcherSource{}}
+	rebindAllowed.add("config:rebind_allowed_domains", len(config.RebindAllowedDomains))
+
+	ttl := matcherSummary{Name: "domain_ttl_overrides", Sources: []matcherSource{}}
+	ttl.add("config:domain_ttl_overrides", len(config.DomainTTLOverrides))
+
+	rewrites := matcherSummary{Name: "answer_rewrites", Sources: []matcherSource{}}
+	rewrites.add("config:answer_rewrites", len(currentState().rewrites))
+
+	return []matcherSummary{blocked, proxied, static, denied, rebindAllowed, ttl, rewrites}
+}
+
+// handleMatchers serves the active matchers as JSON on /debug/matchers
+func handleMatchers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(activeMatchers())
+}
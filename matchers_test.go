@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMatchersEndpoint(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "lists.tar.gz")
+	data := tarGzListArchive(t)
+	if err := os.WriteFile(archive, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	hostsPath := filepath.Join(dir, "hosts")
+	writeHosts(t, hostsPath, "192.0.2.10 nas.lan nas\n192.0.2.11 printer.lan\n", time.Now())
+
+	useConfig(t, &Config{
+		BlockedDomains:       []string{"ads.example", "telemetry.example"},
+		ProxyDomains:         []string{"blocked-site.example"},
+		ProxyDenyList:        []string{"bank.example"},
+		RebindAllowedDomains: []string{"plex.direct"},
+		ListArchive:          archive,
+		ListArchiveSHA256:    "sha256:" + sha256Hex(data),
+		ListDatabasePath:     "lists.db",
+		HostsFile:            hostsPath,
+	})
+	useListBundle(t)
+	if err := listBundle.Refresh(); err != nil {
+		t.Fatalf("archive Refresh: %v", err)
+	}
+	lists := useListDatabase(t)
+	if _, err := lists.db.Exec("INSERT INTO blocked_domains VALUES ('db1.example'), ('db2.example')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lists.Refresh(); err != nil {
+		t.Fatalf("database Refresh: %v", err)
+	}
+	old := hosts
+	hosts = &hostsTable{}
+	t.Cleanup(func() { hosts = old })
+	loadHostsFile()
+
+	recorder := httptest.NewRecorder()
+	handleMatchers(recorder, httptest.NewRequest(http.MethodGet, "/debug/matchers", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", recorder.Code)
+	}
+	var summaries []matcherSummary
+	if err := json.NewDecoder(recorder.Body).Decode(&summaries); err != nil {
+		t.Fatalf("decoding %q: %v", recorder.Body.String(), err)
+	}
+	got := map[string]matcherSummary{}
+	for _, s := range summaries {
+		got[s.Name] = s
+	}
+
+	tests := []struct {
+		name    string
+		total   int
+		sources []matcherSource
+	}{
+		{"blocked", 8, []matcherSource{
+			{"config:blocked_domains", 2},
+			{"database:lists.db", 2},
+			{"archive:blocked/ads.txt", 3},
+			{"archive:blocked/malware.txt", 1},
+		}},
+		{"proxied", 3, []matcherSource{
+			{"config:proxy_domains", 1},
+			{"archive:proxied.txt", 2},
+		}},
+		{"hosts", 3, []matcherSource{{"file:" + hostsPath, 3}}},
+		{"proxy_deny", 1, []matcherSource{{"config:proxy_deny_list", 1}}},
+		{"rebind_allowed", 1, []matcherSource{{"config:rebind_allowed_domains", 1}}},
+		{"domain_ttl_overrides", 0, []matcherSource{}},
+		{"answer_rewrites", 0, []matcherSource{}},
+	}
+	if len(summaries) != len(tests) {
+		t.Errorf("%d matchers reported, want %d", len(summaries), len(tests))
+	}
+	for _, tt := range tests {
+		s, ok := got[tt.name]
+		if !ok {
+			t.Errorf("%s matcher missing", tt.name)
+			continue
+		}
+		if s.Total != tt.total || !reflect.DeepEqual(s.Sources, tt.sources) {
+			t.Errorf("%s = %d from %+v, want %d from %+v", tt.name, s.Total, s.Sources, tt.total, tt.sources)
+		}
+	}
+}
+
+func TestMatchersEndpointMethod(t *testing.T) {
+	useConfig(t, &Config{})
+	recorder := httptest.NewRecorder()
+	handleMatchers(recorder, httptest.NewRequest(http.MethodPost, "/debug/matchers", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status %d, want 405", recorder.Code)
+	}
+}
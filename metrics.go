@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metric is anything that can write itself in the Prometheus text format
+type metric interface {
+	write(w io.Writer)
+}
+
+// metricsRegistry holds every metric exposed on /metrics
+var metricsRegistry = struct {
+	sync.Mutex
+	metrics []metric
+}{}
+
+// registerMetric adds a metric to the registry
+func registerMetric(m metric) {
+	metricsRegistry.Lock()
+	metricsRegistry.metrics = append(metricsRegistry.metrics, m)
+	metricsRegistry.Unlock()
+}
+
+// writeMetrics writes all registered metrics in the Prometheus text format
+func writeMetrics(w io.Writer) {
+	metricsRegistry.Lock()
+	metrics := append([]metric(nil), metricsRegistry.metrics...)
+	metricsRegistry.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// labelString renders label names and values as {a="x",b="y"}
+func labelString(names []string, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// seriesKey joins label values into a map key
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// counterVec is a counter partitioned by label values
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]float64
+	series map[string][]string
+}
+
+// newCounterVec creates and registers a labelled counter
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		series: make(map[string][]string),
+	}
+	registerMetric(c)
+	return c
+}
+
+// Inc adds one to the series with the given label values
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds a value to the series with the given label values
+func (c *counterVec) Add(value float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	c.mutex.Lock()
+	c.values[key] += value
+	c.series[key] = labelValues
+	c.mutex.Unlock()
+}
+
+// Value returns the current value of a series
+func (c *counterVec) Value(labelValues ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.values[seriesKey(labelValues)]
+}
+
+// write renders the counter in the Prometheus text format
+func (c *counterVec) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, labelString(c.labels, c.series[key]), c.values[key])
+	}
+}
+
+// histogramSeries holds the bucket counts for one label combination
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// histogramVec is a histogram partitioned by label values
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+// defaultLatencyBuckets cover fast cache hits up to slow worker fetches, in seconds
+var defaultLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// newHistogramVec creates and registers a labelled histogram
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	registerMetric(h)
+	return h
+}
+
+// Observe records a value in the series with the given label values
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// write renders the histogram in the Prometheus text format
+func (h *histogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, s.labelValues, "le", fmt.Sprintf("%g", bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, labelString(h.labels, s.labelValues), s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, s.labelValues), s.count)
+	}
+}
+
+// sortedKeys returns map keys in a stable order for rendering
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Resolver metrics
+var (
+	queryDuration = newHistogramVec(
+		"phantomdns_query_duration_seconds",
+		"Time taken to resolve a DNS query, by resolution decision.",
+		defaultLatencyBuckets,
+		"decision",
+	)
+	stageDuration = newHistogramVec(
+		"phantomdns_stage_duration_seconds",
+		"Time spent in each resolution stage.",
+		defaultLatencyBuckets,
+		"stage",
+	)
+	slowQueries = newCounterVec(
+		"phantomdns_slow_queries_total",
+		"Queries that exceeded the slow query threshold, by slowest stage.",
+		"stage",
+	)
+)
+
+// Server metrics
+var (
+	handlerPanics = newCounterVec(
+		"phantomdns_handler_panics_total",
+		"Panics recovered while handling a DNS query.",
+	)
+	oversizedQueries = newCounterVec(
+		"phantomdns_oversized_queries_total",
+		"Queries dropped for exceeding max_query_size.",
+	)
+)
+
+// Upstream metrics
+var (
+	upstreamRejected = newCounterVec(
+		"phantomdns_upstream_rejected_total",
+		"Upstream replies discarded by a validation rule.",
+		"rule",
+	)
+	upstreamRaceWins = newCounterVec(
+		"phantomdns_upstream_race_wins_total",
+		"Happy eyeballs races won, by transport.",
+		"transport",
+	)
+)
+
+// Worker metrics
+var (
+	workerRequests = newCounterVec(
+		"phantomdns_worker_requests_total",
+		"Worker fetches by worker URL, region and result.",
+		"worker", "region", "result",
+	)
+	workerFallbacks = newCounterVec(
+		"phantomdns_worker_fallback_total",
+		"Worker fetches served by a fallback worker after the primary failed.",
+	)
+	workerChallenges = newCounterVec(
+		"phantomdns_worker_challenges_total",
+		"Worker responses that were challenge, captcha or login pages, by worker URL and kind.",
+		"worker", "kind",
+	)
+	retryBudgetExhausted = newCounterVec(
+		"phantomdns_retry_budget_exhausted_total",
+		"Retries skipped because the shared retry budget was spent.",
+	)
+)
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// oversizedQueryError reports a query dropped for exceeding MaxQuerySize. It is
+// temporary so the UDP serve loop carries on with the next packet.
+type oversizedQueryError struct {
+	size int
+	max  int
+	from net.Addr
+}
+
+func (e *oversizedQueryError) Error() string {
+	return fmt.Sprintf("dropped oversized query from %s (%d bytes read, limit %d)", e.from, e.size, e.max)
+}
+
+func (e *oversizedQueryError) Timeout() bool   { return false }
+func (e *oversizedQueryError) Temporary() bool { return true }
+
+// sizeLimitReader rejects raw messages over max bytes before they are unpacked
+type sizeLimitReader struct {
+	dns.Reader
+	max int
+}
+
+// limitQuerySize makes a server drop queries larger than max bytes. UDP reads
+// use a buffer one byte larger than max so oversized datagrams are detected
+// rather than silently truncated.
+func limitQuerySize(server *dns.Server, max int) {
+	server.UDPSize = max + 1
+	server.DecorateReader = func(r dns.Reader) dns.Reader {
+		return &sizeLimitReader{Reader: r, max: max}
+	}
+}
+
+// check returns an error for a message over the limit
+func (r *sizeLimitReader) check(m []byte, from net.Addr) error {
+	if len(m) <= r.max {
+		return nil
+	}
+	oversizedQueries.Inc()
+	err := &oversizedQueryError{size: len(m), max: r.max, from: from}
+	log.Printf("%v", err)
+	return err
+}
+
+// ReadTCP reads a TCP message, closing the connection when it is too large
+func (r *sizeLimitReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	m, err := r.Reader.ReadTCP(conn, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.check(m, conn.RemoteAddr()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadUDP reads a UDP datagram, skipping it when it is too large
+func (r *sizeLimitReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	m, session, err := r.Reader.ReadUDP(conn, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := r.check(m, session.RemoteAddr()); err != nil {
+		return nil, nil, err
+	}
+	return m, session, nil
+}
+
+// ReadPacketConn reads from a generic packet connection, skipping oversized messages
+func (r *sizeLimitReader) ReadPacketConn(conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
+	reader, ok := r.Reader.(dns.PacketConnReader)
+	if !ok {
+		return nil, nil, fmt.Errorf("reader does not support packet connections")
+	}
+	m, addr, err := reader.ReadPacketConn(conn, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := r.check(m, addr); err != nil {
+		return nil, nil, err
+	}
+	return m, addr, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// serveSizeLimited starts a UDP or TCP server limited to max byte queries,
+// counting the queries that reach the handler
+func serveSizeLimited(t *testing.T, network string, max int) (string, *atomic.Int32) {
+	t.Helper()
+	handled := &atomic.Int32{}
+	server := &dns.Server{Net: network, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		handled.Add(1)
+		w.WriteMsg(replyWithA(r, "192.0.2.53"))
+	})}
+	var addr string
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.PacketConn, addr = conn, conn.LocalAddr().String()
+	} else {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Listener, addr = listener, listener.Addr().String()
+	}
+	limitQuerySize(server, max)
+
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return addr, handled
+}
+
+// paddedQuery returns an A query padded out to at least size bytes
+func paddedQuery(size int) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, size)})
+	return q
+}
+
+func TestOversizedQueryDropped(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			logs := captureLog(t)
+			addr, handled := serveSizeLimited(t, network, 512)
+			dropped := oversizedQueries.Value()
+			client := &dns.Client{Net: network, Timeout: 300 * time.Millisecond, UDPSize: dns.MaxMsgSize}
+
+			if _, _, err := client.Exchange(paddedQuery(1000), addr); err == nil {
+				t.Error("oversized query was answered")
+			}
+			if handled.Load() != 0 {
+				t.Error("oversized query reached the handler")
+			}
+			if got := oversizedQueries.Value(); got != dropped+1 {
+				t.Errorf("phantomdns_oversized_queries_total = %v, want %v", got, dropped+1)
+			}
+			if !strings.Contains(logs.String(), "dropped oversized query from 127.0.0.1:") {
+				t.Errorf("drop not logged with the source:\n%s", logs)
+			}
+
+			// Queries within the limit are still served
+			r, _, err := client.Exchange(paddedQuery(100), addr)
+			if err != nil {
+				t.Fatalf("query within the limit: %v", err)
+			}
+			if len(r.Answer) != 1 || handled.Load() != 1 {
+				t.Errorf("query within the limit got %d answers after %d handled", len(r.Answer), handled.Load())
+			}
+		})
+	}
+}
+
+func TestMaxQuerySizeDefaults(t *testing.T) {
+	for configured, want := range map[int]int{0: 4096, -1: 4096, 100: 512, 1232: 1232, 100000: 65535} {
+		c := &Config{MaxQuerySize: configured}
+		applyConfigDefaults(c)
+		if c.MaxQuerySize != want {
+			t.Errorf("max_query_size %d became %d, want %d", configured, c.MaxQuerySize, want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// Node is a Blessnet node as returned by the node API
+type Node struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Region   string  `json:"region"`
+	Status   string  `json:"status"`
+	Endpoint string  `json:"endpoint"`
+	Latency  float64 `json:"latency"` // Milliseconds, as reported by the API
+	Version  string  `json:"version"`
+
+	// Raw holds every field of the payload, including ones not mapped above
+	Raw map[string]interface{} `json:"-"`
+}
+
+// UnmarshalJSON decodes the known fields and keeps the full payload in Raw
+func (n *Node) UnmarshalJSON(data []byte) error {
+	type plainNode Node
+	var node plainNode
+	if err := json.Unmarshal(data, &node); err != nil {
+		return err
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*n = Node(node)
+	n.Raw = raw
+	return nil
+}
+
+// Field returns a raw payload field, for values the struct doesn't map
+func (n *Node) Field(name string) (interface{}, bool) {
+	value, ok := n.Raw[name]
+	return value, ok
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// nodePayload is a representative node as returned by the node API
+const nodePayload = `{
+	"id": "node-7",
+	"name": "edge-fra-1",
+	"region": "eu-central",
+	"status": "online",
+	"endpoint": "https://fra1.nodes.example",
+	"latency": 12.5,
+	"version": "2.3.1",
+	"capacity": {"cpu": 8},
+	"tags": ["edge", "wasm"]
+}`
+
+func TestNodeUnmarshal(t *testing.T) {
+	var node Node
+	if err := json.Unmarshal([]byte(nodePayload), &node); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	want := Node{
+		ID:       "node-7",
+		Name:     "edge-fra-1",
+		Region:   "eu-central",
+		Status:   "online",
+		Endpoint: "https://fra1.nodes.example",
+		Latency:  12.5,
+		Version:  "2.3.1",
+	}
+	got := node
+	got.Raw = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("node = %+v, want %+v", got, want)
+	}
+
+	// Fields the struct doesn't map stay reachable through the raw payload
+	capacity, ok := node.Field("capacity")
+	if !ok || capacity.(map[string]interface{})["cpu"] != float64(8) {
+		t.Errorf("capacity = %v (present %v), want the raw object", capacity, ok)
+	}
+	if _, ok := node.Field("missing"); ok {
+		t.Error("Field reported a field the payload doesn't have")
+	}
+}
+
+func TestNodeUnmarshalRejectsBadTypes(t *testing.T) {
+	var node Node
+	if err := json.Unmarshal([]byte(`{"id": "node-1", "latency": "fast"}`), &node); err == nil {
+		t.Error("string latency decoded, want an error")
+	}
+}
+
+func TestNodeAPIMethodsDecodeNodes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/nodes":
+			fmt.Fprintf(w, `{"data":[%s]}`, nodePayload)
+		case "/nodes":
+			fmt.Fprintf(w, `[%s]`, nodePayload)
+		case "/nodes/node-7":
+			fmt.Fprint(w, nodePayload)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	api := NewBlessnetNodeAPI(server.URL)
+
+	nodes, err := api.GetNodes()
+	if err != nil || len(nodes) != 1 || nodes[0].Region != "eu-central" {
+		t.Errorf("GetNodes = %+v, %v", nodes, err)
+	}
+	nodes, err = api.ListAvailableNodes()
+	if err != nil || len(nodes) != 1 || nodes[0].Endpoint != "https://fra1.nodes.example" {
+		t.Errorf("ListAvailableNodes = %+v, %v", nodes, err)
+	}
+	node, err := api.FetchNodeStatus("node-7")
+	if err != nil || node.Status != "online" || node.Latency != 12.5 {
+		t.Errorf("FetchNodeStatus = %+v, %v", node, err)
+	}
+}
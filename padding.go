@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// padMessage adds an EDNS0 padding option sized so the packed message is a
+// multiple of blockSize bytes (RFC 7830). It does nothing for a blockSize of 0.
+func padMessage(m *dns.Msg, blockSize int) {
+	if blockSize <= 0 {
+		return
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	removePadding(opt)
+
+	// The option code and length take 4 bytes on top of the padding itself
+	length := m.Len() + 4
+	padding := 0
+	if rem := length % blockSize; rem != 0 {
+		padding = blockSize - rem
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padding)})
+}
+
+// removePadding drops any padding option so a message can be padded afresh
+func removePadding(opt *dns.OPT) {
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0PADDING {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
+
+// requestsPadding reports whether a query carries a padding option, the
+// client's signal that it wants a padded response
+func requestsPadding(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0PADDING {
+			return true
+		}
+	}
+	return false
+}
+
+// padReply pads a reply for a client that padded its query. Padding is left
+// off when it would push a UDP reply past the client's advertised size.
+func padReply(m *dns.Msg, r *dns.Msg, udp bool) {
+	config := currentConfig()
+	if config.EDNSPadding <= 0 || !requestsPadding(r) {
+		return
+	}
+
+	hadOPT := m.IsEdns0() != nil
+	padMessage(m, config.EDNSPadding)
+	if !udp || m.Len() <= int(r.IsEdns0().UDPSize()) {
+		return
+	}
+
+	removePadding(m.IsEdns0())
+	if !hadOPT {
+		m.Extra = m.Extra[:len(m.Extra)-1]
+	}
+}
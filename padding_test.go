@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// paddingLength returns the length of a message's padding option, or -1 without one
+func paddingLength(m *dns.Msg) int {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return -1
+	}
+	for _, option := range opt.Option {
+		if padding, ok := option.(*dns.EDNS0_PADDING); ok {
+			return len(padding.Padding)
+		}
+	}
+	return -1
+}
+
+// packedLength packs m and returns its wire length
+func packedLength(t *testing.T, m *dns.Msg) int {
+	t.Helper()
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	return len(packed)
+}
+
+func TestPadMessageAlignsToBlockSize(t *testing.T) {
+	for _, blockSize := range []int{128, 468} {
+		for _, name := range []string{"a.", "example.com.", "a-much-longer-name.with.several.labels.example.org."} {
+			m := new(dns.Msg)
+			m.SetQuestion(name, dns.TypeA)
+			padMessage(m, blockSize)
+			if paddingLength(m) < 0 {
+				t.Fatalf("%s padded to %d has no padding option", name, blockSize)
+			}
+			if n := packedLength(t, m); n%blockSize != 0 {
+				t.Errorf("%s padded to %d is %d bytes", name, blockSize, n)
+			}
+
+			// Padding again replaces the option instead of adding a second one
+			padMessage(m, blockSize)
+			if n := packedLength(t, m); n%blockSize != 0 || len(m.IsEdns0().Option) != 1 {
+				t.Errorf("%s re-padded is %d bytes with %d options", name, n, len(m.IsEdns0().Option))
+			}
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	padMessage(m, 0)
+	if m.IsEdns0() != nil {
+		t.Error("padding block size 0 added an OPT record")
+	}
+}
+
+func TestDoHQueryPadded(t *testing.T) {
+	var mutex sync.Mutex
+	var sizes []int
+	var padded []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		q := new(dns.Msg)
+		if err := q.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mutex.Lock()
+		sizes = append(sizes, len(body))
+		padded = append(padded, paddingLength(q))
+		mutex.Unlock()
+
+		packed, _ := replyWithA(q, "203.0.113.1").Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(packed)
+	}))
+	defer server.Close()
+
+	for _, blockSize := range []int{0, 128} {
+		useConfig(t, &Config{DoHUpstream: server.URL, EDNSPadding: blockSize})
+		if _, err := exchangeDoH(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, false); err != nil {
+			t.Fatalf("exchangeDoH: %v", err)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if padded[0] >= 0 {
+		t.Errorf("query padded with edns_padding 0")
+	}
+	if padded[1] < 0 || sizes[1]%128 != 0 {
+		t.Errorf("query is %d bytes with padding %d, want a padded multiple of 128", sizes[1], padded[1])
+	}
+}
+
+func TestPadReply(t *testing.T) {
+	useConfig(t, &Config{EDNSPadding: 468})
+	reply := func(query *dns.Msg) *dns.Msg {
+		return replyWithA(query, "203.0.113.1", "203.0.113.2")
+	}
+	query := func(pad bool, udpSize uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.SetEdns0(udpSize, false)
+		if pad {
+			padMessage(q, 128)
+		}
+		return q
+	}
+
+	// A client that padded its query gets a padded reply
+	q := query(true, 1232)
+	m := reply(q)
+	padReply(m, q, true)
+	if paddingLength(m) < 0 || packedLength(t, m)%468 != 0 {
+		t.Errorf("reply is %d bytes with padding %d, want a padded multiple of 468", packedLength(t, m), paddingLength(m))
+	}
+
+	// One that didn't pad doesn't
+	q = query(false, 1232)
+	m = reply(q)
+	padReply(m, q, true)
+	if paddingLength(m) >= 0 {
+		t.Error("reply padded for a client that didn't pad its query")
+	}
+
+	// Padding that would overflow the client's UDP size is left off, over TCP it isn't
+	q = query(true, 300)
+	m = reply(q)
+	padReply(m, q, true)
+	if paddingLength(m) >= 0 || m.IsEdns0() != nil {
+		t.Errorf("UDP reply padded to %d bytes past the client's 300 byte limit", packedLength(t, m))
+	}
+	m = reply(q)
+	padReply(m, q, false)
+	if paddingLength(m) < 0 || packedLength(t, m)%468 != 0 {
+		t.Errorf("TCP reply is %d bytes with padding %d, want a padded multiple of 468", packedLength(t, m), paddingLength(m))
+	}
+}
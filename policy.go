@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// policyClient queries the external category API
+var policyClient = &http.Client{Timeout: 2 * time.Second}
+
+// proxyPolicyVerdict is the response expected from the category API
+type proxyPolicyVerdict struct {
+	Allowed  bool   `json:"allowed"`
+	Category string `json:"category"`
+}
+
+// proxyTargetDenied checks a proxy target against the deny list and, if
+// configured, the external category API. It returns the zone to report in the
+// block response. The category API fails open so an outage doesn't break proxying.
+func proxyTargetDenied(domain string) (string, bool) {
+	config := currentConfig()
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, d := range config.ProxyDenyList {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return d, true
+		}
+	}
+
+	if config.ProxyPolicyURL == "" {
+		return "", false
+	}
+
+	verdict, err := queryProxyPolicy(domain)
+	if err != nil {
+		log.Printf("Proxy policy check for %s failed, allowing: %v", domain, err)
+		return "", false
+	}
+	if !verdict.Allowed {
+		log.Printf("Proxy policy denied %s (category: %s)", domain, verdict.Category)
+		return domain, true
+	}
+	return "", false
+}
+
+// queryProxyPolicy asks the category API whether a domain may be proxied
+func queryProxyPolicy(domain string) (*proxyPolicyVerdict, error) {
+	policyURL, err := url.Parse(currentConfig().ProxyPolicyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy_policy_url: %v", err)
+	}
+	q := policyURL.Query()
+	q.Set("domain", domain)
+	policyURL.RawQuery = q.Encode()
+
+	resp, err := policyClient.Get(policyURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("error querying policy API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("policy API returned status %d", resp.StatusCode)
+	}
+
+	var verdict proxyPolicyVerdict
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return nil, fmt.Errorf("error parsing policy response: %v", err)
+	}
+	return &verdict, nil
+}
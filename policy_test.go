@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// useProxyPolicy proxies *.proxy.test through a counting worker under the given policy
+func useProxyPolicy(t *testing.T, denyList []string, policyURL string) *[]*http.Request {
+	t.Helper()
+	useConfig(t, &Config{
+		ProxyDomains:      []string{"proxy.test"},
+		ProxyDenyList:     denyList,
+		ProxyPolicyURL:    policyURL,
+		ProxyMode:         "ephemeral",
+		ProxyEphemeralTTL: 5,
+		HostsFile:         "off",
+	})
+	useMemoryCache(t)
+	useServerReady(t)
+	resetProxyIPCache(t)
+	return countingEnvelopeWorker(t)
+}
+
+// resolvePolicyTest resolves name and returns the reply and decision
+func resolvePolicyTest(name string) (*dns.Msg, string) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	return resolveWithDecision(q)
+}
+
+func TestProxyDenyList(t *testing.T) {
+	requests := useProxyPolicy(t, []string{"Malware.Proxy.Test."}, "")
+
+	m, decision := resolvePolicyTest("cdn.malware.proxy.test.")
+	if decision != "denied" {
+		t.Errorf("denied target decision = %q, want denied", decision)
+	}
+	if m.Rcode != dns.RcodeNameError || len(m.Answer) != 0 {
+		t.Errorf("denied target got rcode %s with %v, want the block response", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	if len(*requests) != 0 {
+		t.Errorf("worker fetched a denied target %d times, want 0", len(*requests))
+	}
+
+	m, decision = resolvePolicyTest("allowed.proxy.test.")
+	if decision != "proxied" || len(m.Answer) != 1 {
+		t.Errorf("allowed target: decision %q with %v, want it proxied", decision, m.Answer)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("worker saw %d requests for the allowed target, want 1", len(*requests))
+	}
+}
+
+func TestProxyPolicyAPI(t *testing.T) {
+	var asked []string
+	policy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		domain := r.URL.Query().Get("domain")
+		asked = append(asked, domain)
+		json.NewEncoder(w).Encode(proxyPolicyVerdict{Allowed: domain != "gambling.proxy.test", Category: "gambling"})
+	}))
+	defer policy.Close()
+	requests := useProxyPolicy(t, nil, policy.URL)
+
+	if _, decision := resolvePolicyTest("gambling.proxy.test."); decision != "denied" {
+		t.Errorf("category-denied target decision = %q, want denied", decision)
+	}
+	if _, decision := resolvePolicyTest("news.proxy.test."); decision != "proxied" {
+		t.Errorf("allowed target decision = %q, want proxied", decision)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("worker saw %d requests, want only the allowed target fetched", len(*requests))
+	}
+	if len(asked) != 2 || asked[0] != "gambling.proxy.test" {
+		t.Errorf("policy API asked about %v, want both targets without the trailing dot", asked)
+	}
+}
+
+func TestProxyPolicyAPIFailsOpen(t *testing.T) {
+	requests := useProxyPolicy(t, nil, closedServerURL())
+
+	if _, decision := resolvePolicyTest("news.proxy.test."); decision != "proxied" {
+		t.Errorf("decision with the policy API down = %q, want proxied", decision)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("worker saw %d requests, want 1", len(*requests))
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// prefetchDomains resolves the given domains upstream and stores the answers
+// in the cache, with at most concurrency lookups in flight
+func prefetchDomains(domains []string, concurrency int) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for _, domain := range domains {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			q := dns.Question{Name: dns.Fqdn(domain), Qtype: qtype, Qclass: dns.ClassINET}
+
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				r, err := exchangeUpstream(q)
+				if err != nil {
+					log.Printf("Prefetch of %s %s failed: %v", q.Name, dns.TypeToString[q.Qtype], err)
+					return
+				}
+				dnsCache.Set(q.Name, q.Qtype, r.Answer)
+			}()
+		}
+	}
+
+	wg.Wait()
+}
+
+// runPrefetchLoop refreshes the prefetch list on the configured interval
+func runPrefetchLoop() {
+	for {
+		time.Sleep(time.Duration(currentConfig().PrefetchIntervalSeconds) * time.Second)
+
+		// Re-read after sleeping so a reload in between is picked up
+		config := currentConfig()
+		if len(config.PrefetchDomains) > 0 {
+			prefetchDomains(config.PrefetchDomains, config.PrefetchConcurrency)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPrefetchDomainsPopulatesCache(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, UpstreamRetries: new(int)})
+	cache := useMemoryCache(t)
+	logs := captureLog(t)
+
+	var mutex sync.Mutex
+	inflight, maxInflight := 0, 0
+	fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		mutex.Lock()
+		inflight++
+		if inflight > maxInflight {
+			maxInflight = inflight
+		}
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			inflight--
+			mutex.Unlock()
+		}()
+		time.Sleep(5 * time.Millisecond)
+
+		q := m.Question[0]
+		switch {
+		case q.Name == "broken.example.":
+			return nil, errors.New("i/o timeout")
+		case q.Qtype == dns.TypeA:
+			return replyWithA(m, "203.0.113.10"), nil
+		}
+		r := new(dns.Msg)
+		r.SetReply(m)
+		return r, nil
+	})
+
+	prefetchDomains([]string{"one.example", "two.example", "broken.example"}, 2)
+
+	for _, name := range []string{"one.example.", "two.example."} {
+		records, ok := cache.Get(name, dns.TypeA)
+		if !ok || len(records) != 1 {
+			t.Errorf("%s A not cached after prefetch", name)
+		}
+		if _, ok := cache.Get(name, dns.TypeAAAA); ok {
+			t.Errorf("%s AAAA cached from an empty answer", name)
+		}
+	}
+	if _, ok := cache.Get("broken.example.", dns.TypeA); ok {
+		t.Error("failed prefetch left a cache entry")
+	}
+
+	// A and AAAA for each domain, and nothing else
+	if got := len(fake.Calls()); got != 6 {
+		t.Errorf("upstream saw %d queries, want 6", got)
+	}
+	if maxInflight > 2 {
+		t.Errorf("%d prefetches ran at once, want at most 2", maxInflight)
+	}
+	if !strings.Contains(logs.String(), "Prefetch of broken.example. A failed") {
+		t.Errorf("failed prefetch not logged, got:\n%s", logs)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyIPEntry is a worker origin IP remembered for a proxied domain
+type proxyIPEntry struct {
+	ip        net.IP
+	expiresAt time.Time
+}
+
+// proxyIPCache remembers worker origin IPs per domain in persistent proxy mode
+var proxyIPCache = struct {
+	sync.Mutex
+	entries map[string]proxyIPEntry
+}{entries: make(map[string]proxyIPEntry)}
+
+// lookupProxyIP returns the IP and TTL to answer with for a proxied domain.
+// In "ephemeral" mode every query triggers a fresh worker fetch and a short TTL;
+// in "persistent" mode the worker origin IP is reused until it expires.
+// The request ID is passed on to the worker fetch.
+func lookupProxyIP(domain string, requestID string) (net.IP, uint32, error) {
+	config := currentConfig()
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	persistent := config.ProxyMode == "persistent"
+
+	if persistent {
+		proxyIPCache.Lock()
+		entry, ok := proxyIPCache.entries[domain]
+		proxyIPCache.Unlock()
+		if ok {
+			if remaining := time.Until(entry.expiresAt); remaining > 0 {
+				return entry.ip, uint32(remaining.Seconds()), nil
+			}
+		}
+	}
+
+	ip, envelope, err := resolveWorkerOrigin(domain, requestID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !persistent {
+		return ip, proxyTTL(envelope, config.ProxyEphemeralTTL), nil
+	}
+
+	ttl := proxyTTL(envelope, config.ProxyPersistentTTL)
+	proxyIPCache.Lock()
+	proxyIPCache.entries[domain] = proxyIPEntry{
+		ip:        ip,
+		expiresAt: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	proxyIPCache.Unlock()
+
+	return ip, ttl, nil
+}
+
+// proxyTTL returns the TTL for a proxied answer: the one derived from the
+// envelope's caching headers if ProxyHonorCacheHeaders is set, else the fallback
+func proxyTTL(envelope *WorkerEnvelope, fallback uint32) uint32 {
+	if !currentConfig().ProxyHonorCacheHeaders {
+		return fallback
+	}
+	if ttl, ok := envelope.CacheTTL(time.Now()); ok {
+		return clampTTL(ttl)
+	}
+	return fallback
+}
+
+// resolveWorkerOrigin fetches the domain through the worker and returns the
+// IP the worker resolved for it, or the worker's own address for legacy
+// workers, along with the envelope
+func resolveWorkerOrigin(domain string, requestID string) (net.IP, *WorkerEnvelope, error) {
+	var envelope *WorkerEnvelope
+	var err error
+	if worker, ok := proxyWorkerOverride(domain); ok {
+		envelope, err = blessnetClient.FetchEnvelopeFrom(worker, "https://"+domain, requestID)
+	} else {
+		envelope, err = blessnetClient.FetchEnvelope("https://"+domain, requestID)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("worker fetch for %s failed: %v", domain, err)
+	}
+
+	// Only a structured response says where the content came from, an error
+	// page or arbitrary content says nothing about the worker either
+	if envelope.Raw && currentConfig().ProxyUnexpectedContent != "worker" {
+		return nil, envelope, &unexpectedWorkerContentError{domain: domain, contentType: envelope.ContentType}
+	}
+
+	if ip := net.ParseIP(envelope.ResolvedIP).To4(); ip != nil {
+		return ip, envelope, nil
+	}
+
+	ip, err := lookupWorkerIP(envelope.Worker.URL)
+	return ip, envelope, err
+}
+
+// unexpectedWorkerContentError reports a worker response that wasn't an envelope
+type unexpectedWorkerContentError struct {
+	domain      string
+	contentType string
+}
+
+func (e *unexpectedWorkerContentError) Error() string {
+	return fmt.Sprintf("worker returned %s for %s instead of an envelope", e.contentType, e.domain)
+}
+
+// proxyWorkerOverride returns the worker configured for a domain in
+// ProxyDomainWorkers, preferring the most specific matching suffix
+func proxyWorkerOverride(domain string) (WorkerEndpoint, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	workerURL, matched := "", ""
+	for suffix, worker := range currentConfig().ProxyDomainWorkers {
+		d := strings.ToLower(strings.TrimSuffix(suffix, "."))
+		if (domain == d || strings.HasSuffix(domain, "."+d)) && len(d) > len(matched) {
+			workerURL, matched = worker, d
+		}
+	}
+	if workerURL == "" {
+		return WorkerEndpoint{}, false
+	}
+	return WorkerEndpoint{URL: workerURL, Region: "override"}, true
+}
+
+// inProxyCanary reports whether a client's queries for a proxied domain go
+// through the proxy. Hashing client and domain keeps each client on the same
+// side of the split instead of flapping between answers.
+func inProxyCanary(domain string, client net.IP) bool {
+	percent := proxyCanaryPercent(domain)
+	if percent >= 100 {
+		return true
+	}
+	if percent <= 0 {
+		return false
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(client.String() + "|" + strings.ToLower(strings.TrimSuffix(domain, "."))))
+	return int(h.Sum32()%100) < percent
+}
+
+// proxyCanaryPercent returns the canary percentage for a domain, preferring
+// the most specific suffix in ProxyCanaryDomains over the global value
+func proxyCanaryPercent(domain string) int {
+	config := currentConfig()
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	percent, matched := *config.ProxyCanaryPercent, ""
+	for suffix, p := range config.ProxyCanaryDomains {
+		d := strings.ToLower(strings.TrimSuffix(suffix, "."))
+		if (domain == d || strings.HasSuffix(domain, "."+d)) && len(d) > len(matched) {
+			percent, matched = p, d
+		}
+	}
+	return percent
+}
+
+// lookupWorkerIP resolves the IPv4 address of a worker URL's host
+func lookupWorkerIP(workerURL string) (net.IP, error) {
+	u, err := url.Parse(workerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid worker URL %s: %v", workerURL, err)
+	}
+
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("error resolving worker host %s: %v", u.Hostname(), err)
+	}
+
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4, nil
+		}
+	}
+
+	return nil, fmt.Errorf("worker host %s has no IPv4 address", u.Hostname())
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// resetProxyIPCache forgets the origin IPs remembered by earlier tests
+func resetProxyIPCache(t *testing.T) {
+	t.Helper()
+	clear := func() {
+		proxyIPCache.Lock()
+		proxyIPCache.entries = make(map[string]proxyIPEntry)
+		proxyIPCache.Unlock()
+	}
+	clear()
+	t.Cleanup(clear)
+}
+
+// countingEnvelopeWorker answers every fetch with an envelope carrying a new resolved IP
+func countingEnvelopeWorker(t *testing.T) *[]*http.Request {
+	t.Helper()
+	count := 0
+	_, requests := useWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		count++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":200,"target":%q,"resolvedIP":"203.0.113.%d","contentType":"text/html"}`, r.URL.Query().Get("TARGET"), count)
+	})
+	return requests
+}
+
+func TestLookupProxyIPEphemeralNeverReuses(t *testing.T) {
+	useConfig(t, &Config{ProxyMode: "ephemeral", ProxyEphemeralTTL: 5})
+	resetProxyIPCache(t)
+	requests := countingEnvelopeWorker(t)
+
+	first, ttl, err := lookupProxyIP("example.com.", "")
+	if err != nil {
+		t.Fatalf("lookupProxyIP: %v", err)
+	}
+	if ttl != 5 {
+		t.Errorf("TTL = %d, want the ephemeral TTL 5", ttl)
+	}
+	second, _, err := lookupProxyIP("example.com.", "")
+	if err != nil {
+		t.Fatalf("lookupProxyIP: %v", err)
+	}
+
+	if first.Equal(second) {
+		t.Errorf("ephemeral mode reused %s", first)
+	}
+	if len(*requests) != 2 {
+		t.Errorf("worker fetched %d times, want 2", len(*requests))
+	}
+}
+
+func TestLookupProxyIPPersistentReusesWithinTTL(t *testing.T) {
+	useConfig(t, &Config{ProxyMode: "persistent", ProxyPersistentTTL: 600})
+	resetProxyIPCache(t)
+	requests := countingEnvelopeWorker(t)
+
+	first, ttl, err := lookupProxyIP("Example.com.", "")
+	if err != nil {
+		t.Fatalf("lookupProxyIP: %v", err)
+	}
+	if ttl != 600 {
+		t.Errorf("TTL = %d, want the persistent TTL 600", ttl)
+	}
+	second, ttl, err := lookupProxyIP("example.com", "")
+	if err != nil {
+		t.Fatalf("lookupProxyIP: %v", err)
+	}
+
+	if !first.Equal(second) {
+		t.Errorf("persistent mode returned %s then %s", first, second)
+	}
+	if ttl == 0 || ttl > 600 {
+		t.Errorf("reused TTL = %d, want the remaining time", ttl)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("worker fetched %d times, want 1", len(*requests))
+	}
+}
+
+func TestLookupProxyIPPersistentRefetchesAfterExpiry(t *testing.T) {
+	useConfig(t, &Config{ProxyMode: "persistent", ProxyPersistentTTL: 600})
+	resetProxyIPCache(t)
+	requests := countingEnvelopeWorker(t)
+
+	first, _, _ := lookupProxyIP("example.com", "")
+
+	// Expire the remembered IP
+	proxyIPCache.Lock()
+	entry := proxyIPCache.entries["example.com"]
+	entry.expiresAt = time.Now().Add(-time.Second)
+	proxyIPCache.entries["example.com"] = entry
+	proxyIPCache.Unlock()
+
+	second, _, _ := lookupProxyIP("example.com", "")
+	if first.Equal(second) || len(*requests) != 2 {
+		t.Errorf("expired IP %s reused (%d fetches)", second, len(*requests))
+	}
+}
+
+// useProxyOnFailure proxies blocked.test only when upstream answers with the
+// poison IP 198.51.100.66 or fails, with upstream answering through answer
+func useProxyOnFailure(t *testing.T, answer func(m *dns.Msg, address string) (*dns.Msg, error)) *[]*http.Request {
+	t.Helper()
+	useConfig(t, &Config{
+		Nameservers:        []string{"192.0.2.1"},
+		ProxyDomains:       []string{"blocked.test"},
+		ProxyOnFailureOnly: true,
+		PoisonIPs:          []string{"198.51.100.66"},
+		ProxyMode:          "ephemeral",
+		ProxyEphemeralTTL:  5,
+	})
+	useMemoryCache(t)
+	useServerReady(t)
+	resetProxyIPCache(t)
+	useUpstream(t, answer)
+	return countingEnvelopeWorker(t)
+}
+
+// resolveBlockedTest resolves blocked.test and returns its only A record
+func resolveBlockedTest(t *testing.T) (string, string) {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("blocked.test.", dns.TypeA)
+	m, decision := resolveWithDecision(q)
+	if len(m.Answer) != 1 {
+		t.Fatalf("got %d answers (rcode %s), want 1", len(m.Answer), dns.RcodeToString[m.Rcode])
+	}
+	return m.Answer[0].(*dns.A).A.String(), decision
+}
+
+func TestProxyOnFailurePoisonedAnswer(t *testing.T) {
+	requests := useProxyOnFailure(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "198.51.100.66"), nil
+	})
+
+	ip, decision := resolveBlockedTest(t)
+	if ip != "203.0.113.1" || decision != "proxied" {
+		t.Errorf("answer %s (%s), want the worker's 203.0.113.1 proxied", ip, decision)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("worker saw %d requests, want 1", len(*requests))
+	}
+}
+
+func TestProxyOnFailureNXDOMAIN(t *testing.T) {
+	requests := useProxyOnFailure(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetRcode(m, dns.RcodeNameError)
+		return r, nil
+	})
+
+	if ip, decision := resolveBlockedTest(t); ip != "203.0.113.1" || decision != "proxied" {
+		t.Errorf("answer %s (%s), want the worker's 203.0.113.1 proxied", ip, decision)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("worker saw %d requests, want 1", len(*requests))
+	}
+}
+
+func TestProxyOnFailureCleanAnswer(t *testing.T) {
+	requests := useProxyOnFailure(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "192.0.2.80"), nil
+	})
+
+	if ip, decision := resolveBlockedTest(t); ip != "192.0.2.80" || decision != "forwarded" {
+		t.Errorf("answer %s (%s), want upstream's 192.0.2.80 forwarded", ip, decision)
+	}
+	if len(*requests) != 0 {
+		t.Errorf("worker saw %d requests, want none for a clean answer", len(*requests))
+	}
+}
+
+// useStartup marks startup as still running; the test flips serverReady itself
+func useStartup(t *testing.T, action string) (*fakeExchanger, *[]*http.Request) {
+	t.Helper()
+	useConfig(t, &Config{
+		Nameservers:       []string{"192.0.2.1"},
+		ProxyDomains:      []string{"proxied.test"},
+		ProxyMode:         "ephemeral",
+		NotReadyAction:    action,
+		HostsFile:         "off",
+		ProxyEphemeralTTL: 5,
+	})
+	useMemoryCache(t)
+	resetProxyIPCache(t)
+	old := serverReady.Load()
+	serverReady.Store(false)
+	t.Cleanup(func() { serverReady.Store(old) })
+	upstream := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "192.0.2.80"), nil
+	})
+	return upstream, countingEnvelopeWorker(t)
+}
+
+// queryProxiedTest sends an A query for proxied.test through the handler
+func queryProxiedTest(t *testing.T) *dns.Msg {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("proxied.test.", dns.TypeA)
+	w := newFakeResponseWriter("127.0.0.1")
+	handleDNSRequest(w, q)
+	if len(w.replies) != 1 {
+		t.Fatalf("got %d replies, want 1", len(w.replies))
+	}
+	return w.replies[0]
+}
+
+func TestNotReadyServfail(t *testing.T) {
+	upstream, requests := useStartup(t, "servfail")
+
+	m := queryProxiedTest(t)
+	if m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode before ready = %s, want SERVFAIL", dns.RcodeToString[m.Rcode])
+	}
+	if len(upstream.Calls()) != 0 || len(*requests) != 0 {
+		t.Errorf("%d upstream and %d worker requests before ready, want none", len(upstream.Calls()), len(*requests))
+	}
+
+	serverReady.Store(true)
+	m = queryProxiedTest(t)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "203.0.113.1" {
+		t.Errorf("answer after ready = %v, want the worker's 203.0.113.1", m.Answer)
+	}
+}
+
+func TestNotReadyForward(t *testing.T) {
+	upstream, requests := useStartup(t, "forward")
+
+	m := queryProxiedTest(t)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.0.2.80" {
+		t.Errorf("answer before ready = %v, want the upstream 192.0.2.80", m.Answer)
+	}
+	if len(upstream.Calls()) != 1 || len(*requests) != 0 {
+		t.Errorf("%d upstream and %d worker requests before ready, want the upstream only", len(upstream.Calls()), len(*requests))
+	}
+
+	serverReady.Store(true)
+	m = queryProxiedTest(t)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "203.0.113.1" {
+		t.Errorf("answer after ready = %v, want the worker's 203.0.113.1", m.Answer)
+	}
+}
+
+// envelopeWorkerServer starts a worker answering every fetch with an envelope resolving to ip
+func envelopeWorkerServer(t *testing.T, ip string) (*httptest.Server, *[]*http.Request) {
+	t.Helper()
+	return workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":200,"target":%q,"resolvedIP":%q,"contentType":"text/html"}`, r.URL.Query().Get("TARGET"), ip)
+	})
+}
+
+func TestProxyDomainWorkers(t *testing.T) {
+	geo, geoRequests := envelopeWorkerServer(t, "198.51.100.1")
+	de, deRequests := envelopeWorkerServer(t, "198.51.100.2")
+	useConfig(t, &Config{
+		ProxyDomains:       []string{"geo.test", "other.test"},
+		ProxyDomainWorkers: map[string]string{"geo.test": geo.URL, "DE.geo.test.": de.URL},
+		ProxyMode:          "ephemeral",
+		ProxyEphemeralTTL:  5,
+		HostsFile:          "off",
+	})
+	useMemoryCache(t)
+	useServerReady(t)
+	resetProxyIPCache(t)
+	defaultRequests := countingEnvelopeWorker(t)
+
+	tests := []struct {
+		name     string
+		want     string
+		requests *[]*http.Request
+	}{
+		{"www.geo.test.", "198.51.100.1", geoRequests},
+		{"shop.de.geo.test.", "198.51.100.2", deRequests},
+		{"www.other.test.", "203.0.113.1", defaultRequests},
+	}
+	for _, tt := range tests {
+		before := len(*tt.requests)
+		q := new(dns.Msg)
+		q.SetQuestion(tt.name, dns.TypeA)
+		m, _ := resolveWithDecision(q)
+		if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != tt.want {
+			t.Errorf("%s: answer %v, want %s", tt.name, m.Answer, tt.want)
+		}
+		if len(*tt.requests) != before+1 {
+			t.Errorf("%s: expected worker saw %d new requests, want 1", tt.name, len(*tt.requests)-before)
+		}
+	}
+	if len(*geoRequests) != 1 || len(*deRequests) != 1 || len(*defaultRequests) != 1 {
+		t.Errorf("worker requests geo=%d de=%d default=%d, want one each", len(*geoRequests), len(*deRequests), len(*defaultRequests))
+	}
+}
+
+func TestProxiedQueryRequestID(t *testing.T) {
+	useConfig(t, &Config{ProxyDomains: []string{"proxied.test"}, HostsFile: "off"})
+	useMemoryCache(t)
+	useServerReady(t)
+	resetProxyIPCache(t)
+	requests := countingEnvelopeWorker(t)
+	logs := captureLog(t)
+
+	queryProxiedTest(t)
+	if len(*requests) != 1 {
+		t.Fatalf("%d worker requests, want 1", len(*requests))
+	}
+	id := (*requests)[0].Header.Get("X-Request-ID")
+	if id == "" {
+		t.Fatal("worker request has no X-Request-ID header")
+	}
+	if got := (*requests)[0].URL.Query().Get("REQUEST_ID"); got != id {
+		t.Errorf("REQUEST_ID = %q, want the X-Request-ID %q", got, id)
+	}
+
+	// Every line about the fetch carries the same ID, from the query to the worker's reply
+	for _, line := range []string{
+		"[" + id + "] Proxying domain: proxied.test.",
+		"[" + id + "] Fetching from worker: https://proxied.test",
+		"[" + id + "] Worker response status: 200 OK",
+	} {
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("log missing %q:\n%s", line, logs)
+		}
+	}
+
+	// The next query gets an ID of its own
+	resetProxyIPCache(t)
+	queryProxiedTest(t)
+	if len(*requests) != 2 || (*requests)[1].Header.Get("X-Request-ID") == id {
+		t.Errorf("second query reused request ID %q", id)
+	}
+}
+
+func TestLookupProxyIPCacheHeaderTTL(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		honor        bool
+		ttl          uint32
+	}{
+		{"max-age=120", true, 120},
+		{"max-age=5", true, 30},
+		{"max-age=86400", true, 3600},
+		{"no-store", true, 30},
+		{"", true, 600},
+		{"max-age=120", false, 600},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%v", tt.cacheControl, tt.honor), func(t *testing.T) {
+			useConfig(t, &Config{
+				ProxyMode:              "persistent",
+				ProxyPersistentTTL:     600,
+				ProxyHonorCacheHeaders: tt.honor,
+				MinTTL:                 30,
+				MaxTTL:                 3600,
+			})
+			resetProxyIPCache(t)
+			useWorker(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"status":200,"resolvedIP":"203.0.113.1","cacheControl":%q}`, tt.cacheControl)
+			})
+
+			_, ttl, err := lookupProxyIP("example.com.", "")
+			if err != nil {
+				t.Fatalf("lookupProxyIP: %v", err)
+			}
+			if ttl != tt.ttl {
+				t.Errorf("TTL = %d, want %d", ttl, tt.ttl)
+			}
+
+			// The worker IP is reused for as long as the answer may be cached
+			proxyIPCache.Lock()
+			remaining := time.Until(proxyIPCache.entries["example.com"].expiresAt)
+			proxyIPCache.Unlock()
+			if want := time.Duration(tt.ttl) * time.Second; remaining > want || remaining < want-time.Minute {
+				t.Errorf("worker IP reused for %v, want %v", remaining, want)
+			}
+		})
+	}
+}
+
+func TestProxyCanaryPercentConfig(t *testing.T) {
+	tests := []struct {
+		data string
+		want int
+	}{
+		{`{}`, 100},
+		{`{"proxy_canary_percent": 0}`, 0},
+		{`{"proxy_canary_percent": 25}`, 25},
+		{`{"proxy_canary_percent": 250}`, 100},
+		{`{"proxy_canary_percent": -1}`, 100},
+	}
+	for _, tt := range tests {
+		config, err := parseConfig([]byte(tt.data))
+		if err != nil {
+			t.Fatalf("parseConfig(%s): %v", tt.data, err)
+		}
+		if *config.ProxyCanaryPercent != tt.want {
+			t.Errorf("parseConfig(%s) canary = %d, want %d", tt.data, *config.ProxyCanaryPercent, tt.want)
+		}
+	}
+}
+
+func TestProxyCanaryRatio(t *testing.T) {
+	zero, quarter := 0, 25
+	useConfig(t, &Config{
+		ProxyCanaryPercent: &quarter,
+		ProxyCanaryDomains: map[string]int{"half.test": 50, "off.test": 0, "all.test": 100},
+	})
+
+	// Count the share of 10000 clients routed through the proxy for each domain
+	ratio := func(domain string) float64 {
+		proxied := 0
+		for i := 0; i < 10000; i++ {
+			client := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+			if inProxyCanary(domain, client) {
+				proxied++
+			}
+		}
+		return float64(proxied) / 10000
+	}
+	for domain, want := range map[string]float64{
+		"global.test":     0.25,
+		"www.half.test":   0.50,
+		"half.test":       0.50,
+		"off.test":        0,
+		"cdn.all.test":    1,
+		"nothalf.test":    0.25,
+		"other.global.io": 0.25,
+	} {
+		if got := ratio(domain); got < want-0.03 || got > want+0.03 {
+			t.Errorf("%s: %.3f of clients proxied, want %.2f", domain, got, want)
+		}
+	}
+
+	// A client stays on its side of the split
+	client := net.ParseIP("192.0.2.7")
+	first := inProxyCanary("www.half.test", client)
+	for i := 0; i < 100; i++ {
+		if inProxyCanary("www.half.test", client) != first {
+			t.Fatal("canary decision flapped for the same client and domain")
+		}
+	}
+
+	// 0% globally turns the proxy off for everyone
+	useConfig(t, &Config{ProxyCanaryPercent: &zero})
+	if got := ratio("global.test"); got != 0 {
+		t.Errorf("%.3f of clients proxied at 0%%, want none", got)
+	}
+}
+
+func TestProxyUnexpectedWorkerContent(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	bodies := []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{"html error page", "text/html", []byte("<!DOCTYPE html><html><body>502 Bad Gateway</body></html>")},
+		{"json without envelope", "application/json", []byte(`{"error":"quota exceeded"}`)},
+		{"binary", "image/png", png},
+	}
+	tests := []struct {
+		action string
+		rcode  int
+		answer string
+	}{
+		{"", dns.RcodeSuccess, "192.0.2.80"},
+		{"upstream", dns.RcodeSuccess, "192.0.2.80"},
+		{"servfail", dns.RcodeServerFailure, ""},
+		{"worker", dns.RcodeSuccess, "127.0.0.1"},
+	}
+	for _, body := range bodies {
+		for _, tt := range tests {
+			t.Run(body.name+"/"+tt.action, func(t *testing.T) {
+				useConfig(t, &Config{
+					Nameservers:            []string{"192.0.2.1"},
+					ProxyDomains:           []string{"proxied.test"},
+					ProxyUnexpectedContent: tt.action,
+					HostsFile:              "off",
+				})
+				useMemoryCache(t)
+				useServerReady(t)
+				resetProxyIPCache(t)
+				upstream := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+					return replyWithA(m, "192.0.2.80"), nil
+				})
+				useWorker(t, func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", body.contentType)
+					w.Write(body.body)
+				})
+
+				m := queryProxiedTest(t)
+				if m.Rcode != tt.rcode {
+					t.Fatalf("rcode = %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.rcode])
+				}
+				var answer string
+				if len(m.Answer) == 1 {
+					answer = m.Answer[0].(*dns.A).A.String()
+				}
+				if answer != tt.answer {
+					t.Errorf("answer %v, want %q", m.Answer, tt.answer)
+				}
+				if forwarded := len(upstream.Calls()) > 0; forwarded != (tt.answer == "192.0.2.80") {
+					t.Errorf("%d upstream queries, want them only when falling back upstream", len(upstream.Calls()))
+				}
+			})
+		}
+	}
+
+	// An envelope is still used whatever the setting
+	useConfig(t, &Config{ProxyDomains: []string{"proxied.test"}, ProxyUnexpectedContent: "servfail", HostsFile: "off"})
+	useMemoryCache(t)
+	useServerReady(t)
+	resetProxyIPCache(t)
+	countingEnvelopeWorker(t)
+	if m := queryProxiedTest(t); len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "203.0.113.1" {
+		t.Errorf("envelope answered %v, want the worker's 203.0.113.1", m.Answer)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// minimizeQName shortens a query name for upstream privacy. For names under a
+// configured minimization zone only the zone plus QNameMinimizationKeepLabels
+// labels are sent, so the upstream never sees per-user or per-device prefixes.
+// It returns the name unchanged when minimization doesn't apply.
+func minimizeQName(name string) string {
+	config := currentConfig()
+	if !config.QNameMinimization {
+		return name
+	}
+
+	// Pick the most specific matching zone
+	name = dns.Fqdn(name)
+	zone := ""
+	for _, candidate := range config.QNameMinimizationZones {
+		candidate = dns.Fqdn(candidate)
+		if dns.IsSubDomain(candidate, name) && dns.CountLabel(candidate) > dns.CountLabel(zone) {
+			zone = candidate
+		}
+	}
+	if zone == "" {
+		return name
+	}
+
+	keep := dns.CountLabel(zone) + config.QNameMinimizationKeepLabels
+	labels := dns.SplitDomainName(name)
+	if len(labels) <= keep {
+		return name
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-keep:], "."))
+}
+
+// exchangeMinimized resolves q through exchange, probing the minimized name
+// first. The probe is an NS query, so it never answers the client's question.
+// If the minimized name doesn't exist neither does anything below it (RFC 8020)
+// and the full name is never sent. Otherwise the full name is asked as is.
+func exchangeMinimized(q dns.Question, checkingDisabled bool, exchange func(dns.Question, bool) (*dns.Msg, error)) (*dns.Msg, error) {
+	qname := minimizeQName(q.Name)
+	if qname == q.Name {
+		return exchange(q, checkingDisabled)
+	}
+
+	probe, err := exchange(dns.Question{Name: qname, Qtype: dns.TypeNS, Qclass: q.Qclass}, checkingDisabled)
+	if err != nil || probe.Rcode != dns.RcodeNameError {
+		return exchange(q, checkingDisabled)
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion(q.Name, q.Qtype)
+	r.Response = true
+	r.RecursionAvailable = probe.RecursionAvailable
+	r.Rcode = dns.RcodeNameError
+	r.Ns = probe.Ns
+	return r, nil
+}
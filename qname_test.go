@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMinimizeQName(t *testing.T) {
+	c := &Config{
+		QNameMinimization:           true,
+		QNameMinimizationZones:      []string{"example.com", "corp.example.com."},
+		QNameMinimizationKeepLabels: 1,
+	}
+	useConfig(t, c)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"user42.device7.cdn.example.com.", "cdn.example.com."},
+		{"cdn.example.com.", "cdn.example.com."},
+		{"example.com.", "example.com."},
+		{"Host.Team.Corp.Example.com", "Team.Corp.Example.com."},
+		{"user42.example.org.", "user42.example.org."},
+		{"user42.notexample.com.", "user42.notexample.com."},
+	}
+	for _, tt := range tests {
+		if got := minimizeQName(tt.name); got != tt.want {
+			t.Errorf("minimizeQName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	c.QNameMinimization = false
+	if got := minimizeQName("user42.device7.cdn.example.com."); got != "user42.device7.cdn.example.com." {
+		t.Errorf("minimizeQName with minimization off = %q, want the name unchanged", got)
+	}
+}
+
+func TestMinimizeQNameKeepNoLabels(t *testing.T) {
+	useConfig(t, &Config{QNameMinimization: true, QNameMinimizationZones: []string{"example.com"}})
+
+	if got := minimizeQName("a.b.example.com."); got != "example.com." {
+		t.Errorf("minimizeQName = %q, want only the zone", got)
+	}
+}
+
+// useMinimizingUpstream enables minimization for example.com and records the
+// questions upstream is asked. Names under gone.example.com. don't exist.
+func useMinimizingUpstream(t *testing.T) *[]string {
+	t.Helper()
+	useConfig(t, &Config{
+		Nameservers:                 []string{"192.0.2.1"},
+		QNameMinimization:           true,
+		QNameMinimizationZones:      []string{"example.com"},
+		QNameMinimizationKeepLabels: 1,
+	})
+	useMemoryCache(t)
+	var asked []string
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		q := m.Question[0]
+		asked = append(asked, q.Name+" "+dns.TypeToString[q.Qtype])
+		if dns.IsSubDomain("gone.example.com.", q.Name) {
+			r := new(dns.Msg)
+			r.SetRcode(m, dns.RcodeNameError)
+			soa, _ := dns.NewRR("example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 900 1209600 300")
+			r.Ns = []dns.RR{soa}
+			return r, nil
+		}
+		if q.Qtype == dns.TypeNS {
+			r := new(dns.Msg)
+			r.SetReply(m)
+			return r, nil
+		}
+		return replyWithA(m, "192.0.2.10"), nil
+	})
+	return &asked
+}
+
+func TestMinimizedQNameAnswersTheClientsName(t *testing.T) {
+	asked := useMinimizingUpstream(t)
+
+	q := new(dns.Msg)
+	q.SetQuestion("user42.cdn.example.com.", dns.TypeA)
+	m, _ := resolveWithDecision(q)
+
+	want := []string{"cdn.example.com. NS", "user42.cdn.example.com. A"}
+	if len(*asked) != 2 || (*asked)[0] != want[0] || (*asked)[1] != want[1] {
+		t.Errorf("upstream asked %v, want %v", *asked, want)
+	}
+	if len(m.Answer) != 1 || m.Answer[0].Header().Name != "user42.cdn.example.com." || m.Answer[0].(*dns.A).A.String() != "192.0.2.10" {
+		t.Errorf("answer = %v, want upstream's answer for user42.cdn.example.com.", m.Answer)
+	}
+}
+
+func TestMinimizedQNameNXDOMAIN(t *testing.T) {
+	asked := useMinimizingUpstream(t)
+
+	// Nothing exists under a missing name, so the full name is never sent
+	q := new(dns.Msg)
+	q.SetQuestion("user42.gone.example.com.", dns.TypeA)
+	m, _ := resolveWithDecision(q)
+
+	if len(*asked) != 1 || (*asked)[0] != "gone.example.com. NS" {
+		t.Errorf("upstream asked %v, want only the minimized NS probe", *asked)
+	}
+	if m.Rcode != dns.RcodeNameError || len(m.Answer) != 0 {
+		t.Errorf("got rcode %s with %v, want NXDOMAIN", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	if len(m.Question) != 1 || m.Question[0].Name != "user42.gone.example.com." {
+		t.Errorf("question = %v, want the client's name", m.Question)
+	}
+}
+
+func TestUnminimizedQNameSentOnce(t *testing.T) {
+	asked := useMinimizingUpstream(t)
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.org.", dns.TypeA)
+	resolveWithDecision(q)
+	if len(*asked) != 1 || (*asked)[0] != "www.example.org. A" {
+		t.Errorf("upstream asked %v, want just the client's question", *asked)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rateLimitIdle is how long an untouched client bucket is kept before pruning
+const rateLimitIdle = 5 * time.Minute
+
+// tokenBucket tracks one client's query allowance
+type tokenBucket struct {
+	tokens  float64
+	last    time.Time
+	limited uint64
+}
+
+// rateLimiter applies a per-client token bucket to incoming queries
+type rateLimiter struct {
+	mutex     sync.Mutex
+	qps       float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+// newRateLimiter creates a limiter from the configured rate, or nil when disabled
+func newRateLimiter(config *Config) *rateLimiter {
+	if config.RateLimitQPS <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		qps:       config.RateLimitQPS,
+		burst:     float64(config.RateLimitBurst),
+		buckets:   make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// reconfigureRateLimiter applies the configured rate to an existing limiter,
+// keeping its client buckets, and creates or drops the limiter as needed
+func reconfigureRateLimiter(l *rateLimiter, config *Config) *rateLimiter {
+	if l == nil || config.RateLimitQPS <= 0 {
+		return newRateLimiter(config)
+	}
+	l.Reconfigure(config.RateLimitQPS, float64(config.RateLimitBurst))
+	return l
+}
+
+// Reconfigure changes the rate and burst in place. Each bucket is refilled at
+// the old rate up to now and then capped at the new burst, so a lower burst
+// applies at once and a higher one doesn't hand out tokens clients didn't earn.
+func (l *rateLimiter) Reconfigure(qps float64, burst float64) {
+	l.reconfigureAt(qps, burst, time.Now())
+}
+
+// reconfigureAt is Reconfigure with an explicit clock
+func (l *rateLimiter) reconfigureAt(qps float64, burst float64, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, bucket := range l.buckets {
+		bucket.tokens += now.Sub(bucket.last).Seconds() * l.qps
+		if bucket.tokens > l.burst {
+			bucket.tokens = l.burst
+		}
+		if bucket.tokens > burst {
+			bucket.tokens = burst
+		}
+		bucket.last = now
+	}
+	l.qps = qps
+	l.burst = burst
+}
+
+// Allow takes a token for the client, returning false and the number of
+// consecutive limited queries when the client is over its limit
+func (l *rateLimiter) Allow(ip net.IP) (bool, uint64) {
+	if l == nil || ip == nil {
+		return true, 0
+	}
+
+	now := time.Now()
+	key := ip.String()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastPrune) > rateLimitIdle {
+		l.prune(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	// Refill for the time elapsed since the last query
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.qps
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		bucket.limited++
+		return false, bucket.limited
+	}
+	bucket.tokens--
+	bucket.limited = 0
+	return true, 0
+}
+
+// prune drops buckets of clients that have been quiet for a while
+func (l *rateLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) > rateLimitIdle {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// handleRateLimited answers (or drops) a query from a client over its limit.
+// The truncate action implements RRL slip: every RateLimitSlip-th limited
+// query gets an empty truncated reply so real clients can retry over TCP,
+// the rest are dropped.
+func handleRateLimited(w dns.ResponseWriter, r *dns.Msg, limited uint64) {
+	config := currentConfig()
+	action := config.RateLimitAction
+	rateLimitedQueries.Inc(action)
+
+	m := new(dns.Msg)
+	switch action {
+	case "drop":
+		return
+	case "servfail":
+		m.SetRcode(r, dns.RcodeServerFailure)
+	case "truncate":
+		// TCP clients can't be spoofed, so there is nothing to gain from slipping
+		if _, isTCP := w.RemoteAddr().(*net.TCPAddr); isTCP {
+			m.SetRcode(r, dns.RcodeRefused)
+			break
+		}
+		slip := uint64(config.RateLimitSlip)
+		if slip == 0 || limited%slip != 0 {
+			return
+		}
+		m.SetReply(r)
+		m.Truncated = true
+	default:
+		m.SetRcode(r, dns.RcodeRefused)
+	}
+	w.WriteMsg(m)
+}
+
+// Rate limiting metrics
+var rateLimitedQueries = newCounterVec(
+	"phantomdns_rate_limited_queries_total",
+	"Queries from clients over their rate limit, by configured action.",
+	"action",
+)
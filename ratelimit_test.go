@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useRateLimit allows each client a single query, then applies action
+func useRateLimit(t *testing.T, action string) {
+	t.Helper()
+	useConfig(t, &Config{ProxyDomains: []string{"owned.test"}, RateLimitQPS: 0.01, RateLimitAction: action})
+	useServerReady(t)
+	if w := queryFrom("127.0.0.1"); len(w.replies) != 1 || w.replies[0].Rcode != dns.RcodeSuccess {
+		t.Fatalf("first query not answered normally: %v", w.replies)
+	}
+}
+
+func TestRateLimitActionRcodes(t *testing.T) {
+	for action, rcode := range map[string]int{"refused": dns.RcodeRefused, "servfail": dns.RcodeServerFailure} {
+		t.Run(action, func(t *testing.T) {
+			useRateLimit(t, action)
+			w := queryFrom("127.0.0.1")
+			if len(w.replies) != 1 {
+				t.Fatalf("got %d replies, want 1", len(w.replies))
+			}
+			if got := w.replies[0].Rcode; got != rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[got], dns.RcodeToString[rcode])
+			}
+		})
+	}
+}
+
+func TestRateLimitActionDrop(t *testing.T) {
+	useRateLimit(t, "drop")
+	if w := queryFrom("127.0.0.1"); len(w.replies) != 0 {
+		t.Errorf("got %d replies, want the query dropped", len(w.replies))
+	}
+
+	// Other clients have their own budget
+	if w := queryFrom("127.0.0.2"); len(w.replies) != 1 {
+		t.Errorf("another client got %d replies, want 1", len(w.replies))
+	}
+}
+
+func TestRateLimitActionTruncateSlips(t *testing.T) {
+	useRateLimit(t, "truncate")
+
+	// With the default slip of 2 every second limited query gets a TC reply
+	var replies []*dns.Msg
+	for i := 0; i < 4; i++ {
+		replies = append(replies, queryFrom("127.0.0.1").replies...)
+	}
+	if len(replies) != 2 {
+		t.Fatalf("got %d replies to 4 limited queries, want 2", len(replies))
+	}
+	for _, m := range replies {
+		if !m.Truncated || len(m.Answer) != 0 || m.Rcode != dns.RcodeSuccess {
+			t.Errorf("reply TC=%v with %d answers and rcode %s, want an empty truncated reply", m.Truncated, len(m.Answer), dns.RcodeToString[m.Rcode])
+		}
+	}
+}
+
+func TestRateLimitActionTruncateOverTCP(t *testing.T) {
+	useConfig(t, &Config{ProxyDomains: []string{"owned.test"}, RateLimitQPS: 0.01, RateLimitAction: "truncate"})
+	useServerReady(t)
+
+	var replies []*dns.Msg
+	for i := 0; i < 2; i++ {
+		w := &fakeResponseWriter{remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53000}}
+		q := new(dns.Msg)
+		q.SetQuestion("owned.test.", dns.TypeSOA)
+		handleDNSRequest(w, q)
+		replies = append(replies, w.replies...)
+	}
+	if len(replies) != 2 {
+		t.Fatalf("got %d replies, want 2", len(replies))
+	}
+	if replies[1].Rcode != dns.RcodeRefused || replies[1].Truncated {
+		t.Errorf("limited TCP query got rcode %s (TC=%v), want REFUSED since TCP can't be spoofed", dns.RcodeToString[replies[1].Rcode], replies[1].Truncated)
+	}
+}
+
+// allowed counts how many of n queries from ip the limiter lets through
+func allowed(l *rateLimiter, ip string, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if ok, _ := l.Allow(net.ParseIP(ip)); ok {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRateLimiterReconfigureKeepsBuckets(t *testing.T) {
+	l := newRateLimiter(&Config{RateLimitQPS: 0.01, RateLimitBurst: 5})
+	if got := allowed(l, "192.0.2.1", 10); got != 5 {
+		t.Fatalf("%d of 10 queries allowed, want the burst of 5", got)
+	}
+	allowed(l, "192.0.2.2", 1)
+
+	// A bigger burst doesn't refill a client that used up its tokens
+	l.Reconfigure(0.01, 10)
+	if got := allowed(l, "192.0.2.1", 10); got != 0 {
+		t.Errorf("exhausted client allowed %d queries after the reload, want its bucket kept", got)
+	}
+	// New clients start with the new burst
+	if got := allowed(l, "192.0.2.3", 20); got != 10 {
+		t.Errorf("new client allowed %d queries, want the new burst of 10", got)
+	}
+
+	// A smaller burst caps saved up tokens at once
+	l.Reconfigure(0.01, 2)
+	if got := allowed(l, "192.0.2.2", 10); got != 2 {
+		t.Errorf("client with 4 saved tokens allowed %d queries, want the new burst of 2", got)
+	}
+
+	// A higher rate refills existing buckets from now on
+	l.Reconfigure(1000, 2)
+	time.Sleep(20 * time.Millisecond)
+	if got := allowed(l, "192.0.2.1", 1); got != 1 {
+		t.Error("exhausted client still limited after the rate was raised")
+	}
+}
+
+func TestRateLimiterReconfigureAtRefillsAtOldRate(t *testing.T) {
+	l := newRateLimiter(&Config{RateLimitQPS: 1, RateLimitBurst: 10})
+	allowed(l, "192.0.2.1", 10)
+	bucket := l.buckets["192.0.2.1"]
+
+	// Time before the reload earns tokens at the old rate, not the new one
+	l.reconfigureAt(100, 10, bucket.last.Add(3*time.Second))
+	if bucket.tokens < 2.9 || bucket.tokens > 3.1 {
+		t.Errorf("bucket holds %.2f tokens after 3s at 1 qps, want 3", bucket.tokens)
+	}
+}
+
+func TestReloadKeepsRateLimitState(t *testing.T) {
+	first := &Config{RateLimitQPS: 0.01, RateLimitBurst: 3}
+	applyConfigDefaults(first)
+	state, err := newRuntimeState(first, nil)
+	if err != nil {
+		t.Fatalf("newRuntimeState: %v", err)
+	}
+	allowed(state.limiter, "192.0.2.1", 3)
+
+	second := &Config{RateLimitQPS: 0.01, RateLimitBurst: 6}
+	applyConfigDefaults(second)
+	reloaded, err := newRuntimeState(second, state)
+	if err != nil {
+		t.Fatalf("newRuntimeState: %v", err)
+	}
+	if reloaded.limiter != state.limiter {
+		t.Error("reload replaced the rate limiter, resetting every client")
+	}
+	if got := allowed(reloaded.limiter, "192.0.2.1", 1); got != 0 {
+		t.Error("reload let an exhausted client burst again")
+	}
+	if got := allowed(reloaded.limiter, "192.0.2.2", 10); got != 6 {
+		t.Errorf("new client allowed %d queries after the reload, want the new burst of 6", got)
+	}
+
+	// Turning rate limiting off drops the limiter
+	off := &Config{}
+	applyConfigDefaults(off)
+	if disabled, err := newRuntimeState(off, reloaded); err != nil || disabled.limiter != nil {
+		t.Errorf("limiter after disabling = %v, %v, want none", disabled.limiter, err)
+	}
+}
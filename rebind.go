@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rebindFilter removes private addresses from upstream answers for public names,
+// so a hostile domain can't rebind itself onto the local network
+type rebindFilter struct {
+	protected []*net.IPNet
+	allowed   []string
+}
+
+// newRebindFilter builds the filter from the configured CIDRs, or nil when disabled
+func newRebindFilter(config *Config) (*rebindFilter, error) {
+	if !config.RebindProtection {
+		return nil, nil
+	}
+
+	protected, err := parseCIDRList(config.RebindProtectedCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rebind_protected_cidrs: %v", err)
+	}
+
+	allowed := make([]string, 0, len(config.RebindAllowedDomains))
+	for _, domain := range config.RebindAllowedDomains {
+		allowed = append(allowed, strings.ToLower(dns.Fqdn(domain)))
+	}
+
+	return &rebindFilter{protected: protected, allowed: allowed}, nil
+}
+
+// isAllowed reports whether a name may legitimately resolve to protected addresses
+func (f *rebindFilter) isAllowed(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, domain := range f.allowed {
+		if dns.IsSubDomain(domain, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isProtected reports whether an address falls in a protected range
+func (f *rebindFilter) isProtected(ip net.IP) bool {
+	for _, network := range f.protected {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter strips A/AAAA records pointing at protected addresses from an answer.
+// It returns the remaining records and whether anything was removed.
+func (f *rebindFilter) Filter(name string, records []dns.RR) ([]dns.RR, bool) {
+	if f == nil || f.isAllowed(name) {
+		return records, false
+	}
+
+	kept := make([]dns.RR, 0, len(records))
+	stripped := false
+	for _, rr := range records {
+		var ip net.IP
+		switch record := rr.(type) {
+		case *dns.A:
+			ip = record.A
+		case *dns.AAAA:
+			ip = record.AAAA
+		}
+		if ip != nil && f.isProtected(ip) {
+			stripped = true
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	return kept, stripped
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// resolveRebindTest resolves name against an upstream answering with ips
+func resolveRebindTest(t *testing.T, c *Config, name string, ips ...string) *dns.Msg {
+	t.Helper()
+	c.Nameservers = []string{"192.0.2.1"}
+	c.RebindProtection = true
+	useConfig(t, c)
+	useMemoryCache(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, ips...), nil
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	m, _ := resolveWithDecision(q)
+	return m
+}
+
+func TestRebindProtectionStripsLoopback(t *testing.T) {
+	m := resolveRebindTest(t, &Config{}, "attacker.example.", "127.0.0.1")
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("got rcode %s with %v, want 127.0.0.1 stripped from the answer", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+}
+
+func TestRebindProtectionKeepsPublicAddresses(t *testing.T) {
+	m := resolveRebindTest(t, &Config{}, "mixed.example.", "192.168.1.10", "93.184.216.34")
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "93.184.216.34" {
+		t.Errorf("answer = %v, want only the public address left", m.Answer)
+	}
+}
+
+func TestRebindProtectionStripsIPv6(t *testing.T) {
+	tests := []struct {
+		name string
+		ips  []string
+		want []string
+	}{
+		{"loopback", []string{"::1"}, nil},
+		{"unique local", []string{"fd00::1"}, nil},
+		{"link local", []string{"fe80::1"}, nil},
+		{"mixed", []string{"fc00::5", "2606:2800:220:1:248:1893:25c8:1946"}, []string{"2606:2800:220:1:248:1893:25c8:1946"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, RebindProtection: true})
+			useMemoryCache(t)
+			useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+				return replyWithAAAA(m, tt.ips...), nil
+			})
+
+			q := new(dns.Msg)
+			q.SetQuestion("attacker.example.", dns.TypeAAAA)
+			m, _ := resolveWithDecision(q)
+			if m.Rcode != dns.RcodeSuccess || len(m.Answer) != len(tt.want) {
+				t.Fatalf("got rcode %s with %v, want %v", dns.RcodeToString[m.Rcode], m.Answer, tt.want)
+			}
+			for i, ip := range tt.want {
+				if got := m.Answer[i].(*dns.AAAA).AAAA.String(); got != ip {
+					t.Errorf("answer %d = %s, want %s", i, got, ip)
+				}
+			}
+		})
+	}
+}
+
+func TestRebindProtectionNXDOMAIN(t *testing.T) {
+	m := resolveRebindTest(t, &Config{RebindAction: "nxdomain"}, "attacker.example.", "10.0.0.5")
+	if m.Rcode != dns.RcodeNameError || len(m.Answer) != 0 {
+		t.Errorf("got rcode %s with %v, want NXDOMAIN", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+}
+
+func TestRebindProtectionAllowedDomain(t *testing.T) {
+	m := resolveRebindTest(t, &Config{RebindAllowedDomains: []string{"corp.example"}}, "nas.corp.example.", "192.168.1.20")
+	if len(m.Answer) != 1 {
+		t.Errorf("answer = %v, want the private address kept for an allowlisted name", m.Answer)
+	}
+}
+
+func TestRebindProtectionDisabled(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}})
+	useMemoryCache(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "127.0.0.1"), nil
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("localhost.example.", dns.TypeA)
+	if m, _ := resolveWithDecision(q); len(m.Answer) != 1 {
+		t.Errorf("answer = %v, want it untouched with rebind_protection off", m.Answer)
+	}
+}
+
+func TestNewRebindFilterInvalidCIDR(t *testing.T) {
+	if _, err := newRebindFilter(&Config{RebindProtection: true, RebindProtectedCIDRs: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("invalid CIDR accepted, want an error")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// runCommand runs an external command and returns its combined output.
+// It is a variable so the deploy flow can be driven without the blessnet CLI.
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// deployedURLPattern finds the worker URL in blessnet deploy output
+var deployedURLPattern = regexp.MustCompile(`https://[A-Za-z0-9.-]+\.bls\.dev`)
+
+// RedeployWorker writes a fresh worker from CreateWorkerTemplate, deploys it
+// with the blessnet CLI and switches the client to the deployed URL
+func (b *BlessnetClient) RedeployWorker() (string, error) {
+	config := currentConfig()
+
+	// Never ship a worker that is malformed
+	source := b.CreateWorkerTemplate(b.workerTemplateOptions())
+	if err := ValidateWorkerTemplate(source); err != nil {
+		return "", fmt.Errorf("generated worker is invalid: %v", err)
+	}
+	if err := ioutil.WriteFile(config.WorkerSourcePath, []byte(source), 0644); err != nil {
+		return "", fmt.Errorf("error writing worker source: %v", err)
+	}
+	if config.WorkerTypeCheck {
+		ran, err := typeCheckWorker(config.WorkerSourcePath)
+		if err != nil {
+			return "", err
+		}
+		if !ran {
+			log.Printf("tsc not found, deploying %s without a type check", config.WorkerSourcePath)
+		}
+	}
+
+	output, err := runCommand("blessnet", "deploy")
+	if err != nil {
+		return "", fmt.Errorf("failed to deploy worker: %v: %s", err, output)
+	}
+
+	workerURL := deployedURLPattern.FindString(string(output))
+	if workerURL == "" {
+		return "", fmt.Errorf("deploy output contains no worker URL")
+	}
+
+	// The fresh deployment replaces any node picked before it
+	b.mutex.Lock()
+	b.WorkerURL = workerURL
+	b.ActiveNode = ""
+	b.mutex.Unlock()
+
+	return workerURL, nil
+}
+
+// workerRedeployer redeploys the worker after repeated failed self-tests,
+// at most once per cooldown so a persistent outage can't cause a deploy loop
+type workerRedeployer struct {
+	mutex        sync.Mutex
+	failures     int
+	lastRedeploy time.Time
+	redeploy     func() (string, error)
+}
+
+// Global redeployer fed by the health check loop
+var redeployer = &workerRedeployer{
+	redeploy: func() (string, error) { return blessnetClient.RedeployWorker() },
+}
+
+// Observe records a proxy self-test result and redeploys when the worker has
+// failed AutoRedeployAfterFailures times in a row. It reports whether a redeploy ran.
+func (r *workerRedeployer) Observe(proxyOK bool) bool {
+	config := currentConfig()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if proxyOK {
+		r.failures = 0
+		return false
+	}
+	r.failures++
+
+	if !config.AutoRedeploy || r.failures < config.AutoRedeployAfterFailures {
+		return false
+	}
+	cooldown := time.Duration(config.AutoRedeployCooldownSeconds) * time.Second
+	if !r.lastRedeploy.IsZero() && time.Since(r.lastRedeploy) < cooldown {
+		return false
+	}
+
+	log.Printf("Worker failed %d self-tests in a row, redeploying", r.failures)
+	r.lastRedeploy = time.Now()
+	workerURL, err := r.redeploy()
+	if err != nil {
+		log.Printf("Worker redeploy failed: %v", err)
+		return true
+	}
+	log.Printf("Worker redeployed at %s", workerURL)
+	r.failures = 0
+	return true
+}
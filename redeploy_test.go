@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useFakeRunner replaces the blessnet CLI with one that reports a deployed worker URL
+func useFakeRunner(t *testing.T) *[]string {
+	t.Helper()
+	var mutex sync.Mutex
+	var commands []string
+	old := runCommand
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		mutex.Lock()
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		mutex.Unlock()
+		return []byte("Deployed function at https://redeployed-worker.bls.dev\n"), nil
+	}
+	t.Cleanup(func() { runCommand = old })
+	return &commands
+}
+
+// useBrokenWorker configures auto redeploy against a worker that fails every self-test
+func useBrokenWorker(t *testing.T) string {
+	t.Helper()
+	source := filepath.Join(t.TempDir(), "index.ts")
+	useConfig(t, &Config{
+		AutoRedeploy:                true,
+		AutoRedeployAfterFailures:   2,
+		AutoRedeployCooldownSeconds: 3600,
+		WorkerSourcePath:            source,
+	})
+	useWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "worker script error", http.StatusNotFound)
+	})
+	return source
+}
+
+func TestRedeployBrokenWorkerOncePerCooldown(t *testing.T) {
+	source := useBrokenWorker(t)
+	commands := useFakeRunner(t)
+	r := &workerRedeployer{redeploy: blessnetClient.RedeployWorker}
+
+	// The first self-test really goes through the broken worker
+	check := checkProxyHealth()
+	if check.OK {
+		t.Fatal("proxy self-test passed against a broken worker")
+	}
+	if r.Observe(check.OK) {
+		t.Error("redeployed after one failure, want auto_redeploy_after_failures of 2")
+	}
+
+	redeploys := 0
+	for i := 0; i < 10; i++ {
+		if r.Observe(false) {
+			redeploys++
+		}
+	}
+	if redeploys != 1 || len(*commands) != 1 || (*commands)[0] != "blessnet deploy" {
+		t.Errorf("%d redeploys running %v, want exactly one blessnet deploy within the cooldown", redeploys, *commands)
+	}
+	if blessnetClient.WorkerURL != "https://redeployed-worker.bls.dev" {
+		t.Errorf("WorkerURL = %q, want the redeployed worker", blessnetClient.WorkerURL)
+	}
+	if data, err := os.ReadFile(source); err != nil || ValidateWorkerTemplate(string(data)) != nil {
+		t.Errorf("worker source not rewritten from the template: %v", err)
+	}
+
+	// Once the cooldown has passed a still broken worker is redeployed again
+	r.lastRedeploy = time.Now().Add(-2 * time.Hour)
+	if !r.Observe(false) || len(*commands) != 2 {
+		t.Errorf("ran %d deploys after the cooldown, want a second one", len(*commands))
+	}
+}
+
+func TestRedeployNeedsConsecutiveFailures(t *testing.T) {
+	useBrokenWorker(t)
+	calls := 0
+	r := &workerRedeployer{redeploy: func() (string, error) {
+		calls++
+		return "https://redeployed-worker.bls.dev", nil
+	}}
+
+	// A passing self-test in between resets the count
+	for _, ok := range []bool{false, true, false, true, false} {
+		r.Observe(ok)
+	}
+	if calls != 0 {
+		t.Errorf("redeployed %d times without consecutive failures, want 0", calls)
+	}
+}
+
+func TestRedeployDisabled(t *testing.T) {
+	useConfig(t, &Config{AutoRedeployAfterFailures: 1})
+	calls := 0
+	r := &workerRedeployer{redeploy: func() (string, error) {
+		calls++
+		return "", nil
+	}}
+
+	for i := 0; i < 5; i++ {
+		r.Observe(false)
+	}
+	if calls != 0 {
+		t.Errorf("redeployed %d times with auto_redeploy off, want 0", calls)
+	}
+}
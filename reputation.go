@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// reputationErrorTTL is how long a failed check is remembered as allowed,
+	// so an unreachable service doesn't add its timeout to every query
+	reputationErrorTTL = 30 * time.Second
+
+	// reputationMaxEntries bounds the verdict cache
+	reputationMaxEntries = 10000
+)
+
+// reputationEntry is a cached verdict for a domain
+type reputationEntry struct {
+	block     bool
+	expiresAt time.Time
+}
+
+// reputationChecker asks an external reputation service whether to block a
+// domain. The service is called as GET <ReputationURL>?domain=<name> and
+// answers {"verdict": "block"} or {"verdict": "allow"}. Any error allows the
+// domain, resolution must not depend on the service being up.
+type reputationChecker struct {
+	endpoint string
+	ttl      time.Duration
+	client   *http.Client
+	mutex    sync.Mutex
+	cache    map[string]reputationEntry
+}
+
+// newReputationChecker creates a checker from the config, or nil when disabled
+func newReputationChecker(config *Config) *reputationChecker {
+	if config.ReputationURL == "" {
+		return nil
+	}
+	return &reputationChecker{
+		endpoint: config.ReputationURL,
+		ttl:      time.Duration(config.ReputationCacheSeconds) * time.Second,
+		client:   &http.Client{Timeout: time.Duration(config.ReputationTimeoutMs) * time.Millisecond},
+		cache:    make(map[string]reputationEntry),
+	}
+}
+
+// Blocked reports whether the service says to block a domain. A nil checker
+// never blocks.
+func (c *reputationChecker) Blocked(domain string) bool {
+	if c == nil {
+		return false
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	now := time.Now()
+
+	c.mutex.Lock()
+	entry, ok := c.cache[domain]
+	c.mutex.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.block
+	}
+
+	block, err := c.lookup(domain)
+	ttl := c.ttl
+	if err != nil {
+		log.Printf("Reputation check for %s failed, allowing: %v", domain, err)
+		reputationChecks.Inc("error")
+		block, ttl = false, reputationErrorTTL
+	} else if block {
+		reputationChecks.Inc("block")
+	} else {
+		reputationChecks.Inc("allow")
+	}
+
+	c.mutex.Lock()
+	if len(c.cache) >= reputationMaxEntries {
+		c.prune(now)
+	}
+	c.cache[domain] = reputationEntry{block: block, expiresAt: now.Add(ttl)}
+	c.mutex.Unlock()
+	return block
+}
+
+// prune drops expired verdicts, or all of them if that doesn't free any room.
+// Callers must hold the mutex.
+func (c *reputationChecker) prune(now time.Time) {
+	for domain, entry := range c.cache {
+		if !now.Before(entry.expiresAt) {
+			delete(c.cache, domain)
+		}
+	}
+	if len(c.cache) >= reputationMaxEntries {
+		c.cache = make(map[string]reputationEntry)
+	}
+}
+
+// lookup asks the service for a verdict
+func (c *reputationChecker) lookup(domain string) (bool, error) {
+	u, err := url.Parse(c.endpoint)
+	if err != nil {
+		return false, fmt.Errorf("invalid reputation_url: %v", err)
+	}
+	query := u.Query()
+	query.Set("domain", domain)
+	u.RawQuery = query.Encode()
+
+	resp, err := c.client.Get(u.String())
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("reputation service returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Verdict string `json:"verdict"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+		return false, fmt.Errorf("error decoding reputation response: %v", err)
+	}
+	return strings.EqualFold(result.Verdict, "block"), nil
+}
+
+// Reputation metrics
+var reputationChecks = newCounterVec(
+	"phantomdns_reputation_checks_total",
+	"Reputation service lookups, by verdict (block, allow or error).",
+	"verdict",
+)
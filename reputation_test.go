@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// reputationServer flags the domains in bad and records every domain asked about
+func reputationServer(t *testing.T, bad ...string) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mutex sync.Mutex
+	var asked []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		domain := r.URL.Query().Get("domain")
+		mutex.Lock()
+		asked = append(asked, domain)
+		mutex.Unlock()
+
+		verdict := "allow"
+		for _, name := range bad {
+			if domain == name {
+				verdict = "block"
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]string{"verdict": verdict})
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), asked...)
+	}
+}
+
+// useReputation installs a config consulting the reputation service at url
+// with an upstream answering everything
+func useReputation(t *testing.T, url string, timeoutMs int) *fakeExchanger {
+	t.Helper()
+	useConfig(t, &Config{
+		Nameservers:         []string{"192.0.2.1"},
+		BlockedDomains:      []string{"ads.example"},
+		ReputationURL:       url,
+		ReputationTimeoutMs: timeoutMs,
+		HostsFile:           "off",
+	})
+	useMemoryCache(t)
+	return useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "192.0.2.80"), nil
+	})
+}
+
+func TestReputationBlockAndAllow(t *testing.T) {
+	server, asked := reputationServer(t, "malware.example")
+	upstream := useReputation(t, server.URL, 0)
+
+	q := new(dns.Msg)
+	q.SetQuestion("malware.example.", dns.TypeA)
+	m, decision := resolveWithDecision(q)
+	if decision != "blocked" || m.Rcode != dns.RcodeNameError {
+		t.Errorf("flagged domain got %s (%s), want it blocked with NXDOMAIN", dns.RcodeToString[m.Rcode], decision)
+	}
+
+	q.SetQuestion("good.example.", dns.TypeA)
+	m, decision = resolveWithDecision(q)
+	if decision != "forwarded" || len(m.Answer) != 1 {
+		t.Errorf("allowed domain got %v (%s), want the upstream answer", m.Answer, decision)
+	}
+	if len(upstream.Calls()) != 1 {
+		t.Errorf("%d upstream queries, want only the allowed domain forwarded", len(upstream.Calls()))
+	}
+
+	// Names on the static lists are decided without asking
+	q.SetQuestion("tracker.ads.example.", dns.TypeA)
+	if _, decision := resolveWithDecision(q); decision != "blocked" {
+		t.Errorf("listed domain decision = %q, want blocked", decision)
+	}
+	if got := asked(); len(got) != 2 || got[0] != "malware.example" || got[1] != "good.example" {
+		t.Errorf("service asked about %v, want only the unlisted domains", got)
+	}
+}
+
+func TestReputationVerdictsCached(t *testing.T) {
+	server, asked := reputationServer(t, "malware.example")
+	useReputation(t, server.URL, 0)
+	checker := currentState().reputation
+
+	for i := 0; i < 3; i++ {
+		if !checker.Blocked("malware.example.") || checker.Blocked("good.example.") {
+			t.Fatalf("round %d: wrong verdicts", i+1)
+		}
+	}
+	if got := asked(); len(got) != 2 {
+		t.Errorf("service asked %d times, want each domain once: %v", len(got), got)
+	}
+}
+
+func TestReputationFailsOpen(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(2 * time.Second):
+		}
+		json.NewEncoder(w).Encode(map[string]string{"verdict": "block"})
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(broken.Close)
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"timeout", slow.URL},
+		{"error status", broken.URL},
+		{"unreachable", closedServerURL()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useReputation(t, tt.url, 100)
+			failed := reputationChecks.Value("error")
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			start := time.Now()
+			m, decision := resolveWithDecision(q)
+			if decision != "forwarded" || len(m.Answer) != 1 {
+				t.Errorf("got %v (%s), want the name allowed and forwarded", m.Answer, decision)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("query took %v, want the check to give up after its timeout", elapsed)
+			}
+			if got := reputationChecks.Value("error"); got != failed+1 {
+				t.Errorf("phantomdns_reputation_checks_total{verdict=\"error\"} = %v, want %v", got, failed+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// retransmitKey identifies a query across client retransmissions
+type retransmitKey struct {
+	client string
+	id     uint16
+	qname  string
+	qtype  uint16
+}
+
+// pendingQuery is a query still being resolved. done is closed once it has
+// finished, with reply set if an answer was produced.
+type pendingQuery struct {
+	done  chan struct{}
+	reply *dns.Msg
+}
+
+// retransmitTracker coalesces UDP retransmissions onto the query already in flight
+type retransmitTracker struct {
+	mutex   sync.Mutex
+	pending map[retransmitKey]*pendingQuery
+}
+
+// Global tracker of UDP queries being resolved
+var pendingQueries = newRetransmitTracker()
+
+// newRetransmitTracker creates an empty tracker
+func newRetransmitTracker() *retransmitTracker {
+	return &retransmitTracker{pending: make(map[retransmitKey]*pendingQuery)}
+}
+
+// newRetransmitKey builds the key for a query from a client address
+func newRetransmitKey(addr net.Addr, r *dns.Msg) retransmitKey {
+	q := r.Question[0]
+	return retransmitKey{client: addr.String(), id: r.Id, qname: q.Name, qtype: q.Qtype}
+}
+
+// Begin registers a query, returning the pending entry and true when this is
+// the first copy, or the entry of the copy already in flight and false
+func (t *retransmitTracker) Begin(key retransmitKey) (*pendingQuery, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if pending, ok := t.pending[key]; ok {
+		return pending, false
+	}
+	pending := &pendingQuery{done: make(chan struct{})}
+	t.pending[key] = pending
+	return pending, true
+}
+
+// Finish removes a query and releases any retransmissions waiting on it
+func (t *retransmitTracker) Finish(key retransmitKey, pending *pendingQuery) {
+	t.mutex.Lock()
+	delete(t.pending, key)
+	t.mutex.Unlock()
+	close(pending.done)
+}
+
+// Resolve records the answer for retransmissions to share. A nil pending
+// query (dedup disabled or not UDP) is ignored.
+func (p *pendingQuery) Resolve(m *dns.Msg) {
+	if p != nil {
+		p.reply = m.Copy()
+	}
+}
+
+// handleDuplicateQuery deals with a retransmission of a query still in
+// flight: "drop" ignores it, "wait" answers it with the original's reply
+func handleDuplicateQuery(w dns.ResponseWriter, r *dns.Msg, pending *pendingQuery) {
+	action := currentConfig().DuplicateQueryAction
+	duplicateQueries.Inc(action)
+	if action == "drop" {
+		return
+	}
+
+	<-pending.done
+	if pending.reply == nil {
+		return
+	}
+	m := pending.reply.Copy()
+	padReply(m, r, true)
+	w.WriteMsg(m)
+}
+
+// Retransmission metrics
+var duplicateQueries = newCounterVec(
+	"phantomdns_duplicate_queries_total",
+	"UDP retransmissions of a query still being resolved, by configured action.",
+	"action",
+)
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useBlockingWorker installs a worker that holds every fetch until release is
+// called, reporting each one on entered and counting them in fetches. Held
+// fetches are released when the test ends.
+func useBlockingWorker(t *testing.T) (entered chan struct{}, release func(), fetches *atomic.Int32) {
+	t.Helper()
+	entered = make(chan struct{}, 8)
+	released := make(chan struct{})
+	var once sync.Once
+	release = func() { once.Do(func() { close(released) }) }
+	fetches = &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := fetches.Add(1)
+		entered <- struct{}{}
+		<-released
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":200,"target":%q,"resolvedIP":"203.0.113.%d","contentType":"text/html"}`, r.URL.Query().Get("TARGET"), n)
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(release)
+
+	old := blessnetClient
+	blessnetClient = &BlessnetClient{Config: currentConfig(), WorkerURL: server.URL, auth: &AuthConfig{}}
+	t.Cleanup(func() { blessnetClient = old })
+	return entered, release, fetches
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRetransmittedQueryCoalesced(t *testing.T) {
+	tests := []struct {
+		action  string
+		fetches int32
+		replies int
+	}{
+		{"wait", 1, 1},
+		{"drop", 1, 0},
+		{"off", 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			useConfig(t, &Config{ProxyDomains: []string{"proxied.test"}, DuplicateQueryAction: tt.action, HostsFile: "off"})
+			useMemoryCache(t)
+			useServerReady(t)
+			resetProxyIPCache(t)
+			entered, release, fetches := useBlockingWorker(t)
+			duplicates := duplicateQueries.Value(tt.action)
+
+			q := new(dns.Msg)
+			q.SetQuestion("proxied.test.", dns.TypeA)
+			q.Id = 4242
+			original, retransmit := newFakeResponseWriter("127.0.0.7"), newFakeResponseWriter("127.0.0.7")
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				handleDNSRequest(original, q.Copy())
+			}()
+			<-entered
+
+			// The client gives up waiting and sends the same query again
+			go func() {
+				defer wg.Done()
+				handleDNSRequest(retransmit, q.Copy())
+			}()
+			if tt.action == "off" {
+				<-entered
+			} else {
+				waitFor(t, "the retransmission to be recognized", func() bool {
+					return duplicateQueries.Value(tt.action) == duplicates+1
+				})
+			}
+			release()
+			wg.Wait()
+
+			if got := fetches.Load(); got != tt.fetches {
+				t.Errorf("%d worker fetches, want %d", got, tt.fetches)
+			}
+			if len(original.replies) != 1 || len(original.replies[0].Answer) != 1 {
+				t.Fatalf("original query got %v, want the proxied answer", original.replies)
+			}
+			if len(retransmit.replies) != tt.replies {
+				t.Fatalf("retransmission got %d replies, want %d", len(retransmit.replies), tt.replies)
+			}
+			if tt.action == "wait" {
+				got, want := retransmit.replies[0], original.replies[0]
+				if got.Id != 4242 || got.Answer[0].String() != want.Answer[0].String() {
+					t.Errorf("retransmission answered %v, want the original's %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetransmitKeyDistinguishesQueries(t *testing.T) {
+	useConfig(t, &Config{ProxyDomains: []string{"proxied.test"}, HostsFile: "off"})
+	useMemoryCache(t)
+	useServerReady(t)
+	resetProxyIPCache(t)
+	entered, release, fetches := useBlockingWorker(t)
+
+	// A new query ID or another client is a new query, not a retransmission
+	first := new(dns.Msg)
+	first.SetQuestion("proxied.test.", dns.TypeA)
+	first.Id = 1
+	newID := first.Copy()
+	newID.Id = 2
+	queries := []struct {
+		client string
+		q      *dns.Msg
+	}{
+		{"127.0.0.7", first},
+		{"127.0.0.7", newID},
+		{"127.0.0.8", first},
+	}
+
+	var wg sync.WaitGroup
+	for _, query := range queries {
+		wg.Add(1)
+		go func(client string, q *dns.Msg) {
+			defer wg.Done()
+			handleDNSRequest(newFakeResponseWriter(client), q.Copy())
+		}(query.client, query.q)
+		<-entered
+	}
+	release()
+	wg.Wait()
+
+	if got := fetches.Load(); got != int32(len(queries)) {
+		t.Errorf("%d worker fetches, want one per distinct query", got)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// retryPolicy controls how many attempts an outbound call gets and how long
+// to wait between them
+type retryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// defaultRetryPolicy is used for worker fetches and node API calls
+var defaultRetryPolicy = retryPolicy{
+	Attempts:  3,
+	BaseDelay: 200 * time.Millisecond,
+	MaxDelay:  2 * time.Second,
+}
+
+// retryBudgetLimiter caps retries per second across all outbound calls, so
+// retries can't compound into a storm during a broad outage
+type retryBudgetLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// retryBudget is shared by every withRetry caller
+var retryBudget = newRetryBudget(10)
+
+// newRetryBudget creates a budget allowing rate retries per second, with bursts of the same size
+func newRetryBudget(rate float64) *retryBudgetLimiter {
+	return &retryBudgetLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// SetRate changes the budget's rate, keeping the tokens already available
+func (b *retryBudgetLimiter) SetRate(rate float64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rate = rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+}
+
+// Take spends one retry from the budget, returning false when it is exhausted
+func (b *retryBudgetLimiter) Take() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// backoff returns the delay before the given attempt, doubling each time
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return delay
+}
+
+// withRetry runs fn until it succeeds, reports a non-retryable error, or the
+// policy or the shared retry budget runs out, sleeping with exponential backoff in between
+func withRetry(policy retryPolicy, fn func(attempt int) (bool, error)) error {
+	attempts := policy.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			// Fail fast once the shared retry budget is spent
+			if !retryBudget.Take() {
+				retryBudgetExhausted.Inc()
+				log.Printf("Retry budget exhausted, giving up after %d attempts", attempt)
+				return err
+			}
+			time.Sleep(policy.backoff(attempt))
+		}
+
+		var retry bool
+		retry, err = fn(attempt)
+		if err == nil || !retry {
+			return err
+		}
+	}
+
+	return err
+}
+
+// isRetryableStatus reports whether an HTTP status is worth retrying elsewhere
+func isRetryableStatus(code int) bool {
+	return code >= http.StatusInternalServerError
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// useRetryBudget gives the test its own shared retry budget
+func useRetryBudget(t *testing.T, rate float64) {
+	t.Helper()
+	old := retryBudget
+	retryBudget = newRetryBudget(rate)
+	t.Cleanup(func() { retryBudget = old })
+}
+
+func TestRetryBudgetTake(t *testing.T) {
+	budget := newRetryBudget(20)
+	for i := 0; i < 20; i++ {
+		if !budget.Take() {
+			t.Fatalf("Take %d refused within the burst of 20", i+1)
+		}
+	}
+	if budget.Take() {
+		t.Error("Take allowed past the burst, want the budget exhausted")
+	}
+
+	// One token comes back every 50ms
+	time.Sleep(60 * time.Millisecond)
+	if !budget.Take() {
+		t.Error("Take refused after the budget refilled")
+	}
+}
+
+func TestWithRetryThrottledByBudget(t *testing.T) {
+	useRetryBudget(t, 3)
+	policy := retryPolicy{Attempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	exhausted := retryBudgetExhausted.Value()
+
+	// Ten calls against a broad outage would make 40 retries without a budget
+	calls := 0
+	for i := 0; i < 10; i++ {
+		err := withRetry(policy, func(attempt int) (bool, error) {
+			calls++
+			return true, errors.New("upstream down")
+		})
+		if err == nil {
+			t.Fatal("withRetry succeeded against a failing call")
+		}
+	}
+
+	// 10 first attempts plus the 3 retries the budget holds; a slow run may
+	// refill one more
+	if calls < 13 || calls > 14 {
+		t.Errorf("made %d calls, want the retries capped at the budget of 3", calls)
+	}
+	if got := retryBudgetExhausted.Value() - exhausted; got < 6 {
+		t.Errorf("budget exhaustion counted %v times, want most calls to fail fast", got)
+	}
+}
+
+func TestWithRetryNonRetryableSpendsNoBudget(t *testing.T) {
+	useRetryBudget(t, 1)
+	policy := retryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	calls := 0
+	withRetry(policy, func(attempt int) (bool, error) {
+		calls++
+		return false, errors.New("bad request")
+	})
+	if calls != 1 {
+		t.Errorf("made %d calls for a non-retryable error, want 1", calls)
+	}
+	if !retryBudget.Take() {
+		t.Error("non-retryable failure spent the retry budget")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// answerRewrite maps addresses in one network onto another of the same size,
+// keeping the host part: 203.0.113.0/24 -> 10.0.0.0/24 turns 203.0.113.7 into 10.0.0.7
+type answerRewrite struct {
+	from *net.IPNet
+	to   *net.IPNet
+}
+
+// newAnswerRewrites parses the configured rewrites. Either side may be a CIDR
+// or a single address, but both must be the same family and prefix length.
+func newAnswerRewrites(config *Config) ([]answerRewrite, error) {
+	rewrites := make([]answerRewrite, 0, len(config.AnswerRewrites))
+	for _, entry := range config.AnswerRewrites {
+		networks, err := parseCIDRList([]string{entry.From, entry.To})
+		if err != nil {
+			return nil, fmt.Errorf("invalid answer_rewrites entry %s -> %s: %v", entry.From, entry.To, err)
+		}
+		from, to := networks[0], networks[1]
+
+		fromOnes, fromBits := from.Mask.Size()
+		toOnes, toBits := to.Mask.Size()
+		if fromBits != toBits || fromOnes != toOnes {
+			return nil, fmt.Errorf("invalid answer_rewrites entry %s -> %s: networks must be the same family and size", entry.From, entry.To)
+		}
+		rewrites = append(rewrites, answerRewrite{from: from, to: to})
+	}
+	return rewrites, nil
+}
+
+// apply returns ip moved into the target network, or nil if it isn't in the source network
+func (r answerRewrite) apply(ip net.IP) net.IP {
+	if !r.from.Contains(ip) {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil && len(r.from.IP) == net.IPv4len {
+		ip = v4
+	}
+
+	result := make(net.IP, len(ip))
+	for i := range ip {
+		result[i] = r.to.IP[i] | (ip[i] &^ r.to.Mask[i])
+	}
+	return result
+}
+
+// rewriteAddress applies the first rewrite whose source network holds ip
+func rewriteAddress(rewrites []answerRewrite, ip net.IP) (net.IP, bool) {
+	for _, rewrite := range rewrites {
+		if rewritten := rewrite.apply(ip); rewritten != nil {
+			return rewritten, true
+		}
+	}
+	return ip, false
+}
+
+// rewriteAnswers applies the configured rewrites to A/AAAA records in place
+func rewriteAnswers(records []dns.RR) {
+	rewrites := currentState().rewrites
+	if len(rewrites) == 0 {
+		return
+	}
+	for _, rr := range records {
+		switch record := rr.(type) {
+		case *dns.A:
+			if ip, ok := rewriteAddress(rewrites, record.A); ok {
+				record.A = ip
+			}
+		case *dns.AAAA:
+			if ip, ok := rewriteAddress(rewrites, record.AAAA); ok {
+				record.AAAA = ip
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNewAnswerRewritesRejectsMismatches(t *testing.T) {
+	for _, entry := range []AnswerRewrite{
+		{From: "203.0.113.0/24", To: "10.0.0.0/16"},
+		{From: "203.0.113.0/24", To: "fd00::/120"},
+		{From: "203.0.113.0/24", To: "not-a-network"},
+		{From: "203.0.113.1", To: "10.0.0.0/24"},
+	} {
+		if _, err := newAnswerRewrites(&Config{AnswerRewrites: []AnswerRewrite{entry}}); err == nil {
+			t.Errorf("%s -> %s accepted", entry.From, entry.To)
+		}
+	}
+}
+
+func TestRewriteAddress(t *testing.T) {
+	rewrites, err := newAnswerRewrites(&Config{AnswerRewrites: []AnswerRewrite{
+		{From: "198.51.100.1", To: "192.168.1.10"},
+		{From: "203.0.113.0/24", To: "10.0.0.0/24"},
+		{From: "198.51.0.0/16", To: "172.16.0.0/16"},
+		{From: "2001:db8:1::/64", To: "fd00::/64"},
+	}})
+	if err != nil {
+		t.Fatalf("newAnswerRewrites: %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"203.0.113.7", "10.0.0.7"},
+		{"203.0.113.255", "10.0.0.255"},
+		// The 1:1 map comes first and wins over the /16 holding it
+		{"198.51.100.1", "192.168.1.10"},
+		{"198.51.100.2", "172.16.100.2"},
+		{"2001:db8:1::abcd", "fd00::abcd"},
+		{"2001:db8:1:0:1:2:3:4", "fd00::1:2:3:4"},
+		// Addresses outside every source network are left alone
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8:2::1", "2001:db8:2::1"},
+	}
+	for _, tt := range tests {
+		got, rewritten := rewriteAddress(rewrites, net.ParseIP(tt.ip))
+		if !got.Equal(net.ParseIP(tt.want)) || rewritten != (tt.ip != tt.want) {
+			t.Errorf("%s rewritten to %s (%v), want %s", tt.ip, got, rewritten, tt.want)
+		}
+	}
+}
+
+func TestAnswerRewritesAppliedToUpstreamAnswers(t *testing.T) {
+	useConfig(t, &Config{
+		Nameservers:    []string{"192.0.2.1"},
+		HostsFile:      "off",
+		AnswerRewrites: []AnswerRewrite{{From: "203.0.113.0/24", To: "10.20.30.0/24"}},
+	})
+	useMemoryCache(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "203.0.113.80", "192.0.2.80"), nil
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("intranet.example.", dns.TypeA)
+	for _, want := range []string{"forwarded", "cached"} {
+		m, decision := resolveWithDecision(q)
+		if decision != want {
+			t.Errorf("decision = %q, want %q", decision, want)
+		}
+		var got []string
+		for _, rr := range m.Answer {
+			got = append(got, rr.(*dns.A).A.String())
+		}
+		if len(got) != 2 || !containsString(got, "10.20.30.80") || !containsString(got, "192.0.2.80") {
+			t.Errorf("%s answer %v, want the public address mapped to 10.20.30.80 and the other kept", want, got)
+		}
+	}
+}
+
+func TestAnswerRewritesAppliedToIPv6Answers(t *testing.T) {
+	useConfig(t, &Config{
+		Nameservers:    []string{"192.0.2.1"},
+		HostsFile:      "off",
+		AnswerRewrites: []AnswerRewrite{{From: "2001:db8:1::/64", To: "fd00:10::/64"}},
+	})
+	useMemoryCache(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithAAAA(m, "2001:db8:1::80", "2001:db8:2::80"), nil
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("intranet.example.", dns.TypeAAAA)
+	for _, want := range []string{"forwarded", "cached"} {
+		m, decision := resolveWithDecision(q)
+		if decision != want {
+			t.Errorf("decision = %q, want %q", decision, want)
+		}
+		var got []string
+		for _, rr := range m.Answer {
+			got = append(got, rr.(*dns.AAAA).AAAA.String())
+		}
+		if len(got) != 2 || !containsString(got, "fd00:10::80") || !containsString(got, "2001:db8:2::80") {
+			t.Errorf("%s answer %v, want 2001:db8:1::80 mapped to fd00:10::80 and the other kept", want, got)
+		}
+	}
+}
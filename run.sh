@@ -1,2 +1,2 @@
 #!/bin/bash
-go run main.go blessnet.go blessnet_api.go config.go "$@"
+go run . "$@"
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"time"
+)
+
+// selfCheck is the outcome of one startup check. Status is "pass", "fail" or
+// "skip"; a failed check that isn't Required is reported but doesn't stop startup.
+type selfCheck struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Required bool   `json:"required"`
+	Error    string `json:"error,omitempty"`
+	Latency  string `json:"latency,omitempty"`
+}
+
+// selfCheckReport is the startup summary. Status is "ok", "degraded" when an
+// optional check failed, or "failed" when a required one did.
+type selfCheckReport struct {
+	Status string      `json:"status"`
+	Checks []selfCheck `json:"checks"`
+}
+
+// newSelfCheck builds a check from a health check result
+func newSelfCheck(name string, required bool, check healthCheck) selfCheck {
+	result := selfCheck{Name: name, Status: "pass", Required: required, Latency: check.Latency}
+	if !check.OK {
+		result.Status = "fail"
+		result.Error = check.Error
+	}
+	return result
+}
+
+// skippedSelfCheck records a check that doesn't apply to this configuration
+func skippedSelfCheck(name string, reason string) selfCheck {
+	return selfCheck{Name: name, Status: "skip", Error: reason}
+}
+
+// summarizeSelfChecks works out the overall status from the individual checks
+func summarizeSelfChecks(checks []selfCheck) selfCheckReport {
+	report := selfCheckReport{Status: "ok", Checks: checks}
+	for _, check := range checks {
+		if check.Status != "fail" {
+			continue
+		}
+		if check.Required {
+			report.Status = "failed"
+			break
+		}
+		report.Status = "degraded"
+	}
+	return report
+}
+
+// String renders the report as a single line of JSON for the log
+func (r selfCheckReport) String() string {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Sprintf("{\"status\":%q}", r.Status)
+	}
+	return string(data)
+}
+
+// runStartupSelfCheck checks everything the resolver depends on. The listen
+// result comes from the servers started earlier in main.
+func runStartupSelfCheck(listen healthCheck) selfCheckReport {
+	checks := []selfCheck{
+		newSelfCheck("config", true, checkConfigSanity()),
+		newSelfCheck("listen", true, listen),
+		newSelfCheck("upstream", false, checkUpstreamHealth()),
+		newSelfCheck("worker", false, checkProxyHealth()),
+	}
+
+	// The CLI is only needed to redeploy the worker
+	if currentConfig().AutoRedeploy {
+		start := time.Now()
+		_, err := exec.LookPath("blessnet")
+		checks = append(checks, newSelfCheck("blessnet_cli", false, newHealthCheck(start, err)))
+	} else {
+		checks = append(checks, skippedSelfCheck("blessnet_cli", "auto_redeploy is disabled"))
+	}
+
+	return summarizeSelfChecks(checks)
+}
+
+// checkConfigSanity catches settings that parse but can't work
+func checkConfigSanity() healthCheck {
+	config := currentConfig()
+	start := time.Now()
+	for _, ns := range config.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return newHealthCheck(start, fmt.Errorf("nameserver %q is not an IP address", ns))
+		}
+	}
+	if !isWorkerURL(config.BlessnetWorkerURL) {
+		return newHealthCheck(start, fmt.Errorf("blessnet_worker_url %q is not an http(s) URL", config.BlessnetWorkerURL))
+	}
+	return newHealthCheck(start, nil)
+}
+
+// waitForListeners waits until count servers have reported they are serving
+func waitForListeners(started <-chan struct{}, count int, timeout time.Duration) healthCheck {
+	start := time.Now()
+	deadline := time.After(timeout)
+	for i := 0; i < count; i++ {
+		select {
+		case <-started:
+		case <-deadline:
+			return newHealthCheck(start, fmt.Errorf("only %d of %d DNS listeners started", i, count))
+		}
+	}
+	return newHealthCheck(start, nil)
+}
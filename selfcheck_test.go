@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSummarizeSelfChecks(t *testing.T) {
+	pass := func(name string, required bool) selfCheck {
+		return newSelfCheck(name, required, newHealthCheck(time.Now(), nil))
+	}
+	fail := func(name string, required bool) selfCheck {
+		return newSelfCheck(name, required, newHealthCheck(time.Now(), errors.New(name+" broken")))
+	}
+	tests := []struct {
+		name   string
+		checks []selfCheck
+		want   string
+	}{
+		{"all pass", []selfCheck{pass("config", true), pass("upstream", false)}, "ok"},
+		{"skipped checks don't count", []selfCheck{pass("config", true), skippedSelfCheck("blessnet_cli", "not needed")}, "ok"},
+		{"optional failure", []selfCheck{pass("config", true), fail("worker", false)}, "degraded"},
+		{"required failure", []selfCheck{fail("listen", true), pass("upstream", false)}, "failed"},
+		{"required failure after optional", []selfCheck{fail("upstream", false), fail("config", true), fail("worker", false)}, "failed"},
+		{"no checks", nil, "ok"},
+	}
+	for _, tt := range tests {
+		if got := summarizeSelfChecks(tt.checks); got.Status != tt.want {
+			t.Errorf("%s: status = %q, want %q", tt.name, got.Status, tt.want)
+		}
+	}
+}
+
+func TestSelfCheckReportJSON(t *testing.T) {
+	report := summarizeSelfChecks([]selfCheck{
+		newSelfCheck("worker", false, newHealthCheck(time.Now(), errors.New("worker unreachable"))),
+		skippedSelfCheck("blessnet_cli", "auto_redeploy is disabled"),
+	})
+
+	var decoded selfCheckReport
+	if err := json.Unmarshal([]byte(report.String()), &decoded); err != nil {
+		t.Fatalf("report %s is not JSON: %v", report, err)
+	}
+	if decoded.Status != "degraded" || len(decoded.Checks) != 2 {
+		t.Fatalf("decoded %+v, want a degraded report with two checks", decoded)
+	}
+	if check := decoded.Checks[0]; check.Status != "fail" || check.Error != "worker unreachable" || check.Latency == "" {
+		t.Errorf("worker check = %+v, want the failure and its latency", check)
+	}
+	if check := decoded.Checks[1]; check.Status != "skip" || check.Latency != "" {
+		t.Errorf("skipped check = %+v", check)
+	}
+}
+
+func TestRunStartupSelfCheck(t *testing.T) {
+	listening := newHealthCheck(time.Now(), nil)
+
+	// A working upstream with a broken worker degrades but doesn't stop startup
+	useHealthWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusBadGateway)
+	})
+	report := runStartupSelfCheck(listening)
+	if report.Status != "degraded" {
+		t.Errorf("status = %q, want degraded: %s", report.Status, report)
+	}
+	statuses := map[string]string{}
+	for _, check := range report.Checks {
+		statuses[check.Name] = check.Status
+	}
+	want := map[string]string{"config": "pass", "listen": "pass", "upstream": "pass", "worker": "fail", "blessnet_cli": "skip"}
+	for name, status := range want {
+		if statuses[name] != status {
+			t.Errorf("%s check = %q, want %q", name, statuses[name], status)
+		}
+	}
+
+	// Listeners that never came up fail startup
+	started := make(chan struct{}, 2)
+	started <- struct{}{}
+	listen := waitForListeners(started, 2, 10*time.Millisecond)
+	if listen.OK {
+		t.Fatal("waitForListeners passed with one of two listeners started")
+	}
+	if report := runStartupSelfCheck(listen); report.Status != "failed" {
+		t.Errorf("status = %q with a failed listener, want failed", report.Status)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// signWorkerTarget signs a target and timestamp with the shared worker secret.
+// The worker recomputes HMAC-SHA256(secret, target + "\n" + timestamp) and
+// rejects requests whose signature doesn't match or whose timestamp is stale.
+func signWorkerTarget(secret string, target string, timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(target + "\n" + strconv.FormatInt(timestamp, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// addWorkerSignature adds the TS and SIG parameters for a target when a secret is configured
+func addWorkerSignature(q url.Values, secret string, target string) {
+	if secret == "" {
+		return
+	}
+	timestamp := time.Now().Unix()
+	q.Set("TS", strconv.FormatInt(timestamp, 10))
+	q.Set("SIG", signWorkerTarget(secret, target, timestamp))
+}
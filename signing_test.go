@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkerRequestSigned(t *testing.T) {
+	useConfig(t, &Config{WorkerSigningSecret: "s3cret"})
+	server, requests := workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	before := time.Now().Unix()
+	if _, err := fetchFromWorkerWithOptions("https://example.com/page", workerFetchOptions{WorkerURL: server.URL}); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+
+	q := (*requests)[0].URL.Query()
+	ts, err := strconv.ParseInt(q.Get("TS"), 10, 64)
+	if err != nil || ts < before || ts > time.Now().Unix() {
+		t.Fatalf("TS = %q, want the current time", q.Get("TS"))
+	}
+	sig := q.Get("SIG")
+	if sig != signWorkerTarget("s3cret", "https://example.com/page", ts) {
+		t.Errorf("SIG = %q, want HMAC-SHA256 of the target and timestamp", sig)
+	}
+
+	// Changing the target, the timestamp or the secret invalidates the signature
+	for name, tampered := range map[string]string{
+		"target":    signWorkerTarget("s3cret", "https://evil.example/", ts),
+		"timestamp": signWorkerTarget("s3cret", "https://example.com/page", ts+1),
+		"secret":    signWorkerTarget("guess", "https://example.com/page", ts),
+	} {
+		if tampered == sig {
+			t.Errorf("tampered %s still matches the signature", name)
+		}
+	}
+}
+
+func TestWorkerRequestUnsignedWithoutSecret(t *testing.T) {
+	useConfig(t, &Config{})
+	server, requests := workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	if _, err := fetchFromWorkerWithOptions("https://example.com", workerFetchOptions{WorkerURL: server.URL}); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	q := (*requests)[0].URL.Query()
+	if q.Has("TS") || q.Has("SIG") {
+		t.Errorf("query %v carries a signature without a secret", q)
+	}
+}
+
+func TestWorkerTemplateVerifiesSignature(t *testing.T) {
+	config := useConfig(t, &Config{WorkerSigningSecret: "s3cret", WorkerSignatureMaxAgeSeconds: 60})
+	client := &BlessnetClient{Config: config}
+
+	source := client.CreateWorkerTemplate(WorkerTemplateOptions{})
+	for _, want := range []string{
+		`const SIGNING_SECRET = "s3cret";`,
+		`const SIGNATURE_MAX_AGE = 60;`,
+		`verifySignature(targetUrl, env.TS || "", env.SIG || "")`,
+	} {
+		if !strings.Contains(source, want) {
+			t.Errorf("worker source is missing %s", want)
+		}
+	}
+}
@@ -1,9 +1,25 @@
 import { main } from "@blockless/sdk-ts/dist/lib/entry"; // Import directly from submodule
 // import { writeOutput } from "@blockless/sdk-ts/dist/lib/stdin"; // This might not be needed?
 
+// Maximum number of redirects followed for a target, matches max_redirects
+const MAX_REDIRECTS = 5;
+
+// Shared secret for request signatures, matches worker_signing_secret. Empty to accept unsigned requests
+const SIGNING_SECRET = "";
+
+// Maximum age in seconds of a signed request
+const SIGNATURE_MAX_AGE = 300;
+
+// Token every request must carry as AUTH, matches worker_auth_token. Empty to accept any request
+const AUTH_TOKEN = "";
+
 // Define a type for environment variables
 interface EnvVars {
   TARGET?: string;
+  TS?: string;
+  SIG?: string;
+  REQUEST_ID?: string;
+  AUTH?: string;
 }
 
 main(async () => {
@@ -13,12 +29,21 @@ main(async () => {
     // Get environment variables and check if TARGET is empty or undefined
     const env: EnvVars = process.env as any;
     const targetUrl = env.TARGET || "";
+
+    // Request ID from PhantomDNS, logged and echoed back so fetches can be correlated with queries
+    const requestId = env.REQUEST_ID || "";
+    const tag = requestId ? "[" + requestId + "] " : "";
+
+    // Only PhantomDNS knows the token, anyone else gets a plain 404
+    if (AUTH_TOKEN !== "" && env.AUTH !== AUTH_TOKEN) {
+      return new Response("Not Found", { status: 404, headers: { "Content-Type": "text/plain" } });
+    }
     
-    console.log(`Environment check - TARGET: ${targetUrl ? "provided" : "missing"}`);
+    console.log(`${tag}Environment check - TARGET: ${targetUrl ? "provided" : "missing"}`);
     
     // Show info if no target is specified
     if (!targetUrl || targetUrl.trim() === "") {
-      console.log("PhantomDNS Worker is active - No target specified, displaying welcome info");
+      console.log(tag + "PhantomDNS Worker is active - No target specified, displaying welcome info");
       
       // Simple plain text response
       const welcomeInfo = 
@@ -35,6 +60,7 @@ main(async () => {
           "Content-Type": "text/plain; charset=utf-8",
           "Cache-Control": "no-store, no-cache",
           "X-Proxy-By": "PhantomDNS",
+          "X-Request-ID": requestId,
           "Access-Control-Allow-Origin": "*",
           "Access-Control-Allow-Methods": "GET, POST, OPTIONS",
           "Access-Control-Allow-Headers": "Content-Type"
@@ -42,12 +68,27 @@ main(async () => {
       });
     }
     
-    console.log(`PhantomDNS Worker active - Processing request for: ${targetUrl}`);
+    // Reject unsigned, tampered or stale requests so the worker isn't an open proxy
+    if (SIGNING_SECRET !== "" && !(await verifySignature(targetUrl, env.TS || "", env.SIG || ""))) {
+      console.log(`${tag}Rejected request with invalid signature for: ${targetUrl}`);
+      return new Response("ERROR: Invalid or expired signature", {
+        status: 403,
+        headers: {
+          "Content-Type": "text/plain; charset=utf-8",
+          "X-Proxy-By": "PhantomDNS",
+          "X-Request-ID": requestId,
+          "Cache-Control": "no-store, no-cache"
+        }
+      });
+    }
+
+    console.log(`${tag}PhantomDNS Worker active - Processing request for: ${targetUrl}`);
 
     try {
-      console.log(`Establishing connection: ${targetUrl}`);
-      const response = await fetch(targetUrl, { 
+      console.log(`${tag}Establishing connection: ${targetUrl}`);
+      const requestOptions = { 
         method: 'GET', 
+        redirect: 'manual' as RequestRedirect,
         headers: { 
           "User-Agent": "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
           "Accept": "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7",
@@ -64,16 +105,32 @@ main(async () => {
           "priority": "u=0, i",
           "dnt": "1"
         }
-      });
+      };
+      let finalUrl = targetUrl;
+      let response = await fetch(finalUrl, requestOptions);
+
+      // Follow redirects ourselves so they can be bounded and loops detected
+      const visited: string[] = [finalUrl];
+      while (response.status >= 300 && response.status < 400 && response.headers.get("Location")) {
+        if (visited.length > MAX_REDIRECTS) {
+          throw new Error(`Too many redirects (limit ${MAX_REDIRECTS}), last URL: ${finalUrl}`);
+        }
+        finalUrl = new URL(response.headers.get("Location") || "", finalUrl).toString();
+        if (visited.indexOf(finalUrl) !== -1) {
+          throw new Error(`Redirect loop detected at ${finalUrl}`);
+        }
+        visited.push(finalUrl);
+        response = await fetch(finalUrl, requestOptions);
+      }
 
-      console.log(`Connection status: ${response.status}`);
+      console.log(`${tag}Connection status: ${response.status} (final URL: ${finalUrl})`);
 
       // Clone the response to read it multiple times
       const clonedResponse = response.clone();
 
       if (!response.ok) {
         const errorText = await clonedResponse.text();
-        console.error(`Connection error: ${response.status}. Content: ${errorText.substring(0, 100)}`);
+        console.error(`${tag}Connection error: ${response.status}. Content: ${errorText.substring(0, 100)}`);
         
         // Return simple error text
         const errorInfo = 
@@ -87,40 +144,40 @@ main(async () => {
           headers: {
             "Content-Type": "text/plain; charset=utf-8",
             "X-Proxy-By": "PhantomDNS",
+            "X-Request-ID": requestId,
             "Access-Control-Allow-Origin": "*",
             "Cache-Control": "no-store, no-cache"
           }
         });
       }
 
-      // Get content type from original response
-      const contentType = response.headers.get("Content-Type") || "text/plain";
-      console.log(`Content-Type: ${contentType}`);
-
-      // Return the actual response with all headers preserved
+      // Return the response as a structured envelope PhantomDNS can decode
       const responseText = await clonedResponse.text();
-      console.log(`Connection successful. Response size: ${responseText.length} bytes`);
-      
-      // Pass through the original content with minimal modification
-      const headers = new Headers();
-      
-      // Copy all the response headers
-      response.headers.forEach((value, key) => {
-        headers.set(key, value);
-      });
-      
-      // Add our proxy headers
-      headers.set("X-Proxy-By", "PhantomDNS");
-      headers.set("Access-Control-Allow-Origin", "*");
-      headers.set("Cache-Control", "no-store, no-cache");
-      
-      return new Response(responseText, {
+      console.log(`${tag}Connection successful. Response size: ${responseText.length} bytes`);
+
+      const envelope = {
         status: response.status,
-        headers: headers
-      });
+        target: targetUrl,
+        finalURL: finalUrl,
+        resolvedIP: await resolveTarget(targetUrl),
+        contentType: response.headers.get("Content-Type") || "",
+        cacheControl: response.headers.get("Cache-Control") || "",
+        expires: response.headers.get("Expires") || "",
+        bodyBase64: btoa(unescape(encodeURIComponent(responseText)))
+      };
 
+      return new Response(JSON.stringify(envelope), {
+        status: 200,
+        headers: {
+          "Content-Type": "application/json",
+          "X-Proxy-By": "PhantomDNS",
+          "X-Request-ID": requestId,
+          "Access-Control-Allow-Origin": "*",
+          "Cache-Control": "no-store, no-cache"
+        }
+      });
     } catch (error) {
-      console.error(`Error during connection: ${error}`);
+      console.error(`${tag}Error during connection: ${error}`);
       
       // Return simple error text
       const errorInfo = 
@@ -134,6 +191,7 @@ main(async () => {
         headers: {
           "Content-Type": "text/plain; charset=utf-8",
           "X-Proxy-By": "PhantomDNS",
+          "X-Request-ID": requestId,
           "Access-Control-Allow-Origin": "*",
           "Cache-Control": "no-store, no-cache"
         }
@@ -170,4 +228,44 @@ async function testPermissions(): Promise<string> {
   } catch (error) {
     return `FAILED (${String(error)})`;
   }
-} 
\ No newline at end of file
+} 
+
+// Check SIG = hex(HMAC-SHA256(SIGNING_SECRET, target + "\n" + TS)) and that TS is recent
+async function verifySignature(targetUrl: string, ts: string, sig: string): Promise<boolean> {
+  const timestamp = parseInt(ts, 10);
+  if (isNaN(timestamp) || Math.abs(Date.now() / 1000 - timestamp) > SIGNATURE_MAX_AGE) {
+    return false;
+  }
+  const encoder = new TextEncoder();
+  const key = await crypto.subtle.importKey(
+    "raw", encoder.encode(SIGNING_SECRET), { name: "HMAC", hash: "SHA-256" }, false, ["sign"]
+  );
+  const digest = await crypto.subtle.sign("HMAC", key, encoder.encode(targetUrl + "\n" + ts));
+  const expected = Array.from(new Uint8Array(digest)).map((b) => b.toString(16).padStart(2, "0")).join("");
+
+  // Compare in constant time
+  if (expected.length !== sig.length) {
+    return false;
+  }
+  let diff = 0;
+  for (let i = 0; i < expected.length; i++) {
+    diff |= expected.charCodeAt(i) ^ sig.charCodeAt(i);
+  }
+  return diff === 0;
+}
+
+// Resolve the target host's IPv4 address over DNS-over-HTTPS
+async function resolveTarget(targetUrl: string): Promise<string> {
+  try {
+    const host = new URL(targetUrl).hostname;
+    const response = await fetch("https://cloudflare-dns.com/dns-query?type=A&name=" + encodeURIComponent(host), {
+      headers: { "Accept": "application/dns-json" }
+    });
+    const data: any = await response.json();
+    const answer = (data.Answer || []).find((record: any) => record.type === 1);
+    return answer ? answer.data : "";
+  } catch (error) {
+    console.error(`Error resolving target: ${error}`);
+    return "";
+  }
+}
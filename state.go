@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// runtimeState is the running configuration together with everything built
+// from it. A reload publishes a new state as a whole, so a query sees either
+// the old configuration or the new one, never a mix of both.
+type runtimeState struct {
+	config     *Config
+	acl        *queryACL
+	limiter    *rateLimiter
+	rebind     *rebindFilter
+	inflight   *inflightLimiter
+	reputation *reputationChecker
+	rewrites   []answerRewrite
+	dns64      *net.IPNet
+	stats      *topTalkers
+}
+
+// Live runtime state, nil until main has loaded the configuration
+var liveState atomic.Pointer[runtimeState]
+
+// reloadMutex keeps SIGHUP and control socket reloads from interleaving
+var reloadMutex sync.Mutex
+
+// currentState returns the live runtime state
+func currentState() *runtimeState {
+	return liveState.Load()
+}
+
+// currentConfig returns the live configuration, nil before it is loaded.
+// Callers that read several fields should keep the result in a local so
+// they all come from the same configuration.
+func currentConfig() *Config {
+	if state := liveState.Load(); state != nil {
+		return state.config
+	}
+	return nil
+}
+
+// newRuntimeState builds the state for config. Parts that hold live data,
+// like rate limiter buckets, in-flight slots, cached reputation verdicts and
+// query counts, are carried over from prev when their settings haven't changed.
+func newRuntimeState(config *Config, prev *runtimeState) (*runtimeState, error) {
+	acl, err := newQueryACL(config)
+	if err != nil {
+		return nil, fmt.Errorf("error loading query ACL: %v", err)
+	}
+
+	rebind, err := newRebindFilter(config)
+	if err != nil {
+		return nil, fmt.Errorf("error loading rebind protection: %v", err)
+	}
+
+	dns64, err := newDNS64Prefix(config)
+	if err != nil {
+		return nil, fmt.Errorf("error loading DNS64 prefix: %v", err)
+	}
+
+	rewrites, err := newAnswerRewrites(config)
+	if err != nil {
+		return nil, fmt.Errorf("error loading answer rewrites: %v", err)
+	}
+
+	state := &runtimeState{
+		config:   config,
+		acl:      acl,
+		rebind:   rebind,
+		dns64:    dns64,
+		rewrites: rewrites,
+	}
+
+	if prev == nil {
+		state.limiter = newRateLimiter(config)
+		state.inflight = newInflightLimiter(config)
+		state.reputation = newReputationChecker(config)
+		state.stats = newTopTalkers(config)
+		return state, nil
+	}
+
+	old := prev.config
+	state.limiter = reconfigureRateLimiter(prev.limiter, config)
+
+	// Queries already running release into the limiter they acquired from
+	state.inflight = prev.inflight
+	if config.MaxInflightQueries != prev.inflight.Size() {
+		state.inflight = newInflightLimiter(config)
+	}
+
+	state.reputation = prev.reputation
+	if config.ReputationURL != old.ReputationURL || config.ReputationTimeoutMs != old.ReputationTimeoutMs || config.ReputationCacheSeconds != old.ReputationCacheSeconds {
+		state.reputation = newReputationChecker(config)
+	}
+
+	state.stats = prev.stats
+	if config.StatsWindowSeconds != old.StatsWindowSeconds || config.StatsMaxKeys != old.StatsMaxKeys {
+		state.stats = newTopTalkers(config)
+	}
+
+	return state, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats counts resolver activity since startup
+type Stats struct {
+	StartTime      time.Time
+	Queries        atomic.Uint64
+	Proxied        atomic.Uint64
+	Forwarded      atomic.Uint64
+	CacheHits      atomic.Uint64
+	UpstreamErrors atomic.Uint64
+}
+
+// Global resolver statistics
+var stats = &Stats{StartTime: time.Now()}
+
+// Snapshot returns the current counters in a JSON-friendly form
+func (s *Stats) Snapshot() map[string]interface{} {
+	snapshot := map[string]interface{}{
+		"uptime_seconds":  int64(time.Since(s.StartTime).Seconds()),
+		"queries":         s.Queries.Load(),
+		"proxied":         s.Proxied.Load(),
+		"forwarded":       s.Forwarded.Load(),
+		"cache_hits":      s.CacheHits.Load(),
+		"upstream_errors": s.UpstreamErrors.Load(),
+	}
+	if dnsCache != nil {
+		snapshot["cache_entries"] = dnsCache.Len()
+	}
+	return snapshot
+}
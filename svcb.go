@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// proxyServiceALPN lists the protocols advertised for proxied domains
+var proxyServiceALPN = []string{"h2", "http/1.1"}
+
+// handleProxiedService answers an HTTPS or SVCB query for a proxied domain with
+// a service record pointing clients at the proxy endpoint, so they don't pick
+// up hints that lead around it
+func handleProxiedService(m *dns.Msg, q dns.Question, trace *queryTrace) {
+	if zone, denied := proxyTargetDenied(q.Name); denied {
+		trace.decide("denied")
+		trace.explain(dns.ExtendedErrorCodeProhibited, "proxy target denied by policy")
+		handleBlockedDomain(m, q, zone)
+		return
+	}
+
+	stats.Proxied.Add(1)
+	trace.decide("proxied")
+
+	start := time.Now()
+	ip, ttl, err := lookupProxyIP(q.Name, trace.id)
+	trace.timeStage("worker", start)
+	if err != nil {
+		handleProxyLookupError(m, q, trace, err)
+		return
+	}
+
+	m.Answer = append(m.Answer, newServiceRecord(q, ip, ttl))
+}
+
+// newServiceRecord builds a ServiceMode HTTPS or SVCB record for the owner name
+// itself, hinting the given address
+func newServiceRecord(q dns.Question, ip net.IP, ttl uint32) dns.RR {
+	svcb := dns.SVCB{
+		Hdr:      dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl},
+		Priority: 1,
+		Target:   ".",
+		Value:    []dns.SVCBKeyValue{&dns.SVCBAlpn{Alpn: proxyServiceALPN}},
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv4Hint{Hint: []net.IP{ip4}})
+	} else {
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv6Hint{Hint: []net.IP{ip}})
+	}
+
+	if q.Qtype == dns.TypeHTTPS {
+		return &dns.HTTPS{SVCB: svcb}
+	}
+	return &svcb
+}
+
+// addCompanionRecords attaches the configured service records for a proxied
+// name to the additional section, where RFC 9460 has resolvers put them
+func addCompanionRecords(m *dns.Msg, q dns.Question, ip net.IP, ttl uint32) {
+	for _, rrtype := range currentConfig().ProxyCompanionRecords {
+		companion := dns.Question{Name: q.Name, Qtype: dns.StringToType[rrtype], Qclass: dns.ClassINET}
+		m.Extra = append(m.Extra, newServiceRecord(companion, ip, ttl))
+	}
+}
+
+// wantsProxiedService reports whether an HTTPS or SVCB query should be synthesized
+func wantsProxiedService(q dns.Question, trace *queryTrace) bool {
+	domain := strings.TrimSuffix(q.Name, ".")
+	return currentConfig().ProxyServiceRecords && serverReady.Load() && isProxyDomain(domain) && inProxyCanary(domain, trace.client)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// serviceUpstream answers CAA, HTTPS and SVCB queries with one record each
+func serviceUpstream(m *dns.Msg, address string) (*dns.Msg, error) {
+	q := m.Question[0]
+	r := new(dns.Msg)
+	r.SetReply(m)
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 300}
+	svcb := dns.SVCB{Hdr: hdr, Priority: 1, Target: ".", Value: []dns.SVCBKeyValue{&dns.SVCBAlpn{Alpn: []string{"h3"}}}}
+	switch q.Qtype {
+	case dns.TypeCAA:
+		r.Answer = append(r.Answer, &dns.CAA{Hdr: hdr, Tag: "issue", Value: "letsencrypt.org"})
+	case dns.TypeHTTPS:
+		r.Answer = append(r.Answer, &dns.HTTPS{SVCB: svcb})
+	case dns.TypeSVCB:
+		r.Answer = append(r.Answer, &svcb)
+	}
+	return r, nil
+}
+
+func TestForwardAndCacheServiceTypes(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, HostsFile: "off"})
+	useMemoryCache(t)
+	fake := useUpstream(t, serviceUpstream)
+
+	types := []uint16{dns.TypeCAA, dns.TypeHTTPS, dns.TypeSVCB}
+	for i, want := range []string{"forwarded", "cached"} {
+		for _, qtype := range types {
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", qtype)
+			m, decision := resolveWithDecision(q)
+			if decision != want {
+				t.Errorf("%s query %d decision = %q, want %q", dns.TypeToString[qtype], i+1, decision, want)
+			}
+			if len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != qtype {
+				t.Fatalf("%s query %d answered %v", dns.TypeToString[qtype], i+1, m.Answer)
+			}
+		}
+	}
+	if len(fake.Calls()) != len(types) {
+		t.Errorf("%d upstream queries, want one per type", len(fake.Calls()))
+	}
+}
+
+func TestProxiedHTTPSSynthesized(t *testing.T) {
+	useConfig(t, &Config{
+		Nameservers:         []string{"192.0.2.1"},
+		ProxyDomains:        []string{"proxied.test"},
+		ProxyServiceRecords: true,
+		HostsFile:           "off",
+	})
+	useMemoryCache(t)
+	useServerReady(t)
+	resetProxyIPCache(t)
+	requests := countingEnvelopeWorker(t)
+	fake := useUpstream(t, serviceUpstream)
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.proxied.test.", dns.TypeHTTPS)
+	m, decision := resolveWithDecision(q)
+	if decision != "proxied" || len(*requests) != 1 || len(fake.Calls()) != 0 {
+		t.Fatalf("decision %q with %d worker and %d upstream requests, want proxied through the worker", decision, len(*requests), len(fake.Calls()))
+	}
+	if len(m.Answer) != 1 {
+		t.Fatalf("got %d answers, want 1", len(m.Answer))
+	}
+	https, ok := m.Answer[0].(*dns.HTTPS)
+	if !ok {
+		t.Fatalf("answer %v is not an HTTPS record", m.Answer[0])
+	}
+	if https.Hdr.Name != "www.proxied.test." || https.Priority != 1 || https.Target != "." {
+		t.Errorf("record %v, want a ServiceMode record for the owner name", https)
+	}
+	var alpn, hint string
+	for _, value := range https.Value {
+		switch v := value.(type) {
+		case *dns.SVCBAlpn:
+			alpn = v.String()
+		case *dns.SVCBIPv4Hint:
+			hint = v.String()
+		}
+	}
+	if alpn != "h2,http/1.1" || hint != "203.0.113.1" {
+		t.Errorf("alpn %q ipv4hint %q, want h2,http/1.1 pointing at the proxy 203.0.113.1", alpn, hint)
+	}
+
+	// Without proxy_service_records the proxied zone answers NODATA, never
+	// the upstream's hints that lead around the proxy
+	currentConfig().ProxyServiceRecords = false
+	m, decision = resolveWithDecision(q)
+	if decision != "authoritative" || len(m.Answer) != 0 || len(fake.Calls()) != 0 {
+		t.Errorf("got %v (%s) after %d upstream queries, want NODATA", m.Answer, decision, len(fake.Calls()))
+	}
+}
+
+func TestProxiedCompanionRecords(t *testing.T) {
+	config := useConfig(t, &Config{
+		ProxyDomains:          []string{"proxied.test"},
+		ProxyCompanionRecords: []string{"https", "SVCB", "MX"},
+		HostsFile:             "off",
+	})
+	if got := strings.Join(config.ProxyCompanionRecords, ","); got != "HTTPS,SVCB" {
+		t.Errorf("proxy_companion_records = %s, want HTTPS,SVCB with MX dropped", got)
+	}
+	useMemoryCache(t)
+	useServerReady(t)
+	resetProxyIPCache(t)
+	requests := countingEnvelopeWorker(t)
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.proxied.test.", dns.TypeA)
+	m, decision := resolveWithDecision(q)
+	if decision != "proxied" || len(*requests) != 1 {
+		t.Fatalf("decision %q with %d worker requests, want one proxied fetch", decision, len(*requests))
+	}
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "203.0.113.1" {
+		t.Fatalf("answer %v, want the proxy address", m.Answer)
+	}
+
+	var types []string
+	for _, rr := range m.Extra {
+		var svcb *dns.SVCB
+		switch rr := rr.(type) {
+		case *dns.HTTPS:
+			svcb = &rr.SVCB
+		case *dns.SVCB:
+			svcb = rr
+		default:
+			continue
+		}
+		types = append(types, dns.TypeToString[rr.Header().Rrtype])
+		if svcb.Hdr.Name != "www.proxied.test." || svcb.Hdr.Ttl != m.Answer[0].Header().Ttl {
+			t.Errorf("%s record %v, want the owner name and the A record's TTL", dns.TypeToString[rr.Header().Rrtype], rr)
+		}
+		var hint string
+		for _, value := range svcb.Value {
+			if v, ok := value.(*dns.SVCBIPv4Hint); ok {
+				hint = v.String()
+			}
+		}
+		if hint != "203.0.113.1" {
+			t.Errorf("%s ipv4hint %q, want the proxy address", dns.TypeToString[rr.Header().Rrtype], hint)
+		}
+	}
+	if strings.Join(types, ",") != "HTTPS,SVCB" {
+		t.Errorf("additional records %v, want an HTTPS and an SVCB record", m.Extra)
+	}
+
+	// Without companion records configured the A is sent alone
+	config.ProxyCompanionRecords = nil
+	if m, _ := resolveWithDecision(q); len(m.Answer) != 1 || len(m.Extra) != 0 {
+		t.Errorf("got answer %v additional %v, want the A record alone", m.Answer, m.Extra)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// dialSyslog connects to a syslog daemon, logging at info level with the
+// given facility code
+func dialSyslog(addr string, facility int) (io.WriteCloser, error) {
+	network, raddr, err := parseSyslogAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return syslog.Dial(network, raddr, syslog.Priority(facility<<3)|syslog.LOG_INFO, "phantomdns")
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// dialSyslog always fails, log/syslog isn't available on this platform
+func dialSyslog(addr string, facility int) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,132 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useLogOutput applies the log settings of c and goes back to stderr when the test ends
+func useLogOutput(t *testing.T, c *Config) {
+	t.Helper()
+	applyConfigDefaults(c)
+	applyLogOutput(c)
+	t.Cleanup(func() { applyLogOutput(&Config{}) })
+}
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	useLogOutput(t, &Config{LogSyslog: true, SyslogAddr: conn.LocalAddr().String(), SyslogFacility: "LOCAL3"})
+
+	log.Printf("Query for %s", "example.com.")
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no syslog message received: %v", err)
+	}
+	message := string(buf[:n])
+
+	// local3 (19) at info (6) is priority 19*8+6
+	if !strings.HasPrefix(message, "<158>") {
+		t.Errorf("message %q, want priority <158> for local3.info", message)
+	}
+	if !strings.Contains(message, "phantomdns") || !strings.Contains(message, "Query for example.com.") {
+		t.Errorf("message %q, want the tagged log line", message)
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		lines <- line
+	}()
+	useLogOutput(t, &Config{LogSyslog: true, SyslogAddr: "tcp://" + listener.Addr().String()})
+
+	log.Printf("Blocked query for %s", "ads.example.")
+
+	select {
+	case line := <-lines:
+		// The default facility is daemon (3), at info (6)
+		if !strings.HasPrefix(line, "<30>") || !strings.Contains(line, "Blocked query for ads.example.") {
+			t.Errorf("message %q, want the log line at daemon.info", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no syslog message received")
+	}
+}
+
+func TestSyslogUnavailableFallsBack(t *testing.T) {
+	useLogOutput(t, &Config{LogSyslog: true, SyslogAddr: "unix:///nonexistent/phantomdns.sock"})
+
+	logOutputMutex.Lock()
+	connected := logOutput != nil
+	logOutputMutex.Unlock()
+	if connected || log.Writer() != os.Stderr {
+		t.Error("syslog output installed for an unreachable socket, want the log left on stderr")
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("connection refused") }
+
+func TestFallbackWriter(t *testing.T) {
+	var primary, fallback bytes.Buffer
+	w := &fallbackWriter{primary: &primary, fallback: &fallback}
+	w.Write([]byte("first\n"))
+	if primary.String() != "first\n" || fallback.Len() != 0 {
+		t.Errorf("primary %q fallback %q, want the line on the primary only", primary.String(), fallback.String())
+	}
+
+	w.primary = failingWriter{}
+	if n, err := w.Write([]byte("second\n")); n != 7 || err != nil || fallback.String() != "second\n" {
+		t.Errorf("Write = %d, %v with fallback %q, want the line on the fallback", n, err, fallback.String())
+	}
+}
+
+func TestParseSyslogAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		network string
+		raddr   string
+		ok      bool
+	}{
+		{"", "", "", true},
+		{"logs.example:514", "udp", "logs.example:514", true},
+		{"tcp://logs.example:601", "tcp", "logs.example:601", true},
+		{"unix:///dev/log", "unix", "/dev/log", true},
+		{"http://logs.example", "", "", false},
+	}
+	for _, tt := range tests {
+		network, raddr, err := parseSyslogAddr(tt.addr)
+		if network != tt.network || raddr != tt.raddr || (err == nil) != tt.ok {
+			t.Errorf("parseSyslogAddr(%q) = %q, %q, %v", tt.addr, network, raddr, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsSlots is how many slices the stats window is split into, so old
+// traffic ages out in steps rather than all at once
+const statsSlots = 6
+
+// cappedCounter counts keys up to a fixed number of entries. When full, a new
+// key takes over the smallest entry and inherits its count (space-saving), so
+// heavy hitters are never lost and counts only ever overestimate
+type cappedCounter struct {
+	max    int
+	counts map[string]uint64
+}
+
+// newCappedCounter creates a counter holding at most max keys
+func newCappedCounter(max int) *cappedCounter {
+	return &cappedCounter{max: max, counts: make(map[string]uint64)}
+}
+
+// Inc adds one to a key, evicting the smallest key if the counter is full
+func (c *cappedCounter) Inc(key string) {
+	if _, ok := c.counts[key]; ok || len(c.counts) < c.max {
+		c.counts[key]++
+		return
+	}
+
+	var minKey string
+	var minCount uint64
+	for k, n := range c.counts {
+		if minKey == "" || n < minCount {
+			minKey, minCount = k, n
+		}
+	}
+	delete(c.counts, minKey)
+	c.counts[key] = minCount + 1
+}
+
+// statsSlot holds the counts for one slice of the window
+type statsSlot struct {
+	start   time.Time
+	clients *cappedCounter
+	domains *cappedCounter
+}
+
+// topTalkers keeps rolling per-client and per-domain query counts
+type topTalkers struct {
+	mutex   sync.Mutex
+	window  time.Duration
+	maxKeys int
+	slots   []*statsSlot
+}
+
+// newTopTalkers creates a tracker from the stats settings in config
+func newTopTalkers(config *Config) *topTalkers {
+	return &topTalkers{
+		window:  time.Duration(config.StatsWindowSeconds) * time.Second,
+		maxKeys: config.StatsMaxKeys,
+	}
+}
+
+// slotFor returns the slot covering now, starting a new one and dropping
+// slots that have left the window as needed
+func (t *topTalkers) slotFor(now time.Time) *statsSlot {
+	slotLength := t.window / statsSlots
+	if n := len(t.slots); n > 0 && now.Sub(t.slots[n-1].start) < slotLength {
+		return t.slots[n-1]
+	}
+
+	t.expire(now)
+	slot := &statsSlot{
+		start:   now.Truncate(slotLength),
+		clients: newCappedCounter(t.maxKeys),
+		domains: newCappedCounter(t.maxKeys),
+	}
+	t.slots = append(t.slots, slot)
+	return slot
+}
+
+// expire drops slots that started before the window
+func (t *topTalkers) expire(now time.Time) {
+	cutoff := now.Add(-t.window)
+	kept := t.slots[:0]
+	for _, slot := range t.slots {
+		if slot.start.After(cutoff) {
+			kept = append(kept, slot)
+		}
+	}
+	t.slots = kept
+}
+
+// Record counts a query from a client for a domain
+func (t *topTalkers) Record(client string, domain string) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	slot := t.slotFor(time.Now())
+	slot.clients.Inc(client)
+	if domain != "" {
+		slot.domains.Inc(strings.ToLower(domain))
+	}
+}
+
+// talker is one entry in a top list
+type talker struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// topStats is the JSON body returned by /stats/top
+type topStats struct {
+	WindowSeconds int      `json:"window_seconds"`
+	Clients       []talker `json:"clients"`
+	Domains       []talker `json:"domains"`
+}
+
+// Top returns the n busiest clients and domains in the current window
+func (t *topTalkers) Top(n int) topStats {
+	top := topStats{Clients: []talker{}, Domains: []talker{}}
+	if t == nil {
+		return top
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.expire(time.Now())
+	clients := make(map[string]uint64)
+	domains := make(map[string]uint64)
+	for _, slot := range t.slots {
+		for k, c := range slot.clients.counts {
+			clients[k] += c
+		}
+		for k, c := range slot.domains.counts {
+			domains[k] += c
+		}
+	}
+
+	top.WindowSeconds = int(t.window / time.Second)
+	top.Clients = topN(clients, n)
+	top.Domains = topN(domains, n)
+	return top
+}
+
+// topN returns the n largest counts, ties broken by key
+func topN(counts map[string]uint64, n int) []talker {
+	result := make([]talker, 0, len(counts))
+	for k, c := range counts {
+		result = append(result, talker{Key: k, Count: c})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Key < result[j].Key
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// handleStatsTop returns the top talkers as JSON, e.g. GET /stats/top?n=20
+func handleStatsTop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := 10
+	if value := r.URL.Query().Get("n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "n must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentState().stats.Top(n))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestStatsTopReflectsQueries(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, HostsFile: "off"})
+	useMemoryCache(t)
+	useServerReady(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "192.0.2.10"), nil
+	})
+
+	traffic := []struct {
+		client string
+		domain string
+		count  int
+	}{
+		{"10.0.0.1", "popular.example.", 5},
+		{"10.0.0.2", "popular.example.", 1},
+		{"10.0.0.2", "Other.example.", 2},
+		{"10.0.0.3", "rare.example.", 1},
+	}
+	for _, tt := range traffic {
+		for i := 0; i < tt.count; i++ {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.domain, dns.TypeA)
+			handleDNSRequest(newFakeResponseWriter(tt.client), q)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleStatsTop(rec, httptest.NewRequest("GET", "/stats/top?n=2", nil))
+	var top topStats
+	if err := json.NewDecoder(rec.Body).Decode(&top); err != nil {
+		t.Fatalf("decoding /stats/top: %v", err)
+	}
+
+	if top.WindowSeconds != 300 {
+		t.Errorf("window_seconds = %d, want the default 300", top.WindowSeconds)
+	}
+	wantClients := []talker{{"10.0.0.1", 5}, {"10.0.0.2", 3}}
+	if fmt.Sprint(top.Clients) != fmt.Sprint(wantClients) {
+		t.Errorf("top clients = %v, want %v", top.Clients, wantClients)
+	}
+	wantDomains := []talker{{"popular.example.", 6}, {"other.example.", 2}}
+	if fmt.Sprint(top.Domains) != fmt.Sprint(wantDomains) {
+		t.Errorf("top domains = %v, want %v", top.Domains, wantDomains)
+	}
+}
+
+func TestStatsTopBadN(t *testing.T) {
+	useConfig(t, &Config{})
+	for _, n := range []string{"0", "-1", "ten"} {
+		rec := httptest.NewRecorder()
+		handleStatsTop(rec, httptest.NewRequest("GET", "/stats/top?n="+n, nil))
+		if rec.Code != 400 {
+			t.Errorf("n=%s: status %d, want 400", n, rec.Code)
+		}
+	}
+}
+
+func TestCappedCounterKeepsHeavyHitters(t *testing.T) {
+	c := newCappedCounter(3)
+	for i := 0; i < 50; i++ {
+		c.Inc("heavy")
+	}
+	for i := 0; i < 100; i++ {
+		c.Inc(fmt.Sprintf("scan-%d", i))
+	}
+
+	if len(c.counts) != 3 {
+		t.Errorf("counter holds %d keys, want the cap of 3", len(c.counts))
+	}
+	if c.counts["heavy"] < 50 {
+		t.Errorf("heavy = %d, want it kept with at least its 50 queries", c.counts["heavy"])
+	}
+}
+
+func TestTopTalkersWindowExpires(t *testing.T) {
+	tracker := newTopTalkers(&Config{StatsWindowSeconds: 60, StatsMaxKeys: 10})
+	tracker.Record("10.0.0.1", "old.example.")
+
+	// Age the recorded slot out of the window
+	tracker.mutex.Lock()
+	tracker.slots[0].start = time.Now().Add(-2 * time.Minute)
+	tracker.mutex.Unlock()
+	tracker.Record("10.0.0.2", "new.example.")
+
+	top := tracker.Top(10)
+	if len(top.Clients) != 1 || top.Clients[0].Key != "10.0.0.2" {
+		t.Errorf("clients = %v, want only the query inside the window", top.Clients)
+	}
+	if len(top.Domains) != 1 || top.Domains[0].Key != "new.example." {
+		t.Errorf("domains = %v, want only the query inside the window", top.Domains)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queryTrace records how a query was resolved and where the time went
+type queryTrace struct {
+	id       string
+	client   net.IP
+	start    time.Time
+	decision string
+	stages   map[string]time.Duration
+	ede      *dns.EDNS0_EDE
+}
+
+// newQueryTrace starts timing a query from a client, which may be nil for internal lookups
+func newQueryTrace(client net.IP) *queryTrace {
+	return &queryTrace{
+		id:       newTraceID(),
+		client:   client,
+		start:    time.Now(),
+		decision: "none",
+		stages:   make(map[string]time.Duration),
+	}
+}
+
+// newTraceID returns a random ID that ties a query to the worker fetches it triggers
+func newTraceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// decide records the resolution path taken for the query
+func (t *queryTrace) decide(decision string) {
+	t.decision = decision
+}
+
+// explain records the extended DNS error (RFC 8914) that describes the outcome,
+// replacing any recorded earlier
+func (t *queryTrace) explain(code uint16, text string) {
+	t.ede = &dns.EDNS0_EDE{InfoCode: code, ExtraText: text}
+}
+
+// timeStage adds the time since start to a stage and records it in the stage histogram
+func (t *queryTrace) timeStage(stage string, start time.Time) {
+	elapsed := time.Since(start)
+	t.stages[stage] += elapsed
+	stageDuration.Observe(elapsed.Seconds(), stage)
+}
+
+// slowestStage returns the stage that took the longest
+func (t *queryTrace) slowestStage() (string, time.Duration) {
+	slowest, longest := "none", time.Duration(0)
+	for stage, elapsed := range t.stages {
+		if elapsed > longest {
+			slowest, longest = stage, elapsed
+		}
+	}
+	return slowest, longest
+}
+
+// finish records the query latency and logs it if it exceeded the slow query threshold
+func (t *queryTrace) finish(q dns.Question) {
+	elapsed := time.Since(t.start)
+	queryDuration.Observe(elapsed.Seconds(), t.decision)
+
+	threshold := time.Duration(currentConfig().SlowQueryThresholdMs) * time.Millisecond
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+
+	stage, stageElapsed := t.slowestStage()
+	slowQueries.Inc(stage)
+	log.Printf("[%s] Slow query: %s %s took %v (decision: %s, slowest stage: %s %v)",
+		t.id, q.Name, dns.TypeToString[q.Qtype], elapsed, t.decision, stage, stageElapsed)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSlowQueryLogsSlowestStage(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, SlowQueryThresholdMs: 20})
+	useMemoryCache(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		time.Sleep(50 * time.Millisecond)
+		return replyWithA(m, "203.0.113.1"), nil
+	})
+	logs := captureLog(t)
+	before := slowQueries.Value("upstream")
+
+	q := new(dns.Msg)
+	q.SetQuestion("slow.example.", dns.TypeA)
+	resolveWithDecision(q)
+
+	if !strings.Contains(logs.String(), "Slow query: slow.example. A took") {
+		t.Fatalf("no slow query line logged, got:\n%s", logs)
+	}
+	if !strings.Contains(logs.String(), "slowest stage: upstream") {
+		t.Errorf("slow query line doesn't name the upstream stage, got:\n%s", logs)
+	}
+	if got := slowQueries.Value("upstream") - before; got != 1 {
+		t.Errorf("slow queries counted for upstream = %v, want 1", got)
+	}
+}
+
+func TestFastQueryNotLoggedAsSlow(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, SlowQueryThresholdMs: 1000})
+	useMemoryCache(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "203.0.113.1"), nil
+	})
+	logs := captureLog(t)
+
+	q := new(dns.Msg)
+	q.SetQuestion("fast.example.", dns.TypeA)
+	resolveWithDecision(q)
+
+	if strings.Contains(logs.String(), "Slow query") {
+		t.Errorf("fast query logged as slow:\n%s", logs)
+	}
+}
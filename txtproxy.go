@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// txtStringLimit is the longest character-string a TXT record can carry
+const txtStringLimit = 255
+
+// txtProxyHardLimit keeps the encoded payload well inside a 64 KiB TCP message
+const txtProxyHardLimit = 60000
+
+// chunkTXT splits data into TXT character-strings of at most txtStringLimit bytes
+func chunkTXT(data string) []string {
+	chunks := make([]string, 0, len(data)/txtStringLimit+1)
+	for len(data) > txtStringLimit {
+		chunks = append(chunks, data[:txtStringLimit])
+		data = data[txtStringLimit:]
+	}
+	if data != "" {
+		chunks = append(chunks, data)
+	}
+	return chunks
+}
+
+// handleProxiedTXT is the experimental TXT fallback for clients without an
+// HTTP path: the target is fetched through the worker and returned base64
+// encoded as the strings of a single TXT record, which keeps them in order.
+// Payloads over ProxyTXTMaxBytes (after encoding) are refused with SERVFAIL.
+func handleProxiedTXT(m *dns.Msg, q dns.Question, trace *queryTrace) {
+	stats.Proxied.Add(1)
+	trace.decide("proxied")
+
+	start := time.Now()
+	encoded, err := fetchTXTPayload(q.Name, trace.id)
+	trace.timeStage("worker", start)
+	if err != nil {
+		log.Printf("[%s] Error proxying %s over TXT: %v", trace.id, q.Name, err)
+		m.Rcode = dns.RcodeServerFailure
+		return
+	}
+
+	m.Answer = append(m.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: currentConfig().ProxyEphemeralTTL},
+		Txt: chunkTXT(encoded),
+	})
+}
+
+// fetchTXTPayload fetches a proxied domain through the worker and base64 encodes the content
+func fetchTXTPayload(domain string, requestID string) (string, error) {
+	config := currentConfig()
+	envelope, err := blessnetClient.FetchEnvelope("https://"+strings.TrimSuffix(domain, "."), requestID)
+	if err != nil {
+		return "", err
+	}
+	body, err := envelope.Body()
+	if err != nil {
+		return "", fmt.Errorf("error decoding worker content: %v", err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(body)
+	if len(encoded) > config.ProxyTXTMaxBytes {
+		return "", fmt.Errorf("content of %d bytes encodes to %d bytes, over the %d byte TXT limit",
+			len(body), len(encoded), config.ProxyTXTMaxBytes)
+	}
+	return encoded, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestChunkTXT(t *testing.T) {
+	tests := []struct {
+		length int
+		want   []int
+	}{
+		{0, nil},
+		{10, []int{10}},
+		{255, []int{255}},
+		{256, []int{255, 1}},
+		{600, []int{255, 255, 90}},
+	}
+	for _, tt := range tests {
+		data := strings.Repeat("a", tt.length)
+		chunks := chunkTXT(data)
+		got := []int(nil)
+		for _, chunk := range chunks {
+			got = append(got, len(chunk))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("chunkTXT of %d bytes gave sizes %v, want %v", tt.length, got, tt.want)
+		}
+		if strings.Join(chunks, "") != data {
+			t.Errorf("chunkTXT of %d bytes doesn't join back to the input", tt.length)
+		}
+	}
+}
+
+// useTXTProxy proxies txt.test over TXT through a worker serving payload
+func useTXTProxy(t *testing.T, maxBytes int, payload []byte) {
+	t.Helper()
+	useConfig(t, &Config{
+		ProxyDomains:      []string{"txt.test"},
+		ProxyTXTFallback:  true,
+		ProxyTXTMaxBytes:  maxBytes,
+		ProxyEphemeralTTL: 5,
+		HostsFile:         "off",
+	})
+	useServerReady(t)
+	useWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":200,"target":%q,"contentType":"application/octet-stream","bodyBase64":%q}`,
+			r.URL.Query().Get("TARGET"), base64.StdEncoding.EncodeToString(payload))
+	})
+}
+
+func TestProxiedTXTChunksPayload(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	useTXTProxy(t, 0, payload)
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.txt.test.", dns.TypeTXT)
+	m, decision := resolveWithDecision(q)
+	if decision != "proxied" || len(m.Answer) != 1 {
+		t.Fatalf("decision %q with %d answers, want one proxied TXT record", decision, len(m.Answer))
+	}
+
+	// 1024 bytes encode to 1368 base64 characters: five full strings and a 93 byte tail
+	txt := m.Answer[0].(*dns.TXT)
+	if len(txt.Txt) != 6 {
+		t.Fatalf("got %d strings, want 6", len(txt.Txt))
+	}
+	for i, s := range txt.Txt {
+		want := txtStringLimit
+		if i == len(txt.Txt)-1 {
+			want = 1368 - 5*txtStringLimit
+		}
+		if len(s) != want {
+			t.Errorf("string %d is %d bytes, want %d", i, len(s), want)
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(txt.Txt, ""))
+	if err != nil || !bytes.Equal(decoded, payload) {
+		t.Errorf("joined strings decode to %d bytes (%v), want the payload back", len(decoded), err)
+	}
+
+	// Still a valid message once packed
+	if _, err := m.Pack(); err != nil {
+		t.Errorf("reply doesn't pack: %v", err)
+	}
+}
+
+func TestProxiedTXTOverLimit(t *testing.T) {
+	useTXTProxy(t, 1000, make([]byte, 1024))
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.txt.test.", dns.TypeTXT)
+	m, _ := resolveWithDecision(q)
+	if m.Rcode != dns.RcodeServerFailure || len(m.Answer) != 0 {
+		t.Errorf("got rcode %s with %d answers, want SERVFAIL for an oversized payload", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+}
+
+func TestProxyTXTMaxBytesCapped(t *testing.T) {
+	config := useConfig(t, &Config{ProxyTXTMaxBytes: 1 << 20})
+	if config.ProxyTXTMaxBytes != txtProxyHardLimit {
+		t.Errorf("ProxyTXTMaxBytes = %d, want it capped at %d", config.ProxyTXTMaxBytes, txtProxyHardLimit)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// validateUpstreamReply checks that a reply actually answers the query we sent.
+// A mismatched ID or question points to spoofing or a buggy resolver.
+func validateUpstreamReply(query *dns.Msg, reply *dns.Msg) error {
+	if reply.Id != query.Id {
+		return fmt.Errorf("reply ID %d does not match query ID %d", reply.Id, query.Id)
+	}
+
+	if len(reply.Question) != len(query.Question) {
+		return fmt.Errorf("reply has %d questions, query had %d", len(reply.Question), len(query.Question))
+	}
+
+	for i, q := range query.Question {
+		rq := reply.Question[i]
+		if !strings.EqualFold(rq.Name, q.Name) || rq.Qtype != q.Qtype || rq.Qclass != q.Qclass {
+			return fmt.Errorf("reply question %s does not match query question %s", rq.String(), q.String())
+		}
+	}
+
+	return nil
+}
+
+// upstreamValidator inspects an upstream reply and returns an error for replies that should be discarded
+type upstreamValidator func(query *dns.Msg, reply *dns.Msg) error
+
+// upstreamValidators are the optional rules selectable with UpstreamValidationRules.
+// Replies from the wrong source port never reach us: the UDP socket is
+// connected to the nameserver, so the kernel drops them.
+var upstreamValidators = map[string]upstreamValidator{
+	"zero_ttl_private":   rejectZeroTTLPrivate,
+	"private_well_known": rejectPrivateWellKnown,
+}
+
+// validateUpstreamAnswer runs the ID/question check and the configured rules
+func validateUpstreamAnswer(query *dns.Msg, reply *dns.Msg) error {
+	if err := validateUpstreamReply(query, reply); err != nil {
+		return err
+	}
+	for _, rule := range currentConfig().UpstreamValidationRules {
+		validator, ok := upstreamValidators[rule]
+		if !ok {
+			continue
+		}
+		if err := validator(query, reply); err != nil {
+			upstreamRejected.Inc(rule)
+			return fmt.Errorf("%s: %v", rule, err)
+		}
+	}
+	return nil
+}
+
+// answerAddresses returns the addresses of the A/AAAA records in an answer
+func answerAddresses(records []dns.RR) []net.IP {
+	ips := []net.IP{}
+	for _, rr := range records {
+		switch record := rr.(type) {
+		case *dns.A:
+			ips = append(ips, record.A)
+		case *dns.AAAA:
+			ips = append(ips, record.AAAA)
+		}
+	}
+	return ips
+}
+
+// isPrivateIP reports whether an address is private, loopback, link-local or unspecified
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// rejectZeroTTLPrivate flags the classic injected answer: one private address with TTL 0
+func rejectZeroTTLPrivate(query *dns.Msg, reply *dns.Msg) error {
+	ips := answerAddresses(reply.Answer)
+	if len(ips) != 1 || !isPrivateIP(ips[0]) {
+		return nil
+	}
+	for _, rr := range reply.Answer {
+		if rr.Header().Ttl == 0 {
+			return fmt.Errorf("single private address %s with TTL 0", ips[0])
+		}
+	}
+	return nil
+}
+
+// rejectPrivateWellKnown flags private addresses for the configured well-known public domains
+func rejectPrivateWellKnown(query *dns.Msg, reply *dns.Msg) error {
+	if len(query.Question) == 0 {
+		return nil
+	}
+	if _, ok := matchAny(query.Question[0].Name, newDomainSet(currentConfig().WellKnownDomains)); !ok {
+		return nil
+	}
+	for _, ip := range answerAddresses(reply.Answer) {
+		if isPrivateIP(ip) {
+			return fmt.Errorf("private address %s for well-known domain %s", ip, query.Question[0].Name)
+		}
+	}
+	return nil
+}
+
+// exchangeUpstream sends a question to the nameservers in upstreamOrder and
+// returns the first valid reply, or an error if none of them could answer
+func exchangeUpstream(q dns.Question) (*dns.Msg, error) {
+	return exchangeUpstreamWithCD(q, false)
+}
+
+// exchangeUpstreamWithCD is exchangeUpstream that can ask upstream to skip
+// DNSSEC validation. With ForwardDNSSECFlags the query also sets AD so the
+// upstream reports whether it validated the answer (RFC 6840)
+func exchangeUpstreamWithCD(q dns.Question, checkingDisabled bool) (*dns.Msg, error) {
+	config := currentConfig()
+	if config.HappyEyeballsUpstream && config.DoHUpstream != "" {
+		return raceUpstream(q, checkingDisabled)
+	}
+	return exchangeNameservers(q, checkingDisabled)
+}
+
+// newUpstreamQuery builds the recursive query sent upstream for a name
+func newUpstreamQuery(qname string, qtype uint16, checkingDisabled bool) *dns.Msg {
+	upstreamMsg := new(dns.Msg)
+	upstreamMsg.SetQuestion(qname, qtype)
+	upstreamMsg.RecursionDesired = true
+	if currentConfig().ForwardDNSSECFlags {
+		upstreamMsg.AuthenticatedData = true
+		upstreamMsg.CheckingDisabled = checkingDisabled
+	}
+	return upstreamMsg
+}
+
+// exchangeNameservers tries the nameservers in upstreamOrder over plain DNS
+func exchangeNameservers(q dns.Question, checkingDisabled bool) (*dns.Msg, error) {
+	return exchangeMinimized(q, checkingDisabled, queryNameservers)
+}
+
+// queryNameservers sends q unchanged to the nameservers in upstreamOrder
+func queryNameservers(q dns.Question, checkingDisabled bool) (*dns.Msg, error) {
+	config := currentConfig()
+
+	// Use a proper upstream DNS (e.g., Google DNS)
+	network := upstreamNetwork(q.Name)
+	for _, ns := range upstreamOrder() {
+		c := newUpstreamExchanger(network)
+		upstreamMsg := newUpstreamQuery(q.Name, q.Qtype, checkingDisabled)
+
+		// Retry the same server first, a lost UDP packet is cheaper to resend than to fail over
+		start := time.Now()
+		r, _, err := c.Exchange(upstreamMsg, fmt.Sprintf("%s:53", ns))
+		for attempt := 0; err != nil && attempt < *config.UpstreamRetries; attempt++ {
+			log.Printf("Retrying upstream DNS %s after error: %v", ns, err)
+			r, _, err = c.Exchange(upstreamMsg, fmt.Sprintf("%s:53", ns))
+		}
+
+		// Retry truncated UDP replies over TCP to get the full answer
+		if err == nil && r.Truncated && network == "udp" {
+			r, _, err = newUpstreamExchanger("tcp").Exchange(upstreamMsg, fmt.Sprintf("%s:53", ns))
+		}
+		if err != nil {
+			log.Printf("Error querying upstream DNS %s: %v", ns, err)
+			stats.UpstreamErrors.Add(1)
+			upstreamScores.Record(ns, time.Since(start), false)
+			continue
+		}
+
+		// Discard replies that don't belong to our query or look bogus
+		if err := validateUpstreamAnswer(upstreamMsg, r); err != nil {
+			log.Printf("Discarding malformed reply from upstream DNS %s: %v", ns, err)
+			stats.UpstreamErrors.Add(1)
+			upstreamScores.Record(ns, time.Since(start), false)
+			continue
+		}
+
+		// REFUSED and SERVFAIL say nothing about the name, another server may answer.
+		// NXDOMAIN and NODATA are real answers and are returned as is.
+		if r.Rcode == dns.RcodeRefused || r.Rcode == dns.RcodeServerFailure {
+			log.Printf("Upstream DNS %s answered %s for %s, trying the next server", ns, dns.RcodeToString[r.Rcode], q.Name)
+			stats.UpstreamErrors.Add(1)
+			upstreamScores.Record(ns, time.Since(start), false)
+			continue
+		}
+		upstreamScores.Record(ns, time.Since(start), true)
+		return r, nil
+	}
+
+	return nil, fmt.Errorf("all upstream DNS servers failed for %s", q.Name)
+}
+
+// wantsAuthenticatedData reports whether a client signalled it understands the
+// AD bit, by setting AD or the EDNS DO bit in its query (RFC 6840)
+func wantsAuthenticatedData(r *dns.Msg) bool {
+	if r.AuthenticatedData {
+		return true
+	}
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// upstreamNetwork picks the transport for a query, honoring ForceTCPUpstream and ForceTCPDomains
+func upstreamNetwork(name string) string {
+	config := currentConfig()
+	if config.ForceTCPUpstream {
+		return "tcp"
+	}
+	for _, domain := range config.ForceTCPDomains {
+		if dns.IsSubDomain(dns.Fqdn(domain), name) {
+			return "tcp"
+		}
+	}
+	return "udp"
+}
+
+// Exchanger sends a query to a nameserver and returns its reply and round trip time.
+// *dns.Client implements it.
+type Exchanger interface {
+	Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error)
+}
+
+// newUpstreamExchanger creates the exchanger for upstream queries over a network.
+// It is a variable so the forwarder can be driven without real nameservers.
+var newUpstreamExchanger = func(network string) Exchanger {
+	return newUpstreamClient(network)
+}
+
+// newUpstreamClient creates a DNS client for upstream queries, bound to the
+// configured source address when one is set
+func newUpstreamClient(network string) *dns.Client {
+	c := &dns.Client{Net: network}
+
+	if ip := net.ParseIP(currentConfig().UpstreamSourceIP); ip != nil {
+		var localAddr net.Addr = &net.UDPAddr{IP: ip}
+		if network == "tcp" {
+			localAddr = &net.TCPAddr{IP: ip}
+		}
+		c.Dialer = &net.Dialer{
+			Timeout:   2 * time.Second,
+			LocalAddr: localAddr,
+		}
+	}
+
+	return c
+}
+
+// validateSourceIP checks that an outgoing source address is assigned to a local interface
+func validateSourceIP(address string) error {
+	if address == "" {
+		return nil
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return fmt.Errorf("invalid upstream_source_ip %q", address)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("error listing local addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("upstream_source_ip %s is not assigned to any local interface", address)
+}
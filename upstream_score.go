@@ -0,0 +1,153 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// scoreAlpha is the weight of the newest sample in the latency and success EWMAs
+	scoreAlpha = 0.3
+
+	// scoreMargin is how much better a nameserver's score must be before it
+	// overtakes the one ahead of it, so small jitter doesn't reshuffle the order
+	scoreMargin = 0.2
+
+	// scoreRecovery is the time constant over which an idle nameserver's
+	// stats drift back to neutral, so a briefly bad server gets retried
+	scoreRecovery = 60 * time.Second
+
+	// neutralLatency is the assumed latency of a nameserver with no samples
+	neutralLatency = 50 * time.Millisecond
+)
+
+// nameserverScore holds the rolling stats for one nameserver
+type nameserverScore struct {
+	latency  float64 // EWMA of latency, in seconds
+	success  float64 // EWMA of success, 0 to 1
+	lastSeen time.Time
+}
+
+// upstreamScoreboard tracks nameserver health and keeps a preferred order
+type upstreamScoreboard struct {
+	mutex  sync.Mutex
+	scores map[string]*nameserverScore
+	order  []string
+}
+
+// upstreamScores is the shared scoreboard used when UpstreamOrdering is "score"
+var upstreamScores = newUpstreamScoreboard()
+
+// newUpstreamScoreboard creates an empty scoreboard
+func newUpstreamScoreboard() *upstreamScoreboard {
+	return &upstreamScoreboard{scores: make(map[string]*nameserverScore)}
+}
+
+// Record folds the outcome of one exchange into a nameserver's stats
+func (b *upstreamScoreboard) Record(ns string, latency time.Duration, ok bool) {
+	b.recordAt(ns, latency, ok, time.Now())
+}
+
+// recordAt is Record with an explicit clock
+func (b *upstreamScoreboard) recordAt(ns string, latency time.Duration, ok bool, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	success := 0.0
+	if ok {
+		success = 1
+	}
+
+	s, exists := b.scores[ns]
+	if !exists {
+		b.scores[ns] = &nameserverScore{latency: latency.Seconds(), success: success, lastSeen: now}
+		return
+	}
+
+	// Start from the recovered values so an idle server isn't judged on stale failures
+	s.latency, s.success = s.current(now)
+	s.latency += scoreAlpha * (latency.Seconds() - s.latency)
+	s.success += scoreAlpha * (success - s.success)
+	s.lastSeen = now
+}
+
+// current returns the stats drifted toward neutral by how long the server has been idle
+func (s *nameserverScore) current(now time.Time) (float64, float64) {
+	drift := 1 - math.Exp(-float64(now.Sub(s.lastSeen))/float64(scoreRecovery))
+	latency := s.latency + (neutralLatency.Seconds()-s.latency)*drift
+	success := s.success + (1-s.success)*drift
+	return latency, success
+}
+
+// score rates a nameserver, lower is better: latency inflated by the failure rate
+func (b *upstreamScoreboard) score(ns string, now time.Time) float64 {
+	s, ok := b.scores[ns]
+	if !ok {
+		return neutralLatency.Seconds()
+	}
+	latency, success := s.current(now)
+	return latency / math.Max(success, 0.01)
+}
+
+// Order returns the nameservers healthiest first. A server only moves ahead of
+// its neighbour when its score is better by scoreMargin, so the previous order
+// is kept through small fluctuations
+func (b *upstreamScoreboard) Order(nameservers []string) []string {
+	return b.orderAt(nameservers, time.Now())
+}
+
+// orderAt is Order with an explicit clock
+func (b *upstreamScoreboard) orderAt(nameservers []string, now time.Time) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !sameMembers(b.order, nameservers) {
+		b.order = append([]string(nil), nameservers...)
+	}
+
+	scores := make(map[string]float64, len(b.order))
+	for _, ns := range b.order {
+		scores[ns] = b.score(ns, now)
+	}
+
+	for swapped := true; swapped; {
+		swapped = false
+		for i := 1; i < len(b.order); i++ {
+			ahead, behind := b.order[i-1], b.order[i]
+			if scores[behind] < scores[ahead]*(1-scoreMargin) {
+				b.order[i-1], b.order[i] = behind, ahead
+				swapped = true
+			}
+		}
+	}
+
+	return append([]string(nil), b.order...)
+}
+
+// sameMembers reports whether two lists hold the same nameservers, ignoring order
+func sameMembers(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int, len(a))
+	for _, ns := range a {
+		seen[ns]++
+	}
+	for _, ns := range b {
+		if seen[ns] == 0 {
+			return false
+		}
+		seen[ns]--
+	}
+	return true
+}
+
+// upstreamOrder returns the nameservers in the order they should be tried
+func upstreamOrder() []string {
+	config := currentConfig()
+	if config.UpstreamOrdering == "score" {
+		return upstreamScores.Order(config.Nameservers)
+	}
+	return config.Nameservers
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// feed records the same outcome n times, a second apart
+func feed(b *upstreamScoreboard, ns string, latency time.Duration, ok bool, n int, now time.Time) time.Time {
+	for i := 0; i < n; i++ {
+		now = now.Add(time.Second)
+		b.recordAt(ns, latency, ok, now)
+	}
+	return now
+}
+
+func TestScoreboardPrefersFasterServer(t *testing.T) {
+	b := newUpstreamScoreboard()
+	now := time.Now()
+	now = feed(b, "192.0.2.1", 120*time.Millisecond, true, 5, now)
+	now = feed(b, "192.0.2.2", 15*time.Millisecond, true, 5, now)
+
+	if got := b.orderAt([]string{"192.0.2.1", "192.0.2.2"}, now); fmt.Sprint(got) != "[192.0.2.2 192.0.2.1]" {
+		t.Errorf("order = %v, want the faster server first", got)
+	}
+}
+
+func TestScoreboardDemotesFailingServer(t *testing.T) {
+	b := newUpstreamScoreboard()
+	servers := []string{"192.0.2.1", "192.0.2.2"}
+	now := time.Now()
+	now = feed(b, "192.0.2.1", 10*time.Millisecond, true, 5, now)
+	now = feed(b, "192.0.2.2", 30*time.Millisecond, true, 5, now)
+	if got := b.orderAt(servers, now); got[0] != "192.0.2.1" {
+		t.Fatalf("order = %v, want the faster server first", got)
+	}
+
+	// The fast server starts failing
+	now = feed(b, "192.0.2.1", 10*time.Millisecond, false, 4, now)
+	if got := b.orderAt(servers, now); got[0] != "192.0.2.2" {
+		t.Errorf("order = %v, want the failing server demoted", got)
+	}
+}
+
+func TestScoreboardHysteresis(t *testing.T) {
+	b := newUpstreamScoreboard()
+	servers := []string{"192.0.2.1", "192.0.2.2"}
+	now := time.Now()
+	now = feed(b, "192.0.2.1", 20*time.Millisecond, true, 5, now)
+	now = feed(b, "192.0.2.2", 18*time.Millisecond, true, 5, now)
+
+	// 10% better is within the margin, the configured order stays
+	if got := b.orderAt(servers, now); fmt.Sprint(got) != fmt.Sprint(servers) {
+		t.Errorf("order = %v, want small jitter ignored", got)
+	}
+
+	// One slow reply from the leader doesn't hand over the lead either
+	now = feed(b, "192.0.2.1", 24*time.Millisecond, true, 1, now)
+	if got := b.orderAt(servers, now); got[0] != "192.0.2.1" {
+		t.Errorf("order = %v, want a briefly slow server kept in place", got)
+	}
+}
+
+func TestScoreboardRecoversIdleServer(t *testing.T) {
+	b := newUpstreamScoreboard()
+	servers := []string{"192.0.2.1", "192.0.2.2"}
+	now := time.Now()
+	now = feed(b, "192.0.2.1", 10*time.Millisecond, false, 6, now)
+	now = feed(b, "192.0.2.2", 80*time.Millisecond, true, 6, now)
+	if got := b.orderAt(servers, now); got[0] != "192.0.2.2" {
+		t.Fatalf("order = %v, want the failing server behind", got)
+	}
+
+	// Five idle minutes later its failures have faded while the other stays slow
+	now = now.Add(5 * time.Minute)
+	now = feed(b, "192.0.2.2", 80*time.Millisecond, true, 3, now)
+	if got := b.orderAt(servers, now); got[0] != "192.0.2.1" {
+		t.Errorf("order = %v, want the recovered server tried first again", got)
+	}
+}
+
+func TestScoreboardNewMembersResetOrder(t *testing.T) {
+	b := newUpstreamScoreboard()
+	now := time.Now()
+	b.orderAt([]string{"192.0.2.1", "192.0.2.2"}, now)
+
+	if got := b.orderAt([]string{"192.0.2.3", "192.0.2.1"}, now); fmt.Sprint(got) != "[192.0.2.3 192.0.2.1]" {
+		t.Errorf("order = %v, want the new configured order", got)
+	}
+}
+
+func TestUpstreamOrderingByScore(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1", "192.0.2.2"}, UpstreamOrdering: "score"})
+	old := upstreamScores
+	upstreamScores = newUpstreamScoreboard()
+	t.Cleanup(func() { upstreamScores = old })
+	fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		if address == "192.0.2.1:53" {
+			return nil, errors.New("timeout")
+		}
+		return replyWithA(m, "192.0.2.10"), nil
+	})
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	for i := 0; i < 3; i++ {
+		if _, err := exchangeUpstream(q); err != nil {
+			t.Fatalf("exchangeUpstream: %v", err)
+		}
+	}
+
+	// Once demoted, the failing server isn't tried first any more
+	before := len(fake.Calls())
+	exchangeUpstream(q)
+	calls := fake.Calls()[before:]
+	if len(calls) != 1 || calls[0] != "192.0.2.2:53" {
+		t.Errorf("queried %v, want only the healthy server", calls)
+	}
+	if got := upstreamOrder(); got[0] != "192.0.2.2" {
+		t.Errorf("upstreamOrder = %v, want the healthy server first", got)
+	}
+}
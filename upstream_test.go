@@ -0,0 +1,752 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeExchanger answers upstream queries from a function instead of the network
+type fakeExchanger struct {
+	mutex    sync.Mutex
+	calls    []string
+	networks []string
+	answer   func(m *dns.Msg, address string) (*dns.Msg, error)
+}
+
+// Exchange records the nameserver queried and returns the fake's answer
+func (f *fakeExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	f.mutex.Lock()
+	f.calls = append(f.calls, address)
+	f.mutex.Unlock()
+	r, err := f.answer(m, address)
+	return r, time.Millisecond, err
+}
+
+// Calls returns the addresses queried so far
+func (f *fakeExchanger) Calls() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+// Networks returns the transport each exchanger was created for, in order
+func (f *fakeExchanger) Networks() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.networks...)
+}
+
+// useUpstream routes upstream queries to a fake for the rest of the test
+func useUpstream(t testing.TB, answer func(m *dns.Msg, address string) (*dns.Msg, error)) *fakeExchanger {
+	t.Helper()
+	fake := &fakeExchanger{answer: answer}
+	old := newUpstreamExchanger
+	newUpstreamExchanger = func(network string) Exchanger {
+		fake.mutex.Lock()
+		fake.networks = append(fake.networks, network)
+		fake.mutex.Unlock()
+		return fake
+	}
+	t.Cleanup(func() { newUpstreamExchanger = old })
+	return fake
+}
+
+// replyWithA answers m with one A record per address
+func replyWithA(m *dns.Msg, ips ...string) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	for _, ip := range ips {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP(ip),
+		})
+	}
+	return r
+}
+
+// replyWithAAAA answers m with one AAAA record per address
+func replyWithAAAA(m *dns.Msg, ips ...string) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	for _, ip := range ips {
+		r.Answer = append(r.Answer, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 300},
+			AAAA: net.ParseIP(ip),
+		})
+	}
+	return r
+}
+
+func TestExchangeUpstreamRejectsMismatchedID(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1", "192.0.2.2"}})
+	fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		if address == "192.0.2.1:53" {
+			r := replyWithA(m, "203.0.113.66")
+			r.Id = m.Id + 1
+			return r, nil
+		}
+		return replyWithA(m, "203.0.113.1"), nil
+	})
+
+	r, err := exchangeUpstream(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if err != nil {
+		t.Fatalf("exchangeUpstream: %v", err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "203.0.113.1" {
+		t.Errorf("answer = %v, want the reply from the second nameserver", r.Answer)
+	}
+	if calls := fake.Calls(); len(calls) != 2 {
+		t.Errorf("queried %v, want both nameservers", calls)
+	}
+}
+
+func TestExchangeUpstreamRejectsMismatchedQuestion(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}})
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		r := replyWithA(m, "203.0.113.66")
+		r.Question[0].Name = "attacker.test."
+		return r, nil
+	})
+
+	if _, err := exchangeUpstream(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); err == nil {
+		t.Fatal("a reply for another question was accepted")
+	}
+}
+
+// suspiciousFirstUpstream makes 192.0.2.1 answer with suspicious and 192.0.2.2 with a clean reply
+func suspiciousFirstUpstream(t *testing.T, suspicious func(m *dns.Msg) *dns.Msg) *fakeExchanger {
+	t.Helper()
+	return useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		if address == "192.0.2.1:53" {
+			return suspicious(m), nil
+		}
+		return replyWithA(m, "93.184.216.34"), nil
+	})
+}
+
+func TestUpstreamValidationRules(t *testing.T) {
+	zeroTTLPrivate := func(m *dns.Msg) *dns.Msg {
+		r := replyWithA(m, "192.168.0.1")
+		r.Answer[0].Header().Ttl = 0
+		return r
+	}
+	privateAddress := func(m *dns.Msg) *dns.Msg {
+		return replyWithA(m, "10.10.10.10")
+	}
+
+	tests := []struct {
+		name       string
+		rule       string
+		qname      string
+		suspicious func(m *dns.Msg) *dns.Msg
+	}{
+		{"zero TTL private", "zero_ttl_private", "example.org.", zeroTTLPrivate},
+		{"private well-known", "private_well_known", "www.google.com.", privateAddress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, &Config{
+				Nameservers:             []string{"192.0.2.1", "192.0.2.2"},
+				UpstreamValidationRules: []string{tt.rule},
+				WellKnownDomains:        []string{"google.com"},
+			})
+			fake := suspiciousFirstUpstream(t, tt.suspicious)
+			rejected := upstreamRejected.Value(tt.rule)
+
+			r, err := exchangeUpstream(dns.Question{Name: tt.qname, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+			if err != nil {
+				t.Fatalf("exchangeUpstream: %v", err)
+			}
+			if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "93.184.216.34" {
+				t.Errorf("answer = %v, want the suspicious reply discarded for the next nameserver's", r.Answer)
+			}
+			if calls := fake.Calls(); len(calls) != 2 {
+				t.Errorf("queried %v, want both nameservers", calls)
+			}
+			if upstreamRejected.Value(tt.rule) != rejected+1 {
+				t.Errorf("rejection not counted for %s", tt.rule)
+			}
+		})
+	}
+}
+
+func TestUpstreamValidationRulesOffByDefault(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1", "192.0.2.2"}, WellKnownDomains: []string{"google.com"}})
+	suspiciousFirstUpstream(t, func(m *dns.Msg) *dns.Msg {
+		return replyWithA(m, "10.10.10.10")
+	})
+
+	r, err := exchangeUpstream(dns.Question{Name: "www.google.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if err != nil || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "10.10.10.10" {
+		t.Errorf("answer = %v, %v, want the first reply accepted without rules", r, err)
+	}
+}
+
+func TestUpstreamValidationRulesKeepLegitimateAnswers(t *testing.T) {
+	useConfig(t, &Config{
+		Nameservers:             []string{"192.0.2.1"},
+		UpstreamValidationRules: []string{"zero_ttl_private", "private_well_known"},
+		WellKnownDomains:        []string{"google.com"},
+	})
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		// Private but with a real TTL, for a name that isn't well known
+		return replyWithA(m, "192.168.1.5"), nil
+	})
+
+	if _, err := exchangeUpstream(dns.Question{Name: "nas.home.arpa.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); err != nil {
+		t.Errorf("legitimate private answer rejected: %v", err)
+	}
+}
+
+func TestValidateUpstreamReply(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("Example.com.", dns.TypeA)
+
+	good := replyWithA(query, "192.0.2.1")
+	good.Question[0].Name = "example.COM."
+	if err := validateUpstreamReply(query, good); err != nil {
+		t.Errorf("case-different question rejected: %v", err)
+	}
+
+	wrongType := replyWithA(query)
+	wrongType.Question[0].Qtype = dns.TypeAAAA
+	noQuestion := replyWithA(query)
+	noQuestion.Question = nil
+	wrongID := replyWithA(query)
+	wrongID.Id ^= 0xffff
+
+	for name, reply := range map[string]*dns.Msg{"type": wrongType, "question count": noQuestion, "id": wrongID} {
+		if err := validateUpstreamReply(query, reply); err == nil {
+			t.Errorf("mismatched %s accepted", name)
+		}
+	}
+}
+
+func TestExchangeUpstreamAllFail(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1", "192.0.2.2"}})
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return nil, errors.New("timeout")
+	})
+
+	if _, err := exchangeUpstream(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); err == nil {
+		t.Fatal("expected an error when every nameserver fails")
+	}
+}
+
+func TestForwardAllUpstreamsFailIsServfail(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1", "192.0.2.2"}})
+	useMemoryCache(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return nil, errors.New("i/o timeout")
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	m, decision := resolveWithDecision(q)
+	if m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode = %s, want SERVFAIL", dns.RcodeToString[m.Rcode])
+	}
+	if decision != "forwarded" {
+		t.Errorf("decision = %q, want forwarded", decision)
+	}
+}
+
+func TestForwardEmptyUpstreamAnswerIsNoData(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}})
+	useMemoryCache(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m), nil
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	m, _ := resolveWithDecision(q)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("got %s with %d answers, want NOERROR with none", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+}
+
+func TestForwardUpstreamServfailTriesNextServer(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1", "192.0.2.2"}})
+	useMemoryCache(t)
+	fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		if address == "192.0.2.1:53" {
+			r := new(dns.Msg)
+			r.SetRcode(m, dns.RcodeServerFailure)
+			return r, nil
+		}
+		r := new(dns.Msg)
+		r.SetRcode(m, dns.RcodeNameError)
+		return r, nil
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("missing.example.", dns.TypeA)
+	m, _ := resolveWithDecision(q)
+	if m.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode = %s, want the NXDOMAIN from the second server", dns.RcodeToString[m.Rcode])
+	}
+	if len(fake.Calls()) != 2 {
+		t.Errorf("queried %v, want both servers", fake.Calls())
+	}
+}
+
+func TestNewUpstreamClientSourceIP(t *testing.T) {
+	useConfig(t, &Config{UpstreamSourceIP: "127.0.0.2"})
+
+	udp := newUpstreamClient("udp")
+	if addr, ok := udp.Dialer.LocalAddr.(*net.UDPAddr); !ok || !addr.IP.Equal(net.ParseIP("127.0.0.2")) {
+		t.Errorf("UDP LocalAddr = %v, want 127.0.0.2", udp.Dialer.LocalAddr)
+	}
+	tcp := newUpstreamClient("tcp")
+	if addr, ok := tcp.Dialer.LocalAddr.(*net.TCPAddr); !ok || !addr.IP.Equal(net.ParseIP("127.0.0.2")) {
+		t.Errorf("TCP LocalAddr = %v, want 127.0.0.2", tcp.Dialer.LocalAddr)
+	}
+
+	useConfig(t, &Config{})
+	if c := newUpstreamClient("udp"); c.Dialer != nil {
+		t.Errorf("Dialer = %+v without a source IP, want the default", c.Dialer)
+	}
+}
+
+func TestUpstreamQueryEgressesFromSourceIP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remotes := make(chan net.Addr, 1)
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		remotes <- w.RemoteAddr()
+		w.WriteMsg(replyWithA(r, "203.0.113.1"))
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	useConfig(t, &Config{UpstreamSourceIP: "127.0.0.2"})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := newUpstreamClient("udp").Exchange(q, conn.LocalAddr().String()); err != nil {
+		t.Skipf("can't send from 127.0.0.2 here: %v", err)
+	}
+	if remote := (<-remotes).(*net.UDPAddr); !remote.IP.Equal(net.ParseIP("127.0.0.2")) {
+		t.Errorf("query came from %v, want 127.0.0.2", remote)
+	}
+}
+
+func TestWorkerFetchEgressesFromSourceIP(t *testing.T) {
+	useConfig(t, &Config{UpstreamSourceIP: "127.0.0.2"})
+	server, requests := workerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	if _, err := fetchFromWorkerWithOptions("https://example.com", workerFetchOptions{WorkerURL: server.URL}); err != nil {
+		t.Skipf("can't connect from 127.0.0.2 here: %v", err)
+	}
+	if host, _, _ := net.SplitHostPort((*requests)[0].RemoteAddr); host != "127.0.0.2" {
+		t.Errorf("fetch came from %s, want 127.0.0.2", host)
+	}
+}
+
+func TestValidateSourceIP(t *testing.T) {
+	for _, address := range []string{"", "127.0.0.1"} {
+		if err := validateSourceIP(address); err != nil {
+			t.Errorf("validateSourceIP(%q) = %v, want nil", address, err)
+		}
+	}
+	for _, address := range []string{"not-an-ip", "192.0.2.99"} {
+		if err := validateSourceIP(address); err == nil {
+			t.Errorf("validateSourceIP(%q) accepted, want an error", address)
+		}
+	}
+}
+
+func TestForceTCPDomains(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, ForceTCPDomains: []string{"big.example"}})
+	fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "203.0.113.1"), nil
+	})
+
+	for _, name := range []string{"big.example.", "www.big.example.", "small.example."} {
+		if _, err := exchangeUpstream(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}); err != nil {
+			t.Fatalf("exchangeUpstream(%s): %v", name, err)
+		}
+	}
+	want := []string{"tcp", "tcp", "udp"}
+	if got := fake.Networks(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("networks = %v, want %v", got, want)
+	}
+}
+
+func TestForceTCPUpstream(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, ForceTCPUpstream: true})
+	fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return replyWithA(m, "203.0.113.1"), nil
+	})
+
+	if _, err := exchangeUpstream(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); err != nil {
+		t.Fatalf("exchangeUpstream: %v", err)
+	}
+	if got := fake.Networks(); len(got) != 1 || got[0] != "tcp" {
+		t.Errorf("networks = %v, want only tcp", got)
+	}
+}
+
+func TestTruncatedUDPRetriedOverTCP(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}})
+	truncated := true
+	fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		r := replyWithA(m, "203.0.113.1")
+		r.Truncated, truncated = truncated, false
+		return r, nil
+	})
+
+	r, err := exchangeUpstream(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if err != nil {
+		t.Fatalf("exchangeUpstream: %v", err)
+	}
+	if r.Truncated {
+		t.Error("truncated UDP reply returned, want the TCP retry's answer")
+	}
+	if got := fake.Networks(); strings.Join(got, ",") != "udp,tcp" {
+		t.Errorf("networks = %v, want udp then tcp", got)
+	}
+}
+
+func TestForwardDNSSECFlags(t *testing.T) {
+	tests := []struct {
+		name          string
+		forward       bool
+		cd, ad        bool
+		wantUpstream  string
+		wantAD        bool
+		wantUpstreams int
+	}{
+		{"forwarded CD and AD", true, true, true, "cd=true ad=true", true, 2},
+		{"AD for a client that asked", true, false, true, "cd=false ad=true", true, 1},
+		{"AD cleared for a client that didn't", true, false, false, "cd=false ad=true", false, 1},
+		{"flags off", false, true, true, "cd=false ad=false", false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, ForwardDNSSECFlags: tt.forward, HostsFile: "off"})
+			useMemoryCache(t)
+			var mutex sync.Mutex
+			var sent []string
+			fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+				mutex.Lock()
+				sent = append(sent, fmt.Sprintf("cd=%v ad=%v", m.CheckingDisabled, m.AuthenticatedData))
+				mutex.Unlock()
+				r := replyWithA(m, "203.0.113.1")
+				r.AuthenticatedData = true
+				return r, nil
+			})
+
+			// Ask twice, CD answers are never cached so both go upstream
+			for i := 0; i < 2; i++ {
+				q := new(dns.Msg)
+				q.SetQuestion("signed.example.", dns.TypeA)
+				q.CheckingDisabled = tt.cd
+				q.AuthenticatedData = tt.ad
+				m, _ := resolveWithDecision(q)
+				if i == 0 && m.AuthenticatedData != tt.wantAD {
+					t.Errorf("reply AD = %v, want %v", m.AuthenticatedData, tt.wantAD)
+				}
+				if len(m.Answer) != 1 {
+					t.Fatalf("got %d answers, want 1", len(m.Answer))
+				}
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if sent[0] != tt.wantUpstream {
+				t.Errorf("upstream query flags %s, want %s", sent[0], tt.wantUpstream)
+			}
+			if got := len(fake.Calls()); got != tt.wantUpstreams {
+				t.Errorf("%d upstream queries for two lookups, want %d", got, tt.wantUpstreams)
+			}
+		})
+	}
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Net: "udp", Err: errors.New("i/o timeout")}
+	none, two := 0, 2
+	tests := []struct {
+		name    string
+		retries *int
+		drops   int
+		want    []string
+	}{
+		{"default retry recovers a dropped packet", nil, 1, []string{"192.0.2.1:53", "192.0.2.1:53"}},
+		{"no retries fails over", &none, 1, []string{"192.0.2.1:53", "192.0.2.2:53"}},
+		{"retries exhausted fail over", &two, 5, []string{"192.0.2.1:53", "192.0.2.1:53", "192.0.2.1:53", "192.0.2.2:53"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, &Config{Nameservers: []string{"192.0.2.1", "192.0.2.2"}, UpstreamRetries: tt.retries})
+			dropped := 0
+			fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+				// The first server loses the first packets it is sent
+				if address == "192.0.2.1:53" && dropped < tt.drops {
+					dropped++
+					return nil, timeout
+				}
+				return replyWithA(m, "203.0.113.1"), nil
+			})
+
+			r, err := exchangeUpstream(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+			if err != nil {
+				t.Fatalf("exchangeUpstream: %v", err)
+			}
+			if len(r.Answer) != 1 {
+				t.Errorf("got %d answers, want 1", len(r.Answer))
+			}
+			if got := fake.Calls(); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("queried %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardWithFakeExchanger(t *testing.T) {
+	none := 0
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}, UpstreamRetries: &none})
+	useMemoryCache(t)
+
+	// Each nameserver has its own canned behaviour
+	canned := map[string]func(m *dns.Msg) (*dns.Msg, error){
+		"192.0.2.1:53": func(m *dns.Msg) (*dns.Msg, error) {
+			return nil, errors.New("connection refused")
+		},
+		"192.0.2.2:53": func(m *dns.Msg) (*dns.Msg, error) {
+			r := new(dns.Msg)
+			r.SetRcode(m, dns.RcodeRefused)
+			return r, nil
+		},
+		"192.0.2.3:53": func(m *dns.Msg) (*dns.Msg, error) {
+			return replyWithA(m, "203.0.113.3"), nil
+		},
+		"192.0.2.4:53": func(m *dns.Msg) (*dns.Msg, error) {
+			return replyWithA(m, "203.0.113.4"), nil
+		},
+	}
+	fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return canned[address](m)
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	m, decision := resolveWithDecision(q)
+	if decision != "forwarded" || m.Rcode != dns.RcodeSuccess {
+		t.Fatalf("got %s (%s), want a forwarded answer", dns.RcodeToString[m.Rcode], decision)
+	}
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "203.0.113.3" {
+		t.Errorf("answer = %v, want the third server's 203.0.113.3", m.Answer)
+	}
+	want := []string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.3:53"}
+	if got := fake.Calls(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("queried %v, want %v", got, want)
+	}
+}
+
+func TestNewUpstreamExchangerDefault(t *testing.T) {
+	useConfig(t, &Config{})
+	for _, network := range []string{"udp", "tcp"} {
+		c, ok := newUpstreamExchanger(network).(*dns.Client)
+		if !ok {
+			t.Fatalf("default exchanger for %s is %T, want *dns.Client", network, newUpstreamExchanger(network))
+		}
+		if c.Net != network {
+			t.Errorf("client network = %q, want %q", c.Net, network)
+		}
+	}
+}
+
+func TestForwardFailoverByRcode(t *testing.T) {
+	tests := []struct {
+		first   int
+		answers int
+		rcode   int
+		servers int
+	}{
+		// REFUSED and SERVFAIL fail over, NXDOMAIN and NODATA are answers
+		{dns.RcodeRefused, 1, dns.RcodeSuccess, 2},
+		{dns.RcodeServerFailure, 1, dns.RcodeSuccess, 2},
+		{dns.RcodeNameError, 0, dns.RcodeNameError, 1},
+		{dns.RcodeSuccess, 0, dns.RcodeSuccess, 1},
+	}
+	for _, tt := range tests {
+		t.Run(dns.RcodeToString[tt.first], func(t *testing.T) {
+			useConfig(t, &Config{Nameservers: []string{"192.0.2.1", "192.0.2.2"}})
+			useMemoryCache(t)
+			fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+				// The first server answers with the rcode under test and no records
+				if address == "192.0.2.1:53" {
+					r := new(dns.Msg)
+					r.SetRcode(m, tt.first)
+					return r, nil
+				}
+				return replyWithA(m, "203.0.113.2"), nil
+			})
+
+			q := new(dns.Msg)
+			q.SetQuestion("policy.example.", dns.TypeA)
+			m, _ := resolveWithDecision(q)
+			if m.Rcode != tt.rcode || len(m.Answer) != tt.answers {
+				t.Errorf("got %s with %d answers, want %s with %d", dns.RcodeToString[m.Rcode], len(m.Answer), dns.RcodeToString[tt.rcode], tt.answers)
+			}
+			if got := len(fake.Calls()); got != tt.servers {
+				t.Errorf("queried %v, want %d servers", fake.Calls(), tt.servers)
+			}
+		})
+	}
+}
+
+func TestForwardAndCacheSRVAndNAPTR(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, HostsFile: "off"})
+	useMemoryCache(t)
+	var mutex sync.Mutex
+	var asked []string
+	fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		q := m.Question[0]
+		mutex.Lock()
+		asked = append(asked, dns.TypeToString[q.Qtype])
+		mutex.Unlock()
+
+		r := new(dns.Msg)
+		r.SetReply(m)
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 300}
+		switch q.Qtype {
+		case dns.TypeSRV:
+			r.Answer = append(r.Answer, &dns.SRV{Hdr: hdr, Priority: 10, Weight: 5, Port: 5060, Target: "sip.example.com."})
+		case dns.TypeNAPTR:
+			r.Answer = append(r.Answer, &dns.NAPTR{Hdr: hdr, Order: 100, Preference: 10, Flags: "S", Service: "SIP+D2U", Replacement: "_sip._udp.example.com."})
+		}
+		return r, nil
+	})
+
+	// Same name, two types: each is forwarded once and then served from its own cache entry
+	for i := 0; i < 2; i++ {
+		for _, qtype := range []uint16{dns.TypeSRV, dns.TypeNAPTR} {
+			q := new(dns.Msg)
+			q.SetQuestion("_sip._udp.example.com.", qtype)
+			m, decision := resolveWithDecision(q)
+			if want := []string{"forwarded", "cached"}[i]; decision != want {
+				t.Errorf("%s query %d decision = %q, want %q", dns.TypeToString[qtype], i+1, decision, want)
+			}
+			if len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != qtype {
+				t.Fatalf("%s query %d answered %v", dns.TypeToString[qtype], i+1, m.Answer)
+			}
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if fmt.Sprint(asked) != "[SRV NAPTR]" || len(fake.Calls()) != 2 {
+		t.Errorf("upstream asked for %v, want SRV and NAPTR once each", asked)
+	}
+}
+
+func TestForwardOtherTypes(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, ProxyDomains: []string{"proxied.test"}, HostsFile: "off"})
+	useMemoryCache(t)
+	fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		q := m.Question[0]
+		r := new(dns.Msg)
+		r.SetReply(m)
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 300}
+		switch q.Qtype {
+		case dns.TypeAAAA:
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::80")})
+		case dns.TypeTXT:
+			r.Answer = append(r.Answer, &dns.TXT{Hdr: hdr, Txt: []string{"v=spf1 -all"}})
+		case dns.TypeMX:
+			r.Answer = append(r.Answer, &dns.MX{Hdr: hdr, Preference: 10, Mx: "mail.example.com."})
+		case dns.TypePTR:
+			r.Answer = append(r.Answer, &dns.PTR{Hdr: hdr, Ptr: "host.example.com."})
+		}
+		return r, nil
+	})
+
+	// Names nobody owns are resolved upstream whatever the type
+	tests := []struct {
+		name  string
+		qtype uint16
+	}{
+		{"example.com.", dns.TypeAAAA},
+		{"example.com.", dns.TypeTXT},
+		{"example.com.", dns.TypeMX},
+		{"80.2.0.192.in-addr.arpa.", dns.TypePTR},
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(tt.name, tt.qtype)
+		m, decision := resolveWithDecision(q)
+		if decision != "forwarded" || len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != tt.qtype {
+			t.Errorf("%s %s got %v (%s), want the upstream answer", tt.name, dns.TypeToString[tt.qtype], m.Answer, decision)
+		}
+	}
+
+	// Owned names only have A records, other types are NODATA without asking upstream
+	calls := len(fake.Calls())
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeTXT, dns.TypeMX} {
+		q := new(dns.Msg)
+		q.SetQuestion("proxied.test.", qtype)
+		if m, decision := resolveWithDecision(q); decision != "authoritative" || len(m.Answer) != 0 {
+			t.Errorf("owned %s got %v (%s), want NODATA", dns.TypeToString[qtype], m.Answer, decision)
+		}
+	}
+	if len(fake.Calls()) != calls {
+		t.Errorf("%d upstream queries for owned names, want none", len(fake.Calls())-calls)
+	}
+}
+
+func TestAllowRecursion(t *testing.T) {
+	for _, allow := range []bool{true, false} {
+		t.Run(fmt.Sprint(allow), func(t *testing.T) {
+			useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, AllowRecursion: &allow, HostsFile: "off"})
+			cache := useMemoryCache(t)
+			fake := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+				return replyWithA(m, "203.0.113.1"), nil
+			})
+			cached, _ := dns.NewRR("cached.example. 300 IN A 203.0.113.9")
+			cache.Set("cached.example.", dns.TypeA, []dns.RR{cached})
+
+			// Names not known locally are only resolved by a recursive server
+			q := new(dns.Msg)
+			q.SetQuestion("uncached.example.", dns.TypeA)
+			m, _ := resolveWithDecision(q)
+			if m.RecursionAvailable != allow {
+				t.Errorf("RA = %v, want %v", m.RecursionAvailable, allow)
+			}
+			wantRcode, wantAnswers, wantCalls := dns.RcodeSuccess, 1, 1
+			if !allow {
+				wantRcode, wantAnswers, wantCalls = dns.RcodeRefused, 0, 0
+			}
+			if m.Rcode != wantRcode || len(m.Answer) != wantAnswers {
+				t.Errorf("got %s with %d answers, want %s with %d", dns.RcodeToString[m.Rcode], len(m.Answer), dns.RcodeToString[wantRcode], wantAnswers)
+			}
+			if len(fake.Calls()) != wantCalls {
+				t.Errorf("%d upstream queries, want %d", len(fake.Calls()), wantCalls)
+			}
+
+			// Cached answers are served either way
+			q.SetQuestion("cached.example.", dns.TypeA)
+			m, decision := resolveWithDecision(q)
+			if decision != "cached" || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+				t.Errorf("cached name got %s (%s) with %d answers, want the cached answer", dns.RcodeToString[m.Rcode], decision, len(m.Answer))
+			}
+			if m.RecursionAvailable != allow {
+				t.Errorf("RA on a cached answer = %v, want %v", m.RecursionAvailable, allow)
+			}
+		})
+	}
+}
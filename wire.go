@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// dnsHeaderLen is the size of the fixed DNS message header
+const dnsHeaderLen = 12
+
+// resolvePacked resolves a wire-format query and returns the packed reply.
+// Queries that can't be unpacked still get a FORMERR as long as the header
+// is readable, so callers always have a well-formed reply to send.
+func resolvePacked(data []byte) ([]byte, error) {
+	query := new(dns.Msg)
+	if err := query.Unpack(data); err != nil {
+		if len(data) < dnsHeaderLen {
+			return nil, fmt.Errorf("message too short for a DNS header: %d bytes", len(data))
+		}
+		return formErrReply(binary.BigEndian.Uint16(data[0:2])).Pack()
+	}
+
+	// Never answer responses, that only invites reflection loops
+	if query.Response {
+		return nil, fmt.Errorf("message %d is a response, not a query", query.Id)
+	}
+
+	return Resolve(query).Pack()
+}
+
+// formErrReply builds a bare FORMERR reply for a query that couldn't be parsed
+func formErrReply(id uint16) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.Id = id
+	reply.Response = true
+	reply.Rcode = dns.RcodeFormatError
+	return reply
+}
+
+// validateQuestions checks that a query has a single question with a usable name.
+// Like most resolvers we don't answer multi-question messages: one RCODE can't
+// describe several outcomes, so they get FORMERR rather than an ambiguous reply.
+func validateQuestions(questions []dns.Question) error {
+	if len(questions) == 0 {
+		return fmt.Errorf("query has no questions")
+	}
+	if len(questions) > 1 {
+		return fmt.Errorf("query has %d questions, only one is supported", len(questions))
+	}
+	for _, q := range questions {
+		if _, ok := dns.IsDomainName(q.Name); !ok || !dns.IsFqdn(q.Name) {
+			return fmt.Errorf("invalid question name %q", q.Name)
+		}
+	}
+	return nil
+}
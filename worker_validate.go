@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// requiredWorkerSnippets must appear in every generated worker: the SDK entry
+// import and the main() wrapper the Blockless runtime calls
+var requiredWorkerSnippets = []string{
+	`import { main } from "@blockless/sdk-ts/dist/lib/entry"`,
+	"main(async () => {",
+}
+
+// workerPlaceholderPattern matches template placeholders left unfilled
+var workerPlaceholderPattern = regexp.MustCompile(`\{\{[A-Z_]+\}\}`)
+
+// ValidateWorkerTemplate performs basic structural checks on generated worker
+// source: no unfilled placeholders, the required entry points present, and
+// balanced braces, brackets and parentheses outside strings and comments
+func ValidateWorkerTemplate(source string) error {
+	if placeholder := workerPlaceholderPattern.FindString(source); placeholder != "" {
+		return fmt.Errorf("unfilled placeholder %s", placeholder)
+	}
+	for _, snippet := range requiredWorkerSnippets {
+		if !strings.Contains(source, snippet) {
+			return fmt.Errorf("missing %q", snippet)
+		}
+	}
+	return checkWorkerDelimiters(source)
+}
+
+// checkWorkerDelimiters reports the first unbalanced delimiter or unterminated
+// string or comment, with its line number
+func checkWorkerDelimiters(source string) error {
+	type opener struct {
+		char byte
+		line int
+	}
+	closers := map[byte]byte{'}': '{', ']': '[', ')': '('}
+
+	var stack []opener
+	line := 1
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+		switch {
+		case c == '\n':
+			line++
+		case c == '/' && i+1 < len(source) && source[i+1] == '/':
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+			line++
+		case c == '/' && i+1 < len(source) && source[i+1] == '*':
+			end := strings.Index(source[i+2:], "*/")
+			if end < 0 {
+				return fmt.Errorf("unterminated comment at line %d", line)
+			}
+			line += strings.Count(source[i:i+2+end], "\n")
+			i += end + 3
+		case c == '"' || c == '\'':
+			start := line
+			for i++; i < len(source) && source[i] != c; i++ {
+				if source[i] == '\\' {
+					i++
+				} else if source[i] == '\n' {
+					return fmt.Errorf("unterminated string at line %d", start)
+				}
+			}
+			if i >= len(source) {
+				return fmt.Errorf("unterminated string at line %d", start)
+			}
+		case c == '{' || c == '[' || c == '(':
+			stack = append(stack, opener{c, line})
+		case c == '}' || c == ']' || c == ')':
+			if len(stack) == 0 || stack[len(stack)-1].char != closers[c] {
+				return fmt.Errorf("unexpected %c at line %d", c, line)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if len(stack) > 0 {
+		last := stack[len(stack)-1]
+		return fmt.Errorf("unclosed %c opened at line %d", last.char, last.line)
+	}
+	return nil
+}
+
+// typeCheckWorker runs tsc --noEmit on the worker source through runCommand.
+// It returns false without an error when tsc isn't installed.
+func typeCheckWorker(path string) (bool, error) {
+	output, err := runCommand("tsc", "--noEmit", "--skipLibCheck", "--target", "es2020", "--module", "esnext", "--moduleResolution", "node", path)
+	if errors.Is(err, exec.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("tsc rejected %s: %v: %s", path, err, output)
+	}
+	return true, nil
+}
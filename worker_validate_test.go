@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateWorkerTemplateGood(t *testing.T) {
+	client := &BlessnetClient{Config: useConfig(t, &Config{WorkerSigningSecret: `s3"cret`})}
+	for _, opts := range []WorkerTemplateOptions{
+		{},
+		{DisableWelcome: true},
+		{DisableWelcome: true, AuthToken: "t0k}en"},
+	} {
+		if err := ValidateWorkerTemplate(client.CreateWorkerTemplate(opts)); err != nil {
+			t.Errorf("template with %+v rejected: %v", opts, err)
+		}
+	}
+
+	// The checked in worker passes too
+	source, err := os.ReadFile("src/index.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateWorkerTemplate(string(source)); err != nil {
+		t.Errorf("src/index.ts rejected: %v", err)
+	}
+}
+
+func TestValidateWorkerTemplateBroken(t *testing.T) {
+	client := &BlessnetClient{Config: useConfig(t, &Config{})}
+	good := client.CreateWorkerTemplate(WorkerTemplateOptions{})
+
+	// Drop the closing brace of the first if block after the target check
+	brace := strings.Index(good, "  }\n")
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"missing brace", good[:brace] + good[brace+4:], "unexpected )"},
+		{"unclosed block", good + "\nif (ready) {\n", "unclosed { opened at line"},
+		{"stray paren", strings.Replace(good, "console.log(", "console.log((", 1), "unexpected }"},
+		{"unterminated string", strings.Replace(good, `"X-Proxy-By": "PhantomDNS"`, `"X-Proxy-By": "PhantomDNS`, 1), "unterminated string"},
+		{"unterminated comment", good + "\n/* trailing", "unterminated comment"},
+		{"unfilled placeholder", strings.Replace(good, "const MAX_REDIRECTS = 5;", "const MAX_REDIRECTS = {{MAX_REDIRECTS}};", 1), "unfilled placeholder {{MAX_REDIRECTS}}"},
+		{"no main wrapper", strings.Replace(good, "main(async () => {", "run(async () => {", 1), `missing "main(async () => {"`},
+		{"no SDK import", strings.Replace(good, "@blockless/sdk-ts", "@blockless/sdk", 1), "missing"},
+	}
+	for _, tt := range tests {
+		err := ValidateWorkerTemplate(tt.source)
+		if err == nil {
+			t.Errorf("%s: broken template accepted", tt.name)
+		} else if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %q, want it to mention %q", tt.name, err, tt.want)
+		}
+	}
+
+	// Delimiters inside strings and comments don't count
+	quoted := good + "\n// closing } in a comment\nconst s = \"{ ( [\";\n/* ) */\n"
+	if err := ValidateWorkerTemplate(quoted); err != nil {
+		t.Errorf("delimiters in strings and comments rejected: %v", err)
+	}
+}
+
+func TestTypeCheckWorker(t *testing.T) {
+	var commands []string
+	var result error
+	old := runCommand
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return []byte("index.ts(3,1): error TS1005"), result
+	}
+	t.Cleanup(func() { runCommand = old })
+
+	ran, err := typeCheckWorker("index.ts")
+	if !ran || err != nil {
+		t.Errorf("typeCheckWorker = %v, %v, want a passing check", ran, err)
+	}
+	if len(commands) != 1 || !strings.HasPrefix(commands[0], "tsc --noEmit ") || !strings.HasSuffix(commands[0], " index.ts") {
+		t.Errorf("ran %v, want tsc --noEmit on the source", commands)
+	}
+
+	result = fmt.Errorf("exit status 2")
+	if ran, err := typeCheckWorker("index.ts"); !ran || err == nil || !strings.Contains(err.Error(), "TS1005") {
+		t.Errorf("typeCheckWorker = %v, %v, want the tsc output in the error", ran, err)
+	}
+
+	result = &exec.Error{Name: "tsc", Err: exec.ErrNotFound}
+	if ran, err := typeCheckWorker("index.ts"); ran || err != nil {
+		t.Errorf("typeCheckWorker = %v, %v without tsc, want it skipped", ran, err)
+	}
+}
+
+func TestRedeployStopsOnTypeCheckFailure(t *testing.T) {
+	useConfig(t, &Config{WorkerTypeCheck: true, WorkerSourcePath: filepath.Join(t.TempDir(), "index.ts")})
+	var commands []string
+	old := runCommand
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		commands = append(commands, name)
+		if name == "tsc" {
+			return []byte("error TS2304"), errors.New("exit status 2")
+		}
+		return []byte("Deployed function at https://redeployed-worker.bls.dev\n"), nil
+	}
+	t.Cleanup(func() { runCommand = old })
+
+	client := &BlessnetClient{Config: currentConfig(), WorkerURL: "https://old-worker.bls.dev"}
+	if _, err := client.RedeployWorker(); err == nil {
+		t.Fatal("worker deployed despite failing the type check")
+	}
+	if fmt.Sprint(commands) != "[tsc]" || client.WorkerURL != "https://old-worker.bls.dev" {
+		t.Errorf("ran %v and switched to %s, want only tsc and the old worker kept", commands, client.WorkerURL)
+	}
+}
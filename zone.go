@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ownedZone returns the owned suffix that a domain falls under, if any
+func ownedZone(domain string) (string, bool) {
+	return matchAny(domain, suffixList(currentConfig().ProxyDomains), listDB.Proxied(), listBundle.Proxied())
+}
+
+// synthesizeSOA builds the SOA record for an owned zone
+func synthesizeSOA(zone string) dns.RR {
+	config := currentConfig()
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(zone),
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    config.SOA.Minimum,
+		},
+		Ns:      dns.Fqdn(config.SOA.MName),
+		Mbox:    dns.Fqdn(config.SOA.RName),
+		Serial:  config.SOA.Serial,
+		Refresh: config.SOA.Refresh,
+		Retry:   config.SOA.Retry,
+		Expire:  config.SOA.Expire,
+		Minttl:  config.SOA.Minimum,
+	}
+}
+
+// synthesizeNS builds the NS record pointing an owned zone at PhantomDNS
+func synthesizeNS(zone string) dns.RR {
+	config := currentConfig()
+	return &dns.NS{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(zone),
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    config.SOA.Refresh,
+		},
+		Ns: dns.Fqdn(config.SOA.MName),
+	}
+}
+
+// handleZoneApex answers SOA and NS queries for an owned zone
+func handleZoneApex(m *dns.Msg, q dns.Question, zone string) {
+	m.Authoritative = true
+
+	// Only the apex carries SOA/NS records, names below it get NODATA
+	if !strings.EqualFold(dns.Fqdn(q.Name), dns.Fqdn(zone)) {
+		m.Ns = append(m.Ns, synthesizeSOA(zone))
+		return
+	}
+
+	switch q.Qtype {
+	case dns.TypeSOA:
+		m.Answer = append(m.Answer, synthesizeSOA(zone))
+	case dns.TypeNS:
+		m.Answer = append(m.Answer, synthesizeNS(zone))
+	}
+}
+
+// handleOwnedNoData answers a type an owned name has no records for with
+// NODATA: NOERROR, an empty answer and the zone SOA in the authority section,
+// which is what lets downstream caches cache the negative answer
+func handleOwnedNoData(m *dns.Msg, zone string) {
+	m.Authoritative = true
+	m.Ns = append(m.Ns, synthesizeSOA(zone))
+}
+
+// requestsEDNSExpire reports whether a query carries the EDNS EXPIRE option
+func requestsEDNSExpire(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0EXPIRE {
+			return true
+		}
+	}
+	return false
+}
+
+// addEDNSExpire answers an EXPIRE request with the owned zone's SOA expire
+// value, so secondaries mirroring our records know how long they stay valid
+func addEDNSExpire(m *dns.Msg, r *dns.Msg) {
+	config := currentConfig()
+	if !config.EDNSExpire || !requestsEDNSExpire(r) {
+		return
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(r.IsEdns0().UDPSize(), r.IsEdns0().Do())
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EXPIRE{
+		Code:   dns.EDNS0EXPIRE,
+		Expire: config.SOA.Expire,
+	})
+}
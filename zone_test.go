@@ -0,0 +1,197 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestOwnedZoneApexQueries(t *testing.T) {
+	useConfig(t, &Config{ProxyDomains: []string{"example.com"}})
+
+	tests := []struct {
+		qtype uint16
+		check func(dns.RR) bool
+	}{
+		{dns.TypeSOA, func(rr dns.RR) bool { soa, ok := rr.(*dns.SOA); return ok && soa.Ns == "ns1.phantomdns.local." }},
+		{dns.TypeNS, func(rr dns.RR) bool { ns, ok := rr.(*dns.NS); return ok && ns.Ns == "ns1.phantomdns.local." }},
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion("Example.COM.", tt.qtype)
+		m, decision := resolveWithDecision(q)
+
+		name := dns.TypeToString[tt.qtype]
+		if decision != "authoritative" || !m.Authoritative || m.Rcode != dns.RcodeSuccess {
+			t.Fatalf("%s: decision %q, AA %v, rcode %s", name, decision, m.Authoritative, dns.RcodeToString[m.Rcode])
+		}
+		if len(m.Answer) != 1 || !tt.check(m.Answer[0]) {
+			t.Errorf("%s: unexpected answer %v", name, m.Answer)
+		}
+		if m.Answer[0].Header().Name != "example.com." {
+			t.Errorf("%s: owner %q, want the zone apex", name, m.Answer[0].Header().Name)
+		}
+	}
+}
+
+func TestOwnedZoneBelowApexIsNoData(t *testing.T) {
+	useConfig(t, &Config{ProxyDomains: []string{"example.com"}})
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeNS)
+	m, _ := resolveWithDecision(q)
+
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Fatalf("got rcode %s with %d answers, want NODATA", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+	if len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA || m.Ns[0].Header().Name != "example.com." {
+		t.Errorf("authority section %v, want the zone SOA", m.Ns)
+	}
+}
+
+func TestOwnedNameOtherTypesAreNoData(t *testing.T) {
+	c := &Config{ProxyDomains: []string{"example.com"}, Nameservers: []string{"192.0.2.1"}}
+	c.SOA.Minimum = 120
+	useConfig(t, c)
+	useMemoryCache(t)
+	upstream := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		return r, nil
+	})
+
+	for _, qtype := range []uint16{dns.TypeTXT, dns.TypeMX, dns.TypeSRV} {
+		name := dns.TypeToString[qtype]
+		q := new(dns.Msg)
+		q.SetQuestion("www.example.com.", qtype)
+		m, decision := resolveWithDecision(q)
+
+		if decision != "authoritative" || !m.Authoritative {
+			t.Errorf("%s: decision %q, AA %v, want an authoritative answer", name, decision, m.Authoritative)
+		}
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+			t.Errorf("%s: rcode %s with %d answers, want NODATA", name, dns.RcodeToString[m.Rcode], len(m.Answer))
+		}
+		if len(m.Ns) != 1 {
+			t.Fatalf("%s: authority section %v, want the zone SOA", name, m.Ns)
+		}
+		soa, ok := m.Ns[0].(*dns.SOA)
+		if !ok || soa.Hdr.Name != "example.com." || soa.Hdr.Ttl != 120 || soa.Minttl != 120 {
+			t.Errorf("%s: authority %v, want the example.com. SOA with TTL 120 for negative caching", name, m.Ns[0])
+		}
+	}
+	if len(upstream.Calls()) != 0 {
+		t.Errorf("upstream asked %d times about owned names, want 0", len(upstream.Calls()))
+	}
+}
+
+func TestOwnedNameNoDataSkippedWhenProxyOnFailure(t *testing.T) {
+	useConfig(t, &Config{Nameservers: []string{"192.0.2.1"}, ProxyDomains: []string{"example.com"}, ProxyOnFailureOnly: true})
+	useMemoryCache(t)
+	upstream := useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		return r, nil
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeTXT)
+	m, decision := resolveWithDecision(q)
+	if decision == "authoritative" || m.Authoritative || len(m.Ns) != 0 {
+		t.Errorf("decision %q, AA %v, authority %v, want no synthesized NODATA for names that live upstream", decision, m.Authoritative, m.Ns)
+	}
+	if len(upstream.Calls()) != 1 {
+		t.Errorf("upstream asked %d times, want the TXT query forwarded once", len(upstream.Calls()))
+	}
+}
+
+func TestOwnedZoneLabelBoundary(t *testing.T) {
+	useConfig(t, &Config{ProxyDomains: []string{"example.com"}})
+
+	tests := []struct {
+		name  string
+		owned bool
+	}{
+		{"example.com.", true},
+		{"www.example.com.", true},
+		{"WWW.Example.Com.", true},
+		{"evilexample.com.", false},
+		{"example.com.evil.", false},
+	}
+	for _, tt := range tests {
+		zone, ok := ownedZone(tt.name)
+		if ok != tt.owned {
+			t.Errorf("ownedZone(%q) = %v, want %v", tt.name, ok, tt.owned)
+		}
+		if ok && zone != "example.com" {
+			t.Errorf("ownedZone(%q) zone %q, want example.com", tt.name, zone)
+		}
+	}
+}
+
+// expireQuery asks for the SOA of name with the EDNS EXPIRE option set
+func expireQuery(name string) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeSOA)
+	q.SetEdns0(1232, false)
+	opt := q.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE})
+	return q
+}
+
+// replyExpire returns the EXPIRE option value in m, if any
+func replyExpire(m *dns.Msg) (uint32, bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+	for _, option := range opt.Option {
+		if expire, ok := option.(*dns.EDNS0_EXPIRE); ok {
+			return expire.Expire, true
+		}
+	}
+	return 0, false
+}
+
+func TestEDNSExpireOnOwnedZone(t *testing.T) {
+	c := &Config{ProxyDomains: []string{"example.com"}, EDNSExpire: true, Nameservers: []string{"192.0.2.1"}}
+	c.SOA.Expire = 86400
+	useConfig(t, c)
+	useMemoryCache(t)
+	useUpstream(t, func(m *dns.Msg, address string) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		return r, nil
+	})
+
+	m, decision := resolveWithDecision(expireQuery("example.com."))
+	if decision != "authoritative" {
+		t.Fatalf("decision = %q, want authoritative", decision)
+	}
+	if expire, ok := replyExpire(m); !ok || expire != 86400 {
+		t.Errorf("EXPIRE = %d (present %v), want the SOA expire 86400", expire, ok)
+	}
+
+	// Only owned-zone answers carry it
+	m, _ = resolveWithDecision(expireQuery("example.org."))
+	if _, ok := replyExpire(m); ok {
+		t.Error("forwarded answer carries EXPIRE, want it on owned-zone responses only")
+	}
+
+	// Without the option in the query there's nothing to answer
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeSOA)
+	m, _ = resolveWithDecision(q)
+	if _, ok := replyExpire(m); ok {
+		t.Error("EXPIRE added to a query that didn't ask for it")
+	}
+}
+
+func TestEDNSExpireDisabled(t *testing.T) {
+	useConfig(t, &Config{ProxyDomains: []string{"example.com"}})
+
+	m, _ := resolveWithDecision(expireQuery("example.com."))
+	if _, ok := replyExpire(m); ok {
+		t.Error("EXPIRE included with edns_expire off")
+	}
+}